@@ -0,0 +1,276 @@
+package brick
+
+import (
+  "bytes"
+  "compress/gzip"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "io/fs"
+  "os"
+  "path"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+//
+// 资源包的构建结果, 参考 BuildStaticResource()
+//
+type StaticResource struct {
+  // 文件名 -> gzip 压缩的内容, 与 GetFileMapping() 相同;
+  // 开启 Hash 时同时包含原文件名和带散列的文件名
+  Files map[string][]byte
+  // 原文件名 -> 带散列的文件名, 用于 {{asset "app.js"}}
+  Names map[string]string
+}
+
+type StaticOptions struct {
+  // 需要压缩的扩展名, 其他文件 (图片, 字体等已压缩的格式) 只做 gzip 封装;
+  // 默认 .html .htm .js .mjs .css .json .svg .txt .xml .map .wasm
+  Compress []string
+  // 文件名中加入内容的散列, "app.js" -> "app.3f2a1b9c.js", 用于长期缓存
+  Hash     bool
+  // 跳过的文件, 参数是相对 dir 的路径; 默认跳过以 "." 开头的文件和目录
+  Skip     func(name string) bool
+  // 不为空时把结果写入 go 源文件, 程序启动时调用 Install()
+  GoFile   string
+  // 生成源文件的包名, 默认 "main"
+  Package  string
+}
+
+var defaultCompressExt = []string{
+  ".html", ".htm", ".js", ".mjs", ".css", ".json", ".svg", ".txt", ".xml", ".map", ".wasm",
+}
+
+// 原文件名 -> 带散列的文件名, 参考 StaticResource.Install()
+var asset_names map[string]string
+// 带散列的文件名, 内容不会改变, 响应可以长期缓存
+var asset_hashed map[string]bool
+var asset_names_lock sync.RWMutex
+
+
+//
+// 遍历 dir 生成资源包, 用于代替 build.js (不做 html/js/css 压缩).
+// 通常在 go generate 中使用并设置 GoFile, 也可以在启动时直接 Install().
+//
+func BuildStaticResource(dir string, opts StaticOptions) (*StaticResource, error) {
+  compress := opts.Compress
+  if compress == nil {
+    compress = defaultCompressExt
+  }
+  skip := opts.Skip
+  if skip == nil {
+    skip = func(name string) bool {
+      return strings.HasPrefix(path.Base(name), ".")
+    }
+  }
+  res := &StaticResource{
+    Files : make(map[string][]byte),
+    Names : make(map[string]string),
+  }
+
+  err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    }
+    rel, err := filepath.Rel(dir, p)
+    if err != nil || rel == "." {
+      return err
+    }
+    name := filepath.ToSlash(rel)
+    if skip(name) {
+      if d.IsDir() {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    if !d.Type().IsRegular() {
+      return nil
+    }
+
+    data, err := os.ReadFile(p)
+    if err != nil {
+      return err
+    }
+    level := gzip.NoCompression
+    if hasExt(name, compress) {
+      level = gzip.BestCompression
+    }
+    gz, err := gzipBytes(data, level)
+    if err != nil {
+      return fmt.Errorf("%s: %s", name, err)
+    }
+
+    res.Files[name] = gz
+    if opts.Hash {
+      hashed := hashedName(name, data)
+      res.Files[hashed] = gz
+      res.Names[name] = hashed
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  if opts.GoFile != "" {
+    if err := res.WriteGoFile(opts.GoFile, opts.Package); err != nil {
+      return nil, err
+    }
+  }
+  return res, nil
+}
+
+
+//
+// 把文件加入资源包 (同名的文件被替换) 并启用 asset 模板函数的文件名映射
+//
+func (s *StaticResource) Install() {
+  file_mapping_lock.RLock()
+  m := make(map[string][]byte, len(file_mapping) + len(s.Files))
+  for k, v := range file_mapping {
+    m[k] = v
+  }
+  file_mapping_lock.RUnlock()
+  for k, v := range s.Files {
+    m[k] = v
+  }
+  // 生成的源文件中带散列的文件名与原文件共享内容, 不重复保存
+  for name, hashed := range s.Names {
+    if _, has := s.Files[hashed]; !has {
+      m[hashed] = s.Files[name]
+    }
+  }
+  ReplaceFileMapping(m)
+
+  asset_names_lock.Lock()
+  names := make(map[string]string, len(asset_names) + len(s.Names))
+  hashed := make(map[string]bool, len(asset_hashed) + len(s.Names))
+  for k, v := range asset_names {
+    names[k] = v
+    hashed[v] = true
+  }
+  for k, v := range s.Names {
+    names[k] = v
+    hashed[v] = true
+  }
+  asset_names = names
+  asset_hashed = hashed
+  asset_names_lock.Unlock()
+}
+
+
+//
+// 写出 go 源文件, 在 init() 中调用 Install()
+//
+func (s *StaticResource) WriteGoFile(file string, pkg string) error {
+  var buf bytes.Buffer
+  if err := s.WriteGo(&buf, pkg); err != nil {
+    return err
+  }
+  return os.WriteFile(file, buf.Bytes(), 0644)
+}
+
+
+//
+// 写出 go 源文件的内容, 带散列的文件名不重复保存内容
+//
+func (s *StaticResource) WriteGo(w io.Writer, pkg string) error {
+  if pkg == "" {
+    pkg = "main"
+  }
+  var buf bytes.Buffer
+  fmt.Fprintf(&buf, "// Code generated by brick.BuildStaticResource. DO NOT EDIT.\n\n")
+  fmt.Fprintf(&buf, "package %s\n\nimport \"github.com/yanmingsohu/brick\"\n\n", pkg)
+  buf.WriteString("func init() {\n  (&brick.StaticResource{\n    Files: map[string][]byte{\n")
+
+  // 带散列的文件名与原文件共享内容
+  shared := make(map[string]bool, len(s.Names))
+  for _, hashed := range s.Names {
+    shared[hashed] = true
+  }
+  files := make([]string, 0, len(s.Files))
+  for name := range s.Files {
+    files = append(files, name)
+  }
+  sort.Strings(files)
+  for _, name := range files {
+    if shared[name] {
+      continue
+    }
+    fmt.Fprintf(&buf, "      %s: []byte(%s),\n", strconv.Quote(name), strconv.Quote(string(s.Files[name])))
+  }
+  buf.WriteString("    },\n    Names: map[string]string{\n")
+  names := make([]string, 0, len(s.Names))
+  for name := range s.Names {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    fmt.Fprintf(&buf, "      %s: %s,\n", strconv.Quote(name), strconv.Quote(s.Names[name]))
+  }
+  buf.WriteString("    },\n  }).Install()\n}\n")
+
+  _, err := w.Write(buf.Bytes())
+  return err
+}
+
+
+//
+// 返回带散列的文件名, 没有映射时返回 name 本身; 保留 name 开头的 "/"
+//
+func AssetName(name string) string {
+  rel := strings.TrimPrefix(name, "/")
+  asset_names_lock.RLock()
+  defer asset_names_lock.RUnlock()
+  if hashed, has := asset_names[rel]; has {
+    return name[:len(name) - len(rel)] + hashed
+  }
+  return name
+}
+
+
+func isHashedAsset(name string) bool {
+  asset_names_lock.RLock()
+  defer asset_names_lock.RUnlock()
+  return asset_hashed[name]
+}
+
+
+func hasExt(name string, list []string) bool {
+  ext := strings.ToLower(path.Ext(name))
+  for _, e := range list {
+    if strings.ToLower(e) == ext {
+      return true
+    }
+  }
+  return false
+}
+
+
+func gzipBytes(data []byte, level int) ([]byte, error) {
+  var buf bytes.Buffer
+  zw, err := gzip.NewWriterLevel(&buf, level)
+  if err != nil {
+    return nil, err
+  }
+  if _, err := zw.Write(data); err != nil {
+    return nil, err
+  }
+  if err := zw.Close(); err != nil {
+    return nil, err
+  }
+  return buf.Bytes(), nil
+}
+
+
+func hashedName(name string, data []byte) string {
+  sum := sha256.Sum256(data)
+  ext := path.Ext(name)
+  return strings.TrimSuffix(name, ext) +"."+ hex.EncodeToString(sum[:4]) + ext
+}
+
@@ -0,0 +1,152 @@
+package brick
+
+import (
+  "fmt"
+  "net/http"
+  "strings"
+)
+
+const (
+  AuditHigh   = "high"
+  AuditMedium = "medium"
+  AuditLow    = "low"
+)
+
+// 每个级别的问题扣除的分数
+var auditPenalty = map[string]int{
+  AuditHigh   : 30,
+  AuditMedium : 15,
+  AuditLow    : 5,
+}
+
+//
+// 安全检查发现的一个问题
+//
+type AuditFinding struct {
+  // AuditHigh, AuditMedium 或 AuditLow
+  Severity string `json:"severity"`
+  Check    string `json:"check"`
+  Msg      string `json:"msg"`
+  // 建议的修改
+  Fix      string `json:"fix"`
+}
+
+//
+// 安全检查报告, Score 满分 100, 每个问题按级别扣分
+//
+type AuditReport struct {
+  Score    int            `json:"score"`
+  Findings []AuditFinding `json:"findings"`
+}
+
+
+func (r *AuditReport) String() string {
+  lines := []string{ fmt.Sprintf("Security audit: score %d/100", r.Score) }
+  for _, f := range r.Findings {
+    lines = append(lines, fmt.Sprintf("  [%-6s] %s: %s; %s", f.Severity, f.Check, f.Msg, f.Fix))
+  }
+  return strings.Join(lines, "\n")
+}
+
+
+//
+// 检查当前的配置: 调试模式, https, 超时, 请求体限制, 限流, cookie 密钥,
+// session 有效期, 安全响应头和静态目录列表. Run() 启动时有问题则写入日志.
+//
+func (b *Brick) SecurityAudit() *AuditReport {
+  c := &b.config
+  r := &AuditReport{ Findings: []AuditFinding{} }
+  add := func(sev, check, msg, fix string) {
+    r.Findings = append(r.Findings, AuditFinding{ Severity: sev, Check: check, Msg: msg, Fix: fix })
+  }
+
+  if b.Debug {
+    add(AuditHigh, "debug", "debug mode is on, stack traces and debug pages are exposed",
+        "turn off Config.Debug in production")
+  }
+  if !b.listenTLS() && len(b.trusted) == 0 {
+    add(AuditHigh, "https", "no https listener and no trusted proxy terminating TLS",
+        "use ListenTLS() or set Config.TrustedProxies for the TLS proxy")
+  }
+  if c.RequestTimeout <= 0 {
+    add(AuditMedium, "timeout", "requests have no time limit, slow clients can hold connections",
+        "set Config.RequestTimeout")
+  }
+  if c.MaxBodyBytes <= 0 {
+    add(AuditMedium, "body-limit", "request bodies have no size limit",
+        "set Config.MaxBodyBytes")
+  }
+  if c.RateLimit == nil {
+    add(AuditLow, "rate-limit", "no global rate limit", "set Config.RateLimit")
+  }
+  if c.HashKey == nil {
+    add(AuditLow, "cookie-keys", "cookie keys are random, sessions and signed cookies break on restart "+
+        "and differ between instances", "set Config.HashKey and Config.BlockKey")
+  }
+  if c.SessionExp <= 0 && c.SessionIdle <= 0 && c.SessionLifetime <= 0 {
+    add(AuditLow, "session-expiry", "sessions never expire on the server",
+        "set Config.SessionIdle or Config.SessionLifetime")
+  }
+  b.reports.lock.Lock()
+  headers := b.reports.headers
+  b.reports.lock.Unlock()
+  if !headers {
+    add(AuditLow, "security-headers", "no CSP, X-Frame-Options or nosniff headers",
+        "use b.Use(b.SecurityHeaders(...))")
+  }
+  if c.H2C {
+    add(AuditLow, "h2c", "unencrypted HTTP/2 is on", "only enable Config.H2C behind a trusted proxy")
+  }
+
+  b.routeLock.RLock()
+  statics := b.statics
+  b.routeLock.RUnlock()
+  for _, p := range statics {
+    if !p.NoListing {
+      add(AuditMedium, "listing", "static '"+ p.BaseUrl +"' lists directory contents",
+          "set StaticPage.NoListing")
+    }
+  }
+
+  r.Score = 100
+  for _, f := range r.Findings {
+    r.Score -= auditPenalty[f.Severity]
+  }
+  if r.Score < 0 {
+    r.Score = 0
+  }
+  return r
+}
+
+
+//
+// 管理接口, 返回 SecurityAudit() 的报告 (json 或纯文本);
+// 报告暴露部署细节, 应该放在需要认证的分组中
+//
+func (b *Brick) SecurityAuditPage() HttpHandler {
+  return func(h *Http) error {
+    r := b.SecurityAudit()
+    h.CacheTime(0)
+    if h.WantsJSON() {
+      h.Json(Msg{ Data: r })
+      return nil
+    }
+    h.W.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    h.W.WriteHeader(http.StatusOK)
+    h.WriteStr(r.String())
+    return nil
+  }
+}
+
+
+//
+// 启动时记录检查结果
+//
+func (b *Brick) auditReport() {
+  r := b.SecurityAudit()
+  if len(r.Findings) == 0 {
+    b.log.Info(r.String())
+    return
+  }
+  b.log.Warn(r.String())
+}
@@ -0,0 +1,176 @@
+package brick
+
+import (
+  "encoding/base64"
+  "errors"
+  "net/http"
+  "strings"
+  "sync"
+)
+
+//
+// 认证失败时返回, 响应 401 并带有 WWW-Authenticate 头域
+//
+var ErrUnauthorized = NewHttpError(http.StatusUnauthorized, "")
+
+//
+// 身份有效但无权访问, 认证函数返回该错误时响应 403
+//
+var ErrForbidden = NewHttpError(http.StatusForbidden, "")
+
+//
+// 认证通过的用户
+//
+type Principal struct {
+  Name   string
+  Roles  []string
+  // 令牌中携带的其他信息
+  Claims map[string]interface{}
+}
+
+type authScheme struct {
+  // "Basic" 或 "Bearer"
+  name      string
+  challenge string
+  verify    func(credentials string) (*Principal, error)
+}
+
+type authSchemes struct {
+  lock   sync.RWMutex
+  list   []authScheme
+  exempt map[string]bool
+}
+
+
+//
+// 所有服务需要 HTTP Basic 认证, verify 返回 false 时响应 401
+//
+func (b *Brick) UseBasicAuth(realm string, verify func(user, pass string) bool) {
+  b.addAuthScheme(authScheme{
+    name      : "Basic",
+    challenge : `Basic realm="`+ strings.Replace(realm, `"`, `'`, -1) +`", charset="UTF-8"`,
+
+    verify: func(credentials string) (*Principal, error) {
+      raw, err := base64.StdEncoding.DecodeString(credentials)
+      if err != nil {
+        return nil, ErrUnauthorized
+      }
+      i := strings.IndexByte(string(raw), ':')
+      if i < 0 {
+        return nil, ErrUnauthorized
+      }
+      user, pass := string(raw[:i]), string(raw[i+1:])
+      if !verify(user, pass) {
+        return nil, ErrUnauthorized
+      }
+      return &Principal{ Name: user }, nil
+    },
+  })
+}
+
+
+//
+// 所有服务需要 Bearer 令牌认证, verify 返回错误时响应 401,
+// 返回 ErrForbidden (或其他 403 HttpError) 时响应 403.
+//
+func (b *Brick) UseBearerAuth(verify func(token string) (Principal, error)) {
+  b.addAuthScheme(authScheme{
+    name      : "Bearer",
+    challenge : "Bearer",
+
+    verify: func(credentials string) (*Principal, error) {
+      p, err := verify(credentials)
+      if err != nil {
+        return nil, err
+      }
+      return &p, nil
+    },
+  })
+}
+
+
+//
+// paths 上注册的服务不需要认证, 例如登录页和健康检查
+//
+func (b *Brick) AuthExempt(paths ...string) {
+  b.auth.lock.Lock()
+  defer b.auth.lock.Unlock()
+  if b.auth.exempt == nil {
+    b.auth.exempt = make(map[string]bool)
+  }
+  for _, p := range paths {
+    b.auth.exempt[p] = true
+  }
+}
+
+
+//
+// 认证通过的用户, 未认证或免认证的服务返回 nil
+//
+func (h *Http) User() *Principal {
+  return h.user
+}
+
+
+func (b *Brick) addAuthScheme(s authScheme) {
+  b.auth.lock.Lock()
+  defer b.auth.lock.Unlock()
+  if len(b.auth.list) == 0 {
+    b.Use(b.authMiddleware)
+  }
+  b.auth.list = append(b.auth.list, s)
+}
+
+
+func (b *Brick) authMiddleware(next HttpHandler) HttpHandler {
+  return func(h *Http) error {
+    b.auth.lock.RLock()
+    exempt := b.auth.exempt[h.rkey]
+    schemes := b.auth.list
+    b.auth.lock.RUnlock()
+    if exempt {
+      return next(h)
+    }
+
+    p, err := authenticate(h.R, schemes)
+    if err != nil {
+      if errorStatus(err) == http.StatusUnauthorized {
+        for _, s := range schemes {
+          h.W.Header().Add("WWW-Authenticate", s.challenge)
+        }
+      }
+      return err
+    }
+    h.user = p
+    if !b.policyAllows(h.rt, p) {
+      return ErrForbidden
+    }
+    return next(h)
+  }
+}
+
+
+func authenticate(r *http.Request, schemes []authScheme) (*Principal, error) {
+  header := strings.TrimSpace(r.Header.Get("Authorization"))
+  i := strings.IndexByte(header, ' ')
+  if i < 0 {
+    return nil, ErrUnauthorized
+  }
+  name, credentials := header[:i], strings.TrimSpace(header[i+1:])
+
+  for _, s := range schemes {
+    if !strings.EqualFold(s.name, name) {
+      continue
+    }
+    p, err := s.verify(credentials)
+    if err == nil {
+      return p, nil
+    }
+    var he *HttpError
+    if errors.As(err, &he) {
+      return nil, err
+    }
+    return nil, WrapHttpError(http.StatusUnauthorized, err)
+  }
+  return nil, ErrUnauthorized
+}
@@ -0,0 +1,160 @@
+package brick
+
+import (
+  "net/http"
+  "strconv"
+  "time"
+)
+
+//
+// 路由开放的时间, 参考 Route.Available()
+//
+type Availability struct {
+  // 开始开放的时间, 零值不限制
+  From     time.Time
+  // 停止开放的时间, 零值不限制
+  Until    time.Time
+  // 按 cron 表达式重复开放 (参考 Brick.Cron()), 每次开放 Duration;
+  // 与 From/Until 同时设置时两个条件都要满足
+  Cron     string
+  Duration time.Duration
+  // 不开放时的状态码, 默认 404; 410 表示活动已结束,
+  // 503 时 Retry-After 为下一次开放的时间
+  Status   int
+  // 不开放时的响应, 例如维护页面, 没有设置状态码时使用 Status; nil 使用错误处理
+  Closed   HttpHandler
+}
+
+type availability struct {
+  Availability
+  cron *cronSpec
+}
+
+
+//
+// 只在指定的时间内开放路由, 其他时间直接返回 Availability.Status, 不执行中间件和处理函数;
+// 用于限时抢购接口和临时活动页面, 不需要重新部署. cron 表达式错误时引起异常.
+//
+//   b.Service("/sale/order", order).Available(brick.Availability{
+//     From: start, Until: start.Add(2 * time.Hour), Status: http.StatusGone })
+//   b.Service("/report/run", run).Available(brick.Availability{
+//     Cron: "0 1 * * *", Duration: 4 * time.Hour, Status: http.StatusServiceUnavailable })
+//
+func (r *Route) Available(a Availability) *Route {
+  av := &availability{ Availability: a }
+  if a.Cron != "" {
+    c, err := parseCron(a.Cron)
+    if err != nil {
+      panic(err)
+    }
+    if a.Duration <= 0 {
+      panic("Availability.Duration must be positive with Cron")
+    }
+    av.cron = c
+  }
+  if !a.From.IsZero() && !a.Until.IsZero() && !a.Until.After(a.From) {
+    panic("Availability.Until must be after From")
+  }
+  if a.Status == 0 {
+    av.Status = http.StatusNotFound
+  }
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  r.avail = av
+  return r
+}
+
+
+func (r *Route) availability() *availability {
+  if r == nil {
+    return nil
+  }
+  r.lock.RLock()
+  defer r.lock.RUnlock()
+  return r.avail
+}
+
+
+//
+// now 时是否开放, 不开放时返回下一次开放的时间, 不会再开放时返回零值
+//
+func (a *availability) open(now time.Time) (bool, time.Time) {
+  if !a.Until.IsZero() && !now.Before(a.Until) {
+    return false, time.Time{}
+  }
+  if !a.From.IsZero() && now.Before(a.From) {
+    next := a.From
+    if a.cron != nil && !a.inWindow(next) {
+      next = a.cron.next(next)
+    }
+    return false, a.before(next)
+  }
+  if a.cron == nil || a.inWindow(now) {
+    return true, time.Time{}
+  }
+  return false, a.before(a.cron.next(now))
+}
+
+
+//
+// cron 的某次开始时间在 (t - Duration, t] 之间
+//
+func (a *availability) inWindow(t time.Time) bool {
+  return !a.cron.next(t.Add(-a.Duration)).After(t)
+}
+
+
+func (a *availability) before(next time.Time) time.Time {
+  if !a.Until.IsZero() && !next.Before(a.Until) {
+    return time.Time{}
+  }
+  return next
+}
+
+
+//
+// 路由不开放时代替处理函数
+//
+func (a *availability) closed(next time.Time) HttpHandler {
+  return func(h *Http) error {
+    h.CacheTime(0)
+    if a.Status == http.StatusServiceUnavailable && !next.IsZero() {
+      sec := int(time.Until(next).Seconds()) + 1
+      h.W.Header().Set("Retry-After", strconv.Itoa(sec))
+    }
+    if a.Closed != nil {
+      orig := h.W
+      h.W = &closedWriter{ ResponseWriter: orig, status: a.Status }
+      defer func() { h.W = orig }()
+      return a.Closed(h)
+    }
+    return NewHttpError(a.Status, "")
+  }
+}
+
+
+//
+// 把 Closed 响应的默认状态 200 换成 Availability.Status
+//
+type closedWriter struct {
+  http.ResponseWriter
+  status  int
+  written bool
+}
+
+
+func (w *closedWriter) WriteHeader(code int) {
+  if !w.written && code == http.StatusOK {
+    code = w.status
+  }
+  w.written = true
+  w.ResponseWriter.WriteHeader(code)
+}
+
+
+func (w *closedWriter) Write(b []byte) (int, error) {
+  if !w.written {
+    w.WriteHeader(w.status)
+  }
+  return w.ResponseWriter.Write(b)
+}
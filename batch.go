@@ -0,0 +1,207 @@
+package brick
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "io"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+// Batch() 默认的最多子请求数量
+const defaultBatchMax = 20
+
+// 每个子请求的响应最多保存的字节数
+const maxBatchResponse = 1 << 20
+
+// 子请求可以设置的请求头, 其他请求头 (X-Forwarded-For, Host, Connection 等) 被忽略,
+// 防止伪造客户端地址
+var batchHeaders = map[string]bool{
+  "Accept"              : true,
+  "Accept-Language"     : true,
+  "Content-Type"        : true,
+  "If-Match"            : true,
+  "If-None-Match"       : true,
+  "If-Modified-Since"   : true,
+  "If-Unmodified-Since" : true,
+  "Idempotency-Key"     : true,
+  "X-Requested-With"    : true,
+}
+
+var errBatchTooLarge = errors.New("batch response too large")
+
+//
+// 批量请求中的一个子请求, Body 是 json 字符串时作为原文发送 (例如表单),
+// 其他 json 值以 application/json 发送
+//
+type BatchRequest struct {
+  Method string            `json:"method"`
+  Path   string            `json:"path"`
+  Header map[string]string `json:"headers,omitempty"`
+  Body   json.RawMessage   `json:"body,omitempty"`
+}
+
+//
+// 子请求的响应, json 响应的 Body 是 json 值, 其他响应是字符串
+//
+type BatchResponse struct {
+  Status int               `json:"status"`
+  Header map[string]string `json:"headers,omitempty"`
+  Body   json.RawMessage   `json:"body,omitempty"`
+}
+
+// 子请求的 context 中有这个键, 禁止嵌套批量请求
+type batchKey struct{}
+
+//
+// 记录子请求的响应
+//
+type batchWriter struct {
+  header http.Header
+  status int
+  buf    bytes.Buffer
+  over   bool
+}
+
+
+//
+// 返回批量请求的处理函数, 请求体是 BatchRequest 的数组, 按顺序经过完整的路由和中间件执行,
+// 子请求带有外层请求的请求头 (cookie, Authorization 等), 共用认证和会话, 子请求自己只能设置
+// Accept, Content-Type, If-* 等少数请求头; 每个子请求的响应最多 1MB, 超过时状态为 502;
+// 子请求设置的 cookie 合并到外层响应. 返回 BatchResponse 的数组, 每个子请求有自己的状态码.
+// max <= 0 时最多 20 个子请求. 例如:
+//
+//   b.Service("/batch", b.Batch(0)).Methods("POST")
+//
+//   POST /batch
+//   [ {"method":"GET", "path":"/api/user"},
+//     {"method":"POST", "path":"/api/read", "body":{"id":3}} ]
+//
+func (b *Brick) Batch(max int) HttpHandler {
+  if max <= 0 {
+    max = defaultBatchMax
+  }
+  return func(h *Http) error {
+    if h.R.Context().Value(batchKey{}) != nil {
+      return NewHttpError(http.StatusBadRequest, "Nested batch request")
+    }
+    var list []BatchRequest
+    if err := json.NewDecoder(h.R.Body).Decode(&list); err != nil {
+      return &HttpError{ Code: http.StatusBadRequest, Msg: "Invalid JSON body", Err: err }
+    }
+    if len(list) > max {
+      return Errorf(http.StatusRequestEntityTooLarge, "At most %d requests in a batch", max)
+    }
+
+    ret := make([]BatchResponse, len(list))
+    for i, sub := range list {
+      if h.Ctx().Err() != nil {
+        return h.Ctx().Err()
+      }
+      ret[i] = b.batchOne(h, sub)
+    }
+    h.CacheTime(0)
+    h.Json(ret)
+    return nil
+  }
+}
+
+
+func (b *Brick) batchOne(h *Http, sub BatchRequest) BatchResponse {
+  if sub.Method == "" {
+    sub.Method = http.MethodGet
+  }
+  if !IsLocalRedirect(sub.Path) {
+    return batchError(http.StatusBadRequest, "Invalid path")
+  }
+
+  var body io.Reader
+  var text string
+  isText := json.Unmarshal(sub.Body, &text) == nil
+  if isText {
+    body = strings.NewReader(text)
+  } else if len(sub.Body) > 0 {
+    body = bytes.NewReader(sub.Body)
+  }
+  ctx := context.WithValue(h.Ctx(), batchKey{}, true)
+  r, err := http.NewRequestWithContext(ctx, strings.ToUpper(sub.Method), sub.Path, body)
+  if err != nil {
+    return batchError(http.StatusBadRequest, err.Error())
+  }
+  r.RemoteAddr = h.R.RemoteAddr
+  r.Host = h.R.Host
+  r.TLS = h.R.TLS
+  for name, v := range h.R.Header {
+    switch name {
+    case "Content-Type", "Content-Length", "Accept-Encoding", "Content-Encoding":
+      continue
+    }
+    r.Header[name] = v
+  }
+  if len(sub.Body) > 0 && !isText {
+    r.Header.Set("Content-Type", "application/json")
+  }
+  for name, v := range sub.Header {
+    if name = http.CanonicalHeaderKey(name); batchHeaders[name] {
+      r.Header.Set(name, v)
+    }
+  }
+
+  w := &batchWriter{ header: http.Header{} }
+  b.ServeHTTP(w, r)
+  if w.over {
+    return batchError(http.StatusBadGateway, "Response larger than "+ strconv.Itoa(maxBatchResponse) +" bytes")
+  }
+
+  for _, c := range w.header["Set-Cookie"] {
+    h.W.Header().Add("Set-Cookie", c)
+  }
+  w.header.Del("Set-Cookie")
+  res := BatchResponse{ Status: w.status, Header: make(map[string]string) }
+  if res.Status == 0 {
+    res.Status = http.StatusOK
+  }
+  for name, v := range w.header {
+    res.Header[name] = strings.Join(v, ", ")
+  }
+  data := w.buf.Bytes()
+  if strings.Contains(w.header.Get("Content-Type"), "json") && json.Valid(data) {
+    res.Body = json.RawMessage(data)
+  } else if len(data) > 0 {
+    res.Body, _ = json.Marshal(string(data))
+  }
+  return res
+}
+
+
+func batchError(status int, msg string) BatchResponse {
+  body, _ := json.Marshal(Msg{ Code: status, Msg: msg })
+  return BatchResponse{ Status: status, Body: body }
+}
+
+
+func (w *batchWriter) Header() http.Header {
+  return w.header
+}
+
+
+func (w *batchWriter) WriteHeader(code int) {
+  if w.status == 0 {
+    w.status = code
+  }
+}
+
+
+func (w *batchWriter) Write(p []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  if w.over || w.buf.Len() + len(p) > maxBatchResponse {
+    w.over = true
+    return 0, errBatchTooLarge
+  }
+  return w.buf.Write(p)
+}
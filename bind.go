@@ -0,0 +1,408 @@
+package brick
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "reflect"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+//
+// 参数绑定选项, 参考 AllowFields() 和 StrictBind()
+//
+type BindOption func(*bindOptions)
+
+type bindOptions struct {
+  // 允许从用户输入设置的参数名, nil 表示不限制
+  allow  map[string]bool
+  // 出现意外参数时返回错误而不是丢弃
+  strict bool
+}
+
+//
+// 可绑定的结构体字段
+//
+type bindField struct {
+  name      string
+  index     []int
+  protected bool
+  // validate 标签, 参考 BindForm()
+  rules     string
+}
+
+
+//
+// 只允许绑定 names 中列出的参数, 其他参数被记录日志并丢弃
+//
+func AllowFields(names ...string) BindOption {
+  return func(o *bindOptions) {
+    if o.allow == nil {
+      o.allow = make(map[string]bool, len(names))
+    }
+    for _, n := range names {
+      o.allow[n] = true
+    }
+  }
+}
+
+
+//
+// 出现意外参数时 Bind 返回错误
+//
+func StrictBind() BindOption {
+  return func(o *bindOptions) {
+    o.strict = true
+  }
+}
+
+
+//
+// 为 path 路由设置参数白名单, 该路由上所有 Bind 调用只允许绑定这些参数,
+// 与调用时传入的 AllowFields() 取交集.
+//
+func (b *Brick) BindAllow(path string, names ...string) {
+  b.bindLock.Lock()
+  defer b.bindLock.Unlock()
+  if b.bindAllow == nil {
+    b.bindAllow = make(map[string]map[string]bool)
+  }
+  m := make(map[string]bool, len(names))
+  for _, n := range names {
+    m[n] = true
+  }
+  b.bindAllow[path] = m
+}
+
+
+//
+// 把 URI 参数或 POST 表单绑定到结构体 out 的字段上,
+// 参数名取字段的 form 标签, 其次是 json 标签, 最后是字段名.
+// 字段标签 `bind:"-"` 表示该字段受保护, 永远不会从用户输入设置.
+// 未知的, 受保护的或不在白名单中的参数会被记录日志并丢弃.
+//
+func (h *Http) Bind(out interface{}, opts ...BindOption) error {
+  h.init_query()
+  fields, err := bindFields(out, "form")
+  if err != nil {
+    return err
+  }
+  h.rt.noteBind(out, false)
+
+  o := h.bindOptions(opts)
+  rv := reflect.ValueOf(out).Elem()
+  var rejected []string
+
+  for name, values := range *h.q {
+    f, has := fields[name]
+    if !has || !o.allowed(f) {
+      rejected = append(rejected, name)
+      continue
+    }
+    if err := setFieldStrings(rv.FieldByIndex(f.index), values); err != nil {
+      return Errorf(http.StatusBadRequest, "parameter '%s': %s", name, err)
+    }
+  }
+  return h.rejectParams(o, rejected)
+}
+
+
+//
+// 把 json 请求体绑定到结构体 out, 参数名取字段的 json 标签,
+// 白名单和受保护字段的规则与 Bind() 相同, 并递归作用于嵌套的结构体
+// (包括结构体切片), 嵌套参数的名字形如 "address.city".
+// 白名单中的 "address" 允许其下所有字段, "address.city" 只允许该字段.
+//
+func (h *Http) BindJSON(out interface{}, opts ...BindOption) error {
+  _, err := bindFields(out, "json")
+  if err != nil {
+    return err
+  }
+  h.rt.noteBind(out, true)
+
+  body, err := ioutil.ReadAll(h.R.Body)
+  if err != nil {
+    return err
+  }
+  var raw map[string]json.RawMessage
+  if err := json.Unmarshal(body, &raw); err != nil {
+    return &HttpError{ Code: http.StatusBadRequest, Msg: "Invalid JSON body", Err: err }
+  }
+
+  o := h.bindOptions(opts)
+  var rejected []string
+  filtered := filterJSON(reflect.TypeOf(out).Elem(), body, "", false, o, &rejected)
+
+  if len(raw) > 0 {
+    if err := json.Unmarshal(filtered, out); err != nil {
+      return &HttpError{ Code: http.StatusBadRequest, Msg: "Invalid JSON body", Err: err }
+    }
+  }
+  return h.rejectParams(o, rejected)
+}
+
+
+var jsonUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+
+//
+// 按类型 t 过滤 json 值 raw, 删除结构体中未知的, 受保护的或不在白名单中的键,
+// 并把它们的完整名字加入 rejected; whole 表示上级字段整体在白名单中.
+// 自己实现 json.Unmarshaler 的嵌套类型和 map 保持原样.
+//
+func filterJSON(t reflect.Type, raw json.RawMessage, path string, whole bool,
+    o *bindOptions, rejected *[]string) json.RawMessage {
+  for t.Kind() == reflect.Ptr {
+    t = t.Elem()
+  }
+  if path != "" && reflect.PtrTo(t).Implements(jsonUnmarshaler) {
+    return raw
+  }
+
+  switch t.Kind() {
+  case reflect.Slice, reflect.Array:
+    var items []json.RawMessage
+    if json.Unmarshal(raw, &items) != nil {
+      return raw
+    }
+    for i := range items {
+      items[i] = filterJSON(t.Elem(), items[i], path, whole, o, rejected)
+    }
+    filtered, _ := json.Marshal(items)
+    return filtered
+
+  case reflect.Struct:
+    var obj map[string]json.RawMessage
+    if json.Unmarshal(raw, &obj) != nil {
+      return raw
+    }
+    fields := make(map[string]*bindField)
+    collectBindFields(t, nil, "json", fields)
+
+    for key, val := range obj {
+      name := path + key
+      f, has := fields[key]
+      if !has || f.protected || !(whole || o.allowedPath(name)) {
+        *rejected = append(*rejected, name)
+        delete(obj, key)
+        continue
+      }
+      inner := whole || o.allow == nil || o.allow[name]
+      obj[key] = filterJSON(t.FieldByIndex(f.index).Type, val, name +".", inner, o, rejected)
+    }
+    filtered, _ := json.Marshal(obj)
+    return filtered
+  }
+  return raw
+}
+
+
+func (h *Http) bindOptions(opts []BindOption) *bindOptions {
+  o := &bindOptions{}
+  for _, op := range opts {
+    op(o)
+  }
+
+  h.b.bindLock.Lock()
+  routeAllow := h.b.bindAllow[h.rkey]
+  h.b.bindLock.Unlock()
+
+  if routeAllow != nil {
+    if o.allow == nil {
+      o.allow = routeAllow
+    } else {
+      both := make(map[string]bool)
+      for n := range o.allow {
+        if routeAllow[n] {
+          both[n] = true
+        }
+      }
+      o.allow = both
+    }
+  }
+  return o
+}
+
+
+func (o *bindOptions) allowed(f *bindField) bool {
+  if f.protected {
+    return false
+  }
+  return o.allow == nil || o.allow[f.name]
+}
+
+
+//
+// name 或它下面的某个嵌套参数在白名单中
+//
+func (o *bindOptions) allowedPath(name string) bool {
+  if o.allow == nil || o.allow[name] {
+    return true
+  }
+  for n := range o.allow {
+    if strings.HasPrefix(n, name +".") {
+      return true
+    }
+  }
+  return false
+}
+
+
+func (h *Http) rejectParams(o *bindOptions, rejected []string) error {
+  if len(rejected) == 0 {
+    return nil
+  }
+  sort.Strings(rejected)
+  h.b.log.Warn("Bind", h.R.URL.Path, "unexpected parameters:", rejected)
+  if o.strict {
+    return NewHttpError(http.StatusBadRequest, "Unexpected parameters: "+ strings.Join(rejected, ", "))
+  }
+  return nil
+}
+
+
+//
+// 收集结构体中可绑定的字段, tagName 决定参数名的来源
+//
+func bindFields(out interface{}, tagName string) (map[string]*bindField, error) {
+  rv := reflect.ValueOf(out)
+  if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+    return nil, errors.New("Bind target must be a pointer to struct")
+  }
+  fields := make(map[string]*bindField)
+  collectBindFields(rv.Elem().Type(), nil, tagName, fields)
+  return fields, nil
+}
+
+
+func collectBindFields(t reflect.Type, parent []int, tagName string,
+    out map[string]*bindField) {
+  for i := 0; i < t.NumField(); i++ {
+    sf := t.Field(i)
+    index := append(append([]int{}, parent...), i)
+
+    if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+      collectBindFields(sf.Type, index, tagName, out)
+      continue
+    }
+    if sf.PkgPath != "" {
+      continue
+    }
+
+    name := fieldParamName(sf, tagName)
+    if name == "-" {
+      continue
+    }
+    out[name] = &bindField{
+      name      : name,
+      index     : index,
+      protected : sf.Tag.Get("bind") == "-",
+      rules     : sf.Tag.Get("validate"),
+    }
+  }
+}
+
+
+func fieldParamName(sf reflect.StructField, tagName string) string {
+  tags := []string{ tagName, "json" }
+  for _, tn := range tags {
+    if tag, has := sf.Tag.Lookup(tn); has {
+      name := strings.Split(tag, ",")[0]
+      if name != "" {
+        return name
+      }
+    }
+  }
+  return sf.Name
+}
+
+
+//
+// 把字符串参数转换为字段类型并赋值, 支持基本类型, 指针和切片
+//
+func setFieldStrings(v reflect.Value, values []string) error {
+  if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+    s := reflect.MakeSlice(v.Type(), len(values), len(values))
+    for i, str := range values {
+      if err := setFieldString(s.Index(i), str); err != nil {
+        return err
+      }
+    }
+    v.Set(s)
+    return nil
+  }
+  if len(values) == 0 {
+    return nil
+  }
+  return setFieldString(v, values[0])
+}
+
+
+func setFieldString(v reflect.Value, str string) error {
+  if v.Kind() == reflect.Ptr {
+    nv := reflect.New(v.Type().Elem())
+    if err := setFieldString(nv.Elem(), str); err != nil {
+      return err
+    }
+    v.Set(nv)
+    return nil
+  }
+
+  if v.Type() == reflect.TypeOf(time.Duration(0)) {
+    d, err := time.ParseDuration(str)
+    if err != nil {
+      return err
+    }
+    v.SetInt(int64(d))
+    return nil
+  }
+
+  switch v.Kind() {
+  case reflect.String:
+    v.SetString(str)
+
+  case reflect.Bool:
+    if str == "" || str == "on" {
+      v.SetBool(str == "on")
+      return nil
+    }
+    b, err := strconv.ParseBool(str)
+    if err != nil {
+      return err
+    }
+    v.SetBool(b)
+
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    i, err := strconv.ParseInt(str, 10, v.Type().Bits())
+    if err != nil {
+      return err
+    }
+    v.SetInt(i)
+
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+    i, err := strconv.ParseUint(str, 10, v.Type().Bits())
+    if err != nil {
+      return err
+    }
+    v.SetUint(i)
+
+  case reflect.Float32, reflect.Float64:
+    f, err := strconv.ParseFloat(str, v.Type().Bits())
+    if err != nil {
+      return err
+    }
+    v.SetFloat(f)
+
+  case reflect.Slice:
+    // []byte
+    v.SetBytes([]byte(str))
+
+  default:
+    return errors.New("unsupported field type "+ v.Type().String())
+  }
+  return nil
+}
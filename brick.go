@@ -1,6 +1,7 @@
 package brick
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -13,6 +14,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -57,8 +59,55 @@ type Brick struct {
   cachedTemplate  map[string]*CachedTemplate
   tplLock         sync.Mutex
   templateDir     string
+  // 按级别过滤的日志, 输出到 logOut
   log             Logger
+  logOut          Logger
+  levels          logLevels
   errorHandle     HttpErrorHandler
+  i18n            *I18n
+  bindAllow       map[string]map[string]bool
+  bindLock        sync.Mutex
+  config          Config
+  routes          []*Route
+  pathRoutes      map[string][]*Route
+  routeLock       sync.RWMutex
+  schemas         map[string]*schemaNode
+  schemaLock      sync.Mutex
+  metrics         *Metrics
+  health          healthChecks
+  middleware      []Middleware
+  globalLimit     *limiter
+  routeLimits     map[string]*limiter
+  routeCosts      map[string]float64
+  priorities      map[string]Priority
+  shed            *shedder
+  timing          timingExposures
+  auth            authSchemes
+  warm            warmer
+  cookies         cookieCodecs
+  cache           Cache
+  onStart         []StartHook
+  sessions        SessionManager
+  listen          listeners
+  comps           components
+  trusted         trustedProxies
+  jobs            scheduler
+  quota           quotas
+  streams         streamConns
+  emails          emailTemplates
+  statics         []*StaticPage
+  exports         exportSpool
+  budget          budgets
+  provs           providers
+  hosts           hostTable
+  deprecated      deprecations
+  usage           usageStats
+  policy          policyState
+  lanes           laneTable
+  sessSchemas     sessionSchemas
+  share           localShare
+  reports         clientReports
+  limitLock       sync.Mutex
   Debug           bool
 } 
 
@@ -71,13 +120,40 @@ type Http struct {
   q  *url.Values
   // 在记录 http 日志时的附加条目
   L  string
+  // 当前请求使用的语言, 参考 Locale()
+  locale string
+  // 注册服务时的路径
+  route  string
+  // 按路径设置的表 (AuthExempt, RateLimit 等) 的键, 虚拟主机上是 "主机"+路径, 参考 Host()
+  rkey   string
+  // 请求的路由, 参考 Route()
+  rt     *Route
+  // 认证通过的用户, 参考 User()
+  user   *Principal
+  // 缓存标签, 参考 CacheTag()
+  tags   []string
+  // 本次访问不更新 session 的活动时间
+  passive bool
+  // 参考 RequestID()
+  reqID  string
+  // 模板直接输出到客户端, 参考 StreamTemplate()
+  streamTpl bool
+  // 参考 TempDir()
+  tmpDir string
 }
 
 type StaticPage struct {
   BaseUrl    string // web 服务的路径前缀
   FilePath   string // 本地文件路径
+  // 根据 Accept 和 DPR 客户端提示选择 avif/webp/@2x 图片变体
+  ImageVariants bool
+  // 没有 index.html 的目录返回 404 而不是文件列表
+  NoListing  bool
+  // 参考 Protect()
+  rules      []staticRule
   localFS    http.Handler
-  log        Logger
+  b          *Brick
+  rt         *Route
 }
 
 //
@@ -98,6 +174,7 @@ type TplFuncCtx struct {
   Data    *interface{}
   Dirname string
   parent  *template.Template
+  hd      *Http
 }
 
 //
@@ -109,7 +186,7 @@ type TemplateHandler func(*Http)(interface{}, error)
 
 //
 // http 服务处理函数, 在可能返回 error 之前不要写出任何数据
-// 返回的 error 会设置输出为 500 http code
+// 返回的 error 会设置输出为 500 http code, HttpError 使用其中的状态码
 //
 type HttpHandler func(*Http) error
 
@@ -119,36 +196,97 @@ type HttpHandler func(*Http) error
 //
 type HttpErrorHandler func(hd *Http, err interface{})
 
+//
+// 中间件, 包装 HttpHandler 并返回新的 HttpHandler,
+// 可以在调用 next 之前结束请求 (不调用 next 并返回 nil 或 error)
+//
+type Middleware func(next HttpHandler) HttpHandler
+
 // 包内全局变量, 使用 build.js 构建的代码将设置这个变量
 var file_mapping = make(map[string][]byte)
 
+// 替换 file_mapping 时使用, 参考 ReplaceFileMapping()
+var file_mapping_lock sync.RWMutex
+
 //
 // 创建 Brick 的实例, session 对象在 sessionExp 后无效.
+// 端口在 Run() 时才检查, 参考 NewBrickConfig()
 //
 func NewBrick(httpPort int, sessionExp time.Duration) *Brick {
-  secureCookie := securecookie.New(
-    securecookie.GenerateRandomKey(32), 
-    securecookie.GenerateRandomKey(16))
+  b, err := NewBrickConfig(Config{
+    HttpPort   : httpPort,
+    SessionExp : sessionExp,
+  })
+  if err != nil {
+    panic(err)
+  }
+  return b
+}
+
+
+//
+// 使用完整配置创建 Brick 的实例, 配置有错误时返回 ConfigError
+//
+func NewBrickConfig(c Config) (*Brick, error) {
+  if err := c.Validate(); err != nil {
+    return nil, err
+  }
+  if c.SessionCookie == "" {
+    c.SessionCookie = "bricksessionid"
+  }
+  hashKey, blockKey := c.HashKey, c.BlockKey
+  if hashKey == nil {
+    hashKey = securecookie.GenerateRandomKey(32)
+  }
+  if blockKey == nil {
+    blockKey = securecookie.GenerateRandomKey(16)
+  }
+  secureCookie := securecookie.New(hashKey, blockKey)
 
   b := Brick{ 
-    HttpPort        : httpPort,
+    HttpPort        : c.HttpPort,
+    Debug           : c.Debug,
+    templateDir     : c.TemplateDir,
+    config          : c,
     secureCookie    : secureCookie,
+    cookies         : cookieCodecs{ hashKey: hashKey, blockKey: blockKey },
     cachedTemplate  : make(map[string]*CachedTemplate),
     serveMux        : http.NewServeMux(),
     funcMap         : template.FuncMap{},
-    log             : &defaultLogger{},
+    logOut          : &defaultLogger{},
     errorHandle     : defaultErrorHandle,
+    i18n            : NewI18n("en"),
+    usage           : usageStats{ since: time.Now() },
+    health          : healthChecks{
+      checks  : make(map[string]HealthCheck),
+      timeout : 5 * time.Second,
+    },
   
     sess: sessions.New(sessions.Config{
-      Cookie: "bricksessionid",
-      Expires: sessionExp,
+      Cookie: c.SessionCookie,
+      Expires: c.SessionExp,
       Encode: secureCookie.Encode,
       Decode: secureCookie.Decode,
     }),
   }
 
+  b.log = &levelLogger{ b: &b }
+  b.levels.min = c.LogLevel
+  b.sessions.b = &b
+  b.sess.OnDestroy(b.sessions.forget)
+  if c.SessionDB != nil {
+    b.sess.UseDatabase(c.SessionDB)
+    if p, ok := c.SessionDB.(interface{ Ping(context.Context) error }); ok {
+      b.AddHealthCheck("sessions", p.Ping)
+    }
+  }
+  b.trusted, _ = parseTrustedProxies(c.TrustedProxies)
+  if c.RateLimit != nil {
+    b.globalLimit = newLimiter("global", *c.RateLimit)
+  }
+  b.Use(b.rateLimitMiddleware, b.requestLimitMiddleware)
   b.defaultTemplateFunc()
-  return &b;
+  return &b, nil
 }
 
 
@@ -159,12 +297,43 @@ func (b *Brick) defaultTemplateFunc() {
     if err != nil {
       return "", err
     }
-    nfc := TplFuncCtx{ fc, fc.Data, filepath.Dir(fn), ct.template }
+    nfc := TplFuncCtx{ fc, fc.Data, filepath.Dir(fn), ct.template, fc.hd }
     if err := ct.template.Execute(nfc, nfc); err != nil {
       return "", err
     }
     return "", nil
   }
+
+  // {{ sessionRemaining . }} session 剩余的秒数, 不限制时为 -1
+  b.funcMap["sessionRemaining"] = func(fc TplFuncCtx) int {
+    if fc.hd == nil {
+      return -1
+    }
+    if d, limited := fc.hd.SessionRemaining(); limited {
+      return int(d.Seconds())
+    }
+    return -1
+  }
+
+  // {{ asset "app.js" }} 带内容散列的文件名, 参考 BuildStaticResource()
+  b.funcMap["asset"] = AssetName
+
+  // {{ device . }} 设备分类 "mobile", "desktop" 或 "bot", 参考 Http.Device()
+  b.funcMap["device"] = func(fc TplFuncCtx) string {
+    if fc.hd == nil {
+      return DeviceDesktop
+    }
+    fc.hd.VaryDevice()
+    return fc.hd.Device()
+  }
+
+  // {{ t . "key" args... }} 使用请求的语言翻译 key; range/with 中 . 已经改变, 写作 {{ t $ "key" }}
+  b.funcMap["t"] = func(fc TplFuncCtx, key string, args ...interface{}) string {
+    if fc.hd == nil {
+      return b.i18n.Translate(b.i18n.Fallback(), key, args...)
+    }
+    return fc.hd.T(key, args...)
+  }
 }
 
 
@@ -178,12 +347,35 @@ func (b *Brick) setTplFunc(name string, fn interface{})(error) {
 
 
 //
-// 启动服务, 该方法会阻塞
+// 启动服务, 该方法会阻塞; 启动前检查配置, 执行 OnStart() 注册的函数并打印启动报告.
+// 没有调用过 Listen() 时监听 HttpPort, 参考 Run()
 //
 func (b *Brick) StartHttpServer() error {
-  port := ":"+ strconv.Itoa(b.HttpPort);
-  b.log.Info("Server on http://localhost"+ port)
-	return http.ListenAndServe(port, b.serveMux)
+  return b.Run()
+}
+
+
+//
+// 服务启动前执行的函数, 返回错误时服务不会启动
+//
+type StartHook func(ctx context.Context) error
+
+
+//
+// 注册服务启动前按顺序执行的函数, 例如数据库迁移
+//
+func (b *Brick) OnStart(f StartHook) {
+  b.onStart = append(b.onStart, f)
+}
+
+
+func (b *Brick) runStartHooks() error {
+  for _, f := range b.onStart {
+    if err := f(context.Background()); err != nil {
+      return err
+    }
+  }
+  return nil
 }
 
 
@@ -192,53 +384,201 @@ func (b *Brick) StartHttpServer() error {
 //
 func (h *Http) Session()(*sessions.Session) {
   if h.s == nil {
-    h.s = h.b.sess.Start(h.W, h.R)
+    h.s = h.startSession()
+    h.b.sessions.touch(h.s.ID())
+    h.checkSessionActivity()
   } 
   return h.s
 }
 
 
 //
-// 普通 web 服务
+// 普通 web 服务, 返回的路由可以限制请求方法, 参考 Route.Methods()
+//
+func (b *Brick) Service(path string, h HttpHandler) *Route {
+  return b.service(path, h, nil)
+}
+
+
+//
+// 注册服务, g 不为空时先经过分组的中间件, 错误交给分组的错误处理器.
+// 同一路径可以按请求方法注册多个服务.
 //
-func (b *Brick) Service(path string, h HttpHandler) {
-  b.log.Debug("Service", path)
-  b.serveMux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-    t1 := time.Now()
-    hd := Http{ r, w, b, nil, make([]Shutdown, 0, 3), nil, "" }
+func (b *Brick) service(path string, h HttpHandler, g *Group) *Route {
+  b.log.Debug("Service", g.hostOf().name() + path)
+  mux, key := g.hostOf().target(b, path)
+  rt := &Route{ info: RouteInfo{
+    Host    : g.hostOf().name(),
+    Path    : path,
+    Kind    : "service",
+    Handler : handlerName(h),
+  }, h: h, g: g }
+
+  b.routeLock.Lock()
+  defer b.routeLock.Unlock()
+  b.routes = append(b.routes, rt)
+  if b.pathRoutes == nil {
+    b.pathRoutes = make(map[string][]*Route)
+  }
+  if _, has := b.pathRoutes[key]; !has {
+    mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+      b.dispatch(key, w, r)
+    })
+  }
+  b.pathRoutes[key] = append(b.pathRoutes[key], rt)
+  return rt
+}
+
+
+//
+// 执行一次服务请求: 经过全局和分组的中间件, 参考 handle()
+//
+func (b *Brick) serve(rt *Route, h HttpHandler, w http.ResponseWriter, r *http.Request) {
+  b.handle(rt, b.chain(rt.g.chain(h)), w, r)
+}
+
+
+//
+// 所有路由 (服务, 模板, 静态文件, 跳转) 共用的请求处理: 错误处理, 异常恢复, 指标和日志
+//
+func (b *Brick) handle(rt *Route, h HttpHandler, w http.ResponseWriter, r *http.Request) {
+  path := rt.info.Path
+  t1 := time.Now()
+  if a := rt.availability(); a != nil {
+    // 不开放的路由不执行中间件和处理函数
+    if open, next := a.open(t1); !open {
+      h = a.closed(next)
+    }
+  }
+  rw := &responseWriter{ ResponseWriter: w }
+  hd := Http{ R: r, W: rw, b: b, c: make([]Shutdown, 0, 3), route: path, rt: rt,
+      rkey: rt.info.Host + path }
+  errorHandle := rt.g.errorHandler()
+  if errorHandle == nil {
+    errorHandle = b.errorHandle
+  }
 
+  if m := b.metrics; m != nil {
+    m.begin(path)
     defer func() {
-      if err := recover(); err != nil {
-        if b.Debug {
-          var buf [4096]byte
-          n := runtime.Stack(buf[:], false)
-          b.log.Error("==>", err, string(buf[:n]))
-        }
-
-        b.errorHandle(&hd, err)
-      }
+      m.end(path, rw.status, t1)
     }()
-    
-    if err := h(&hd); err != nil {
-      b.errorHandle(&hd, err)
+  }
+  defer func() {
+    rt.recordUse(rw.status)
+  }()
+  defer b.finish(&hd, t1, errorHandle)
+  if d := rt.deprecation(); d != nil {
+    d.writeHeader(rw.Header())
+  }
+
+  if err := h(&hd); err != nil {
+    errorHandle(&hd, err)
+  }
+  b.cache.record(&hd, rw.status)
+}
+
+
+//
+// 请求结束: 处理函数或错误处理中的异常交给错误处理, 然后关闭 CloseOnEnd()
+// 注册的对象并写访问日志; 异常不会中断这些步骤.
+//
+func (b *Brick) finish(hd *Http, begin time.Time, errorHandle HttpErrorHandler) {
+  if err := recover(); err != nil {
+    if b.Debug {
+      var buf [4096]byte
+      n := runtime.Stack(buf[:], false)
+      b.log.Error("==>", hd.routeLabel(), err, string(buf[:n]))
+    }
+    b.recoverErrorHandle(hd, errorHandle, err)
+  }
+  b.protect(hd, "close", hd.shutdown)
+  if d := hd.rt.deprecation(); d != nil {
+    b.recordDeprecated(hd, d)
+  }
+  comp := LogAccess
+  if hd.rt != nil && hd.rt.info.Kind == "static" {
+    comp = LogStatic
+  }
+  serviceLog(b.Logger(comp), begin, hd.R, hd.ClientIP(), hd.L);
+}
+
+
+//
+// 调用错误处理, 错误处理本身出现异常时记录日志并返回 500
+//
+func (b *Brick) recoverErrorHandle(hd *Http, errorHandle HttpErrorHandler, err interface{}) {
+  defer func() {
+    if p := recover(); p != nil {
+      b.log.Error("==>", hd.routeLabel(), "error handler panic:", p, "while handling:", err)
+      if !hd.written() {
+        hd.W.WriteHeader(http.StatusInternalServerError)
+      }
     }
-    hd.shutdown()
+  }()
+  errorHandle(hd, err)
+}
 
-    serviceLog(b.log, t1, r, hd.L);
-  })
+
+func (b *Brick) protect(hd *Http, what string, fn func()) {
+  defer func() {
+    if p := recover(); p != nil {
+      b.log.Error("==>", hd.routeLabel(), what, "panic:", p)
+    }
+  }()
+  fn()
 }
 
 
-func (b *Brick) SetErrorHandler(p HttpErrorHandler) {
-  b.errorHandle = p
+//
+// 用 w 和 r 创建请求对象, 用于测试或在 Service 之外调用 HttpHandler,
+// 参考 bricktest 包
+//
+func (b *Brick) NewHttp(w http.ResponseWriter, r *http.Request) *Http {
+  return &Http{
+    R     : r,
+    W     : &responseWriter{ ResponseWriter: w },
+    b     : b,
+    c     : make([]Shutdown, 0, 3),
+    route : r.URL.Path,
+  }
+}
+
+
+//
+// 实现 http.Handler, 请求经过注册的全部服务, 中间件和错误处理;
+// 按 Host 头选择虚拟主机, 参考 Host()
+//
+func (b *Brick) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  mux := b.serveMux
+  if hs := b.matchHost(r); hs != nil {
+    mux = hs.mux
+  }
+  if _, pattern := mux.Handler(r); pattern == "" {
+    b.recordMissing(r.URL.Path)
+  }
+  mux.ServeHTTP(w, r)
+}
+
+
+//
+// 添加对所有 Service 生效的中间件, 先添加的在外层先执行
+//
+func (b *Brick) Use(m ...Middleware) {
+  b.middleware = append(b.middleware, m...)
 }
 
 
-func defaultErrorHandle(hd *Http, err interface{}) {
-  hd.W.WriteHeader(500)
-  hd.WriteStr(`<p>Service Error</p>`)
-  fmt.Fprintf(hd.W, `<p>%s</p>`, err)
-  hd.b.log.Error("Error:", err)
+func (b *Brick) chain(h HttpHandler) HttpHandler {
+  for i := len(b.middleware) - 1; i >= 0; i-- {
+    h = b.middleware[i](h)
+  }
+  return h
+}
+
+
+func (b *Brick) SetErrorHandler(p HttpErrorHandler) {
+  b.errorHandle = p
 }
 
 
@@ -269,6 +609,7 @@ func (b *Brick) GetCachedTemplate(fileName string)(*CachedTemplate, error) {
     b.cachedTemplate[fileName] = cd
   }
 
+  b.metrics.templateCache(fileName, modtime.Equal(cd.lastTime))
   if !modtime.Equal(cd.lastTime) {
     b.log.Info("Template change", fileName)
     buf, errR := ioutil.ReadAll(file)
@@ -283,6 +624,7 @@ func (b *Brick) GetCachedTemplate(fileName string)(*CachedTemplate, error) {
     cd.lastTime = *modtime
     cd.fileName = fileName
   }
+  b.recordTemplate(fileName, true)
   return cd, nil
 }
 
@@ -294,14 +636,17 @@ func (b *Brick) GetCachedTemplate(fileName string)(*CachedTemplate, error) {
 //
 func (b *Brick) TemplatePage(
     templateFile string, handle TemplateHandler)(HttpHandler) {
-  b.log.Debug("Template", templateFile)
+  b.Logger(LogTemplate).Debug("Template", templateFile)
+  b.recordTemplate(templateFile, false)
   dir := filepath.Dir(templateFile)
 
   return func(hd *Http) error {
     hd.W.Header().Set("Content-Type", "text/html; charset=utf-8")
-    ct, err := b.GetCachedTemplate(templateFile)
+    ct, err := b.GetCachedTemplate(hd.DeviceTemplate(templateFile))
     if err != nil {
-      hd.WriteStr("Parse Template Error<br/>")
+      if hd.streaming() {
+        hd.WriteStr("Parse Template Error<br/>")
+      }
       return err
     }
 
@@ -314,12 +659,52 @@ func (b *Brick) TemplatePage(
       return nil
     }
 
-    fc := TplFuncCtx{ hd.W, &data, dir, ct.template }
-    if err := ct.template.Execute(hd.W, fc); err != nil {
+    if hd.streaming() {
+      fc := TplFuncCtx{ hd.W, &data, dir, ct.template, hd }
+      return ct.template.Execute(hd.W, fc)
+    }
+
+    buf := tplBuffers.Get().(*bytes.Buffer)
+    defer putTplBuffer(buf)
+    fc := TplFuncCtx{ buf, &data, dir, ct.template, hd }
+    if err := ct.template.Execute(buf, fc); err != nil {
+      // 还没有输出任何内容, 错误处理函数可以发送完整的错误页
       return err
     }
-    return nil
+    hd.W.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+    _, err = buf.WriteTo(hd.W)
+    return err
+  }
+}
+
+
+//
+// 本次请求的模板渲染后直接输出到客户端, 不先写入缓冲区;
+// 用于非常大的页面, 渲染出错时客户端收到不完整的页面和 200 状态.
+// 在 TemplateHandler 中调用, 全局设置参考 Config.StreamTemplates
+//
+func (h *Http) StreamTemplate() {
+  h.streamTpl = true
+}
+
+
+func (h *Http) streaming() bool {
+  return h.streamTpl || h.b.config.StreamTemplates
+}
+
+
+var tplBuffers = sync.Pool{
+  New: func() interface{} { return new(bytes.Buffer) },
+}
+
+
+func putTplBuffer(buf *bytes.Buffer) {
+  // 不保留特别大的缓冲区
+  if buf.Cap() > 1 << 20 {
+    return
   }
+  buf.Reset()
+  tplBuffers.Put(buf)
 }
 
 
@@ -328,20 +713,37 @@ func (b *Brick) TemplatePage(
 // 如果参数 location == '/', 则对没有注册过的路径的请求都会转发到 to 上.
 //
 func (b *Brick) HttpJumpMapping(location string, to string) {
-  b.serveMux.HandleFunc(location, func(w http.ResponseWriter, r *http.Request) {
-    if r.Method == "HEAD" {
-      w.WriteHeader(405)
-      return
+  b.jumpMapping(location, to, nil)
+}
+
+
+func (b *Brick) jumpMapping(location string, to string, hs *Host) {
+  rt := b.addRoute(RouteInfo{ Path: location, Methods: []string{ "GET" }, Kind: "redirect", Handler: to }, hs)
+  jump := func(h *Http) error {
+    if h.R.Method == "HEAD" {
+      h.W.WriteHeader(405)
+      return nil
     }
-    http.Redirect(w, r, to, http.StatusMovedPermanently)
+    http.Redirect(h.W, h.R, to, http.StatusMovedPermanently)
+    return nil
+  }
+  mux, _ := hs.target(b, location)
+  mux.HandleFunc(location, func(w http.ResponseWriter, r *http.Request) {
+    b.handle(rt, jump, w, r)
   })
 }
 
 
 //
-// 设置静态文件服务, 必须在该方法之前设置 log 否则无效
+// 设置静态文件服务,
+// 返回的对象可以进一步配置服务选项.
 //
-func (b *Brick) StaticPage(baseURL string, fileDir string) {
+func (b *Brick) StaticPage(baseURL string, fileDir string) *StaticPage {
+  return b.staticPage(baseURL, fileDir, nil)
+}
+
+
+func (b *Brick) staticPage(baseURL string, fileDir string, hs *Host) *StaticPage {
   if (!strings.HasSuffix(baseURL, "/")) {
     baseURL = baseURL + "/"
   }
@@ -350,9 +752,15 @@ func (b *Brick) StaticPage(baseURL string, fileDir string) {
 		BaseUrl		: baseURL,
 		FilePath	: fileDir,
     localFS   : local,
-    log       : b.log,
+    b         : b,
   };
-  b.serveMux.Handle(baseURL, &staticPage);
+  staticPage.rt = b.addRoute(RouteInfo{ Path: baseURL, Methods: []string{ "GET", "HEAD" }, Kind: "static", Handler: fileDir }, hs)
+  b.routeLock.Lock()
+  b.statics = append(b.statics, &staticPage)
+  b.routeLock.Unlock()
+  mux, _ := hs.target(b, baseURL)
+  mux.Handle(baseURL, &staticPage);
+  return &staticPage
 }
 
 
@@ -363,7 +771,7 @@ func (b *Brick) SetLogger(log Logger) {
   if log == nil {
     panic(errors.New("log is null"))
   }
-  b.log = log
+  b.logOut = log
 }
 
 
@@ -378,7 +786,97 @@ func wjson(w http.ResponseWriter, m interface{}) {
 // 返回 json 字符串
 //
 func (h *Http) Json(m interface{}) {
-  wjson(h.W, m)
+  h.checkResponseSchema(m)
+  h.writeJson(0, m)
+}
+
+
+//
+// 返回 json 字符串并设置 http 状态码
+//
+func (h *Http) JsonCode(code int, m interface{}) {
+  h.checkResponseSchema(m)
+  h.writeJson(code, m)
+}
+
+
+//
+// 跳转到 url, code 是 3xx 状态码, 例如 http.StatusFound
+//
+func (h *Http) Redirect(code int, url string) {
+  http.Redirect(h.W, h.R, url, code)
+}
+
+
+//
+// 返回 204 状态, 没有响应体
+//
+func (h *Http) NoContent() {
+  h.W.WriteHeader(http.StatusNoContent)
+}
+
+
+//
+// 发送本地文件, 支持 Range/If-Modified-Since 等条件请求,
+// 文件不存在或是目录返回错误, 此时没有写出任何数据.
+//
+func (h *Http) SendFile(path string) error {
+  file, err := os.Open(path)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+
+  stat, err := file.Stat()
+  if err != nil {
+    return err
+  }
+  if stat.IsDir() {
+    return errors.New(path +" is directory")
+  }
+  http.ServeContent(h.W, h.R, stat.Name(), stat.ModTime(), file)
+  return nil
+}
+
+
+//
+// 作为附件下载本地文件, 浏览器保存为 fileName
+//
+func (h *Http) Download(path string, fileName string) error {
+  if fileName == "" {
+    fileName = filepath.Base(path)
+  }
+  h.W.Header().Set("Content-Disposition",
+    mime.FormatMediaType("attachment", map[string]string{ "filename": fileName }))
+  return h.SendFile(path)
+}
+
+
+//
+// 把 reader 中的数据全部写出到客户端, 支持 Flusher 时每次写出后立即刷新
+//
+func (h *Http) Stream(contentType string, r io.Reader) error {
+  h.W.Header().Set("Content-Type", contentType)
+  flusher, canFlush := h.W.(http.Flusher)
+  buf := make([]byte, 32 * 1024)
+
+  for {
+    n, err := r.Read(buf)
+    if n > 0 {
+      if _, werr := h.W.Write(buf[:n]); werr != nil {
+        return werr
+      }
+      if canFlush {
+        flusher.Flush()
+      }
+    }
+    if err == io.EOF {
+      return nil
+    }
+    if err != nil {
+      return err
+    }
+  }
 }
 
 
@@ -483,15 +981,18 @@ func (h *Http) CloseOnEnd(c Shutdown) {
 }
 
 
+//
+// 关闭 CloseOnEnd() 注册的对象, 一个对象关闭时出现异常不影响其他对象
+//
 func (h *Http) shutdown() {
   for _, c := range h.c {
-    c.Close()
+    h.b.protect(h, "close", c.Close)
   }
 }
 
 
 //
-// 输出纯文本 HTML 标签
+// 输出纯文本 HTML 标签, 文本不转义; 需要转义和嵌套时使用 E() 构建元素
 //
 func (h *Http) TextTag(tagName string, text string, attr ...string) {
   h.Tag(tagName, func() {
@@ -522,11 +1023,11 @@ func (h *Http) Tag(tagName string, body func(), attr ...string) {
 
 
 //
-// 只返回首选 AcceptLanguage
+// 只返回首选 AcceptLanguage, 按 q 值排序后的第一个
 //
 func (h *Http) GetAcceptLanguage()(string) {
-  al := h.R.Header.Get("Accept-Language")
-  ar := strings.Split(al, ",")
+  h.Vary("Accept-Language")
+  ar := ParseAcceptLanguage(h.R.Header.Get("Accept-Language"))
   if len(ar) < 1 {
     return ""
   }
@@ -571,21 +1072,43 @@ func (h *Http) Ctx() context.Context {
 
 
 func (p *StaticPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  p.b.handle(p.rt, p.serveFile, w, r)
+}
+
+
+func (p *StaticPage) serveFile(h *Http) error {
+  w, r := h.W, h.R
   fileName := r.URL.Path[len(p.BaseUrl):]
-  begin    := time.Now()  
-  content, has := file_mapping[fileName]
+  if err := p.authorize(h, fileName); err != nil {
+    return err
+  }
+  if p.ImageVariants {
+    fileName, r = p.negotiateImage(w, r, fileName)
+  }
+  content, has := lookupMapping(fileName)
 
   if has {
-    // log.Println("Prog Resource", fileName)
-    w.Header().Set("Content-Type", getMimeType(fileName))
-		w.Header().Set("Content-Encoding", "gzip")
-    w.WriteHeader(200)
-    w.Write(content)
-    return;
-  } else {
-    p.localFS.ServeHTTP(w, r)
+    serveMapping(w, r, fileName, content)
+    return nil
+  }
+  if p.NoListing && p.isListing(fileName) {
+    return NewHttpError(http.StatusNotFound, "")
   }
-  serviceLog(p.log, begin, r, "");
+  p.localFS.ServeHTTP(w, r)
+  return nil
+}
+
+
+//
+// fileName 是否是没有 index.html 的本地目录
+//
+func (p *StaticPage) isListing(fileName string) bool {
+  dir := filepath.Join(p.FilePath, filepath.FromSlash(path.Clean("/"+ fileName)))
+  if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+    return false
+  }
+  _, err := os.Stat(filepath.Join(dir, "index.html"))
+  return err != nil
 }
 
 
@@ -623,23 +1146,27 @@ func LastSlice(str string, maxLen int, prefix string) string {
   if l > maxLen {
     return prefix + str[l - maxLen + len(prefix):]
   } else if l < maxLen {
-    n := make([]byte, maxLen)
-    copy(n[0:], str)
-    return string(n)
+    return str + strings.Repeat(" ", maxLen - l)
   }
   return str
 }
 
 
+//
+// 返回资源包, 只应该在初始化时修改; 运行中替换使用 ReplaceFileMapping()
+//
 func GetFileMapping() map[string][]byte {
+  file_mapping_lock.RLock()
+  defer file_mapping_lock.RUnlock()
 	return file_mapping
 }
 
 
-func serviceLog(log Logger, begin time.Time, r *http.Request, extLog string) {
-  log.Info(fmt.Sprintf("%4s|%12s|%s %s", 
+func serviceLog(log Logger, begin time.Time, r *http.Request, ip string, extLog string) {
+  log.Info(fmt.Sprintf("%4s|%12s|%15s|%s %s", 
         LastSlice(r.Method, 4, ""), 
         time.Since(begin).String(), 
+        ip,
         r.URL.Path,
         extLog))
 }
@@ -0,0 +1,128 @@
+//
+// 测试 brick 服务的辅助函数, 例如:
+//
+//   h, rec := bricktest.NewHttp("POST", "/user?id=1", url.Values{"name": {"a"}})
+//   err := updateUser(h)
+//   // 检查 err, rec.Code 和 rec.Body
+//
+//   rec := bricktest.Serve(b, httptest.NewRequest("GET", "/user?id=1", nil))
+//
+package bricktest
+
+import (
+  "bytes"
+  "encoding/json"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/yanmingsohu/brick"
+)
+
+var (
+  defaultOnce  sync.Once
+  defaultBrick *brick.Brick
+)
+
+
+//
+// 创建测试用的 Brick: 内存会话, 随机密钥, 不监听端口
+//
+func New() *brick.Brick {
+  b, err := brick.NewBrickConfig(brick.Config{ HttpPort: 80, SessionExp: time.Hour })
+  if err != nil {
+    panic(err)
+  }
+  b.Debug = true
+  return b
+}
+
+
+//
+// NewHttp() 使用的共享 Brick
+//
+func Default() *brick.Brick {
+  defaultOnce.Do(func() {
+    defaultBrick = New()
+  })
+  return defaultBrick
+}
+
+
+//
+// 创建可以直接传给 HttpHandler 的请求对象, 响应写入返回的 recorder.
+// body 可以是 nil, string, []byte, io.Reader, url.Values (表单) 或
+// 其他值 (编码为 json), 请求使用 Default() 的会话存储.
+//
+func NewHttp(method string, target string, body interface{}) (*brick.Http, *httptest.ResponseRecorder) {
+  return NewHttpFor(Default(), method, target, body)
+}
+
+
+//
+// 与 NewHttp() 相同, 使用 b 的配置和会话存储
+//
+func NewHttpFor(b *brick.Brick, method string, target string, body interface{}) (*brick.Http, *httptest.ResponseRecorder) {
+  rec := httptest.NewRecorder()
+  return b.NewHttp(rec, NewRequest(method, target, body)), rec
+}
+
+
+//
+// 创建请求, body 的规则与 NewHttp() 相同
+//
+func NewRequest(method string, target string, body interface{}) *http.Request {
+  var r io.Reader
+  contentType := ""
+
+  switch v := body.(type) {
+  case nil:
+  case string:
+    r = strings.NewReader(v)
+  case []byte:
+    r = bytes.NewReader(v)
+  case io.Reader:
+    r = v
+  case url.Values:
+    r = strings.NewReader(v.Encode())
+    contentType = "application/x-www-form-urlencoded"
+  default:
+    buf, err := json.Marshal(v)
+    if err != nil {
+      panic(err)
+    }
+    r = bytes.NewReader(buf)
+    contentType = "application/json"
+  }
+
+  req := httptest.NewRequest(method, target, r)
+  if contentType != "" {
+    req.Header.Set("Content-Type", contentType)
+  }
+  return req
+}
+
+
+//
+// 把请求交给 b, 经过路由, 中间件和错误处理, 返回记录的响应
+//
+func Serve(b *brick.Brick, req *http.Request) *httptest.ResponseRecorder {
+  rec := httptest.NewRecorder()
+  b.ServeHTTP(rec, req)
+  return rec
+}
+
+
+//
+// 把上一个响应的 cookie (例如会话) 带到下一个请求上
+//
+func WithCookies(req *http.Request, from *httptest.ResponseRecorder) *http.Request {
+  for _, c := range from.Result().Cookies() {
+    req.AddCookie(c)
+  }
+  return req
+}
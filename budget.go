@@ -0,0 +1,126 @@
+package brick
+
+import (
+  "runtime/metrics"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+//
+// 请求的时间和内存预算, 超过时写入警告日志, 参考 Brick.RequestBudget()
+//
+type Budget struct {
+  // 处理时间上限, 0 不检查
+  Time   time.Duration
+  // 处理期间堆分配的字节数上限, 0 不检查
+  Alloc  uint64
+  // 每 N 个请求测量一次内存分配, 默认 1 (每个请求)
+  Sample int
+}
+
+type budgets struct {
+  lock     sync.Mutex
+  routes   map[string]Budget
+  def      *Budget
+  inflight int64
+  count    uint64
+}
+
+
+//
+// 为 path 路由设置预算, path 为空设置所有路由的默认预算.
+// 内存分配取进程的堆分配总量在请求前后的差值, 同时处理的其他请求也计算在内,
+// 警告日志中的 concurrent 字段是测量期间的并发请求数, 为 0 时数值是准确的.
+//
+func (b *Brick) RequestBudget(path string, bu Budget) {
+  if bu.Sample < 1 {
+    bu.Sample = 1
+  }
+  b.budget.lock.Lock()
+  first := b.budget.routes == nil && b.budget.def == nil
+  if path == "" {
+    b.budget.def = &bu
+  } else {
+    if b.budget.routes == nil {
+      b.budget.routes = make(map[string]Budget)
+    }
+    b.budget.routes[path] = bu
+  }
+  b.budget.lock.Unlock()
+  if first {
+    b.Use(b.budgetMiddleware)
+  }
+}
+
+
+func (b *Brick) budgetMiddleware(next HttpHandler) HttpHandler {
+  return func(h *Http) error {
+    s := &b.budget
+    s.lock.Lock()
+    bu, has := s.routes[h.rkey]
+    if !has && s.def != nil {
+      bu, has = *s.def, true
+    }
+    s.lock.Unlock()
+    if !has {
+      return next(h)
+    }
+
+    measure := bu.Alloc > 0 && atomic.AddUint64(&s.count, 1) % uint64(bu.Sample) == 0
+    var before uint64
+    if measure {
+      before = heapAllocs()
+    }
+    others := atomic.AddInt64(&s.inflight, 1) - 1
+    begin := time.Now()
+
+    err := next(h)
+
+    elapsed := time.Since(begin)
+    if now := atomic.AddInt64(&s.inflight, -1); now > others {
+      others = now
+    }
+    var alloc uint64
+    if measure {
+      alloc = heapAllocs() - before
+    }
+
+    overTime := bu.Time > 0 && elapsed > bu.Time
+    overAlloc := measure && alloc > bu.Alloc
+    if overTime || overAlloc {
+      kind := "time"
+      if overAlloc {
+        kind = "alloc"
+        if overTime {
+          kind = "time,alloc"
+        }
+      }
+      b.metrics.Inc("brick_budget_exceeded_total", "Requests over their time or allocation budget",
+          "route", h.route, "kind", kind)
+      l := (&levelLogger{ b: b, comp: LogBudget }).With(
+          "route", h.routeLabel(), "elapsed", elapsed, "alloc_bytes", alloc,
+          "concurrent", others, "request_id", h.RequestID())
+      l.Warn("Request over budget:", kind)
+    }
+    return err
+  }
+}
+
+
+var heapAllocSample = []metrics.Sample{ { Name: "/gc/heap/allocs:bytes" } }
+var heapAllocLock sync.Mutex
+
+
+//
+// 进程启动以来堆分配的总字节数
+//
+func heapAllocs() uint64 {
+  heapAllocLock.Lock()
+  defer heapAllocLock.Unlock()
+  metrics.Read(heapAllocSample)
+  if heapAllocSample[0].Value.Kind() != metrics.KindUint64 {
+    return 0
+  }
+  return heapAllocSample[0].Value.Uint64()
+}
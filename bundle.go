@@ -0,0 +1,231 @@
+package brick
+
+import (
+  "archive/tar"
+  "archive/zip"
+  "bytes"
+  "compress/gzip"
+  "context"
+  "crypto/ed25519"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path"
+  "strings"
+)
+
+//
+// 远程资源包, 参考 Brick.LoadBundle()
+//
+type BundleSource struct {
+  // http(s) 地址或本地文件, 格式由扩展名决定: .zip, .tar, .tar.gz, .tgz
+  URL          string
+  // 资源包的 sha256 (hex)
+  SHA256       string
+  // 验证 ed25519 签名的公钥, 签名从 SignatureURL 读取
+  PublicKey    ed25519.PublicKey
+  // 签名文件 (原始 64 字节或 base64), 默认 URL + ".sig"
+  SignatureURL string
+  // 去掉包内文件路径的前缀目录, 例如 "dist/"
+  StripPrefix  string
+  // 资源包的最大字节数, 默认 256MB
+  MaxBytes     int64
+  // 解压后所有文件的总字节数上限, 默认 MaxBytes 的 4 倍
+  MaxUnpacked  int64
+  // 不做任何验证, 只用于开发环境
+  Insecure     bool
+}
+
+
+//
+// 下载并验证资源包, 验证通过后整体替换资源包 (参考 StaticPage),
+// 可以在启动时或运行中 (例如管理接口) 调用, 失败时保留原来的资源.
+// 返回新资源包中的文件数.
+//
+func (b *Brick) LoadBundle(ctx context.Context, src BundleSource) (int, error) {
+  if src.SHA256 == "" && src.PublicKey == nil && !src.Insecure {
+    return 0, errors.New("bundle "+ src.URL +": SHA256 or PublicKey is required")
+  }
+  if src.MaxBytes <= 0 {
+    src.MaxBytes = 256 << 20
+  }
+  if src.MaxUnpacked <= 0 {
+    src.MaxUnpacked = src.MaxBytes * 4
+  }
+
+  data, err := fetchBundle(ctx, src.URL, src.MaxBytes)
+  if err != nil {
+    return 0, err
+  }
+  if err := verifyBundle(ctx, src, data); err != nil {
+    return 0, err
+  }
+
+  files, err := unpackBundle(src, data)
+  if err != nil {
+    return 0, fmt.Errorf("bundle %s: %s", src.URL, err)
+  }
+  ReplaceFileMapping(files)
+  b.log.Info("Bundle", src.URL, len(files), "files")
+  return len(files), nil
+}
+
+
+func fetchBundle(ctx context.Context, url string, max int64) ([]byte, error) {
+  var r io.ReadCloser
+  if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+      return nil, err
+    }
+    res, err := http.DefaultClient.Do(req)
+    if err != nil {
+      return nil, err
+    }
+    if res.StatusCode != http.StatusOK {
+      res.Body.Close()
+      return nil, fmt.Errorf("fetch %s: %s", url, res.Status)
+    }
+    r = res.Body
+  } else {
+    f, err := os.Open(url)
+    if err != nil {
+      return nil, err
+    }
+    r = f
+  }
+  defer r.Close()
+
+  data, err := ioutil.ReadAll(io.LimitReader(r, max + 1))
+  if err != nil {
+    return nil, err
+  }
+  if int64(len(data)) > max {
+    return nil, fmt.Errorf("fetch %s: larger than %d bytes", url, max)
+  }
+  return data, nil
+}
+
+
+func verifyBundle(ctx context.Context, src BundleSource, data []byte) error {
+  if src.SHA256 != "" {
+    sum := sha256.Sum256(data)
+    want, err := hex.DecodeString(strings.TrimSpace(src.SHA256))
+    if err != nil || subtle.ConstantTimeCompare(sum[:], want) != 1 {
+      return errors.New("bundle "+ src.URL +": sha256 mismatch")
+    }
+  }
+
+  if src.PublicKey != nil {
+    sigURL := src.SignatureURL
+    if sigURL == "" {
+      sigURL = src.URL +".sig"
+    }
+    sig, err := fetchBundle(ctx, sigURL, 1024)
+    if err != nil {
+      return err
+    }
+    if len(sig) != ed25519.SignatureSize {
+      sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+      if err != nil {
+        return errors.New("bundle "+ src.URL +": bad signature file")
+      }
+    }
+    if !ed25519.Verify(src.PublicKey, data, sig) {
+      return errors.New("bundle "+ src.URL +": signature mismatch")
+    }
+  }
+  return nil
+}
+
+
+//
+// 解开资源包, 每个文件 gzip 压缩后放入新的 map,
+// 解压后的总字节数超过 MaxUnpacked 时返回错误.
+//
+func unpackBundle(src BundleSource, data []byte) (map[string][]byte, error) {
+  files := make(map[string][]byte)
+  left  := src.MaxUnpacked
+  add := func(name string, r io.Reader) error {
+    name = path.Clean("/"+ name)[1:]
+    name = strings.TrimPrefix(name, strings.Trim(src.StripPrefix, "/") +"/")
+    if name == "" || name == "." {
+      return nil
+    }
+    var buf bytes.Buffer
+    zw := gzip.NewWriter(&buf)
+    n, err := io.Copy(zw, io.LimitReader(r, left + 1))
+    if err != nil {
+      return err
+    }
+    if left -= n; left < 0 {
+      return fmt.Errorf("unpacked size larger than %d bytes", src.MaxUnpacked)
+    }
+    if err := zw.Close(); err != nil {
+      return err
+    }
+    files[name] = buf.Bytes()
+    return nil
+  }
+
+  u := strings.ToLower(strings.SplitN(src.URL, "?", 2)[0])
+  switch {
+  case strings.HasSuffix(u, ".zip"):
+    zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+    if err != nil {
+      return nil, err
+    }
+    for _, f := range zr.File {
+      if f.FileInfo().IsDir() {
+        continue
+      }
+      rc, err := f.Open()
+      if err != nil {
+        return nil, err
+      }
+      err = add(f.Name, rc)
+      rc.Close()
+      if err != nil {
+        return nil, err
+      }
+    }
+
+  case strings.HasSuffix(u, ".tar.gz") || strings.HasSuffix(u, ".tgz") || strings.HasSuffix(u, ".tar"):
+    var r io.Reader = bytes.NewReader(data)
+    if !strings.HasSuffix(u, ".tar") {
+      gz, err := gzip.NewReader(r)
+      if err != nil {
+        return nil, err
+      }
+      defer gz.Close()
+      r = gz
+    }
+    tr := tar.NewReader(r)
+    for {
+      hd, err := tr.Next()
+      if err == io.EOF {
+        break
+      }
+      if err != nil {
+        return nil, err
+      }
+      if hd.Typeflag != tar.TypeReg {
+        continue
+      }
+      if err := add(hd.Name, tr); err != nil {
+        return nil, err
+      }
+    }
+
+  default:
+    return nil, errors.New("unknown bundle format, want .zip, .tar, .tar.gz or .tgz")
+  }
+  return files, nil
+}
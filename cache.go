@@ -0,0 +1,183 @@
+package brick
+
+import (
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+)
+
+// 每个标签最多记录的地址数, 超过后不再记录新地址, Brick.Cached() 也不再保存这些地址的响应
+const maxTaggedURLs = 1000
+
+//
+// 响应缓存的标签索引, 数据变化时按标签清除相关的页面,
+// 参考 Http.CacheTag() 和 Brick.Cache()
+//
+type Cache struct {
+  lock    sync.Mutex
+  tags    map[string]map[string]bool
+  // 输出标签的响应头, 空表示不输出
+  header  string
+  purgers []func(tags []string, urls []string)
+  // 通知本机的其他进程, 参考 Brick.ShareLocal()
+  share   func(op string, args []string)
+  // Brick.Cached() 保存的响应
+  pages   pageCache
+}
+
+
+//
+// 返回响应缓存
+//
+func (b *Brick) Cache() *Cache {
+  return &b.cache
+}
+
+
+//
+// 在响应中输出标签, 供 CDN 按标签清除缓存,
+// 例如 "Surrogate-Key" (Fastly) 或 "Cache-Tag" (Cloudflare), 空字符串关闭.
+//
+func (c *Cache) EmitSurrogateKeys(header string) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  c.header = header
+}
+
+
+//
+// 清除标签时调用 f, 参数是标签和带有这些标签的地址,
+// 用于通知 CDN 或其他缓存层.
+//
+func (c *Cache) OnPurge(f func(tags []string, urls []string)) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  c.purgers = append(c.purgers, f)
+}
+
+
+//
+// 清除带有任意一个标签的缓存, 包括 Brick.Cached() 保存的响应, 返回受影响的地址
+//
+func (c *Cache) PurgeTag(tags ...string) []string {
+  return c.purgeTags(tags, true)
+}
+
+
+//
+// local 为 false 时是其他进程的清除, 不再调用 OnPurge() 的函数
+//
+func (c *Cache) purgeTags(tags []string, local bool) []string {
+  c.lock.Lock()
+  set := make(map[string]bool)
+  for _, t := range tags {
+    for u := range c.tags[t] {
+      set[u] = true
+    }
+    delete(c.tags, t)
+  }
+  purgers, share := c.purgers, c.share
+  c.lock.Unlock()
+
+  c.pages.lock.Lock()
+  store := c.pages.store
+  c.pages.lock.Unlock()
+  urls := make([]string, 0, len(set))
+  for u := range set {
+    urls = append(urls, u)
+    if store != nil {
+      store.DeletePrefix(u +"\x00")
+    }
+  }
+  sort.Strings(urls)
+  if !local {
+    return urls
+  }
+  for _, f := range purgers {
+    f(tags, urls)
+  }
+  if share != nil {
+    share("tags", tags)
+  }
+  return urls
+}
+
+
+func (c *Cache) setShare(f func(op string, args []string)) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  c.share = f
+}
+
+
+//
+// 带有标签 tag 的地址, 虚拟主机上的路由以主机开头, 参考 Cache.Purge()
+//
+func (c *Cache) Tagged(tag string) []string {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  urls := make([]string, 0, len(c.tags[tag]))
+  for u := range c.tags[tag] {
+    urls = append(urls, u)
+  }
+  sort.Strings(urls)
+  return urls
+}
+
+
+//
+// 给当前响应加上缓存标签, 例如 h.CacheTag("user:42", "users"),
+// 数据变化后 b.Cache().PurgeTag("user:42") 清除所有相关的页面.
+// 必须在写出响应之前调用.
+//
+func (h *Http) CacheTag(tags ...string) {
+  h.tags = append(h.tags, tags...)
+  c := h.b.Cache()
+  c.lock.Lock()
+  header := c.header
+  c.lock.Unlock()
+  if header != "" {
+    h.W.Header().Set(header, strings.Join(h.tags, " "))
+  }
+}
+
+
+//
+// 请求结束后记录成功的 GET 响应的标签
+//
+func (c *Cache) record(h *Http, status int) {
+  if len(h.tags) == 0 || h.R.Method != http.MethodGet || status >= 400 {
+    return
+  }
+  c.index(h.cacheHost() + h.R.URL.RequestURI(), h.tags)
+}
+
+
+//
+// 把地址 u 记入每个标签, 有标签已满时返回 false (其他标签仍然记录)
+//
+func (c *Cache) index(u string, tags []string) bool {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  if c.tags == nil {
+    c.tags = make(map[string]map[string]bool)
+  }
+  ok := true
+  for _, t := range tags {
+    urls := c.tags[t]
+    if urls == nil {
+      urls = make(map[string]bool)
+      c.tags[t] = urls
+    }
+    if urls[u] {
+      continue
+    }
+    if len(urls) < maxTaggedURLs {
+      urls[u] = true
+    } else {
+      ok = false
+    }
+  }
+  return ok
+}
@@ -0,0 +1,419 @@
+package brick
+
+import (
+  "context"
+  "errors"
+  "io"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+//
+// CachingProxy 的缓存策略
+//
+type CachePolicy struct {
+  // 上游没有给出 max-age 时的缓存时间; Override 为 true 时总是使用它
+  TTL          time.Duration
+  // 忽略上游的 Cache-Control (包括 no-store, private), 总是缓存 TTL
+  Override     bool
+  // 上游失败 (连接错误或 5xx) 时可以返回过期多久以内的缓存, 默认 1 小时
+  StaleFor     time.Duration
+  // 最多缓存的响应数, 默认 1000
+  MaxEntries   int
+  // 超过这个大小的响应不缓存, 默认 1MB
+  MaxBodyBytes int64
+  // 参与缓存键的请求头, 例如 "Accept", "Accept-Language"
+  Vary         []string
+  // 请求上游的超时, 默认 10 秒
+  Timeout      time.Duration
+  // 发往上游的请求头, 例如 API key
+  Header       http.Header
+}
+
+//
+// 缓存外部 API 的 GET 响应的代理, 参考 Brick.CachingProxy()
+//
+type CachingProxy struct {
+  b        *Brick
+  prefix   string
+  upstream *url.URL
+  policy   CachePolicy
+  client   *http.Client
+  pass     http.Handler
+
+  lock     sync.Mutex
+  entries  map[string]*proxyEntry
+  inflight map[string]*proxyCall
+  stats    CacheStats
+}
+
+//
+// CachingProxy 的计数
+//
+type CacheStats struct {
+  Hits    uint64
+  Misses  uint64
+  // 上游失败时返回了过期的缓存
+  Stale   uint64
+  // 不可缓存的请求或响应
+  Bypass  uint64
+  Entries int
+}
+
+type proxyEntry struct {
+  status  int
+  header  http.Header
+  body    []byte
+  stored  time.Time
+  expires time.Time
+}
+
+type proxyCall struct {
+  done  chan struct{}
+  entry *proxyEntry
+  err   error
+}
+
+var errProxyTooLarge = errors.New("upstream response larger than MaxBodyBytes")
+
+// 不转发也不缓存的头域
+var hopHeaders = []string{
+  "Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+  "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Set-Cookie",
+}
+
+
+//
+// 把 path 前缀上的请求转发到 upstream (去掉前缀), 缓存 GET 响应:
+//
+//   u, _ := url.Parse("https://api.weather.example/v2/")
+//   b.CachingProxy("/weather/", u, brick.CachePolicy{ TTL: 5*time.Minute })
+//
+// 响应头 X-Cache 为 HIT, MISS, STALE 或 BYPASS; 开启指标时计入
+// brick_proxy_cache_total{path, result}. 其他方法直接转发.
+//
+func (b *Brick) CachingProxy(path string, upstream *url.URL, policy CachePolicy) *CachingProxy {
+  if policy.StaleFor == 0 {
+    policy.StaleFor = time.Hour
+  }
+  if policy.MaxEntries <= 0 {
+    policy.MaxEntries = 1000
+  }
+  if policy.MaxBodyBytes <= 0 {
+    policy.MaxBodyBytes = 1 << 20
+  }
+  if policy.Timeout <= 0 {
+    policy.Timeout = 10 * time.Second
+  }
+  p := &CachingProxy{
+    b        : b,
+    prefix   : path,
+    upstream : upstream,
+    policy   : policy,
+    client   : &http.Client{ Timeout: policy.Timeout },
+    entries  : make(map[string]*proxyEntry),
+    inflight : make(map[string]*proxyCall),
+  }
+
+  o := &proxyOptions{
+    stripPrefix     : true,
+    setHeader       : http.Header{},
+    responseHeader  : http.Header{},
+    dialTimeout     : policy.Timeout,
+    responseTimeout : policy.Timeout,
+  }
+  for name, v := range policy.Header {
+    o.setHeader[name] = v
+  }
+  p.pass = b.newReverseProxy(path, upstream, o)
+
+  b.Service(path, p.serve).Describe("caching proxy to "+ upstream.Host)
+  return p
+}
+
+
+//
+// 缓存的计数
+//
+func (p *CachingProxy) Stats() CacheStats {
+  p.lock.Lock()
+  defer p.lock.Unlock()
+  s := p.stats
+  s.Entries = len(p.entries)
+  return s
+}
+
+
+//
+// 清空缓存
+//
+func (p *CachingProxy) Purge() {
+  p.lock.Lock()
+  defer p.lock.Unlock()
+  p.entries = make(map[string]*proxyEntry)
+}
+
+
+func (p *CachingProxy) serve(h *Http) error {
+  r := h.R
+  if (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+      (!p.policy.Override && strings.Contains(r.Header.Get("Cache-Control"), "no-store")) {
+    p.bypass(h)
+    return nil
+  }
+
+  key := p.key(r)
+  now := time.Now()
+  p.lock.Lock()
+  e := p.entries[key]
+  p.lock.Unlock()
+
+  if e != nil && now.Before(e.expires) {
+    p.count(func(s *CacheStats) { s.Hits++ }, "hit")
+    p.write(h, e, "HIT", now)
+    return nil
+  }
+
+  fresh, err := p.fetch(h.Ctx(), key, r, e)
+  if err == nil {
+    p.count(func(s *CacheStats) { s.Misses++ }, "miss")
+    p.write(h, fresh, "MISS", now)
+    return nil
+  }
+
+  if err == errProxyTooLarge {
+    p.bypass(h)
+    return nil
+  }
+  if e != nil && now.Before(e.expires.Add(p.policy.StaleFor)) {
+    p.b.log.Warn("Caching proxy serves stale", h.route, err)
+    p.count(func(s *CacheStats) { s.Stale++ }, "stale")
+    h.W.Header().Set("Warning", `110 - "Response is Stale"`)
+    p.write(h, e, "STALE", now)
+    return nil
+  }
+  if errors.Is(err, context.DeadlineExceeded) {
+    return WrapHttpError(http.StatusGatewayTimeout, err)
+  }
+  return WrapHttpError(http.StatusBadGateway, err)
+}
+
+
+func (p *CachingProxy) bypass(h *Http) {
+  p.count(func(s *CacheStats) { s.Bypass++ }, "bypass")
+  h.W.Header().Set("X-Cache", "BYPASS")
+  p.pass.ServeHTTP(h.W, h.R)
+}
+
+
+//
+// 请求上游, 同一个键同时只有一个请求; 过期的缓存用条件请求验证
+//
+func (p *CachingProxy) fetch(ctx context.Context, key string, r *http.Request, old *proxyEntry) (*proxyEntry, error) {
+  p.lock.Lock()
+  if c := p.inflight[key]; c != nil {
+    p.lock.Unlock()
+    select {
+    case <-c.done:
+      return c.entry, c.err
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    }
+  }
+  c := &proxyCall{ done: make(chan struct{}) }
+  p.inflight[key] = c
+  p.lock.Unlock()
+
+  // 上游请求不随客户端断开而取消, 结果对其他等待者仍然有用
+  c.entry, c.err = p.roundTrip(r, old)
+
+  p.lock.Lock()
+  delete(p.inflight, key)
+  if c.err == nil && c.entry.expires.After(c.entry.stored) {
+    p.store(key, c.entry)
+  }
+  p.lock.Unlock()
+  close(c.done)
+  return c.entry, c.err
+}
+
+
+func (p *CachingProxy) roundTrip(r *http.Request, old *proxyEntry) (*proxyEntry, error) {
+  u := *p.upstream
+  u.Path = joinURLPath(p.upstream.Path, "/"+ strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, p.prefix), "/"))
+  u.RawPath = ""
+  if p.upstream.RawQuery == "" || r.URL.RawQuery == "" {
+    u.RawQuery = p.upstream.RawQuery + r.URL.RawQuery
+  } else {
+    u.RawQuery = p.upstream.RawQuery +"&"+ r.URL.RawQuery
+  }
+
+  req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+  if err != nil {
+    return nil, err
+  }
+  for _, name := range p.policy.Vary {
+    if v := r.Header.Get(name); v != "" {
+      req.Header.Set(name, v)
+    }
+  }
+  for name, v := range p.policy.Header {
+    req.Header[name] = v
+  }
+  if old != nil {
+    if etag := old.header.Get("ETag"); etag != "" {
+      req.Header.Set("If-None-Match", etag)
+    }
+    if lm := old.header.Get("Last-Modified"); lm != "" {
+      req.Header.Set("If-Modified-Since", lm)
+    }
+  }
+
+  res, err := p.client.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  defer res.Body.Close()
+  now := time.Now()
+
+  if res.StatusCode == http.StatusNotModified && old != nil {
+    renewed := *old
+    renewed.stored = now
+    renewed.expires = now.Add(p.ttl(res.Header))
+    return &renewed, nil
+  }
+  if res.StatusCode >= 500 {
+    return nil, errors.New("upstream "+ res.Status)
+  }
+
+  body, err := io.ReadAll(io.LimitReader(res.Body, p.policy.MaxBodyBytes + 1))
+  if err != nil {
+    return nil, err
+  }
+  e := &proxyEntry{
+    status : res.StatusCode,
+    header : res.Header.Clone(),
+    body   : body,
+    stored : now,
+  }
+  for _, name := range hopHeaders {
+    e.header.Del(name)
+  }
+  if p.cacheable(res) && int64(len(body)) <= p.policy.MaxBodyBytes {
+    e.expires = now.Add(p.ttl(res.Header))
+  } else {
+    // 不缓存; 超过大小的响应体被截断, 由 serve() 重新直接转发
+    if int64(len(body)) > p.policy.MaxBodyBytes {
+      return nil, errProxyTooLarge
+    }
+    e.expires = now
+  }
+  return e, nil
+}
+
+
+func (p *CachingProxy) cacheable(res *http.Response) bool {
+  switch res.StatusCode {
+  case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+      http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+  default:
+    return false
+  }
+  if p.policy.Override {
+    return true
+  }
+  cc := strings.ToLower(res.Header.Get("Cache-Control"))
+  if strings.Contains(cc, "no-store") || strings.Contains(cc, "private") ||
+      strings.Contains(cc, "no-cache") || res.Header.Get("Set-Cookie") != "" {
+    return false
+  }
+  return true
+}
+
+
+//
+// 缓存时间: Override 时用 TTL, 否则 s-maxage, max-age, Expires, 最后是 TTL
+//
+func (p *CachingProxy) ttl(hd http.Header) time.Duration {
+  if p.policy.Override {
+    return p.policy.TTL
+  }
+  cc := strings.ToLower(hd.Get("Cache-Control"))
+  for _, name := range []string{ "s-maxage", "max-age" } {
+    for _, d := range strings.Split(cc, ",") {
+      kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+      if len(kv) == 2 && kv[0] == name {
+        if sec, err := strconv.Atoi(strings.Trim(kv[1], `"`)); err == nil && sec >= 0 {
+          return time.Duration(sec) * time.Second
+        }
+      }
+    }
+  }
+  if exp := hd.Get("Expires"); exp != "" {
+    if t, err := http.ParseTime(exp); err == nil {
+      if d := time.Until(t); d > 0 {
+        return d
+      }
+      return 0
+    }
+  }
+  return p.policy.TTL
+}
+
+
+//
+// 保存响应, 满了先删除最早过期的; 调用者持有锁
+//
+func (p *CachingProxy) store(key string, e *proxyEntry) {
+  if _, has := p.entries[key]; !has && len(p.entries) >= p.policy.MaxEntries {
+    var oldest string
+    var at time.Time
+    for k, v := range p.entries {
+      if oldest == "" || v.expires.Before(at) {
+        oldest, at = k, v.expires
+      }
+    }
+    delete(p.entries, oldest)
+  }
+  p.entries[key] = e
+}
+
+
+func (p *CachingProxy) write(h *Http, e *proxyEntry, state string, now time.Time) {
+  hd := h.W.Header()
+  for name, v := range e.header {
+    hd[name] = v
+  }
+  hd.Set("X-Cache", state)
+  hd.Set("Age", strconv.Itoa(int(now.Sub(e.stored).Seconds())))
+  h.W.WriteHeader(e.status)
+  if h.R.Method != http.MethodHead {
+    h.W.Write(e.body)
+  }
+}
+
+
+func (p *CachingProxy) key(r *http.Request) string {
+  var sb strings.Builder
+  sb.WriteString(r.URL.Path)
+  sb.WriteByte('?')
+  sb.WriteString(r.URL.RawQuery)
+  for _, name := range p.policy.Vary {
+    sb.WriteByte(0)
+    sb.WriteString(r.Header.Get(name))
+  }
+  return sb.String()
+}
+
+
+func (p *CachingProxy) count(f func(*CacheStats), result string) {
+  p.lock.Lock()
+  f(&p.stats)
+  p.lock.Unlock()
+  p.b.metrics.Inc("brick_proxy_cache_total", "Caching proxy requests by result",
+      "path", p.prefix, "result", result)
+}
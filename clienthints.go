@@ -0,0 +1,184 @@
+package brick
+
+import (
+  "net/http"
+  "os"
+  "path"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+//
+// StaticPage 开启图片协商后, 通过 Accept-CH 请求浏览器发送的客户端提示
+//
+var imageClientHints = []string{ "Sec-CH-DPR", "DPR", "Sec-CH-Width", "Width" }
+
+// 可以替换为 avif/webp 变体的原始图片类型
+var negotiableImageExt = map[string]bool{
+  ".png" : true, ".jpg" : true, ".jpeg" : true, ".gif" : true,
+}
+
+
+//
+// 设置 Accept-CH 头域, 要求浏览器在后续请求中发送这些客户端提示,
+// 例如 h.AcceptCH("Sec-CH-DPR", "Sec-CH-Width")
+//
+func (h *Http) AcceptCH(hints ...string) {
+  h.W.Header().Set("Accept-CH", strings.Join(hints, ", "))
+}
+
+
+//
+// 返回客户端设备像素比, 没有提示时返回 1
+//
+func (h *Http) ClientDPR() float64 {
+  return clientDPR(h.R)
+}
+
+
+//
+// 返回客户端期望的图片宽度(css 像素), 没有提示时返回 0
+//
+func (h *Http) ClientWidth() int {
+  return clientHintInt(h.R, "Sec-CH-Width", "Width")
+}
+
+
+//
+// 返回客户端视口宽度, 没有提示时返回 0
+//
+func (h *Http) ClientViewportWidth() int {
+  return clientHintInt(h.R, "Sec-CH-Viewport-Width", "Viewport-Width")
+}
+
+
+//
+// 客户端的 Accept 头域是否明确接受 mime 类型, 例如 "image/webp"
+//
+func (h *Http) AcceptsType(mimeType string) bool {
+  return acceptsType(h.R, mimeType)
+}
+
+
+func clientDPR(r *http.Request) float64 {
+  for _, name := range []string{ "Sec-CH-DPR", "DPR" } {
+    if v := r.Header.Get(name); v != "" {
+      if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && f > 0 {
+        return f
+      }
+    }
+  }
+  return 1
+}
+
+
+func clientHintInt(r *http.Request, names ...string) int {
+  for _, name := range names {
+    if v := r.Header.Get(name); v != "" {
+      if i, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && i > 0 {
+        return i
+      }
+    }
+  }
+  return 0
+}
+
+
+func acceptsType(r *http.Request, mimeType string) bool {
+  for _, it := range parseQualityList(r.Header.Get("Accept")) {
+    if it.q > 0 && strings.EqualFold(it.value, mimeType) {
+      return true
+    }
+  }
+  return false
+}
+
+
+//
+// 为图片请求选择最合适的变体文件名, 按顺序尝试:
+// 高 DPR 的 'name@2x.png' / 'name@3x.png', 然后是 avif / webp 格式,
+// exists 判断变体是否存在; 返回值 vary 说明结果依赖客户端提示.
+//
+func selectImageVariant(r *http.Request, fileName string,
+    exists func(string) bool) (selected string, vary bool) {
+  ext := strings.ToLower(path.Ext(fileName))
+  if !negotiableImageExt[ext] {
+    return fileName, false
+  }
+
+  base := fileName[:len(fileName) - len(ext)]
+  bases := make([]string, 0, 3)
+  dpr := clientDPR(r)
+  if dpr >= 2.5 {
+    bases = append(bases, base +"@3x")
+  }
+  if dpr >= 1.5 {
+    bases = append(bases, base +"@2x")
+  }
+  bases = append(bases, base)
+
+  formats := make([]string, 0, 3)
+  if acceptsType(r, "image/avif") {
+    formats = append(formats, ".avif")
+  }
+  if acceptsType(r, "image/webp") {
+    formats = append(formats, ".webp")
+  }
+  formats = append(formats, fileName[len(base):])
+
+  for _, b := range bases {
+    for _, f := range formats {
+      name := b + f
+      if name == fileName {
+        return fileName, true
+      }
+      if exists(name) {
+        return name, true
+      }
+    }
+  }
+  return fileName, true
+}
+
+
+//
+// 图片变体是否存在于资源包或本地目录中
+//
+func (p *StaticPage) hasFile(name string) bool {
+  if _, has := lookupMapping(name); has {
+    return true
+  }
+  if p.FilePath == "" {
+    return false
+  }
+  st, err := os.Stat(filepath.Join(p.FilePath, filepath.FromSlash(name)))
+  return err == nil && !st.IsDir()
+}
+
+
+//
+// 根据客户端提示选择图片变体, 返回替换后的文件名和请求
+//
+func (p *StaticPage) negotiateImage(w http.ResponseWriter, r *http.Request,
+    fileName string) (string, *http.Request) {
+  selected, vary := selectImageVariant(r, fileName, p.hasFile)
+  if !vary {
+    return fileName, r
+  }
+
+  hd := w.Header()
+  hd.Set("Accept-CH", strings.Join(imageClientHints, ", "))
+  addVary(hd, "Accept", "Sec-CH-DPR", "DPR")
+
+  if selected == fileName {
+    return fileName, r
+  }
+  nr := new(http.Request)
+  *nr = *r
+  u := *r.URL
+  u.Path = p.BaseUrl + selected
+  u.RawPath = ""
+  nr.URL = &u
+  return selected, nr
+}
@@ -0,0 +1,131 @@
+package brick
+
+import (
+  "net"
+  "net/http"
+  "strings"
+)
+
+//
+// Config.TrustedProxies 解析后的网段
+//
+type trustedProxies []*net.IPNet
+
+
+//
+// 解析 "10.0.0.0/8" 或 "127.0.0.1" 形式的地址列表
+//
+func parseTrustedProxies(list []string) (trustedProxies, error) {
+  var ret trustedProxies
+  for _, s := range list {
+    s = strings.TrimSpace(s)
+    if !strings.Contains(s, "/") {
+      ip := net.ParseIP(s)
+      if ip == nil {
+        return nil, &net.ParseError{ Type: "IP address", Text: s }
+      }
+      bits := 128
+      if ip.To4() != nil {
+        ip = ip.To4()
+        bits = 32
+      }
+      ret = append(ret, &net.IPNet{ IP: ip, Mask: net.CIDRMask(bits, bits) })
+      continue
+    }
+    _, n, err := net.ParseCIDR(s)
+    if err != nil {
+      return nil, err
+    }
+    ret = append(ret, n)
+  }
+  return ret, nil
+}
+
+
+func (t trustedProxies) contains(addr string) bool {
+  ip := net.ParseIP(addr)
+  if ip == nil {
+    return false
+  }
+  for _, n := range t {
+    if n.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
+
+
+//
+// 客户端的真实地址 (不含端口). 只有对端是 Config.TrustedProxies 中的代理时
+// 才使用 Forwarded, X-Forwarded-For 或 X-Real-IP, 从右向左跳过可信的代理,
+// 否则返回对端地址; 访问日志, 限流和错误日志都使用这个地址.
+//
+func (h *Http) ClientIP() string {
+  return h.b.clientIP(h.R)
+}
+
+
+func (b *Brick) clientIP(r *http.Request) string {
+  peer := remoteIP(r)
+  if len(b.trusted) == 0 || !b.trusted.contains(peer) {
+    return peer
+  }
+
+  chain := forwardedFor(r.Header.Values("Forwarded"))
+  if len(chain) == 0 {
+    for _, v := range r.Header.Values("X-Forwarded-For") {
+      for _, ip := range strings.Split(v, ",") {
+        chain = append(chain, strings.TrimSpace(ip))
+      }
+    }
+  }
+  if len(chain) == 0 {
+    if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+      return ip
+    }
+    return peer
+  }
+
+  last := peer
+  for i := len(chain) - 1; i >= 0; i-- {
+    ip := chain[i]
+    if net.ParseIP(ip) == nil {
+      // 无法识别的地址 (例如 "unknown") 之前的内容不可信
+      return last
+    }
+    if i == 0 || !b.trusted.contains(ip) {
+      return ip
+    }
+    last = ip
+  }
+  return last
+}
+
+
+//
+// 取出 RFC 7239 Forwarded 头域中的 for= 地址, 去掉引号, 方括号和端口
+//
+func forwardedFor(values []string) []string {
+  var ret []string
+  for _, v := range values {
+    for _, elem := range strings.Split(v, ",") {
+      for _, pair := range strings.Split(elem, ";") {
+        kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+        if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+          continue
+        }
+        addr := strings.Trim(kv[1], `"`)
+        if strings.HasPrefix(addr, "[") {
+          if end := strings.IndexByte(addr, ']'); end > 0 {
+            addr = addr[1:end]
+          }
+        } else if host, _, err := net.SplitHostPort(addr); err == nil {
+          addr = host
+        }
+        ret = append(ret, addr)
+      }
+    }
+  }
+  return ret
+}
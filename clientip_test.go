@@ -0,0 +1,73 @@
+package brick
+
+import (
+  "net/http/httptest"
+  "testing"
+)
+
+
+func TestParseTrustedProxies(t *testing.T) {
+  tests := []struct {
+    list []string
+    ok   bool
+  }{
+    { []string{ "10.0.0.0/8", " 127.0.0.1 ", "::1", "fd00::/8" }, true },
+    { []string{ "10.0.0.1/33" },  false },
+    { []string{ "not-an-ip" },    false },
+    { nil,                        true },
+  }
+  for _, tt := range tests {
+    _, err := parseTrustedProxies(tt.list)
+    if (err == nil) != tt.ok {
+      t.Errorf("parseTrustedProxies(%q) error = %v", tt.list, err)
+    }
+  }
+}
+
+
+func TestClientIP(t *testing.T) {
+  trusted, err := parseTrustedProxies([]string{ "10.0.0.0/8", "::1" })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct {
+    name    string
+    peer    string
+    headers map[string]string
+    want    string
+  }{
+    { "direct",          "203.0.113.9:1234", nil, "203.0.113.9" },
+    { "untrusted peer",  "203.0.113.9:1234",
+      map[string]string{ "X-Forwarded-For": "1.2.3.4" }, "203.0.113.9" },
+    { "xff",             "10.0.0.1:80",
+      map[string]string{ "X-Forwarded-For": "1.2.3.4" }, "1.2.3.4" },
+    { "xff spoofed left", "10.0.0.1:80",
+      map[string]string{ "X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.2" }, "1.2.3.4" },
+    { "xff all trusted", "10.0.0.1:80",
+      map[string]string{ "X-Forwarded-For": "10.0.0.3, 10.0.0.2" }, "10.0.0.3" },
+    { "xff unknown",     "10.0.0.1:80",
+      map[string]string{ "X-Forwarded-For": "1.2.3.4, unknown, 10.0.0.2" }, "10.0.0.2" },
+    { "forwarded",       "10.0.0.1:80",
+      map[string]string{ "Forwarded": `for="[2001:db8::1]:443";proto=https, for=10.0.0.2` },
+      "2001:db8::1" },
+    { "forwarded wins",  "10.0.0.1:80",
+      map[string]string{ "Forwarded": "for=1.2.3.4:80", "X-Forwarded-For": "5.6.7.8" }, "1.2.3.4" },
+    { "real ip",         "[::1]:80",
+      map[string]string{ "X-Real-IP": "1.2.3.4" }, "1.2.3.4" },
+    { "bad real ip",     "[::1]:80",
+      map[string]string{ "X-Real-IP": "nope" }, "::1" },
+  }
+
+  b := &Brick{ trusted: trusted }
+  for _, tt := range tests {
+    r := httptest.NewRequest("GET", "/", nil)
+    r.RemoteAddr = tt.peer
+    for k, v := range tt.headers {
+      r.Header.Set(k, v)
+    }
+    if got := b.clientIP(r); got != tt.want {
+      t.Errorf("%s: clientIP = %s, want %s", tt.name, got, tt.want)
+    }
+  }
+}
@@ -0,0 +1,128 @@
+package brick
+
+import (
+  "errors"
+  "fmt"
+  "time"
+)
+
+//
+// 令牌的版本比当前版本新, 或者已过期
+//
+var ErrClientStoreStale = errors.New("client store token expired or from a newer version")
+
+//
+// 保存在客户端的加密键值对, 用于不需要进入会话存储的偏好设置等.
+// 数据用会话的密钥签名加密, 可以放在 cookie 中 (Load/Save),
+// 也可以作为令牌交给前端保存到 localStorage (Encode/Decode).
+//
+type ClientStore struct {
+  b       *Brick
+  // cookie 名, 同时绑定在令牌的签名中
+  Name    string
+  // 数据结构的版本, 旧版本的数据交给 Migrate 转换
+  Version int
+  // 有效期, 0 或负数为 30 天
+  MaxAge  time.Duration
+  // 编码后的最大字节数, 默认 2048
+  MaxSize int
+  // 转换旧版本的数据, 为空时丢弃旧数据
+  Migrate func(version int, values map[string]string) map[string]string
+  // 保存到 cookie 时的选项, 为空使用 SetSecureCookie() 的默认值和 MaxAge
+  Cookie  *CookieOptions
+}
+
+type clientPayload struct {
+  V int               `json:"v"`
+  E int64             `json:"e"`
+  D map[string]string `json:"d"`
+}
+
+
+func (b *Brick) NewClientStore(name string, version int, maxAge time.Duration) *ClientStore {
+  return &ClientStore{ b: b, Name: name, Version: version, MaxAge: maxAge, MaxSize: 2048 }
+}
+
+
+//
+// 把 values 编码为加密的令牌
+//
+func (s *ClientStore) Encode(values map[string]string) (string, error) {
+  maxAge := s.maxAge()
+  p := clientPayload{ V: s.Version, E: time.Now().Add(maxAge).Unix(), D: values }
+  tok, err := s.b.cookies.codec(maxAge).Encode(s.Name, p)
+  if err != nil {
+    return "", err
+  }
+  if s.MaxSize > 0 && len(tok) > s.MaxSize {
+    return "", fmt.Errorf("client store '%s' is %d bytes, limit %d", s.Name, len(tok), s.MaxSize)
+  }
+  return tok, nil
+}
+
+
+//
+// 解码 Encode() 生成的令牌, 旧版本的数据经过 Migrate 转换
+//
+func (s *ClientStore) Decode(token string) (map[string]string, error) {
+  var p clientPayload
+  if err := s.b.cookies.codec(s.maxAge()).Decode(s.Name, token, &p); err != nil {
+    return nil, err
+  }
+  if p.V > s.Version || time.Now().Unix() > p.E {
+    return nil, ErrClientStoreStale
+  }
+  if p.D == nil {
+    p.D = make(map[string]string)
+  }
+  if p.V < s.Version {
+    if s.Migrate == nil {
+      return make(map[string]string), nil
+    }
+    return s.Migrate(p.V, p.D), nil
+  }
+  return p.D, nil
+}
+
+
+//
+// 从 cookie 读取数据, 没有数据或数据无效时返回空的 map
+//
+func (s *ClientStore) Load(h *Http) map[string]string {
+  c, err := h.R.Cookie(s.Name)
+  if err != nil {
+    return make(map[string]string)
+  }
+  values, err := s.Decode(c.Value)
+  if err != nil {
+    h.b.log.Debug("ClientStore", s.Name, err)
+    return make(map[string]string)
+  }
+  return values
+}
+
+
+//
+// 把数据保存到 cookie, 必须在写出响应之前调用
+//
+func (s *ClientStore) Save(h *Http, values map[string]string) error {
+  tok, err := s.Encode(values)
+  if err != nil {
+    return err
+  }
+  o := cookieDefaults(h.R, s.Cookie)
+  o.MaxAge = s.maxAge()
+  setCookie(h, s.Name, tok, o)
+  return nil
+}
+
+
+//
+// 令牌, 签名和 cookie 使用同一个有效期
+//
+func (s *ClientStore) maxAge() time.Duration {
+  if s.MaxAge <= 0 {
+    return defaultCodecMaxAge
+  }
+  return s.MaxAge
+}
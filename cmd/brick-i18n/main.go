@@ -0,0 +1,52 @@
+//
+// 扫描模板中的 {{ t "key" }} 用法, 生成/合并各语言的消息目录骨架,
+// 并报告缺失和未使用的 key.
+//
+// 运行: brick-i18n -templates www -locales locales -lang en,zh-CN [-write]
+//
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+
+  "github.com/yanmingsohu/brick"
+)
+
+func main() {
+  templates := flag.String("templates", "www", "template directories, comma separated")
+  locales   := flag.String("locales", "locales", "message catalog directory")
+  lang      := flag.String("lang", "en", "locales to check, comma separated")
+  write     := flag.Bool("write", false, "add missing keys to catalog files")
+  flag.Parse()
+
+  keys, err := brick.ExtractTranslationKeys(strings.Split(*templates, ",")...)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(1)
+  }
+  fmt.Printf("%d keys found in templates\n", len(keys))
+
+  reports, err := brick.MergeCatalog(*locales, strings.Split(*lang, ","), keys, *write)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(1)
+  }
+
+  incomplete := false
+  for _, r := range reports {
+    fmt.Printf("\n[%s] %s\n", r.Locale, r.File)
+    for _, k := range r.Missing {
+      fmt.Printf("  missing  %s  (%s)\n", k, strings.Join(keys[k], ", "))
+      incomplete = true
+    }
+    for _, k := range r.Unused {
+      fmt.Printf("  unused   %s\n", k)
+    }
+  }
+  if incomplete && !*write {
+    os.Exit(2)
+  }
+}
@@ -0,0 +1,65 @@
+//
+// 生成配置密钥, 加密和解密配置文件中的值, 参考 brick.LoadConfigFile().
+// 密钥从环境变量 BRICK_CONFIG_KEY (或 BRICK_CONFIG_KEY_名字) 读取, 值从标准输入读取.
+//
+// 运行: brick-secret -keygen
+//       echo -n 'smtp-password' | brick-secret -encrypt [-key default]
+//       echo -n 'ENC[v1,default,...]' | brick-secret -decrypt
+//
+package main
+
+import (
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "strings"
+
+  "github.com/yanmingsohu/brick"
+)
+
+func main() {
+  keygen  := flag.Bool("keygen", false, "print a new base64 key for BRICK_CONFIG_KEY")
+  encrypt := flag.Bool("encrypt", false, "encrypt the value read from stdin")
+  decrypt := flag.Bool("decrypt", false, "decrypt the value read from stdin")
+  keyName := flag.String("key", "default", "key name stored in the encrypted value")
+  flag.Parse()
+
+  if *keygen {
+    fmt.Println(brick.GenerateConfigKey())
+    return
+  }
+  if *encrypt == *decrypt {
+    fmt.Fprintln(os.Stderr, "one of -keygen, -encrypt or -decrypt is required")
+    os.Exit(2)
+  }
+
+  in, err := io.ReadAll(os.Stdin)
+  if err != nil {
+    fail(err)
+  }
+  if *decrypt {
+    plain, err := brick.DecryptConfigValue(strings.TrimSpace(string(in)), nil)
+    if err != nil {
+      fail(err)
+    }
+    fmt.Print(plain)
+    return
+  }
+
+  key, err := brick.EnvSecrets(*keyName)
+  if err != nil {
+    fail(err)
+  }
+  enc, err := brick.EncryptConfigValue(key, *keyName, string(in))
+  if err != nil {
+    fail(err)
+  }
+  fmt.Println(enc)
+}
+
+
+func fail(err error) {
+  fmt.Fprintln(os.Stderr, err)
+  os.Exit(1)
+}
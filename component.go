@@ -0,0 +1,158 @@
+package brick
+
+import (
+  "context"
+  "errors"
+  "strings"
+  "sync"
+)
+
+//
+// 有启动顺序依赖的组件, 例如数据库, 会话存储, 指标导出;
+// 启动时先启动 Needs 中的组件, 关闭时按相反的顺序.
+//
+type Component struct {
+  Name  string
+  // 必须先启动的组件名
+  Needs []string
+  // 服务开始监听之前调用, 可以为 nil
+  Start func(ctx context.Context) error
+  // 所有监听关闭之后调用, 可以为 nil
+  Stop  func(ctx context.Context) error
+}
+
+type components struct {
+  lock    sync.Mutex
+  list    []Component
+  // 已经启动的组件, 按启动顺序
+  started []Component
+}
+
+
+//
+// 注册组件, 在 Run() 之前调用; 顺序由 Needs 决定, 没有依赖关系的组件按注册顺序
+//
+func (b *Brick) AddComponent(c Component) {
+  b.comps.lock.Lock()
+  defer b.comps.lock.Unlock()
+  b.comps.list = append(b.comps.list, c)
+}
+
+
+//
+// 按依赖排序, 依赖不存在或有环时返回错误
+//
+func (cs *components) order() ([]Component, error) {
+  byName := make(map[string]int, len(cs.list))
+  for i, c := range cs.list {
+    if c.Name == "" {
+      return nil, errors.New("component without name")
+    }
+    if _, has := byName[c.Name]; has {
+      return nil, errors.New("component '"+ c.Name +"' registered twice")
+    }
+    byName[c.Name] = i
+  }
+
+  const (
+    visiting = 1
+    done     = 2
+  )
+  state := make([]int, len(cs.list))
+  ret := make([]Component, 0, len(cs.list))
+  var path []string
+
+  var visit func(i int) error
+  visit = func(i int) error {
+    c := cs.list[i]
+    switch state[i] {
+    case done:
+      return nil
+    case visiting:
+      at := 0
+      for path[at] != c.Name {
+        at++
+      }
+      return errors.New("component cycle: "+ strings.Join(append(path[at:], c.Name), " -> "))
+    }
+    state[i] = visiting
+    path = append(path, c.Name)
+    for _, need := range c.Needs {
+      j, has := byName[need]
+      if !has {
+        return errors.New("component '"+ c.Name +"' needs unknown component '"+ need +"'")
+      }
+      if err := visit(j); err != nil {
+        return err
+      }
+    }
+    path = path[:len(path)-1]
+    state[i] = done
+    ret = append(ret, c)
+    return nil
+  }
+
+  for i := range cs.list {
+    if err := visit(i); err != nil {
+      return nil, err
+    }
+  }
+  return ret, nil
+}
+
+
+//
+// 按依赖顺序启动组件, 失败时关闭已经启动的组件
+//
+func (b *Brick) startComponents(ctx context.Context) error {
+  cs := &b.comps
+  cs.lock.Lock()
+  defer cs.lock.Unlock()
+  list, err := cs.order()
+  if err != nil {
+    return err
+  }
+  for _, c := range list {
+    if c.Start != nil {
+      b.log.Debug("Component start", c.Name)
+      if err := c.Start(ctx); err != nil {
+        cs.stop(ctx, b.log)
+        return errors.New("component '"+ c.Name +"': "+ err.Error())
+      }
+    }
+    cs.started = append(cs.started, c)
+  }
+  return nil
+}
+
+
+//
+// 按启动的相反顺序关闭组件, 返回第一个错误, 其他错误写入日志
+//
+func (b *Brick) stopComponents(ctx context.Context) error {
+  b.comps.lock.Lock()
+  defer b.comps.lock.Unlock()
+  return b.comps.stop(ctx, b.log)
+}
+
+
+func (cs *components) stop(ctx context.Context, log Logger) error {
+  var first error
+  for i := len(cs.started) - 1; i >= 0; i-- {
+    c := cs.started[i]
+    if c.Stop == nil {
+      continue
+    }
+    log.Debug("Component stop", c.Name)
+    if err := c.Stop(ctx); err != nil {
+      err = errors.New("component '"+ c.Name +"': "+ err.Error())
+      if first == nil {
+        first = err
+      } else {
+        log.Error(err)
+      }
+    }
+  }
+  cs.started = nil
+  return first
+}
@@ -0,0 +1,260 @@
+package brick
+
+import (
+  "bytes"
+  "fmt"
+  "os"
+  "strings"
+  "time"
+
+  "github.com/kataras/go-sessions"
+)
+
+//
+// 创建 Brick 的完整配置, 参考 NewBrickConfig()
+//
+type Config struct {
+  // http 服务端口, 没有调用 Listen() 时使用, 0 由系统分配; Run() 时才检查
+  HttpPort      int
+  // session 有效期, 同 go-sessions: 0 不过期, -1 浏览器关闭后失效
+  SessionExp    time.Duration
+  // 超过这个时间没有访问则 session 失效, 0 不限制, 参考 Http.SessionRemaining()
+  SessionIdle   time.Duration
+  // 从创建开始计算的 session 最长时间, 不因访问而延长, 0 不限制
+  SessionLifetime time.Duration
+  // session cookie 名称, 默认 "bricksessionid"
+  SessionCookie string
+  // session 存储, nil 使用内存存储
+  SessionDB     sessions.Database
+  // cookie 签名密钥, 32 或 64 字节; nil 则每次启动随机生成
+  HashKey       []byte
+  // cookie 加密密钥, 16/24/32 字节; nil 则每次启动随机生成
+  BlockKey      []byte
+  // html 模板目录, 参考 SetTemplateDir()
+  TemplateDir   string
+  // 模板直接输出到客户端, 默认先渲染到缓冲区, 出错时返回 500; 参考 Http.StreamTemplate()
+  StreamTemplates bool
+  // 全局限流, nil 不限流, 参考 Brick.RateLimit()
+  RateLimit     *RateLimit
+  // 每个请求的处理时间上限, 超时返回 408, 0 不限制
+  RequestTimeout time.Duration
+  // 请求体的字节数上限, 超过返回 413, 0 不限制
+  MaxBodyBytes  int64
+  // 不使用 TLS 时同时提供 HTTP/2 (h2c), 只应在可信的反向代理之后开启; 需要 go1.24
+  H2C           bool
+  // 可信的反向代理地址或网段, 例如 "10.0.0.0/8"; 只有来自这些地址的请求
+  // 才使用 X-Forwarded-For 等头域中的客户端地址, 参考 Http.ClientIP()
+  TrustedProxies []string
+  // 关闭服务时等待处理中请求的最长时间, 默认 30 秒, 参考 Brick.Run()
+  ShutdownTimeout time.Duration
+  // 端口被占用时尝试后面的 N 个端口, PortEphemeral 由系统分配, 0 直接失败;
+  // 实际地址参考 Brick.Addr()
+  PortFallback  int
+  // 关闭服务时通知 SSE/WebSocket 长连接后等待它们断开的时间, 默认 5 秒,
+  // 参考 Http.NotifyShutdown()
+  StreamGrace   time.Duration
+  // Http.Export() 的暂存目录, 默认系统临时目录下的 brick-spool
+  SpoolDir      string
+  // 暂存的导出文件有效时间, 默认 1 小时
+  SpoolTTL      time.Duration
+  // Http.Json() 的响应超过这个字节数并且客户端接受 gzip 时压缩输出, 0 不压缩
+  JsonGzip      int
+  // 全局日志级别, 默认 LevelDebug 输出全部日志, 参考 Brick.SetLogLevel()
+  LogLevel      LogLevel
+  Debug         bool
+}
+
+//
+// 配置检查发现的全部错误
+//
+type ConfigError []error
+
+
+func (e ConfigError) Error() string {
+  msg := make([]string, len(e))
+  for i, err := range e {
+    msg[i] = err.Error()
+  }
+  return "Invalid config: "+ strings.Join(msg, "; ")
+}
+
+
+//
+// 检查配置, 返回包含全部错误的 ConfigError, 没有错误返回 nil
+//
+func (c *Config) Validate() error {
+  var errs ConfigError
+  add := func(f string, v ...interface{}) {
+    errs = append(errs, fmt.Errorf(f, v...))
+  }
+
+  if c.SessionIdle < 0 || c.SessionLifetime < 0 {
+    add("SessionIdle and SessionLifetime must not be negative")
+  }
+  if c.SessionExp > 0 && c.SessionLifetime > c.SessionExp {
+    add("SessionLifetime %s is longer than SessionExp %s, the store expires it first",
+        c.SessionLifetime, c.SessionExp)
+  }
+  if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+    add("TrustedProxies: %s", err)
+  }
+  if c.ShutdownTimeout < 0 {
+    add("ShutdownTimeout %s is negative", c.ShutdownTimeout)
+  }
+  if c.SpoolTTL < 0 {
+    add("SpoolTTL %s is negative", c.SpoolTTL)
+  }
+  if c.PortFallback < PortEphemeral {
+    add("PortFallback %d is invalid", c.PortFallback)
+  }
+  if c.JsonGzip < 0 {
+    add("JsonGzip %d is negative", c.JsonGzip)
+  }
+  if c.StreamGrace < 0 {
+    add("StreamGrace %s is negative", c.StreamGrace)
+  }
+  if c.H2C && !h2cSupported {
+    add("H2C needs a build with go1.24 or later")
+  }
+  if c.SessionCookie != "" && !validCookieName(c.SessionCookie) {
+    add("SessionCookie '%s' is not a valid cookie name", c.SessionCookie)
+  }
+
+  if c.HashKey != nil && len(c.HashKey) != 32 && len(c.HashKey) != 64 {
+    add("HashKey length %d, must be 32 or 64 bytes", len(c.HashKey))
+  }
+  if c.BlockKey != nil {
+    if l := len(c.BlockKey); l != 16 && l != 24 && l != 32 {
+      add("BlockKey length %d, must be 16, 24 or 32 bytes", l)
+    }
+  }
+  if c.HashKey != nil && c.BlockKey != nil && bytes.Equal(c.HashKey, c.BlockKey) {
+    add("HashKey and BlockKey must be different")
+  }
+
+  if c.RequestTimeout < 0 {
+    add("RequestTimeout %s is negative", c.RequestTimeout)
+  }
+  if c.MaxBodyBytes < 0 {
+    add("MaxBodyBytes %d is negative", c.MaxBodyBytes)
+  }
+  if c.RateLimit != nil {
+    if err := c.RateLimit.validate(); err != nil {
+      add("%s", err)
+    }
+  }
+
+  if c.TemplateDir != "" {
+    if st, err := os.Stat(c.TemplateDir); err != nil {
+      add("TemplateDir: %s", err)
+    } else if !st.IsDir() {
+      add("TemplateDir '%s' is not a directory", c.TemplateDir)
+    }
+  }
+
+  if len(errs) > 0 {
+    return errs
+  }
+  return nil
+}
+
+
+func validCookieName(name string) bool {
+  for _, c := range name {
+    if c <= ' ' || c >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", c) {
+      return false
+    }
+  }
+  return name != ""
+}
+
+
+//
+// 启动时检查 Brick 的当前状态, 配置对象创建后仍然可以修改的属性在这里检查
+//
+func (b *Brick) validate() error {
+  c := b.config
+  c.HttpPort = b.HttpPort
+  c.TemplateDir = b.templateDir
+  var errs ConfigError
+  if err := c.Validate(); err != nil {
+    errs = err.(ConfigError)
+  }
+
+  // 端口只在没有调用 Listen() 时使用
+  b.listen.lock.Lock()
+  listen := len(b.listen.list)
+  b.listen.lock.Unlock()
+  if listen == 0 && (b.HttpPort < 0 || b.HttpPort > 65535) {
+    errs = append(errs, fmt.Errorf("HttpPort %d out of range 0-65535", b.HttpPort))
+  }
+
+  if len(errs) > 0 {
+    return errs
+  }
+  return nil
+}
+
+
+//
+// 打印启动报告
+//
+func (b *Brick) startupReport() {
+  c := &b.config
+  store := "memory"
+  if c.SessionDB != nil {
+    store = fmt.Sprintf("%T", c.SessionDB)
+  }
+  keys := "random"
+  if c.HashKey != nil {
+    keys = "configured"
+  }
+  tpl := "(not set)"
+  if b.templateDir != "" {
+    tpl = b.templateDir
+  }
+
+  b.routeLock.RLock()
+  routes := len(b.routes)
+  b.routeLock.RUnlock()
+
+  lines := []string{
+    "Brick startup report",
+    fmt.Sprintf("  listen    : %s", b.listenReport()),
+    fmt.Sprintf("  tls       : %s", orOff(b.listenTLS(), "on")),
+    fmt.Sprintf("  session   : %s, cookie '%s', expires %s, keys %s",
+                store, c.SessionCookie, c.SessionExp, keys),
+    fmt.Sprintf("  routes    : %d", routes),
+    fmt.Sprintf("  ratelimit : %s", b.rateLimitReport()),
+    fmt.Sprintf("  limits    : timeout %s, body %s", orOff(c.RequestTimeout > 0, c.RequestTimeout),
+                orOff(c.MaxBodyBytes > 0, fmt.Sprint(c.MaxBodyBytes, " bytes"))),
+    fmt.Sprintf("  templates : %s, recompile on change", tpl),
+    fmt.Sprintf("  resources : %d packed files", len(GetFileMapping())),
+    fmt.Sprintf("  debug     : %v", b.Debug),
+  }
+  if b.Debug {
+    for _, r := range b.Routes() {
+      methods := "*"
+      if len(r.Methods) > 0 {
+        methods = strings.Join(r.Methods, ",")
+      }
+      line := fmt.Sprintf("    %-8s %-10s %s -> %s", r.Kind, methods, r.Path, r.Handler)
+      if r.Description != "" {
+        line += "  # "+ r.Description
+      }
+      lines = append(lines, line)
+    }
+  }
+  b.log.Info(strings.Join(lines, "\n"))
+  if c.BlockKey != nil && c.HashKey == nil {
+    b.log.Warn("BlockKey is set but HashKey is random, cookies will not survive restart")
+  }
+}
+
+
+func orOff(on bool, v interface{}) string {
+  if on {
+    return fmt.Sprint(v)
+  }
+  return "off"
+}
@@ -0,0 +1,279 @@
+package brick
+
+import (
+  "bytes"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "os"
+  "reflect"
+  "strings"
+  "time"
+)
+
+// 加密的配置值的前缀, 完整格式 "ENC[v1,密钥名,base64(nonce+密文)]"
+const encPrefix = "ENC[v1,"
+
+//
+// 返回名为 name 的配置解密密钥 (32 字节), 例如从 KMS 或 Vault 读取; 参考 EnvSecrets()
+//
+type SecretProvider func(name string) ([]byte, error)
+
+var (
+  durationType = reflect.TypeOf(time.Duration(0))
+  logLevelType = reflect.TypeOf(LogLevel(0))
+)
+
+
+//
+// 从环境变量读取密钥: "default" 读 BRICK_CONFIG_KEY, 其他名字读 BRICK_CONFIG_KEY_名字 (大写),
+// 值是 base64 编码的 32 字节, 参考 GenerateConfigKey()
+//
+func EnvSecrets(name string) ([]byte, error) {
+  env := "BRICK_CONFIG_KEY"
+  if name != "default" {
+    env += "_"+ strings.ToUpper(name)
+  }
+  v := os.Getenv(env)
+  if v == "" {
+    return nil, fmt.Errorf("config key '%s': %s is not set", name, env)
+  }
+  key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+  if err != nil {
+    return nil, fmt.Errorf("config key '%s': %s is not base64: %w", name, env, err)
+  }
+  return key, nil
+}
+
+
+//
+// 生成新的配置密钥, 返回 base64 编码
+//
+func GenerateConfigKey() string {
+  key := make([]byte, 32)
+  if _, err := rand.Read(key); err != nil {
+    panic(err)
+  }
+  return base64.StdEncoding.EncodeToString(key)
+}
+
+
+func configAEAD(key []byte) (cipher.AEAD, error) {
+  if len(key) != 32 {
+    return nil, fmt.Errorf("config key must be 32 bytes, got %d", len(key))
+  }
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return nil, err
+  }
+  return cipher.NewGCM(block)
+}
+
+
+//
+// 用 AES-256-GCM 加密配置值, 返回 "ENC[v1,keyName,...]" 写入配置文件;
+// keyName 在解密时传给 SecretProvider, 换密钥时新旧值可以共存
+//
+func EncryptConfigValue(key []byte, keyName string, plain string) (string, error) {
+  if keyName == "" || strings.ContainsAny(keyName, ",]") {
+    return "", fmt.Errorf("invalid key name '%s'", keyName)
+  }
+  aead, err := configAEAD(key)
+  if err != nil {
+    return "", err
+  }
+  nonce := make([]byte, aead.NonceSize())
+  if _, err := rand.Read(nonce); err != nil {
+    return "", err
+  }
+  sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(keyName))
+  return encPrefix + keyName +","+ base64.StdEncoding.EncodeToString(sealed) +"]", nil
+}
+
+
+//
+// 解密 EncryptConfigValue() 的结果, 不是加密格式的值原样返回; keys 为 nil 时使用 EnvSecrets
+//
+func DecryptConfigValue(s string, keys SecretProvider) (string, error) {
+  if !strings.HasPrefix(s, encPrefix) {
+    return s, nil
+  }
+  if keys == nil {
+    keys = EnvSecrets
+  }
+  body := strings.TrimSuffix(strings.TrimPrefix(s, encPrefix), "]")
+  parts := strings.SplitN(body, ",", 2)
+  if len(parts) != 2 || !strings.HasSuffix(s, "]") {
+    return "", errors.New("malformed encrypted value")
+  }
+  sealed, err := base64.StdEncoding.DecodeString(parts[1])
+  if err != nil {
+    return "", errors.New("malformed encrypted value")
+  }
+  key, err := keys(parts[0])
+  if err != nil {
+    return "", err
+  }
+  aead, err := configAEAD(key)
+  if err != nil {
+    return "", err
+  }
+  if len(sealed) < aead.NonceSize() {
+    return "", errors.New("malformed encrypted value")
+  }
+  plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(parts[0]))
+  if err != nil {
+    return "", fmt.Errorf("cannot decrypt with key '%s'", parts[0])
+  }
+  return string(plain), nil
+}
+
+
+//
+// 读取 json 配置文件并检查, 参考 LoadConfigFile(). 例如:
+//
+//   { "HttpPort": 8080, "SessionExp": "12h", "LogLevel": "info",
+//     "HashKey": "ENC[v1,default,...]", "BlockKey": "ENC[v1,default,...]" }
+//
+// SessionDB 等不能序列化的字段在读取后设置.
+//
+func LoadConfig(file string, keys SecretProvider) (Config, error) {
+  var c Config
+  if err := LoadConfigFile(file, &c, keys); err != nil {
+    return c, err
+  }
+  return c, nil
+}
+
+
+//
+// 把 json 配置文件读到 out (结构体指针), 可以是 Config 或应用自己的配置结构.
+// 字符串值可以是 EncryptConfigValue() 加密的值, 在读取时用 keys 提供的密钥解密,
+// keys 为 nil 时从环境变量读取 (EnvSecrets). 时间长度可以写成 "30s", 日志级别写成 "info";
+// []byte 字段是 base64, 加密的 []byte 值解密后也是 base64. 未知的字段返回错误.
+//
+func LoadConfigFile(file string, out interface{}, keys SecretProvider) error {
+  rv := reflect.ValueOf(out)
+  if rv.Kind() != reflect.Ptr || rv.IsNil() {
+    return errors.New("LoadConfigFile target must be a pointer")
+  }
+  buf, err := os.ReadFile(file)
+  if err != nil {
+    return err
+  }
+  var raw interface{}
+  if err := json.Unmarshal(buf, &raw); err != nil {
+    return fmt.Errorf("%s: %w", file, err)
+  }
+  raw, err = prepareConfig(raw, rv.Type().Elem(), "$", keys)
+  if err != nil {
+    return fmt.Errorf("%s: %w", file, err)
+  }
+
+  buf, _ = json.Marshal(raw)
+  dec := json.NewDecoder(bytes.NewReader(buf))
+  dec.DisallowUnknownFields()
+  if err := dec.Decode(out); err != nil {
+    return fmt.Errorf("%s: %w", file, err)
+  }
+  if c, ok := out.(*Config); ok {
+    return c.Validate()
+  }
+  return nil
+}
+
+
+//
+// 解密字符串值, 并按目标字段的类型转换时间长度和日志级别
+//
+func prepareConfig(v interface{}, t reflect.Type, path string, keys SecretProvider) (interface{}, error) {
+  for t != nil && t.Kind() == reflect.Ptr {
+    t = t.Elem()
+  }
+  switch x := v.(type) {
+  case string:
+    plain, err := DecryptConfigValue(x, keys)
+    if err != nil {
+      return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    switch t {
+    case durationType:
+      d, err := time.ParseDuration(plain)
+      if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+      }
+      return int64(d), nil
+    case logLevelType:
+      l, err := ParseLogLevel(plain)
+      if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+      }
+      return int(l), nil
+    }
+    return plain, nil
+
+  case []interface{}:
+    var elem reflect.Type
+    if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+      elem = t.Elem()
+    }
+    for i := range x {
+      n, err := prepareConfig(x[i], elem, fmt.Sprintf("%s[%d]", path, i), keys)
+      if err != nil {
+        return nil, err
+      }
+      x[i] = n
+    }
+
+  case map[string]interface{}:
+    for k, item := range x {
+      var ft reflect.Type
+      if t != nil && t.Kind() == reflect.Map {
+        ft = t.Elem()
+      } else if t != nil && t.Kind() == reflect.Struct {
+        ft = configFieldType(t, k)
+      }
+      n, err := prepareConfig(item, ft, path +"."+ k, keys)
+      if err != nil {
+        return nil, err
+      }
+      x[k] = n
+    }
+  }
+  return v, nil
+}
+
+
+//
+// json 键对应的字段类型, 匹配规则与 encoding/json 相同: json 标签, 然后不区分大小写的字段名
+//
+func configFieldType(t reflect.Type, key string) reflect.Type {
+  var fold reflect.Type
+  for i := 0; i < t.NumField(); i++ {
+    sf := t.Field(i)
+    if sf.PkgPath != "" {
+      continue
+    }
+    if sf.Anonymous && sf.Type.Kind() == reflect.Struct && sf.Tag.Get("json") == "" {
+      if ft := configFieldType(sf.Type, key); ft != nil {
+        return ft
+      }
+      continue
+    }
+    name := sf.Name
+    if tag := strings.Split(sf.Tag.Get("json"), ",")[0]; tag != "" {
+      name = tag
+    }
+    if name == key {
+      return sf.Type
+    }
+    if fold == nil && strings.EqualFold(name, key) {
+      fold = sf.Type
+    }
+  }
+  return fold
+}
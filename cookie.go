@@ -0,0 +1,146 @@
+package brick
+
+import (
+  "net/http"
+  "sync"
+  "time"
+
+  "github.com/gorilla/securecookie"
+)
+
+//
+// SetSecureCookie() 的选项, nil 表示 Path "/", HttpOnly, SameSite=Lax,
+// https 请求上 Secure, 浏览器关闭时失效.
+//
+type CookieOptions struct {
+  Path     string
+  Domain   string
+  // 有效期, 0 表示浏览器关闭时失效 (服务端最多接受 30 天)
+  MaxAge   time.Duration
+  Secure   bool
+  HttpOnly bool
+  // 默认 http.SameSiteLaxMode
+  SameSite http.SameSite
+}
+
+//
+// 按有效期缓存的编码器, 与会话共用密钥
+//
+type cookieCodecs struct {
+  lock     sync.Mutex
+  hashKey  []byte
+  blockKey []byte
+  codecs   map[time.Duration]*securecookie.SecureCookie
+}
+
+
+//
+// 把 value 编码为 json, 签名并加密后保存在名为 name 的 cookie 中,
+// 编码后超过 4096 字节返回错误. 必须在写出响应之前调用.
+//
+func (h *Http) SetSecureCookie(name string, value interface{}, opts *CookieOptions) error {
+  o := cookieDefaults(h.R, opts)
+  enc, err := h.b.cookies.codec(o.MaxAge).Encode(name, value)
+  if err != nil {
+    return err
+  }
+  setCookie(h, name, enc, o)
+  return nil
+}
+
+
+func setCookie(h *Http, name string, value string, o CookieOptions) {
+  c := &http.Cookie{
+    Name     : name,
+    Value    : value,
+    Path     : o.Path,
+    Domain   : o.Domain,
+    Secure   : o.Secure,
+    HttpOnly : o.HttpOnly,
+    SameSite : o.SameSite,
+  }
+  if o.MaxAge > 0 {
+    c.MaxAge = int(o.MaxAge.Seconds())
+    c.Expires = time.Now().Add(o.MaxAge)
+  }
+  http.SetCookie(h.W, c)
+}
+
+
+//
+// 读取 SetSecureCookie() 保存的值到 out, cookie 不存在返回 http.ErrNoCookie,
+// 被篡改或过期返回 securecookie 的错误. opts 的 MaxAge 必须与保存时相同.
+//
+func (h *Http) GetSecureCookie(name string, out interface{}, opts ...*CookieOptions) error {
+  c, err := h.R.Cookie(name)
+  if err != nil {
+    return err
+  }
+  var maxAge time.Duration
+  if len(opts) > 0 && opts[0] != nil {
+    maxAge = opts[0].MaxAge
+  }
+  return h.b.cookies.codec(maxAge).Decode(name, c.Value, out)
+}
+
+
+//
+// 删除 cookie, opts 的 Path 和 Domain 必须与保存时相同
+//
+func (h *Http) DeleteCookie(name string, opts *CookieOptions) {
+  o := cookieDefaults(h.R, opts)
+  http.SetCookie(h.W, &http.Cookie{
+    Name     : name,
+    Path     : o.Path,
+    Domain   : o.Domain,
+    MaxAge   : -1,
+    Expires  : time.Unix(1, 0),
+    Secure   : o.Secure,
+    HttpOnly : o.HttpOnly,
+    SameSite : o.SameSite,
+  })
+}
+
+
+func cookieDefaults(r *http.Request, opts *CookieOptions) CookieOptions {
+  if opts == nil {
+    return CookieOptions{
+      Path     : "/",
+      Secure   : r.TLS != nil,
+      HttpOnly : true,
+      SameSite : http.SameSiteLaxMode,
+    }
+  }
+  o := *opts
+  if o.Path == "" {
+    o.Path = "/"
+  }
+  if o.SameSite == 0 {
+    o.SameSite = http.SameSiteLaxMode
+  }
+  return o
+}
+
+
+// 没有指定有效期时签名的有效期
+const defaultCodecMaxAge = 30 * 24 * time.Hour
+
+
+func (c *cookieCodecs) codec(maxAge time.Duration) *securecookie.SecureCookie {
+  if maxAge <= 0 {
+    maxAge = defaultCodecMaxAge
+  }
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  if sc, has := c.codecs[maxAge]; has {
+    return sc
+  }
+  if c.codecs == nil {
+    c.codecs = make(map[time.Duration]*securecookie.SecureCookie)
+  }
+  sc := securecookie.New(c.hashKey, c.blockKey).
+      MaxAge(int(maxAge.Seconds())).
+      SetSerializer(securecookie.JSONEncoder{})
+  c.codecs[maxAge] = sc
+  return sc
+}
@@ -0,0 +1,219 @@
+package brick
+
+import (
+  "net/http"
+  "sort"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// 每个弃用路由最多记录的客户端数量, 之后的客户端合并为 "other"
+const maxDeprecatedClients = 1000
+
+//
+// 路由的弃用信息, 参考 Route.Deprecate()
+//
+type Deprecation struct {
+  // 开始弃用的时间, 零值时 Deprecation 头为 "true"
+  Since     time.Time `json:"since"`
+  // 计划下线的时间, 设置 Sunset 头 (RFC 8594)
+  Sunset    time.Time `json:"sunset"`
+  // 迁移说明文档, Link: <url>; rel="deprecation"
+  Link      string    `json:"link,omitempty"`
+  // 替代的接口, Link: <url>; rel="successor-version"
+  Successor string    `json:"successor,omitempty"`
+}
+
+//
+// 一个客户端对弃用路由的使用情况
+//
+type DeprecatedUse struct {
+  Client string    `json:"client"`
+  Count  uint64    `json:"count"`
+  First  time.Time `json:"first"`
+  Last   time.Time `json:"last"`
+}
+
+//
+// 弃用路由和仍在使用它的客户端, 参考 Brick.DeprecationReport()
+//
+type DeprecatedRoute struct {
+  Route       RouteInfo       `json:"route"`
+  Deprecation Deprecation     `json:"deprecation"`
+  Clients     []DeprecatedUse `json:"clients"`
+}
+
+type deprecations struct {
+  lock   sync.Mutex
+  client func(*Http) string
+  // 路由 -> 客户端 -> 使用情况
+  usage  map[*Route]map[string]*DeprecatedUse
+}
+
+
+//
+// 标记路由为弃用, 响应自动带上 Deprecation, Sunset 和 Link 头,
+// 每个客户端第一次调用时写日志 (LogDeprecated), 使用情况参考 Brick.DeprecationReport().
+//
+//   b.Service("/api/v1/users", listUsersV1).Deprecate(brick.Deprecation{
+//     Sunset: time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC), Successor: "/api/v2/users" })
+//
+func (r *Route) Deprecate(d Deprecation) *Route {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  r.dep = &d
+  return r
+}
+
+
+func (r *Route) deprecation() *Deprecation {
+  if r == nil {
+    return nil
+  }
+  r.lock.RLock()
+  defer r.lock.RUnlock()
+  return r.dep
+}
+
+
+//
+// 设置统计弃用路由时区分客户端的方法, 默认依次使用 Quota.APIKey, 认证的用户名和客户端 IP
+//
+func (b *Brick) DeprecationClient(f func(*Http) string) {
+  b.deprecated.lock.Lock()
+  defer b.deprecated.lock.Unlock()
+  b.deprecated.client = f
+}
+
+
+//
+// 在响应头中声明弃用, 在处理函数之前调用
+//
+func (d *Deprecation) writeHeader(hdr http.Header) {
+  if d.Since.IsZero() {
+    hdr.Set("Deprecation", "true")
+  } else {
+    hdr.Set("Deprecation", "@"+ strconv.FormatInt(d.Since.Unix(), 10))
+  }
+  if !d.Sunset.IsZero() {
+    hdr.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+  }
+  if d.Link != "" {
+    hdr.Add("Link", "<"+ d.Link +`>; rel="deprecation"`)
+  }
+  if d.Successor != "" {
+    hdr.Add("Link", "<"+ d.Successor +`>; rel="successor-version"`)
+  }
+}
+
+
+//
+// 记录客户端对弃用路由的使用, 在处理函数之后调用, 此时认证中间件已经设置了用户
+//
+func (b *Brick) recordDeprecated(h *Http, d *Deprecation) {
+  s := &b.deprecated
+  s.lock.Lock()
+  clientOf := s.client
+  s.lock.Unlock()
+  var client string
+  if clientOf != nil {
+    client = clientOf(h)
+  } else {
+    client = b.deprecationClient(h)
+  }
+
+  now := time.Now()
+  s.lock.Lock()
+  if s.usage == nil {
+    s.usage = make(map[*Route]map[string]*DeprecatedUse)
+  }
+  clients := s.usage[h.rt]
+  if clients == nil {
+    clients = make(map[string]*DeprecatedUse)
+    s.usage[h.rt] = clients
+  }
+  u := clients[client]
+  first := u == nil
+  if first {
+    if len(clients) >= maxDeprecatedClients {
+      client = "other"
+      u = clients[client]
+    }
+    if u == nil {
+      u = &DeprecatedUse{ Client: client, First: now }
+      clients[client] = u
+    }
+  }
+  u.Count++
+  u.Last = now
+  s.lock.Unlock()
+
+  b.metrics.Inc("brick_deprecated_requests_total", "Requests to deprecated routes", "route", h.route)
+  if first {
+    l := (&levelLogger{ b: b, comp: LogDeprecated }).With(
+        "route", h.routeLabel(), "client", client, "request_id", h.RequestID())
+    if !d.Sunset.IsZero() && now.After(d.Sunset) {
+      l.Warn("Deprecated route used after sunset", d.Sunset.Format(time.RFC3339))
+    } else {
+      l.Info("Deprecated route used")
+    }
+  }
+}
+
+
+func (b *Brick) deprecationClient(h *Http) string {
+  if q := b.quotaConf(); q != nil {
+    if key := q.APIKey(h); key != "" {
+      return key
+    }
+  }
+  if u := h.User(); u != nil && u.Name != "" {
+    return u.Name
+  }
+  return h.ClientIP()
+}
+
+
+//
+// 所有弃用的路由和调用过它们的客户端, 客户端按最后使用时间从新到旧排序
+//
+func (b *Brick) DeprecationReport() []DeprecatedRoute {
+  b.routeLock.RLock()
+  routes := append([]*Route(nil), b.routes...)
+  b.routeLock.RUnlock()
+
+  s := &b.deprecated
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  var ret []DeprecatedRoute
+  for _, rt := range routes {
+    d := rt.deprecation()
+    if d == nil {
+      continue
+    }
+    dr := DeprecatedRoute{ Route: rt.Info(), Deprecation: *d, Clients: []DeprecatedUse{} }
+    for _, u := range s.usage[rt] {
+      dr.Clients = append(dr.Clients, *u)
+    }
+    sort.Slice(dr.Clients, func(i, j int) bool {
+      return dr.Clients[i].Last.After(dr.Clients[j].Last)
+    })
+    ret = append(ret, dr)
+  }
+  return ret
+}
+
+
+//
+// 返回 DeprecationReport() 的 json, 应注册在需要认证的分组中:
+//
+//   admin.Service("/deprecations", b.DeprecationPage()).Methods("GET")
+//
+func (b *Brick) DeprecationPage() HttpHandler {
+  return func(h *Http) error {
+    h.CacheTime(0)
+    h.Json(Msg{ Data: b.DeprecationReport() })
+    return nil
+  }
+}
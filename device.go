@@ -0,0 +1,97 @@
+package brick
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+//
+// 设备分类, 参考 Http.Device()
+//
+const (
+  DeviceDesktop = "desktop"
+  DeviceMobile  = "mobile"
+  DeviceBot     = "bot"
+)
+
+// User-Agent 中表示爬虫的片段 (小写)
+var botAgents = []string{
+  "bot", "crawl", "spider", "slurp", "facebookexternalhit", "mediapartners",
+  "lighthouse", "headlesschrome", "curl/", "wget/", "python-requests",
+}
+
+// User-Agent 中表示手机的片段 (小写), 平板按桌面处理 (安卓平板没有 "mobile")
+var mobileAgents = []string{
+  "mobi", "iphone", "ipod", "windows phone", "blackberry", "opera mini",
+}
+
+
+//
+// 返回客户端的设备分类: DeviceMobile, DeviceDesktop 或 DeviceBot.
+// 优先使用客户端提示 Sec-CH-UA-Mobile, 没有时从 User-Agent 判断;
+// 响应因此不同时必须调用 VaryDevice().
+//
+func (h *Http) Device() string {
+  ua := strings.ToLower(h.R.Header.Get("User-Agent"))
+  for _, s := range botAgents {
+    if strings.Contains(ua, s) {
+      return DeviceBot
+    }
+  }
+  switch h.R.Header.Get("Sec-CH-UA-Mobile") {
+  case "?1":
+    return DeviceMobile
+  case "?0":
+    return DeviceDesktop
+  }
+  if ua == "" {
+    return DeviceDesktop
+  }
+  for _, s := range mobileAgents {
+    if strings.Contains(ua, s) {
+      return DeviceMobile
+    }
+  }
+  return DeviceDesktop
+}
+
+
+//
+// 设置 Vary 头域, 告诉缓存响应按设备分类而不同
+//
+func (h *Http) VaryDevice() {
+  h.Vary("Sec-CH-UA-Mobile", "User-Agent")
+}
+
+
+//
+// 按设备选择模板文件: page.html 在手机上优先使用 page.mobile.html,
+// 爬虫优先使用 page.bot.html, 不存在时使用 page.html.
+// 存在任何变体时设置 Vary, TemplatePage 会自动调用.
+//
+func (h *Http) DeviceTemplate(file string) string {
+  ext  := filepath.Ext(file)
+  base := strings.TrimSuffix(file, ext)
+  found := ""
+  varies := false
+  device := h.Device()
+
+  for _, d := range []string{ DeviceMobile, DeviceBot, DeviceDesktop } {
+    name := base +"."+ d + ext
+    if _, err := os.Stat(name); err != nil {
+      continue
+    }
+    varies = true
+    if d == device {
+      found = name
+    }
+  }
+  if varies {
+    h.VaryDevice()
+  }
+  if found == "" {
+    return file
+  }
+  return found
+}
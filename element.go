@@ -0,0 +1,301 @@
+package brick
+
+import (
+  "bytes"
+  "fmt"
+  "html"
+  "io"
+  "sort"
+  "strings"
+)
+
+//
+// 可以输出为 html 的节点, 参考 E()
+//
+type Node interface {
+  Render(w io.Writer) error
+}
+
+//
+// 元素属性, 值为 true 输出无值属性, false 和 nil 不输出,
+// 其他值用 fmt.Sprint 转换并转义.
+//
+type Attr map[string]interface{}
+
+//
+// 按条件组合 class 属性, Attr{ "class": Classes{ "active": isActive } }
+//
+type Classes map[string]bool
+
+//
+// html 元素
+//
+type Element struct {
+  Tag      string
+  Attrs    Attr
+  Children []Node
+}
+
+type textNode string
+type rawNode string
+type fragment []Node
+
+// 没有结束标签的元素
+var voidElements = map[string]bool{
+  "area": true, "base": true, "br": true, "col": true, "embed": true,
+  "hr": true, "img": true, "input": true, "link": true, "meta": true,
+  "source": true, "track": true, "wbr": true,
+}
+
+// 值是 url 的属性, 禁止 javascript: 等脚本协议
+var urlAttributes = map[string]bool{
+  "href": true, "src": true, "action": true, "formaction": true,
+  "poster": true, "cite": true, "background": true,
+}
+
+
+//
+// 创建元素, args 可以是:
+// Attr 属性, Node 子节点, []Node 子节点列表, string 转义后的文本,
+// nil 被忽略 (配合 If() 使用), 其他值用 fmt.Sprint 转换为文本.
+// 例: E("div", Attr{"class": "x"}, E("b", "bold"), " text")
+//
+func E(tag string, args ...interface{}) *Element {
+  e := &Element{ Tag: strings.ToLower(tag) }
+  for _, a := range args {
+    e.append(a)
+  }
+  return e
+}
+
+
+func (e *Element) append(a interface{}) {
+  switch v := a.(type) {
+  case nil:
+  case Attr:
+    if e.Attrs == nil {
+      e.Attrs = Attr{}
+    }
+    for k, val := range v {
+      e.Attrs[k] = val
+    }
+  case Node:
+    if v != nil {
+      e.Children = append(e.Children, v)
+    }
+  case []Node:
+    e.Children = append(e.Children, v...)
+  case string:
+    e.Children = append(e.Children, textNode(v))
+  case []interface{}:
+    for _, c := range v {
+      e.append(c)
+    }
+  default:
+    e.Children = append(e.Children, textNode(fmt.Sprint(v)))
+  }
+}
+
+
+//
+// 追加子节点或属性, 参数规则与 E() 相同
+//
+func (e *Element) Add(args ...interface{}) *Element {
+  for _, a := range args {
+    e.append(a)
+  }
+  return e
+}
+
+
+//
+// 转义后的文本节点
+//
+func Text(s string) Node {
+  return textNode(s)
+}
+
+
+//
+// 不转义的 html 片段, 只能用于可信内容
+//
+func Raw(s string) Node {
+  return rawNode(s)
+}
+
+
+//
+// 没有外层元素的节点列表, 参数规则与 E() 相同
+//
+func Frag(args ...interface{}) Node {
+  e := &Element{}
+  for _, a := range args {
+    e.append(a)
+  }
+  return fragment(e.Children)
+}
+
+
+//
+// cond 为 true 返回 n, 否则返回 nil, 用于条件子节点和属性
+//
+func If(cond bool, n interface{}) interface{} {
+  if cond {
+    return n
+  }
+  return nil
+}
+
+
+//
+// 为列表中的每个元素生成节点, 用于可复用的组件函数
+//
+func Each[T any](items []T, fn func(int, T) Node) []Node {
+  ret := make([]Node, 0, len(items))
+  for i, it := range items {
+    if n := fn(i, it); n != nil {
+      ret = append(ret, n)
+    }
+  }
+  return ret
+}
+
+
+func (t textNode) Render(w io.Writer) error {
+  _, err := io.WriteString(w, html.EscapeString(string(t)))
+  return err
+}
+
+
+func (r rawNode) Render(w io.Writer) error {
+  _, err := io.WriteString(w, string(r))
+  return err
+}
+
+
+func (f fragment) Render(w io.Writer) error {
+  for _, c := range f {
+    if err := c.Render(w); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+
+func (e *Element) Render(w io.Writer) error {
+  if !validAttrName(e.Tag) {
+    return fmt.Errorf("invalid tag name '%s'", e.Tag)
+  }
+  var buf bytes.Buffer
+  buf.WriteByte('<')
+  buf.WriteString(e.Tag)
+
+  names := make([]string, 0, len(e.Attrs))
+  for k := range e.Attrs {
+    names = append(names, k)
+  }
+  sort.Strings(names)
+
+  for _, name := range names {
+    if !validAttrName(name) {
+      return fmt.Errorf("invalid attribute name '%s'", name)
+    }
+    val, show := attrValue(name, e.Attrs[name])
+    if !show {
+      continue
+    }
+    buf.WriteByte(' ')
+    buf.WriteString(name)
+    if val != nil {
+      buf.WriteString(`="`)
+      buf.WriteString(html.EscapeString(*val))
+      buf.WriteByte('"')
+    }
+  }
+  buf.WriteByte('>')
+  if _, err := w.Write(buf.Bytes()); err != nil {
+    return err
+  }
+
+  if voidElements[e.Tag] {
+    return nil
+  }
+  if err := fragment(e.Children).Render(w); err != nil {
+    return err
+  }
+  _, err := io.WriteString(w, "</"+ e.Tag +">")
+  return err
+}
+
+
+//
+// 返回属性的字符串值; 值为 nil 表示无值属性, show 为 false 不输出
+//
+func attrValue(name string, v interface{}) (val *string, show bool) {
+  var s string
+  switch t := v.(type) {
+  case nil:
+    return nil, false
+  case bool:
+    return nil, t
+  case string:
+    s = t
+  case Classes:
+    names := make([]string, 0, len(t))
+    for c, on := range t {
+      if on {
+        names = append(names, c)
+      }
+    }
+    if len(names) == 0 {
+      return nil, false
+    }
+    sort.Strings(names)
+    s = strings.Join(names, " ")
+  default:
+    s = fmt.Sprint(t)
+  }
+
+  if urlAttributes[strings.ToLower(name)] && unsafeURL(s) {
+    s = "about:invalid"
+  }
+  return &s, true
+}
+
+
+func unsafeURL(u string) bool {
+  u = strings.ToLower(strings.TrimSpace(u))
+  u = strings.Map(func(r rune) rune {
+    if r <= ' ' {
+      return -1
+    }
+    return r
+  }, u)
+  return strings.HasPrefix(u, "javascript:") || strings.HasPrefix(u, "vbscript:") ||
+         (strings.HasPrefix(u, "data:") && !strings.HasPrefix(u, "data:image/"))
+}
+
+
+func validAttrName(name string) bool {
+  if name == "" {
+    return false
+  }
+  for _, c := range name {
+    if c <= ' ' || c == '"' || c == '\'' || c == '>' || c == '/' || c == '=' || c == '<' {
+      return false
+    }
+  }
+  return true
+}
+
+
+//
+// 输出节点到客户端, 没有设置 Content-Type 时设置为 html
+//
+func (h *Http) Render(n Node) error {
+  if h.W.Header().Get("Content-Type") == "" {
+    h.W.Header().Set("Content-Type", "text/html; charset=utf-8")
+  }
+  return n.Render(h.W)
+}
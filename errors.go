@@ -0,0 +1,148 @@
+package brick
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "html"
+  "net/http"
+)
+
+//
+// 带有 http 状态码的错误, HttpHandler 返回该错误时,
+// 默认错误处理输出对应的状态码和 Msg, Err 只记录到日志不发送给客户端.
+//
+type HttpError struct {
+  Code int
+  Msg  string
+  Err  error
+}
+
+
+//
+// 创建带状态码的错误, msg 会发送给客户端
+//
+func NewHttpError(code int, msg string) *HttpError {
+  if msg == "" {
+    msg = http.StatusText(code)
+  }
+  return &HttpError{ Code: code, Msg: msg }
+}
+
+
+//
+// 用格式化字符串创建带状态码的错误
+//
+func Errorf(code int, format string, v ...interface{}) *HttpError {
+  return &HttpError{ Code: code, Msg: fmt.Sprintf(format, v...) }
+}
+
+
+//
+// 用状态码包装 err, 客户端只能看到状态码的标准说明
+//
+func WrapHttpError(code int, err error) *HttpError {
+  return &HttpError{ Code: code, Msg: http.StatusText(code), Err: err }
+}
+
+
+func (e *HttpError) Error() string {
+  if e.Err != nil {
+    return fmt.Sprintf("%d %s: %s", e.Code, e.Msg, e.Err)
+  }
+  return fmt.Sprintf("%d %s", e.Code, e.Msg)
+}
+
+
+func (e *HttpError) Unwrap() error {
+  return e.Err
+}
+
+
+//
+// 错误对应的 http 状态码, 不是 HttpError 的错误为 500
+//
+func errorStatus(err interface{}) int {
+  if e, ok := err.(error); ok {
+    var he *HttpError
+    if errors.As(e, &he) && he.Code >= 400 && he.Code < 600 {
+      return he.Code
+    }
+    var ve ValidationErrors
+    if errors.As(e, &ve) {
+      return http.StatusBadRequest
+    }
+  }
+  return http.StatusInternalServerError
+}
+
+
+//
+// 发送给客户端的错误信息; 普通 error 和 panic 的 5xx 只发送状态码的说明,
+// 其中可能有 SQL, 文件路径等内部信息, Debug 时才发送原文 (详情总是写入日志)
+//
+func errorMessage(err interface{}, code int, debug bool) string {
+  if e, ok := err.(error); ok {
+    var he *HttpError
+    if errors.As(e, &he) {
+      return he.Msg
+    }
+    var ve ValidationErrors
+    if errors.As(e, &ve) {
+      return "Invalid parameters"
+    }
+  }
+  if code >= 500 && !debug {
+    return http.StatusText(code)
+  }
+  return fmt.Sprint(err)
+}
+
+
+//
+// 默认错误处理, 根据 Accept 输出 Msg 格式的 json 或转义后的 html,
+// 已经写出响应头时只追加错误信息.
+//
+func defaultErrorHandle(hd *Http, err interface{}) {
+  code := errorStatus(err)
+  msg  := errorMessage(err, code, hd.b.Debug)
+
+  if code >= 500 {
+    hd.b.log.Error("Error:", hd.routeLabel(), hd.ClientIP(), err)
+  } else {
+    hd.b.log.Warn("Error:", hd.routeLabel(), hd.ClientIP(), err)
+  }
+
+  if hd.written() {
+    hd.WriteStr(html.EscapeString(msg))
+    return
+  }
+
+  var ve ValidationErrors
+  if e, ok := err.(error); !ok || !errors.As(e, &ve) {
+    ve = nil
+  }
+
+  if hd.WantsJSON() {
+    hd.W.Header().Set("Content-Type", "application/json; charset=utf-8")
+    hd.W.WriteHeader(code)
+    m := Msg{ Code: code, Msg: msg }
+    if ve != nil {
+      m.Data = ve
+    }
+    json.NewEncoder(hd.W).Encode(m)
+    return
+  }
+  hd.W.Header().Set("Content-Type", "text/html; charset=utf-8")
+  hd.W.Header().Set("X-Content-Type-Options", "nosniff")
+  hd.W.WriteHeader(code)
+  if ve != nil {
+    writeValidationErrors(hd, ve)
+    return
+  }
+  if code >= 500 {
+    hd.WriteStr(`<p>Service Error</p>`)
+  }
+  fmt.Fprintf(hd.W, `<p>%s</p>`, html.EscapeString(msg))
+}
+
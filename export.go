@@ -0,0 +1,217 @@
+package brick
+
+import (
+  "compress/gzip"
+  "crypto/sha256"
+  "encoding/hex"
+  "io"
+  "mime"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "sync"
+  "time"
+)
+
+//
+// 生成导出文件的内容, 写入 w 的数据被保存到暂存目录
+//
+type ExportFunc func(w io.Writer) error
+
+//
+// 正在生成和已经生成的导出文件, 参考 Http.Export()
+//
+type exportSpool struct {
+  lock      sync.Mutex
+  running   map[string]*exportCall
+  lastClean time.Time
+}
+
+type exportCall struct {
+  done chan struct{}
+  err  error
+}
+
+
+//
+// 下载一个生成的大文件 (CSV/JSON 导出): 第一次请求时调用 gen 把内容写入
+// Config.SpoolDir 中的暂存文件 (同时保存 gzip 版本), Config.SpoolTTL 内 key
+// 相同的请求直接发送暂存文件, 支持 Range/If-Range 断点续传, 不重新生成.
+// key 标识内容, 例如 "orders-2026-10-u42", 必须包含所有影响内容的参数和用户;
+// filename 是下载的文件名, 同时决定 Content-Type.
+//
+func (h *Http) Export(filename string, key string, gen ExportFunc) error {
+  b := h.b
+  id := exportID(key)
+  dir := b.spoolDir()
+  file := filepath.Join(dir, id)
+  b.cleanSpool(dir)
+
+  st, err := os.Stat(file)
+  if err != nil || time.Since(st.ModTime()) > b.spoolTTL() {
+    if err := b.generateExport(dir, id, gen); err != nil {
+      return err
+    }
+  }
+
+  gz := false
+  if acceptsGzip(h.R) {
+    if _, err := os.Stat(file +".gz"); err == nil {
+      gz = true
+      file += ".gz"
+    }
+  }
+  f, err := os.Open(file)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+  st, err = f.Stat()
+  if err != nil {
+    return err
+  }
+
+  hd := h.W.Header()
+  etag := id[:16] +"-"+ strconv.FormatInt(st.ModTime().UnixNano(), 36)
+  if gz {
+    hd.Set("Content-Encoding", "gzip")
+    etag += "-gz"
+  }
+  hd.Set("ETag", `"`+ etag +`"`)
+  addVary(hd, "Accept-Encoding")
+  hd.Set("Content-Type", getMimeType(filename))
+  hd.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{ "filename": filename }))
+  hd.Set("Cache-Control", "private, no-cache")
+  http.ServeContent(h.W, h.R, filename, st.ModTime(), f)
+  return nil
+}
+
+
+//
+// 生成暂存文件, 同一个 key 同时只生成一次, 其他请求等待结果
+//
+func (b *Brick) generateExport(dir string, id string, gen ExportFunc) error {
+  s := &b.exports
+  s.lock.Lock()
+  if call, has := s.running[id]; has {
+    s.lock.Unlock()
+    <-call.done
+    return call.err
+  }
+  if s.running == nil {
+    s.running = make(map[string]*exportCall)
+  }
+  call := &exportCall{ done: make(chan struct{}) }
+  s.running[id] = call
+  s.lock.Unlock()
+
+  // gen 异常时也要让等待的请求返回
+  defer func() {
+    s.lock.Lock()
+    delete(s.running, id)
+    s.lock.Unlock()
+    close(call.done)
+  }()
+  call.err = writeSpool(dir, id, gen)
+  if call.err != nil {
+    b.log.Error("Export", call.err)
+  }
+  return call.err
+}
+
+
+//
+// 写入临时文件后改名, 下载中的请求仍然读取旧文件
+//
+func writeSpool(dir string, id string, gen ExportFunc) (err error) {
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return err
+  }
+  raw, err := os.CreateTemp(dir, id +".*.tmp")
+  if err != nil {
+    return err
+  }
+  gzf, err := os.CreateTemp(dir, id +".gz.*.tmp")
+  if err != nil {
+    raw.Close()
+    os.Remove(raw.Name())
+    return err
+  }
+  defer func() {
+    raw.Close()
+    gzf.Close()
+    if err != nil {
+      os.Remove(raw.Name())
+      os.Remove(gzf.Name())
+    }
+  }()
+
+  zw := gzip.NewWriter(gzf)
+  if err = gen(io.MultiWriter(raw, zw)); err != nil {
+    return err
+  }
+  if err = zw.Close(); err != nil {
+    return err
+  }
+  if err = raw.Close(); err != nil {
+    return err
+  }
+  if err = gzf.Close(); err != nil {
+    return err
+  }
+  if err = os.Rename(gzf.Name(), filepath.Join(dir, id +".gz")); err != nil {
+    return err
+  }
+  return os.Rename(raw.Name(), filepath.Join(dir, id))
+}
+
+
+//
+// 删除过期的暂存文件, 最多每分钟检查一次
+//
+func (b *Brick) cleanSpool(dir string) {
+  s := &b.exports
+  s.lock.Lock()
+  if time.Since(s.lastClean) < time.Minute {
+    s.lock.Unlock()
+    return
+  }
+  s.lastClean = time.Now()
+  s.lock.Unlock()
+
+  entries, err := os.ReadDir(dir)
+  if err != nil {
+    return
+  }
+  // 正在下载的文件已经打开, 删除不影响读取
+  expire := time.Now().Add(-2 * b.spoolTTL())
+  for _, e := range entries {
+    if info, err := e.Info(); err == nil && info.ModTime().Before(expire) {
+      os.Remove(filepath.Join(dir, e.Name()))
+    }
+  }
+}
+
+
+func (b *Brick) spoolDir() string {
+  if b.config.SpoolDir != "" {
+    return b.config.SpoolDir
+  }
+  return filepath.Join(os.TempDir(), "brick-spool")
+}
+
+
+func (b *Brick) spoolTTL() time.Duration {
+  if b.config.SpoolTTL > 0 {
+    return b.config.SpoolTTL
+  }
+  return time.Hour
+}
+
+
+func exportID(key string) string {
+  sum := sha256.Sum256([]byte(key))
+  return hex.EncodeToString(sum[:])
+}
+
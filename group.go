@@ -0,0 +1,136 @@
+package brick
+
+import (
+  "strings"
+  "sync"
+)
+
+//
+// 路由分组, 组内的服务共享路径前缀, 中间件和错误处理器,
+// 参考 Brick.Group()
+//
+type Group struct {
+  b           *Brick
+  parent      *Group
+  prefix      string
+  lock        sync.RWMutex
+  middleware  []Middleware
+  errorHandle HttpErrorHandler
+  // 分组所在的虚拟主机, 参考 Brick.Host()
+  host        *Host
+}
+
+
+//
+// 创建路径前缀为 prefix 的分组, m 只对组内的服务生效,
+// 在 Brick.Use() 的全局中间件之后执行. 例如:
+//
+//   api := b.Group("/api/v1", authMiddleware)
+//   api.Service("/users", listUsers)   // /api/v1/users
+//
+func (b *Brick) Group(prefix string, m ...Middleware) *Group {
+  return &Group{ b: b, prefix: cleanPrefix(prefix), middleware: m }
+}
+
+
+//
+// 创建子分组, 前缀和中间件叠加在当前分组之后
+//
+func (g *Group) Group(prefix string, m ...Middleware) *Group {
+  return &Group{ b: g.b, parent: g, prefix: g.prefix + cleanPrefix(prefix), middleware: m, host: g.host }
+}
+
+
+//
+// 分组的路径前缀
+//
+func (g *Group) Prefix() string {
+  return g.prefix
+}
+
+
+//
+// 组内服务的完整路径
+//
+func (g *Group) Path(path string) string {
+  if path == "" || path == "/" {
+    return g.prefix +"/"
+  }
+  return g.prefix +"/"+ strings.TrimPrefix(path, "/")
+}
+
+
+//
+// 添加只对组内服务 (包括子分组) 生效的中间件
+//
+func (g *Group) Use(m ...Middleware) {
+  g.lock.Lock()
+  defer g.lock.Unlock()
+  g.middleware = append(g.middleware, m...)
+}
+
+
+//
+// 设置组内服务的错误处理器, 没有设置时使用上级分组或 Brick 的
+//
+func (g *Group) SetErrorHandler(p HttpErrorHandler) {
+  g.lock.Lock()
+  defer g.lock.Unlock()
+  g.errorHandle = p
+}
+
+
+//
+// 在分组的前缀下注册服务, path 为 "/" 时匹配前缀下的所有路径
+//
+func (g *Group) Service(path string, h HttpHandler) *Route {
+  return g.b.service(g.Path(path), h, g)
+}
+
+
+//
+// 外层分组的中间件在外层先执行
+//
+func (g *Group) chain(h HttpHandler) HttpHandler {
+  for ; g != nil; g = g.parent {
+    g.lock.RLock()
+    for i := len(g.middleware) - 1; i >= 0; i-- {
+      h = g.middleware[i](h)
+    }
+    g.lock.RUnlock()
+  }
+  return h
+}
+
+
+func (g *Group) hostOf() *Host {
+  if g == nil {
+    return nil
+  }
+  return g.host
+}
+
+
+func (g *Group) errorHandler() HttpErrorHandler {
+  for ; g != nil; g = g.parent {
+    g.lock.RLock()
+    p := g.errorHandle
+    g.lock.RUnlock()
+    if p != nil {
+      return p
+    }
+  }
+  return nil
+}
+
+
+//
+// "api/v1/" -> "/api/v1", "/" -> ""
+//
+func cleanPrefix(prefix string) string {
+  prefix = strings.Trim(prefix, "/")
+  if prefix == "" {
+    return ""
+  }
+  return "/"+ prefix
+}
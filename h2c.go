@@ -0,0 +1,23 @@
+//go:build go1.24
+
+package brick
+
+import (
+  "net/http"
+)
+
+const h2cSupported = true
+
+
+//
+// 同时接受 HTTP/1 和不加密的 HTTP/2, 参考 Config.H2C
+//
+func enableH2C(s *http.Server, on bool) {
+  if !on {
+    return
+  }
+  p := new(http.Protocols)
+  p.SetHTTP1(true)
+  p.SetUnencryptedHTTP2(true)
+  s.Protocols = p
+}
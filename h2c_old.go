@@ -0,0 +1,14 @@
+//go:build !go1.24
+
+package brick
+
+import (
+  "net/http"
+)
+
+// 标准库在 go1.24 之前不支持 h2c, Config.Validate() 会拒绝 H2C
+const h2cSupported = false
+
+
+func enableH2C(s *http.Server, on bool) {
+}
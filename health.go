@@ -0,0 +1,365 @@
+package brick
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+//
+// 健康检查探针, 返回 nil 表示依赖正常
+//
+type HealthCheck func(ctx context.Context) error
+
+//
+// 单个探针的检查结果
+//
+type HealthResult struct {
+  Status      string     `json:"status"`
+  Error       string     `json:"error,omitempty"`
+  Duration    string     `json:"duration"`
+  // 以下字段只在后台探测时有值, 参考 Brick.ProbeHealth()
+  CheckedAt   *time.Time `json:"checked_at,omitempty"`
+  LastSuccess *time.Time `json:"last_success,omitempty"`
+  // 连续失败的次数
+  Failures    int        `json:"failures,omitempty"`
+}
+
+//
+// 健康检查接口的输出
+//
+type HealthReport struct {
+  Status string                   `json:"status"`
+  Checks map[string]*HealthResult `json:"checks,omitempty"`
+}
+
+//
+// 后台探测的设置, 参考 Brick.ProbeHealth()
+//
+type HealthProbe struct {
+  // 探测间隔, 0 不在后台探测, 每次就绪检查都执行探针
+  Interval time.Duration
+  // 连续失败 Fall 次后才报告失败, 默认 1
+  Fall     int
+  // 失败后连续成功 Rise 次才恢复, 默认 1
+  Rise     int
+}
+
+type healthChecks struct {
+  lock    sync.Mutex
+  checks  map[string]HealthCheck
+  timeout time.Duration
+  probe   HealthProbe
+  // 后台探测的结果, 探测运行时不为空
+  states  map[string]*probeState
+  cancel  context.CancelFunc
+}
+
+type probeState struct {
+  fail        bool
+  okRun       int
+  failRun     int
+  last        *HealthResult
+  lastSuccess time.Time
+}
+
+
+//
+// 注册名为 name 的就绪探针, 所有探针都通过时就绪接口返回 200, 否则返回 503
+//
+func (b *Brick) AddHealthCheck(name string, fn HealthCheck) {
+  if fn == nil {
+    panic(fmt.Errorf("health check '%s' is nil", name))
+  }
+  b.health.lock.Lock()
+  defer b.health.lock.Unlock()
+  b.health.checks[name] = fn
+}
+
+
+//
+// 设置每次就绪检查中探针的超时时间, 默认 5 秒
+//
+func (b *Brick) SetHealthTimeout(d time.Duration) {
+  b.health.lock.Lock()
+  defer b.health.lock.Unlock()
+  b.health.timeout = d
+}
+
+
+//
+// 服务运行期间在后台每隔 p.Interval 执行一次全部探针, 就绪检查只返回最近的结果,
+// 负载均衡频繁的检查不会压到数据库上. Fall 和 Rise 防止状态抖动:
+// 探针偶尔失败一次时结果仍是 "ok" 但带有 error 和 failures 字段.
+// 第一轮探测在开始接受请求之前完成.
+//
+//   b.ProbeHealth(brick.HealthProbe{ Interval: 10 * time.Second, Fall: 3, Rise: 2 })
+//
+func (b *Brick) ProbeHealth(p HealthProbe) {
+  if p.Fall < 1 {
+    p.Fall = 1
+  }
+  if p.Rise < 1 {
+    p.Rise = 1
+  }
+  b.health.lock.Lock()
+  defer b.health.lock.Unlock()
+  b.health.probe = p
+}
+
+
+//
+// 在 path 上提供健康检查服务:
+// 'path/live' 存活检查, 进程能响应就返回 200;
+// 'path/ready' 和 'path' 就绪检查, 执行全部探针, 失败返回 503.
+// 探针的错误信息可能含有内部地址等细节, 只写入日志, Debug 时才在输出中返回.
+//
+func (b *Brick) Health(path string) {
+  path = strings.TrimSuffix(path, "/")
+
+  b.Service(path +"/live", func(h *Http) error {
+    h.CacheTime(0)
+    h.Json(HealthReport{ Status: "ok" })
+    return nil
+  })
+
+  ready := func(h *Http) error {
+    rep := b.CheckHealth(h.Ctx())
+    code := http.StatusOK
+    if rep.Status != "ok" {
+      code = http.StatusServiceUnavailable
+    }
+    if !b.Debug {
+      for _, res := range rep.Checks {
+        res.Error = ""
+      }
+    }
+    h.CacheTime(0)
+    h.JsonCode(code, rep)
+    return nil
+  }
+  b.Service(path +"/ready", ready)
+  b.Service(path, ready)
+}
+
+
+//
+// 返回就绪检查的结果: 后台探测运行时返回最近的结果, 否则并行执行全部就绪探针
+//
+func (b *Brick) CheckHealth(ctx context.Context) *HealthReport {
+  rep := &HealthReport{ Status: "ok" }
+  if rep.Checks = b.probedHealth(); rep.Checks == nil {
+    rep.Checks = b.runHealthChecks(ctx)
+    for name, res := range rep.Checks {
+      if res.Status != "ok" {
+        b.log.Warn("Health check", name, "failed:", res.Error)
+      }
+    }
+  }
+  for _, res := range rep.Checks {
+    if res.Status != "ok" {
+      rep.Status = "fail"
+    }
+  }
+  return rep
+}
+
+
+func (b *Brick) probedHealth() map[string]*HealthResult {
+  b.health.lock.Lock()
+  defer b.health.lock.Unlock()
+  if b.health.states == nil {
+    return nil
+  }
+  ret := make(map[string]*HealthResult, len(b.health.checks))
+  for name := range b.health.checks {
+    st := b.health.states[name]
+    if st == nil || st.last == nil {
+      ret[name] = &HealthResult{ Status: "fail", Error: "not checked yet" }
+      continue
+    }
+    res := *st.last
+    res.Status = "ok"
+    if st.fail {
+      res.Status = "fail"
+    }
+    if !st.lastSuccess.IsZero() {
+      t := st.lastSuccess
+      res.LastSuccess = &t
+    }
+    res.Failures = st.failRun
+    ret[name] = &res
+  }
+  return ret
+}
+
+
+func (b *Brick) runHealthChecks(ctx context.Context) map[string]*HealthResult {
+  b.health.lock.Lock()
+  checks := make(map[string]HealthCheck, len(b.health.checks))
+  for n, c := range b.health.checks {
+    checks[n] = c
+  }
+  timeout := b.health.timeout
+  b.health.lock.Unlock()
+
+  ctx, cancel := context.WithTimeout(ctx, timeout)
+  defer cancel()
+
+  ret := make(map[string]*HealthResult, len(checks))
+  var lock sync.Mutex
+  var wg sync.WaitGroup
+
+  for name, fn := range checks {
+    wg.Add(1)
+    go func(name string, fn HealthCheck) {
+      defer wg.Done()
+      res := runHealthCheck(ctx, fn)
+      lock.Lock()
+      ret[name] = res
+      lock.Unlock()
+    }(name, fn)
+  }
+  wg.Wait()
+  return ret
+}
+
+
+//
+// 由 Run() 调用, 设置了 ProbeHealth() 时同步执行第一轮探测, 然后在后台定期探测
+//
+func (b *Brick) startHealthProbes() {
+  b.health.lock.Lock()
+  p := b.health.probe
+  if p.Interval <= 0 || b.health.cancel != nil {
+    b.health.lock.Unlock()
+    return
+  }
+  ctx, cancel := context.WithCancel(context.Background())
+  b.health.cancel = cancel
+  b.health.states = make(map[string]*probeState)
+  b.health.lock.Unlock()
+
+  b.probeHealthOnce(ctx)
+  go func() {
+    t := time.NewTicker(p.Interval)
+    defer t.Stop()
+    for {
+      select {
+      case <-ctx.Done():
+        return
+      case <-t.C:
+        b.probeHealthOnce(ctx)
+      }
+    }
+  }()
+}
+
+
+//
+// 由 Shutdown() 调用, 之后就绪检查恢复为每次执行探针
+//
+func (b *Brick) stopHealthProbes() {
+  b.health.lock.Lock()
+  defer b.health.lock.Unlock()
+  if b.health.cancel != nil {
+    b.health.cancel()
+    b.health.cancel = nil
+    b.health.states = nil
+  }
+}
+
+
+func (b *Brick) probeHealthOnce(ctx context.Context) {
+  results := b.runHealthChecks(ctx)
+  if ctx.Err() != nil {
+    return
+  }
+  now := time.Now()
+
+  b.health.lock.Lock()
+  defer b.health.lock.Unlock()
+  if b.health.states == nil {
+    return
+  }
+  p := b.health.probe
+  for name, res := range results {
+    st := b.health.states[name]
+    if st == nil {
+      st = &probeState{}
+      b.health.states[name] = st
+    }
+    at := now
+    res.CheckedAt = &at
+    st.last = res
+
+    if res.Status == "ok" {
+      st.lastSuccess = now
+      st.failRun = 0
+      st.okRun++
+      if st.fail && st.okRun >= p.Rise {
+        st.fail = false
+        b.log.Info("Health check", name, "recovered")
+      }
+    } else {
+      st.okRun = 0
+      st.failRun++
+      // 第一次探测就失败时直接报告, 不等 Fall 次
+      if !st.fail && (st.failRun >= p.Fall || st.lastSuccess.IsZero()) {
+        st.fail = true
+        b.log.Warn("Health check", name, "failed:", res.Error)
+      }
+    }
+  }
+}
+
+
+//
+// 返回注册的探针名称
+//
+func (b *Brick) HealthChecks() []string {
+  b.health.lock.Lock()
+  defer b.health.lock.Unlock()
+  names := make([]string, 0, len(b.health.checks))
+  for n := range b.health.checks {
+    names = append(names, n)
+  }
+  sort.Strings(names)
+  return names
+}
+
+
+func runHealthCheck(ctx context.Context, fn HealthCheck) (res *HealthResult) {
+  begin := time.Now()
+  res = &HealthResult{ Status: "ok" }
+
+  defer func() {
+    res.Duration = time.Since(begin).String()
+  }()
+
+  done := make(chan error, 1)
+  go func() {
+    defer func() {
+      if err := recover(); err != nil {
+        done <- fmt.Errorf("panic: %v", err)
+      }
+    }()
+    done <- fn(ctx)
+  }()
+
+  var err error
+  select {
+  case err = <-done:
+  case <-ctx.Done():
+    err = ctx.Err()
+  }
+  if err != nil {
+    res.Status = "fail"
+    res.Error = err.Error()
+  }
+  return res
+}
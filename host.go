@@ -0,0 +1,252 @@
+package brick
+
+import (
+  "net"
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+)
+
+//
+// 虚拟主机, 按请求的 Host 头选择, 有自己的服务, 静态文件, 中间件,
+// 错误处理器和会话 cookie 的域; 参考 Brick.Host()
+//
+type Host struct {
+  root      Group
+  pattern   string
+  mux       *http.ServeMux
+  domain    string
+  domainSet bool
+}
+
+type hostTable struct {
+  lock  sync.RWMutex
+  exact map[string]*Host
+  // "*.example.com", 后缀长的在前
+  wild  []*Host
+  def   *Host
+}
+
+
+//
+// 返回 pattern 的虚拟主机, 同一个 pattern 返回同一个对象. pattern 是主机名
+// 或 "*.example.com" (匹配 example.com 的任意子域名, 不包括 example.com),
+// 不区分大小写, 忽略端口. 不匹配任何主机的请求交给 Default() 的主机,
+// 没有设置时交给直接注册在 Brick 上的服务. 例如:
+//
+//   admin := b.Host("admin.example.com")
+//   admin.Use(requireAdmin)
+//   admin.Service("/", b.TemplatePage("admin/index.html", adminHome))
+//   admin.StaticPage("/static", "admin/static")
+//
+// Brick 上按路径设置的 AuthExempt(), RateLimit(), RouteCost(), RouteLane(), RouteClass(),
+// RoutePriority() 等对主机上的路由使用 pattern+路径, 例如 b.AuthExempt("admin.example.com/login");
+// 只写路径时只对直接注册在 Brick 上的路由生效.
+//
+func (b *Brick) Host(pattern string) *Host {
+  pattern = strings.ToLower(strings.TrimSpace(pattern))
+  b.hosts.lock.Lock()
+  defer b.hosts.lock.Unlock()
+  if hs := b.hosts.find(pattern); hs != nil {
+    return hs
+  }
+
+  hs := &Host{ pattern: pattern, mux: http.NewServeMux() }
+  hs.root.b = b
+  hs.root.host = hs
+  if strings.HasPrefix(pattern, "*.") {
+    b.hosts.wild = append(b.hosts.wild, hs)
+    sort.SliceStable(b.hosts.wild, func(i, j int) bool {
+      return len(b.hosts.wild[i].pattern) > len(b.hosts.wild[j].pattern)
+    })
+  } else {
+    if b.hosts.exact == nil {
+      b.hosts.exact = make(map[string]*Host)
+    }
+    b.hosts.exact[pattern] = hs
+  }
+  return hs
+}
+
+
+func (t *hostTable) find(pattern string) *Host {
+  if hs := t.exact[pattern]; hs != nil {
+    return hs
+  }
+  for _, hs := range t.wild {
+    if hs.pattern == pattern {
+      return hs
+    }
+  }
+  return nil
+}
+
+
+//
+// 主机的 pattern
+//
+func (hs *Host) Pattern() string {
+  return hs.pattern
+}
+
+
+//
+// 在这个主机上注册服务, 参考 Brick.Service()
+//
+func (hs *Host) Service(path string, h HttpHandler) *Route {
+  return hs.root.Service(path, h)
+}
+
+
+//
+// 创建这个主机上的分组, 参考 Brick.Group()
+//
+func (hs *Host) Group(prefix string, m ...Middleware) *Group {
+  return hs.root.Group(prefix, m...)
+}
+
+
+//
+// 添加只对这个主机上的服务生效的中间件, 在 Brick.Use() 的全局中间件之后执行
+//
+func (hs *Host) Use(m ...Middleware) {
+  hs.root.Use(m...)
+}
+
+
+//
+// 设置这个主机上的错误处理器, 包括静态文件和跳转, 没有设置时使用 Brick 的
+//
+func (hs *Host) SetErrorHandler(p HttpErrorHandler) {
+  hs.root.SetErrorHandler(p)
+}
+
+
+//
+// 不匹配任何主机的请求 (包括没有 Host 头的请求) 由这个主机处理
+//
+func (hs *Host) Default() *Host {
+  b := hs.root.b
+  b.hosts.lock.Lock()
+  defer b.hosts.lock.Unlock()
+  b.hosts.def = hs
+  return hs
+}
+
+
+//
+// 设置这个主机上会话 cookie 的 Domain, 例如 ".example.com" 让子域名共享会话;
+// 空字符串使 cookie 只发给当前主机. 不设置时由会话库决定.
+//
+func (hs *Host) SessionDomain(domain string) *Host {
+  hs.domain, hs.domainSet = strings.TrimPrefix(domain, "."), true
+  return hs
+}
+
+
+//
+// 在这个主机上设置静态文件服务, 参考 Brick.StaticPage()
+//
+func (hs *Host) StaticPage(baseURL string, fileDir string) *StaticPage {
+  return hs.root.b.staticPage(baseURL, fileDir, hs)
+}
+
+
+//
+// 在这个主机上把 location 跳转到 to, 参考 Brick.HttpJumpMapping()
+//
+func (hs *Host) HttpJumpMapping(location string, to string) {
+  hs.root.b.jumpMapping(location, to, hs)
+}
+
+
+//
+// 请求的主机, 没有匹配时返回 Default() 的主机或 nil
+//
+func (b *Brick) matchHost(r *http.Request) *Host {
+  b.hosts.lock.RLock()
+  defer b.hosts.lock.RUnlock()
+  if b.hosts.exact == nil && b.hosts.wild == nil {
+    return nil
+  }
+  name := hostName(r)
+  if hs := b.hosts.exact[name]; hs != nil {
+    return hs
+  }
+  for _, hs := range b.hosts.wild {
+    if strings.HasSuffix(name, hs.pattern[1:]) {
+      return hs
+    }
+  }
+  return b.hosts.def
+}
+
+
+//
+// 请求的主机名, 小写, 去掉端口和末尾的点
+//
+func hostName(r *http.Request) string {
+  name := strings.ToLower(r.Host)
+  if h, _, err := net.SplitHostPort(name); err == nil {
+    name = h
+  }
+  return strings.TrimSuffix(name, ".")
+}
+
+
+//
+// 缓存键和标签索引中的主机: 主机上的路由使用主机的 pattern, "*.example.com" 的主机
+// 使用请求的主机名 (子域名可能输出不同的内容); 直接注册在 Brick 上的路由为空.
+//
+func (h *Http) cacheHost() string {
+  if h.rt == nil || h.rt.info.Host == "" {
+    return ""
+  }
+  if strings.HasPrefix(h.rt.info.Host, "*.") {
+    return hostName(h.R)
+  }
+  return h.rt.info.Host
+}
+
+
+//
+// 路由的注册位置: 主机的 mux 或 Brick 的 mux; 同一路径在不同主机上用不同的键
+//
+func (hs *Host) target(b *Brick, path string) (*http.ServeMux, string) {
+  if hs == nil {
+    return b.serveMux, path
+  }
+  return hs.mux, hs.pattern + path
+}
+
+
+func (hs *Host) name() string {
+  if hs == nil {
+    return ""
+  }
+  return hs.pattern
+}
+
+
+//
+// 会话库写出 cookie 后按主机的 SessionDomain() 改写会话 cookie 的 Domain
+//
+func (h *Http) fixSessionCookie() {
+  hs := h.b.matchHost(h.R)
+  if hs == nil || !hs.domainSet {
+    return
+  }
+  list := h.W.Header()["Set-Cookie"]
+  prefix := h.b.config.SessionCookie +"="
+  for i, v := range list {
+    if !strings.HasPrefix(v, prefix) {
+      continue
+    }
+    cookies := (&http.Response{ Header: http.Header{ "Set-Cookie": { v } } }).Cookies()
+    if len(cookies) == 1 {
+      cookies[0].Domain = hs.domain
+      list[i] = cookies[0].String()
+    }
+  }
+}
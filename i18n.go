@@ -0,0 +1,422 @@
+package brick
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+//
+// 多语言消息包, 每个 locale 保存一组 key -> 消息模板,
+// 消息模板使用 fmt.Sprintf 格式化参数.
+//
+type I18n struct {
+  lock     sync.RWMutex
+  bundles  map[string]map[string]string
+  fallback string
+}
+
+//
+// Accept-Language / Accept 等头域中的一个条目
+//
+type qualityItem struct {
+  value string
+  q     float64
+}
+
+
+//
+// 创建消息包, 找不到匹配的语言时使用 fallback
+//
+func NewI18n(fallback string) *I18n {
+  return &I18n{
+    bundles  : make(map[string]map[string]string),
+    fallback : normalizeLocale(fallback),
+  }
+}
+
+
+//
+// 设置默认语言
+//
+func (i *I18n) SetFallback(locale string) {
+  i.lock.Lock()
+  defer i.lock.Unlock()
+  i.fallback = normalizeLocale(locale)
+}
+
+
+func (i *I18n) Fallback() string {
+  i.lock.RLock()
+  defer i.lock.RUnlock()
+  return i.fallback
+}
+
+
+//
+// 加载目录中的全部消息文件, 文件名(不含扩展名)作为 locale,
+// 支持 .json 和 .toml 两种格式, 例如 'zh-CN.json', 'en.toml'
+//
+func (i *I18n) LoadDir(dir string) error {
+  files, err := ioutil.ReadDir(dir)
+  if err != nil {
+    return err
+  }
+  for _, f := range files {
+    if f.IsDir() {
+      continue
+    }
+    ext := filepath.Ext(f.Name())
+    if ext != ".json" && ext != ".toml" {
+      continue
+    }
+    locale := strings.TrimSuffix(f.Name(), ext)
+    if err := i.LoadFile(locale, filepath.Join(dir, f.Name())); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+
+//
+// 加载一个消息文件到 locale 中, 已经存在的 key 会被覆盖
+//
+func (i *I18n) LoadFile(locale string, fileName string) error {
+  buf, err := ioutil.ReadFile(fileName)
+  if err != nil {
+    return err
+  }
+
+  msgs := make(map[string]string)
+  switch filepath.Ext(fileName) {
+  case ".json":
+    var tree map[string]interface{}
+    if err := json.Unmarshal(buf, &tree); err != nil {
+      return fmt.Errorf("%s: %s", fileName, err)
+    }
+    flattenMessages("", tree, msgs)
+  case ".toml":
+    if err := parseTomlMessages(string(buf), msgs); err != nil {
+      return fmt.Errorf("%s: %s", fileName, err)
+    }
+  default:
+    return errors.New("Unsupported message file "+ fileName)
+  }
+
+  i.Add(locale, msgs)
+  return nil
+}
+
+
+//
+// 向 locale 中添加消息
+//
+func (i *I18n) Add(locale string, msgs map[string]string) {
+  locale = normalizeLocale(locale)
+  i.lock.Lock()
+  defer i.lock.Unlock()
+
+  b := i.bundles[locale]
+  if b == nil {
+    b = make(map[string]string, len(msgs))
+    i.bundles[locale] = b
+  }
+  for k, v := range msgs {
+    b[k] = v
+  }
+}
+
+
+//
+// 返回已经加载的 locale 列表
+//
+func (i *I18n) Locales() []string {
+  i.lock.RLock()
+  defer i.lock.RUnlock()
+  ret := make([]string, 0, len(i.bundles))
+  for l := range i.bundles {
+    ret = append(ret, l)
+  }
+  sort.Strings(ret)
+  return ret
+}
+
+
+//
+// 按优先级顺序在 prefs 中选择第一个有消息包的语言,
+// 'zh-Hant-TW' 依次尝试 'zh-hant-tw', 'zh-hant', 'zh',
+// 都没有则返回默认语言.
+//
+func (i *I18n) Match(prefs ...string) string {
+  i.lock.RLock()
+  defer i.lock.RUnlock()
+
+  for _, p := range prefs {
+    for _, l := range localeChain(p) {
+      if _, has := i.bundles[l]; has {
+        return l
+      }
+    }
+  }
+  return i.fallback
+}
+
+
+//
+// 翻译 key, 在 locale 的回退链和默认语言中查找,
+// 找不到则返回 key 本身; args 不为空时用 fmt.Sprintf 格式化.
+//
+func (i *I18n) Translate(locale string, key string, args ...interface{}) string {
+  msg, has := i.lookup(locale, key)
+  if !has {
+    msg = key
+  }
+  if len(args) > 0 {
+    return fmt.Sprintf(msg, args...)
+  }
+  return msg
+}
+
+
+func (i *I18n) lookup(locale string, key string) (string, bool) {
+  i.lock.RLock()
+  defer i.lock.RUnlock()
+
+  chain := append(localeChain(locale), localeChain(i.fallback)...)
+  for _, l := range chain {
+    // 空消息是尚未翻译的骨架, 继续回退
+    if msg, has := i.bundles[l][key]; has && msg != "" {
+      return msg, true
+    }
+  }
+  return "", false
+}
+
+
+//
+// 设置 brick 的多语言消息包
+//
+func (b *Brick) SetI18n(i *I18n) {
+  if i == nil {
+    panic(errors.New("i18n is null"))
+  }
+  b.i18n = i
+}
+
+
+func (b *Brick) I18n() *I18n {
+  return b.i18n
+}
+
+
+//
+// 从目录加载消息文件, 参考 I18n.LoadDir()
+//
+func (b *Brick) LoadMessages(dir string) error {
+  return b.i18n.LoadDir(dir)
+}
+
+
+//
+// 返回当前请求使用的语言, 根据 Accept-Language 和已加载的消息包选择
+//
+func (h *Http) Locale() string {
+  if h.locale == "" {
+    h.Vary("Accept-Language")
+    h.locale = h.b.i18n.Match(ParseAcceptLanguage(h.R.Header.Get("Accept-Language"))...)
+  }
+  return h.locale
+}
+
+
+//
+// 强制设置当前请求使用的语言, 例如来自用户配置
+//
+func (h *Http) SetLocale(locale string) {
+  h.locale = normalizeLocale(locale)
+}
+
+
+//
+// 使用当前请求的语言翻译 key
+//
+func (h *Http) T(key string, args ...interface{}) string {
+  return h.b.i18n.Translate(h.Locale(), key, args...)
+}
+
+
+//
+// 解析 Accept-Language, 按 q 值从高到低返回语言列表, 忽略 q=0 和 '*'
+//
+func ParseAcceptLanguage(header string) []string {
+  items := parseQualityList(header)
+  ret := make([]string, 0, len(items))
+  for _, it := range items {
+    if it.q <= 0 || it.value == "*" {
+      continue
+    }
+    ret = append(ret, it.value)
+  }
+  return ret
+}
+
+
+//
+// 解析 'a;q=0.8, b, c;q=0.1' 格式的头域, 按 q 值从高到低稳定排序
+//
+func parseQualityList(header string) []qualityItem {
+  parts := strings.Split(header, ",")
+  ret := make([]qualityItem, 0, len(parts))
+
+  for _, p := range parts {
+    fields := strings.Split(p, ";")
+    v := strings.TrimSpace(fields[0])
+    if v == "" {
+      continue
+    }
+    it := qualityItem{ value: v, q: 1 }
+    for _, f := range fields[1:] {
+      f = strings.TrimSpace(f)
+      if strings.HasPrefix(f, "q=") {
+        q, err := strconv.ParseFloat(f[2:], 64)
+        if err != nil {
+          q = 0
+        }
+        it.q = q
+      }
+    }
+    ret = append(ret, it)
+  }
+
+  sort.SliceStable(ret, func(a, b int) bool {
+    return ret[a].q > ret[b].q
+  })
+  return ret
+}
+
+
+func normalizeLocale(l string) string {
+  return strings.ToLower(strings.Replace(strings.TrimSpace(l), "_", "-", -1))
+}
+
+
+//
+// 'zh-Hant-TW' -> [zh-hant-tw, zh-hant, zh]
+//
+func localeChain(locale string) []string {
+  l := normalizeLocale(locale)
+  if l == "" {
+    return nil
+  }
+  ret := []string{ l }
+  for {
+    i := strings.LastIndex(l, "-")
+    if i <= 0 {
+      break
+    }
+    l = l[:i]
+    ret = append(ret, l)
+  }
+  return ret
+}
+
+
+//
+// 把嵌套的 json 对象展开为 'a.b.c' 形式的 key
+//
+func flattenMessages(prefix string, tree map[string]interface{}, out map[string]string) {
+  for k, v := range tree {
+    if prefix != "" {
+      k = prefix +"."+ k
+    }
+    switch t := v.(type) {
+    case map[string]interface{}:
+      flattenMessages(k, t, out)
+    case string:
+      out[k] = t
+    default:
+      out[k] = fmt.Sprint(t)
+    }
+  }
+}
+
+
+//
+// 只支持消息文件需要的 toml 子集:
+// '[table]' 作为 key 前缀, 'key = "value"' 或 'key = 'literal'', '#' 注释
+//
+func parseTomlMessages(src string, out map[string]string) error {
+  prefix := ""
+  sc := bufio.NewScanner(strings.NewReader(src))
+  line := 0
+
+  for sc.Scan() {
+    line++
+    s := strings.TrimSpace(sc.Text())
+    if s == "" || s[0] == '#' {
+      continue
+    }
+    if s[0] == '[' {
+      if !strings.HasSuffix(s, "]") {
+        return fmt.Errorf("line %d: bad table", line)
+      }
+      prefix = strings.Trim(strings.TrimSpace(s[1:len(s)-1]), "\"")
+      continue
+    }
+
+    eq := strings.Index(s, "=")
+    if eq <= 0 {
+      return fmt.Errorf("line %d: expect 'key = value'", line)
+    }
+    key := strings.Trim(strings.TrimSpace(s[:eq]), "\"")
+    val, err := tomlString(strings.TrimSpace(s[eq+1:]))
+    if err != nil {
+      return fmt.Errorf("line %d: %s", line, err)
+    }
+    if prefix != "" {
+      key = prefix +"."+ key
+    }
+    out[key] = val
+  }
+  return sc.Err()
+}
+
+
+func tomlString(v string) (string, error) {
+  if len(v) >= 2 && v[0] == '\'' {
+    end := strings.IndexByte(v[1:], '\'')
+    if end < 0 {
+      return "", errors.New("unterminated string")
+    }
+    return v[1:end+1], nil
+  }
+  if len(v) >= 2 && v[0] == '"' {
+    // 找到未转义的结束引号, 之后可能是注释
+    for i := 1; i < len(v); i++ {
+      if v[i] == '\\' {
+        i++
+        continue
+      }
+      if v[i] == '"' {
+        return strconv.Unquote(v[:i+1])
+      }
+    }
+    return "", errors.New("unterminated string")
+  }
+  if i := strings.Index(v, "#"); i >= 0 {
+    v = strings.TrimSpace(v[:i])
+  }
+  if v == "" {
+    return "", errors.New("empty value")
+  }
+  return v, nil
+}
+
@@ -0,0 +1,330 @@
+package brick
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "text/template/parse"
+)
+
+//
+// 扫描模板时处理的文件扩展名
+//
+var TemplateExtensions = []string{ ".html", ".xhtml", ".htm", ".tpl", ".tmpl" }
+
+//
+// 一个语言的消息目录与模板中使用的 key 的比较结果
+//
+type CatalogReport struct {
+  Locale  string
+  File    string
+  // 模板中使用但目录中没有的 key, MergeCatalog 会添加空值骨架
+  Missing []string
+  // 目录中有但模板中没有使用的 key
+  Unused  []string
+}
+
+
+//
+// 扫描目录中的模板, 找出所有 {{ t . "key" }} 和 (range/with 中的) {{ t $ "key" }} 用法,
+// 返回 key -> 出现位置 'file:line' 的列表.
+//
+func ExtractTranslationKeys(dirs ...string) (map[string][]string, error) {
+  keys := make(map[string][]string)
+
+  for _, dir := range dirs {
+    err := filepath.Walk(dir, func(fn string, info os.FileInfo, err error) error {
+      if err != nil {
+        return err
+      }
+      if info.IsDir() || !isTemplateFile(fn) {
+        return nil
+      }
+      buf, err := ioutil.ReadFile(fn)
+      if err != nil {
+        return err
+      }
+      return extractFromTemplate(fn, string(buf), keys)
+    })
+    if err != nil {
+      return nil, err
+    }
+  }
+  return keys, nil
+}
+
+
+func isTemplateFile(fn string) bool {
+  ext := strings.ToLower(filepath.Ext(fn))
+  for _, e := range TemplateExtensions {
+    if ext == e {
+      return true
+    }
+  }
+  return false
+}
+
+
+func extractFromTemplate(fn string, src string, keys map[string][]string) error {
+  tree := parse.New(fn)
+  tree.Mode = parse.SkipFuncCheck
+  trees := make(map[string]*parse.Tree)
+  if _, err := tree.Parse(src, "", "", trees); err != nil {
+    return err
+  }
+
+  for _, t := range trees {
+    if t.Root == nil {
+      continue
+    }
+    walkTemplateNode(t.Root, func(key string, pos parse.Pos) {
+      line := 1 + strings.Count(src[:int(pos)], "\n")
+      keys[key] = append(keys[key], fn +":"+ strconv.Itoa(line))
+    })
+  }
+  return nil
+}
+
+
+func walkTemplateNode(node parse.Node, found func(string, parse.Pos)) {
+  switch n := node.(type) {
+  case *parse.ListNode:
+    if n == nil {
+      return
+    }
+    for _, c := range n.Nodes {
+      walkTemplateNode(c, found)
+    }
+  case *parse.ActionNode:
+    walkTemplateNode(n.Pipe, found)
+  case *parse.IfNode:
+    walkBranchNode(&n.BranchNode, found)
+  case *parse.RangeNode:
+    walkBranchNode(&n.BranchNode, found)
+  case *parse.WithNode:
+    walkBranchNode(&n.BranchNode, found)
+  case *parse.TemplateNode:
+    if n.Pipe != nil {
+      walkTemplateNode(n.Pipe, found)
+    }
+  case *parse.PipeNode:
+    if n == nil {
+      return
+    }
+    for _, c := range n.Cmds {
+      walkTemplateNode(c, found)
+    }
+  case *parse.CommandNode:
+    if key, pos, ok := translationCall(n); ok {
+      found(key, pos)
+    }
+    for _, a := range n.Args {
+      if p, ok := a.(*parse.PipeNode); ok {
+        walkTemplateNode(p, found)
+      }
+    }
+  }
+}
+
+
+func walkBranchNode(n *parse.BranchNode, found func(string, parse.Pos)) {
+  walkTemplateNode(n.Pipe, found)
+  walkTemplateNode(n.List, found)
+  if n.ElseList != nil {
+    walkTemplateNode(n.ElseList, found)
+  }
+}
+
+
+//
+// 命令是否是 't . "key"' 或 't $ "key"' 形式, 第一个参数是模板函数的上下文
+//
+func translationCall(n *parse.CommandNode) (string, parse.Pos, bool) {
+  if len(n.Args) < 3 {
+    return "", 0, false
+  }
+  id, ok := n.Args[0].(*parse.IdentifierNode)
+  if !ok || id.Ident != "t" {
+    return "", 0, false
+  }
+  switch ctx := n.Args[1].(type) {
+  case *parse.DotNode:
+  case *parse.VariableNode:
+    if len(ctx.Ident) != 1 || ctx.Ident[0] != "$" {
+      return "", 0, false
+    }
+  default:
+    return "", 0, false
+  }
+  if s, ok := n.Args[2].(*parse.StringNode); ok {
+    return s.Text, s.Pos, true
+  }
+  return "", 0, false
+}
+
+
+//
+// 把 keys 合并到 dir 目录中每个 locale 的消息文件,
+// 缺少的 key 以空值添加, 已有的消息保持不变; 空值在翻译时被视为缺失.
+// 已存在 .toml 文件时写在第一个表之前, 否则读写 '<locale>.json'.
+// write 为 false 时只比较不写文件.
+//
+func MergeCatalog(dir string, locales []string, keys map[string][]string,
+    write bool) ([]CatalogReport, error) {
+  reports := make([]CatalogReport, 0, len(locales))
+
+  for _, locale := range locales {
+    rep, err := mergeLocaleCatalog(dir, locale, keys, write)
+    if err != nil {
+      return nil, err
+    }
+    reports = append(reports, rep)
+  }
+  return reports, nil
+}
+
+
+func mergeLocaleCatalog(dir string, locale string, keys map[string][]string,
+    write bool) (CatalogReport, error) {
+  rep := CatalogReport{ Locale: locale }
+  msgs := make(map[string]string)
+
+  tomlFile := filepath.Join(dir, locale +".toml")
+  isToml := false
+  if _, err := os.Stat(tomlFile); err == nil {
+    isToml = true
+    rep.File = tomlFile
+    buf, err := ioutil.ReadFile(tomlFile)
+    if err != nil {
+      return rep, err
+    }
+    if err := parseTomlMessages(string(buf), msgs); err != nil {
+      return rep, fmt.Errorf("%s: %s", tomlFile, err)
+    }
+  } else {
+    rep.File = filepath.Join(dir, locale +".json")
+    buf, err := ioutil.ReadFile(rep.File)
+    if err != nil && !os.IsNotExist(err) {
+      return rep, err
+    }
+    if err == nil {
+      var tree map[string]interface{}
+      if err := json.Unmarshal(buf, &tree); err != nil {
+        return rep, fmt.Errorf("%s: %s", rep.File, err)
+      }
+      flattenMessages("", tree, msgs)
+    }
+  }
+
+  for k := range keys {
+    if _, has := msgs[k]; !has {
+      rep.Missing = append(rep.Missing, k)
+    }
+  }
+  for k := range msgs {
+    if _, has := keys[k]; !has {
+      rep.Unused = append(rep.Unused, k)
+    }
+  }
+  sort.Strings(rep.Missing)
+  sort.Strings(rep.Unused)
+
+  if !write || len(rep.Missing) == 0 {
+    return rep, nil
+  }
+  if isToml {
+    return rep, appendTomlSkeleton(tomlFile, rep.Missing)
+  }
+
+  for _, k := range rep.Missing {
+    msgs[k] = ""
+  }
+  buf, err := json.MarshalIndent(msgs, "", "  ")
+  if err != nil {
+    return rep, err
+  }
+  return rep, ioutil.WriteFile(rep.File, append(buf, '\n'), 0644)
+}
+
+
+//
+// 把缺少的键写在第一个 [table] 之前, 写在文件末尾会成为最后一个表中的键.
+// 键写成带引号的完整名字, 例如 "home.title" = "", 在根上与表中的键等价.
+//
+func appendTomlSkeleton(fileName string, missing []string) error {
+  buf, err := ioutil.ReadFile(fileName)
+  if err != nil {
+    return err
+  }
+  text := string(buf)
+  block := "# missing translations\n"
+  for _, k := range missing {
+    block += strconv.Quote(k) +" = \"\"\n"
+  }
+
+  // 第一个表开始的位置
+  at := -1
+  for off := 0; off < len(text); {
+    end := strings.IndexByte(text[off:], '\n')
+    if end < 0 {
+      end = len(text) - off
+    }
+    if strings.HasPrefix(strings.TrimSpace(text[off:off+end]), "[") {
+      at = off
+      break
+    }
+    off += end + 1
+  }
+
+  if at < 0 {
+    if text != "" && !strings.HasSuffix(text, "\n") {
+      text += "\n"
+    }
+    text += "\n"+ block
+  } else {
+    text = text[:at] + block +"\n"+ text[at:]
+  }
+  return ioutil.WriteFile(fileName, []byte(text), 0644)
+}
+
+
+//
+// 扫描模板目录并与已加载的消息包比较, 用于启动时检查
+//
+func (b *Brick) CheckTranslations() ([]CatalogReport, error) {
+  if b.templateDir == "" {
+    return nil, fmt.Errorf("template dir not set")
+  }
+  keys, err := ExtractTranslationKeys(b.templateDir)
+  if err != nil {
+    return nil, err
+  }
+
+  locales := b.i18n.Locales()
+  reports := make([]CatalogReport, 0, len(locales))
+  for _, l := range locales {
+    rep := CatalogReport{ Locale: l }
+    b.i18n.lock.RLock()
+    bundle := b.i18n.bundles[l]
+    for k := range keys {
+      if msg, has := bundle[k]; !has || msg == "" {
+        rep.Missing = append(rep.Missing, k)
+      }
+    }
+    for k := range bundle {
+      if _, has := keys[k]; !has {
+        rep.Unused = append(rep.Unused, k)
+      }
+    }
+    b.i18n.lock.RUnlock()
+    sort.Strings(rep.Missing)
+    sort.Strings(rep.Unused)
+    reports = append(reports, rep)
+  }
+  return reports, nil
+}
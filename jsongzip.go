@@ -0,0 +1,48 @@
+package brick
+
+import (
+  "bytes"
+  "compress/gzip"
+  "encoding/json"
+  "net/http"
+  "strconv"
+)
+
+//
+// 输出 json, code 为 0 时不设置状态码.
+// 设置了 Config.JsonGzip 时先编码到缓冲区, 超过阈值并且客户端接受 gzip 时压缩输出.
+//
+func (h *Http) writeJson(code int, m interface{}) {
+  hdr := h.W.Header()
+  hdr.Set("Content-Type", "application/json; charset=utf-8")
+  min := h.b.config.JsonGzip
+  if min <= 0 {
+    if code != 0 {
+      h.W.WriteHeader(code)
+    }
+    json.NewEncoder(h.W).Encode(m)
+    return
+  }
+
+  var buf bytes.Buffer
+  json.NewEncoder(&buf).Encode(m)
+  body := buf.Bytes()
+  if len(body) >= min && hdr.Get("Content-Encoding") == "" {
+    // 是否压缩取决于 Accept-Encoding, 缓存必须区分
+    h.Vary("Accept-Encoding")
+    if acceptsGzip(h.R) {
+      if gz, err := gzipBytes(body, gzip.DefaultCompression); err == nil {
+        body = gz
+        hdr.Set("Content-Encoding", "gzip")
+      }
+    }
+  }
+  hdr.Set("Content-Length", strconv.Itoa(len(body)))
+  if code == 0 {
+    code = http.StatusOK
+  }
+  h.W.WriteHeader(code)
+  if h.R.Method != http.MethodHead {
+    h.W.Write(body)
+  }
+}
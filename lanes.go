@@ -0,0 +1,182 @@
+package brick
+
+import (
+  "fmt"
+  "net/http"
+  "sort"
+  "strconv"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+//
+// 并发池, 同一个通道中的路由共享并发数, 参考 Brick.DefineLane()
+//
+type Lane struct {
+  // 同时处理的请求数, 必须大于 0
+  Concurrency int
+  // 排队等待的请求数上限, 队列满时返回 503; 0 不排队
+  Queue       int
+  // 排队的最长时间, 超过时返回 503, 默认 10 秒
+  MaxWait     time.Duration
+}
+
+//
+// 通道的当前状态, 参考 Brick.Lanes()
+//
+type LaneStatus struct {
+  Name        string `json:"name"`
+  Concurrency int    `json:"concurrency"`
+  InFlight    int64  `json:"in_flight"`
+  Waiting     int64  `json:"waiting"`
+  Rejected    uint64 `json:"rejected"`
+}
+
+type lane struct {
+  name     string
+  conf     Lane
+  slots    chan struct{}
+  waiting  int64
+  rejected uint64
+}
+
+type laneTable struct {
+  lock   sync.RWMutex
+  lanes  map[string]*lane
+  // 路由 -> 通道名
+  routes map[string]string
+}
+
+
+//
+// 定义名为 name 的通道, 用 RouteLane() 把路由放进通道, 例如报表下载放进 "batch" 通道,
+// 一批大文件下载只占用 batch 的并发数, 不影响其他页面. name 为 "" 的通道用于没有指定通道的路由,
+// 不定义时这些路由不限制并发.
+//
+//   b.DefineLane("batch", brick.Lane{ Concurrency: 4, Queue: 20, MaxWait: 30*time.Second })
+//   b.RouteLane("/report/export", "batch")
+//
+func (b *Brick) DefineLane(name string, conf Lane) {
+  if conf.Concurrency <= 0 {
+    panic(fmt.Errorf("lane '%s': Concurrency must be greater than 0", name))
+  }
+  if conf.Queue < 0 {
+    conf.Queue = 0
+  }
+  if conf.MaxWait <= 0 {
+    conf.MaxWait = 10 * time.Second
+  }
+  t := &b.lanes
+  t.lock.Lock()
+  defer t.lock.Unlock()
+  if t.lanes == nil {
+    t.lanes = make(map[string]*lane)
+    b.Use(b.laneMiddleware)
+  }
+  if _, has := t.lanes[name]; has {
+    panic(fmt.Errorf("lane '%s' already defined", name))
+  }
+  t.lanes[name] = &lane{ name: name, conf: conf, slots: make(chan struct{}, conf.Concurrency) }
+}
+
+
+//
+// 把 path 路由放进通道 name, 通道必须已经用 DefineLane() 定义
+//
+func (b *Brick) RouteLane(path string, name string) {
+  t := &b.lanes
+  t.lock.Lock()
+  defer t.lock.Unlock()
+  if t.lanes[name] == nil {
+    panic(fmt.Errorf("lane '%s' is not defined", name))
+  }
+  if t.routes == nil {
+    t.routes = make(map[string]string)
+  }
+  t.routes[path] = name
+}
+
+
+//
+// 所有通道的状态, 按名字排序
+//
+func (b *Brick) Lanes() []LaneStatus {
+  t := &b.lanes
+  t.lock.RLock()
+  defer t.lock.RUnlock()
+  ret := make([]LaneStatus, 0, len(t.lanes))
+  for _, l := range t.lanes {
+    ret = append(ret, LaneStatus{
+      Name        : l.name,
+      Concurrency : l.conf.Concurrency,
+      InFlight    : int64(len(l.slots)),
+      Waiting     : atomic.LoadInt64(&l.waiting),
+      Rejected    : atomic.LoadUint64(&l.rejected),
+    })
+  }
+  sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+  return ret
+}
+
+
+func (b *Brick) laneOf(route string) *lane {
+  t := &b.lanes
+  t.lock.RLock()
+  defer t.lock.RUnlock()
+  name, has := t.routes[route]
+  if !has {
+    name = ""
+  }
+  return t.lanes[name]
+}
+
+
+func (b *Brick) laneMiddleware(next HttpHandler) HttpHandler {
+  return func(h *Http) error {
+    l := b.laneOf(h.rkey)
+    if l == nil {
+      return next(h)
+    }
+    if err := l.acquire(h); err != nil {
+      atomic.AddUint64(&l.rejected, 1)
+      b.metrics.Inc("brick_lane_rejected_total", "Requests rejected by a full lane.", "lane", l.name)
+      return err
+    }
+    defer func() { <-l.slots }()
+    return next(h)
+  }
+}
+
+
+//
+// 占用一个并发数, 没有空闲时排队等待
+//
+func (l *lane) acquire(h *Http) error {
+  select {
+  case l.slots <- struct{}{}:
+    return nil
+  default:
+  }
+
+  busy := func() error {
+    h.W.Header().Set("Retry-After", strconv.Itoa(int(l.conf.MaxWait.Seconds())))
+    return NewHttpError(http.StatusServiceUnavailable, "")
+  }
+  if atomic.AddInt64(&l.waiting, 1) > int64(l.conf.Queue) {
+    atomic.AddInt64(&l.waiting, -1)
+    return busy()
+  }
+  defer atomic.AddInt64(&l.waiting, -1)
+
+  t := time.NewTimer(l.conf.MaxWait)
+  defer t.Stop()
+  select {
+  case l.slots <- struct{}{}:
+    return nil
+  case <-t.C:
+    return busy()
+  case <-h.Ctx().Done():
+    return h.Ctx().Err()
+  }
+}
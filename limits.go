@@ -0,0 +1,95 @@
+package brick
+
+import (
+  "context"
+  "errors"
+  "net"
+  "net/http"
+  "time"
+)
+
+var (
+  // 请求处理超过 Config.RequestTimeout
+  ErrRequestTimeout = NewHttpError(http.StatusRequestTimeout, "")
+  // 请求体超过 Config.MaxBodyBytes
+  ErrBodyTooLarge   = NewHttpError(http.StatusRequestEntityTooLarge, "")
+)
+
+// 请求 ctx 中保存底层连接的键, 参考 newServer()
+type connKey struct{}
+
+
+//
+// 限制请求体大小和处理时间, 在 NewBrickConfig 中安装;
+// 超时通过 h.Ctx() 传递给处理函数, 处理函数应该在 Done() 后尽快返回.
+// ProxyMapping() 转发的协议升级和流式请求不限制处理时间.
+//
+func (b *Brick) requestLimitMiddleware(next HttpHandler) HttpHandler {
+  return func(h *Http) error {
+    if max := b.config.MaxBodyBytes; max > 0 && h.R.Body != nil {
+      h.R.Body = http.MaxBytesReader(h.W, h.R.Body, max)
+    }
+
+    timeout := b.config.RequestTimeout
+    if timeout <= 0 {
+      return limitError(h, next(h), nil)
+    }
+    if h.untimed() {
+      // 连接的读超时也来自 RequestTimeout, 到期时会取消请求的 ctx
+      if c, ok := h.R.Context().Value(connKey{}).(net.Conn); ok && h.R.ProtoMajor == 1 {
+        c.SetReadDeadline(time.Time{})
+      }
+      return limitError(h, next(h), nil)
+    }
+    ctx, cancel := context.WithTimeout(h.R.Context(), timeout)
+    defer cancel()
+    h.R = h.R.WithContext(ctx)
+    return limitError(h, next(h), ctx)
+  }
+}
+
+
+//
+// 把超时和请求体过大转换为 ErrRequestTimeout 和 ErrBodyTooLarge,
+// 处理函数没有返回错误并且已经输出了响应时不再报告超时;
+// HttpError 已经带有状态码 (例如代理超时的 504), 保持不变.
+//
+func limitError(h *Http, err error, ctx context.Context) error {
+  if err != nil {
+    var he *HttpError
+    if errors.As(err, &he) {
+      return err
+    }
+    var mbe *http.MaxBytesError
+    if errors.As(err, &mbe) {
+      return ErrBodyTooLarge
+    }
+  }
+  if ctx != nil && ctx.Err() == context.DeadlineExceeded {
+    if errors.Is(err, context.DeadlineExceeded) || (err == nil && !h.written()) {
+      return ErrRequestTimeout
+    }
+  }
+  return err
+}
+
+
+//
+// 请求是否不受 Config.RequestTimeout 限制, 参考 ProxyMapping()
+//
+func (h *Http) untimed() bool {
+  rt := h.rt
+  return rt != nil && rt.untimed != nil && rt.untimed(h.R)
+}
+
+
+//
+// 是否已经向客户端输出过响应头
+//
+func (h *Http) written() bool {
+  if rw, ok := h.W.(*responseWriter); ok {
+    return rw.Written()
+  }
+  return false
+}
+
@@ -0,0 +1,431 @@
+package brick
+
+import (
+  "context"
+  "errors"
+  "net"
+  "net/http"
+  "os"
+  "os/signal"
+  "strconv"
+  "strings"
+  "sync"
+  "syscall"
+  "time"
+)
+
+//
+// 一个监听地址, 参考 Listen() 和 ListenTLS()
+//
+type listener struct {
+  network  string
+  addr     string
+  certFile string
+  keyFile  string
+  server   *http.Server
+  // 实际绑定的地址, 参考 Brick.Addrs()
+  bound    net.Addr
+}
+
+//
+// 服务监听的状态, 所有监听共享 Brick 的路由
+//
+type listeners struct {
+  lock    sync.Mutex
+  list    []*listener
+  running bool
+  // 全部监听绑定之后调用, 参考 OnListen()
+  hooks   []func(addrs []net.Addr)
+}
+
+// Config.PortFallback 的值, 端口被占用时由系统分配端口
+const PortEphemeral = -1
+
+//
+// Run() 中每个监听地址的错误
+//
+type ListenError []error
+
+
+func (e ListenError) Error() string {
+  msg := make([]string, len(e))
+  for i, err := range e {
+    msg[i] = err.Error()
+  }
+  return "Listen: "+ strings.Join(msg, "; ")
+}
+
+
+//
+// 增加一个 http 监听地址, 例如 ":8080" 或 "unix:/run/app.sock";
+// 可以调用多次, 在 Run() 之前调用.
+//
+func (b *Brick) Listen(addr string) {
+  b.addListener(addr, "", "")
+}
+
+
+//
+// 增加一个 https 监听地址
+//
+func (b *Brick) ListenTLS(addr string, certFile string, keyFile string) {
+  b.addListener(addr, certFile, keyFile)
+}
+
+
+func (b *Brick) addListener(addr string, certFile string, keyFile string) {
+  network := "tcp"
+  if strings.HasPrefix(addr, "unix:") {
+    network = "unix"
+    addr = strings.TrimPrefix(addr, "unix:")
+  }
+  b.listen.lock.Lock()
+  defer b.listen.lock.Unlock()
+  b.listen.list = append(b.listen.list, &listener{
+    network  : network,
+    addr     : addr,
+    certFile : certFile,
+    keyFile  : keyFile,
+  })
+}
+
+
+//
+// 启动所有监听并阻塞, 没有调用过 Listen() 时监听 HttpPort.
+// 启动前检查配置, 启动 AddComponent() 注册的组件, 执行 OnStart() 注册的函数并打印启动报告
+// 和安全检查 (SecurityAudit()).
+// 任何一个监听出错, 或收到 SIGINT/SIGTERM, 或调用 Shutdown() 时
+// 所有监听一起优雅关闭; 正常关闭返回 nil, 否则返回 ListenError.
+// 需要命令行自检时在 Run() 之前调用 SelfTestMain().
+//
+func (b *Brick) Run() error {
+  if err := b.validate(); err != nil {
+    return err
+  }
+  if err := b.applyPolicy(); err != nil {
+    return err
+  }
+  b.listen.lock.Lock()
+  if b.listen.running {
+    b.listen.lock.Unlock()
+    return errors.New("brick is already running")
+  }
+  if len(b.listen.list) == 0 {
+    b.listen.list = append(b.listen.list, &listener{ network: "tcp", addr: ":"+ strconv.Itoa(b.HttpPort) })
+  }
+  list := b.listen.list
+  b.listen.running = true
+  b.listen.lock.Unlock()
+  b.resetStreams()
+
+  defer func() {
+    b.listen.lock.Lock()
+    b.listen.running = false
+    b.listen.lock.Unlock()
+  }()
+
+  if err := b.startComponents(context.Background()); err != nil {
+    return err
+  }
+  var ret ListenError
+  defer func() {
+    ctx, cancel := context.WithTimeout(context.Background(), b.shutdownTimeout())
+    defer cancel()
+    if err := b.stopComponents(ctx); err != nil {
+      b.log.Error(err)
+    }
+  }()
+
+  if err := b.runStartHooks(); err != nil {
+    return err
+  }
+  b.startupReport()
+  b.auditReport()
+  b.startHealthProbes()
+  b.startShedding()
+  go sweepTempDirs(b.log)
+  defer b.stopHealthProbes()
+  b.startShare()
+  defer b.stopShare()
+
+  // 先绑定全部地址, 任何一个失败都不开始服务
+  socks := make([]net.Listener, 0, len(list))
+  for _, l := range list {
+    s, err := l.bindFallback(b.config.PortFallback)
+    if err != nil {
+      for _, s := range socks {
+        s.Close()
+      }
+      return ListenError{ err }
+    }
+    socks = append(socks, s)
+  }
+  b.listen.lock.Lock()
+  for i, l := range list {
+    l.bound = socks[i].Addr()
+  }
+  hooks := b.listen.hooks
+  b.listen.lock.Unlock()
+  if tcp, ok := list[0].bound.(*net.TCPAddr); ok && list[0].network == "tcp" {
+    b.HttpPort = tcp.Port
+  }
+  for _, f := range hooks {
+    f(b.Addrs())
+  }
+
+  errs := make(chan error, len(list))
+  b.listen.lock.Lock()
+  for _, l := range list {
+    l.server = b.newServer()
+  }
+  b.listen.lock.Unlock()
+
+  for i, l := range list {
+    b.log.Info("Server on "+ l.url())
+    go func(l *listener, s net.Listener) {
+      var err error
+      if l.certFile != "" {
+        err = l.server.ServeTLS(s, l.certFile, l.keyFile)
+      } else {
+        err = l.server.Serve(s)
+      }
+      if err == http.ErrServerClosed {
+        err = nil
+      } else if err != nil {
+        err = errors.New(l.addr +": "+ err.Error())
+      }
+      errs <- err
+    }(l, socks[i])
+  }
+  b.startWarmer()
+  b.startJobs()
+
+  sig := make(chan os.Signal, 1)
+  signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+  defer signal.Stop(sig)
+
+  closing := false
+  // 所有 Serve() 都会因为关闭而返回, errs 有足够的缓冲, 可以在这里等待关闭完成
+  shutdown := func() {
+    if closing {
+      return
+    }
+    closing = true
+    ctx, cancel := context.WithTimeout(context.Background(), b.shutdownTimeout())
+    defer cancel()
+    if err := b.Shutdown(ctx); err != nil {
+      ret = append(ret, err)
+    }
+  }
+
+  for stopped := 0; stopped < len(list); {
+    select {
+    case s := <-sig:
+      b.log.Info("Shutdown on", s)
+      shutdown()
+    case err := <-errs:
+      stopped++
+      if err != nil {
+        ret = append(ret, err)
+        shutdown()
+      }
+    }
+  }
+  if len(ret) > 0 {
+    return ret
+  }
+  return nil
+}
+
+
+//
+// 优雅关闭所有监听和后台任务: 先通知 SSE/WebSocket 长连接并等待 Config.StreamGrace,
+// 然后不再接受新连接, 等待处理中的请求和任务结束或 ctx 到期
+//
+func (b *Brick) Shutdown(ctx context.Context) error {
+  b.listen.lock.Lock()
+  list := b.listen.list
+  b.listen.lock.Unlock()
+  b.drainStreams(ctx)
+
+  var wg sync.WaitGroup
+  var lock sync.Mutex
+  var ret ListenError
+  for _, l := range list {
+    if l.server == nil {
+      continue
+    }
+    wg.Add(1)
+    go func(l *listener) {
+      defer wg.Done()
+      if err := l.server.Shutdown(ctx); err != nil {
+        lock.Lock()
+        ret = append(ret, errors.New(l.addr +": "+ err.Error()))
+        lock.Unlock()
+      }
+    }(l)
+  }
+  wg.Wait()
+  if err := b.stopJobs(ctx); err != nil {
+    ret = append(ret, err)
+  }
+  b.stopHealthProbes()
+  b.stopShare()
+  b.stopShedding()
+  b.stopWarmer()
+  if len(ret) > 0 {
+    return ret
+  }
+  return nil
+}
+
+
+func (b *Brick) newServer() *http.Server {
+  server := &http.Server{
+    Handler           : b,
+    ReadHeaderTimeout : 30 * time.Second,
+    // 慢速客户端上传请求体的时间也受 RequestTimeout 限制
+    ReadTimeout       : b.config.RequestTimeout,
+    ConnContext       : func(ctx context.Context, c net.Conn) context.Context {
+      return context.WithValue(ctx, connKey{}, c)
+    },
+  }
+  enableH2C(server, b.config.H2C)
+  return server
+}
+
+
+func (b *Brick) shutdownTimeout() time.Duration {
+  if b.config.ShutdownTimeout > 0 {
+    return b.config.ShutdownTimeout
+  }
+  return 30 * time.Second
+}
+
+
+//
+// 端口被占用时按 Config.PortFallback 尝试后面的端口或由系统分配端口
+//
+func (l *listener) bindFallback(fallback int) (net.Listener, error) {
+  s, err := l.bind()
+  if err == nil || fallback == 0 || l.network != "tcp" || !errors.Is(err, syscall.EADDRINUSE) {
+    return s, err
+  }
+  host, portStr, e := net.SplitHostPort(l.addr)
+  if e != nil {
+    return nil, err
+  }
+  port, _ := strconv.Atoi(portStr)
+  if fallback == PortEphemeral {
+    return net.Listen("tcp", net.JoinHostPort(host, "0"))
+  }
+  for i := 1; i <= fallback && port + i <= 65535; i++ {
+    if s, e := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port + i))); e == nil {
+      return s, nil
+    }
+  }
+  return nil, err
+}
+
+
+//
+// 所有监听实际绑定的地址, Run() 绑定之前为空
+//
+func (b *Brick) Addrs() []net.Addr {
+  b.listen.lock.Lock()
+  defer b.listen.lock.Unlock()
+  var ret []net.Addr
+  for _, l := range b.listen.list {
+    if l.bound != nil {
+      ret = append(ret, l.bound)
+    }
+  }
+  return ret
+}
+
+
+//
+// 第一个监听实际绑定的地址, 例如 "127.0.0.1:8081"; Run() 绑定之前返回空字符串
+//
+func (b *Brick) Addr() string {
+  if addrs := b.Addrs(); len(addrs) > 0 {
+    return addrs[0].String()
+  }
+  return ""
+}
+
+
+//
+// 注册全部监听绑定之后调用的函数, 参数是实际的地址; 用于向服务发现或开发工具报告地址
+//
+func (b *Brick) OnListen(f func(addrs []net.Addr)) {
+  b.listen.lock.Lock()
+  defer b.listen.lock.Unlock()
+  b.listen.hooks = append(b.listen.hooks, f)
+}
+
+
+//
+// 监听地址; unix socket 文件如果是上次留下的则先删除
+//
+func (l *listener) bind() (net.Listener, error) {
+  if l.network == "unix" {
+    if st, err := os.Stat(l.addr); err == nil && st.Mode() & os.ModeSocket != 0 {
+      if c, err := net.Dial("unix", l.addr); err == nil {
+        c.Close()
+        return nil, errors.New(l.addr +": socket is in use")
+      }
+      os.Remove(l.addr)
+    }
+  }
+  s, err := net.Listen(l.network, l.addr)
+  if err != nil {
+    return nil, err
+  }
+  return s, nil
+}
+
+
+func (l *listener) url() string {
+  scheme := "http"
+  if l.certFile != "" {
+    scheme = "https"
+  }
+  if l.network == "unix" {
+    return scheme +"+unix://"+ l.addr
+  }
+  host := l.addr
+  if l.bound != nil {
+    host = l.bound.String()
+    if h, p, err := net.SplitHostPort(host); err == nil && net.ParseIP(h).IsUnspecified() {
+      host = ":"+ p
+    }
+  }
+  if strings.HasPrefix(host, ":") {
+    host = "localhost"+ host
+  }
+  return scheme +"://"+ host
+}
+
+
+func (b *Brick) listenReport() string {
+  b.listen.lock.Lock()
+  defer b.listen.lock.Unlock()
+  urls := make([]string, len(b.listen.list))
+  for i, l := range b.listen.list {
+    urls[i] = l.url()
+  }
+  return strings.Join(urls, ", ")
+}
+
+
+func (b *Brick) listenTLS() bool {
+  b.listen.lock.Lock()
+  defer b.listen.lock.Unlock()
+  for _, l := range b.listen.list {
+    if l.certFile != "" {
+      return true
+    }
+  }
+  return false
+}
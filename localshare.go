@@ -0,0 +1,410 @@
+package brick
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "errors"
+  "net"
+  "os"
+  "sync"
+  "syscall"
+  "time"
+)
+
+// 向中心取令牌的最长等待时间, 超时使用本进程的令牌桶
+const shareTimeout = 100 * time.Millisecond
+
+// 中心检查 socket 文件是否还属于自己的间隔
+const shareCheckInterval = 5 * time.Second
+
+//
+// 本机进程之间的消息, 每行一个 json
+//
+type shareMsg struct {
+  // "take" 取令牌, "took" 回复, "tags" 按标签清除缓存, "purge" 按前缀清除缓存
+  Op    string   `json:"op"`
+  ID    uint64   `json:"id,omitempty"`
+  Lim   string   `json:"lim,omitempty"`
+  Key   string   `json:"key,omitempty"`
+  N     float64  `json:"n,omitempty"`
+  Rate  float64  `json:"rate,omitempty"`
+  Burst int      `json:"burst,omitempty"`
+  OK    bool     `json:"ok,omitempty"`
+  Wait  int64    `json:"wait,omitempty"`
+  Args  []string `json:"args,omitempty"`
+}
+
+type sharePeer struct {
+  conn  net.Conn
+  wlock sync.Mutex
+}
+
+//
+// 本机共享的状态: 第一个进程监听 unix socket 成为中心, 保存所有进程的令牌桶并转发缓存清除;
+// 其他进程连接中心, 中心退出后重新选出中心.
+//
+type localShare struct {
+  lock   sync.Mutex
+  path   string
+  cancel context.CancelFunc
+  done   chan struct{}
+  // 作为中心时的连接和令牌桶
+  hub    bool
+  peers  map[*sharePeer]bool
+  limits map[string]*limiter
+  // 作为客户端时的连接和等待回复的请求
+  client *sharePeer
+  nextID uint64
+  waits  map[uint64]chan shareMsg
+}
+
+
+//
+// 同一台机器上的多个进程通过 unix socket 共享限流的令牌桶 (Config.RateLimit 和 RateLimit())
+// 和缓存清除 (Cache.PurgeTag() 和 Cache.Purge()), 不需要 redis. 所有进程使用相同的 path,
+// 第一个启动的进程负责保存状态, 它退出后其他进程自动接替. 在 Run() 时开始.
+// socket 文件的权限是 0600, 所有进程应以同一用户运行. 连接不可用时限流使用本进程的令牌桶.
+//
+//   b.ShareLocal("/run/myapp/brick.sock")
+//
+func (b *Brick) ShareLocal(path string) {
+  b.share.lock.Lock()
+  defer b.share.lock.Unlock()
+  b.share.path = path
+}
+
+
+//
+// 由 Run() 调用
+//
+func (b *Brick) startShare() {
+  s := &b.share
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  if s.path == "" || s.cancel != nil {
+    return
+  }
+  ctx, cancel := context.WithCancel(context.Background())
+  s.cancel, s.done = cancel, make(chan struct{})
+  b.cache.setShare(b.shareCache)
+  go b.shareLoop(ctx, s.done)
+}
+
+
+func (b *Brick) stopShare() {
+  s := &b.share
+  s.lock.Lock()
+  cancel, done := s.cancel, s.done
+  s.cancel, s.done = nil, nil
+  s.lock.Unlock()
+  if cancel != nil {
+    b.cache.setShare(nil)
+    cancel()
+    <-done
+  }
+}
+
+
+//
+// 连接中心, 没有中心时自己成为中心, 直到 ctx 结束
+//
+func (b *Brick) shareLoop(ctx context.Context, done chan struct{}) {
+  defer close(done)
+  log := b.Logger(LogShare)
+  s := &b.share
+  for ctx.Err() == nil {
+    conn, err := net.Dial("unix", s.path)
+    if err == nil {
+      log.Debug("Connected to", s.path)
+      b.shareClient(ctx, conn)
+      continue
+    }
+    if errors.Is(err, syscall.ECONNREFUSED) {
+      // 中心异常退出留下的 socket 文件
+      os.Remove(s.path)
+    }
+    ln, err := net.Listen("unix", s.path)
+    if err != nil {
+      log.Debug("Share", err)
+      select {
+      case <-ctx.Done():
+      case <-time.After(time.Second):
+      }
+      continue
+    }
+    // 只允许同一用户的进程连接, 其他用户可以清除缓存或耗尽令牌
+    if err := os.Chmod(s.path, 0600); err != nil {
+      log.Warn("Share", err)
+      ln.Close()
+      select {
+      case <-ctx.Done():
+      case <-time.After(time.Second):
+      }
+      continue
+    }
+    log.Info("Sharing state on", s.path)
+    b.shareHub(ctx, ln)
+  }
+}
+
+
+//
+// 作为中心接受其他进程的连接, socket 文件被替换时退出
+//
+func (b *Brick) shareHub(ctx context.Context, ln net.Listener) {
+  s := &b.share
+  st, _ := os.Stat(s.path)
+  s.lock.Lock()
+  s.hub = true
+  s.peers = make(map[*sharePeer]bool)
+  if s.limits == nil {
+    s.limits = make(map[string]*limiter)
+  }
+  s.lock.Unlock()
+
+  stop := make(chan struct{})
+  go func() {
+    t := time.NewTicker(shareCheckInterval)
+    defer t.Stop()
+    for {
+      select {
+      case <-ctx.Done():
+      case <-t.C:
+        if now, err := os.Stat(s.path); err == nil && st != nil && os.SameFile(st, now) {
+          continue
+        }
+        b.Logger(LogShare).Warn("Socket file replaced, stop sharing on", s.path)
+      case <-stop:
+        return
+      }
+      ln.Close()
+      return
+    }
+  }()
+
+  for {
+    conn, err := ln.Accept()
+    if err != nil {
+      break
+    }
+    p := &sharePeer{ conn: conn }
+    s.lock.Lock()
+    s.peers[p] = true
+    s.lock.Unlock()
+    go b.shareServe(p)
+  }
+  close(stop)
+  ln.Close()
+
+  s.lock.Lock()
+  s.hub = false
+  peers := s.peers
+  s.peers = nil
+  s.lock.Unlock()
+  for p := range peers {
+    p.conn.Close()
+  }
+  if ctx.Err() != nil {
+    os.Remove(s.path)
+  }
+}
+
+
+//
+// 中心处理一个进程的消息
+//
+func (b *Brick) shareServe(p *sharePeer) {
+  s := &b.share
+  defer func() {
+    p.conn.Close()
+    s.lock.Lock()
+    delete(s.peers, p)
+    s.lock.Unlock()
+  }()
+  sc := bufio.NewScanner(p.conn)
+  sc.Buffer(nil, 1 << 20)
+  for sc.Scan() {
+    var m shareMsg
+    if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+      b.Logger(LogShare).Warn("Bad share message", err)
+      return
+    }
+    switch m.Op {
+    case "take":
+      ok, wait := s.hubTake(m.Lim, m.Key, m.N, m.Rate, m.Burst)
+      p.send(shareMsg{ Op: "took", ID: m.ID, OK: ok, Wait: int64(wait) })
+    case "tags", "purge":
+      b.applyShared(m)
+      s.broadcast(m, p)
+    }
+  }
+}
+
+
+//
+// 作为客户端连接中心, 接收回复和其他进程的缓存清除, 连接断开时返回
+//
+func (b *Brick) shareClient(ctx context.Context, conn net.Conn) {
+  s := &b.share
+  p := &sharePeer{ conn: conn }
+  s.lock.Lock()
+  s.client = p
+  s.waits = make(map[uint64]chan shareMsg)
+  s.lock.Unlock()
+
+  stop := make(chan struct{})
+  go func() {
+    select {
+    case <-ctx.Done():
+      conn.Close()
+    case <-stop:
+    }
+  }()
+
+  sc := bufio.NewScanner(conn)
+  sc.Buffer(nil, 1 << 20)
+  for sc.Scan() {
+    var m shareMsg
+    if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+      break
+    }
+    switch m.Op {
+    case "took":
+      s.lock.Lock()
+      ch := s.waits[m.ID]
+      delete(s.waits, m.ID)
+      s.lock.Unlock()
+      if ch != nil {
+        ch <- m
+      }
+    case "tags", "purge":
+      b.applyShared(m)
+    }
+  }
+  close(stop)
+  conn.Close()
+
+  s.lock.Lock()
+  s.client = nil
+  s.waits = nil
+  s.lock.Unlock()
+}
+
+
+func (p *sharePeer) send(m shareMsg) error {
+  buf, err := json.Marshal(m)
+  if err != nil {
+    return err
+  }
+  p.wlock.Lock()
+  defer p.wlock.Unlock()
+  p.conn.SetWriteDeadline(time.Now().Add(time.Second))
+  _, err = p.conn.Write(append(buf, '\n'))
+  return err
+}
+
+
+//
+// 中心把消息发给 from 之外的所有进程
+//
+func (s *localShare) broadcast(m shareMsg, from *sharePeer) {
+  s.lock.Lock()
+  peers := make([]*sharePeer, 0, len(s.peers))
+  for p := range s.peers {
+    if p != from {
+      peers = append(peers, p)
+    }
+  }
+  s.lock.Unlock()
+  for _, p := range peers {
+    p.send(m)
+  }
+}
+
+
+func (s *localShare) hubTake(name string, key string, n float64,
+    rate float64, burst int) (bool, time.Duration) {
+  s.lock.Lock()
+  // 每个 key 的额度 (参考 RateLimit.KeyBudget) 保存在自己的令牌桶中, 不重建限流器
+  l := s.limits[name]
+  if l == nil {
+    l = newLimiter(name, RateLimit{ Rate: rate, Burst: burst })
+    s.limits[name] = l
+  }
+  s.lock.Unlock()
+  return l.take(key, n, time.Now(), rate, burst)
+}
+
+
+//
+// 从共享的令牌桶取令牌, 没有开启共享或中心不可用时使用 l 本身
+//
+func (b *Brick) takeToken(l *limiter, key string, n float64, now time.Time,
+    rate float64, burst int) (bool, time.Duration) {
+  s := &b.share
+  s.lock.Lock()
+  if s.hub {
+    s.lock.Unlock()
+    return s.hubTake(l.name, key, n, rate, burst)
+  }
+  p := s.client
+  if p == nil {
+    s.lock.Unlock()
+    return l.take(key, n, now, rate, burst)
+  }
+  s.nextID++
+  id := s.nextID
+  ch := make(chan shareMsg, 1)
+  s.waits[id] = ch
+  s.lock.Unlock()
+
+  err := p.send(shareMsg{ Op: "take", ID: id, Lim: l.name, Key: key, N: n, Rate: rate, Burst: burst })
+  if err == nil {
+    t := time.NewTimer(shareTimeout)
+    defer t.Stop()
+    select {
+    case m := <-ch:
+      return m.OK, time.Duration(m.Wait)
+    case <-t.C:
+    }
+  }
+  s.lock.Lock()
+  if s.waits != nil {
+    delete(s.waits, id)
+  }
+  s.lock.Unlock()
+  return l.take(key, n, now, rate, burst)
+}
+
+
+//
+// 本进程清除了缓存, 通知其他进程
+//
+func (b *Brick) shareCache(op string, args []string) {
+  s := &b.share
+  m := shareMsg{ Op: op, Args: args }
+  s.lock.Lock()
+  hub, p := s.hub, s.client
+  s.lock.Unlock()
+  if hub {
+    s.broadcast(m, nil)
+  } else if p != nil {
+    p.send(m)
+  }
+}
+
+
+//
+// 执行其他进程的缓存清除, 不再通知 CDN 和其他进程
+//
+func (b *Brick) applyShared(m shareMsg) {
+  switch m.Op {
+  case "tags":
+    b.cache.purgeTags(m.Args, false)
+  case "purge":
+    for _, prefix := range m.Args {
+      b.cache.pageStore().DeletePrefix(prefix)
+    }
+  }
+}
@@ -0,0 +1,266 @@
+package brick
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "fmt"
+  "strings"
+  "sync"
+)
+
+//
+// 日志级别, 低于设置级别的日志被丢弃, 参考 Brick.SetLogLevel()
+//
+type LogLevel int
+
+const (
+  LevelDebug LogLevel = iota
+  LevelInfo
+  LevelWarn
+  LevelError
+)
+
+//
+// 日志组件, 每个组件可以单独设置级别
+//
+const (
+  LogTemplate = "template"
+  LogStatic   = "static"
+  LogSession  = "session"
+  // 服务的访问日志
+  LogAccess   = "access"
+  // 超过预算的请求, 参考 Brick.RequestBudget()
+  LogBudget   = "budget"
+  // 弃用路由的调用, 参考 Route.Deprecate()
+  LogDeprecated = "deprecated"
+  // 本机进程之间的共享, 参考 Brick.ShareLocal()
+  LogShare      = "share"
+  // 浏览器发送的 CSP, NEL 和 js 错误报告, 参考 Brick.ClientReports()
+  LogClient     = "client"
+)
+
+//
+// 支持附加字段的日志, 例如 slog 的适配器; 不支持时字段以 "k=v" 文本加在消息前
+//
+type FieldLogger interface {
+  Logger
+  // 返回带有 kv 字段的日志, kv 是交替的名字和值
+  With(kv ...interface{}) Logger
+}
+
+type logLevels struct {
+  lock  sync.RWMutex
+  min   LogLevel
+  comps map[string]LogLevel
+}
+
+
+//
+// 解析 "debug", "info", "warn", "error"
+//
+func ParseLogLevel(s string) (LogLevel, error) {
+  switch strings.ToLower(s) {
+  case "debug":
+    return LevelDebug, nil
+  case "info":
+    return LevelInfo, nil
+  case "warn", "warning":
+    return LevelWarn, nil
+  case "error":
+    return LevelError, nil
+  }
+  return 0, fmt.Errorf("unknown log level '%s'", s)
+}
+
+
+func (l LogLevel) String() string {
+  switch l {
+  case LevelDebug:
+    return "debug"
+  case LevelInfo:
+    return "info"
+  case LevelWarn:
+    return "warn"
+  case LevelError:
+    return "error"
+  }
+  return fmt.Sprint("level(", int(l), ")")
+}
+
+
+//
+// 设置日志级别, component 为空设置全局级别, 否则设置 LogAccess 等组件的级别,
+// 例如生产环境 b.SetLogLevel("", brick.LevelInfo), b.SetLogLevel(brick.LogStatic, brick.LevelWarn)
+//
+func (b *Brick) SetLogLevel(component string, level LogLevel) {
+  b.levels.lock.Lock()
+  defer b.levels.lock.Unlock()
+  if component == "" {
+    b.levels.min = level
+    return
+  }
+  if b.levels.comps == nil {
+    b.levels.comps = make(map[string]LogLevel)
+  }
+  b.levels.comps[component] = level
+}
+
+
+func (b *Brick) logEnabled(component string, level LogLevel) bool {
+  b.levels.lock.RLock()
+  defer b.levels.lock.RUnlock()
+  if l, has := b.levels.comps[component]; has {
+    return level >= l
+  }
+  return level >= b.levels.min
+}
+
+
+//
+// 返回组件的日志, 消息带有组件标签并按组件的级别过滤
+//
+func (b *Brick) Logger(component string) Logger {
+  return &levelLogger{ b: b, comp: component }
+}
+
+
+//
+// 按级别过滤并加上组件标签, 输出到 SetLogger() 设置的日志;
+// comp 为空时是 Brick 自己的日志
+//
+type levelLogger struct {
+  b      *Brick
+  comp   string
+  fields []interface{}
+}
+
+
+func (l *levelLogger) out() Logger {
+  out := l.b.logOut
+  fields := l.fields
+  if l.comp != "" {
+    fields = append([]interface{}{ "component", l.comp }, fields...)
+  }
+  if len(fields) == 0 {
+    return out
+  }
+  if fl, ok := out.(FieldLogger); ok {
+    return fl.With(fields...)
+  }
+  return &prefixLogger{ out: out, prefix: textFields(l.comp, l.fields) }
+}
+
+
+func (l *levelLogger) Debug(v ...interface{}) {
+  if l.b.logEnabled(l.comp, LevelDebug) {
+    l.out().Debug(v...)
+  }
+}
+
+
+func (l *levelLogger) Info(v ...interface{}) {
+  if l.b.logEnabled(l.comp, LevelInfo) {
+    l.out().Info(v...)
+  }
+}
+
+
+func (l *levelLogger) Warn(v ...interface{}) {
+  if l.b.logEnabled(l.comp, LevelWarn) {
+    l.out().Warn(v...)
+  }
+}
+
+
+func (l *levelLogger) Error(v ...interface{}) {
+  if l.b.logEnabled(l.comp, LevelError) {
+    l.out().Error(v...)
+  }
+}
+
+
+func (l *levelLogger) Fmt(f string, v ...interface{}) {
+  if l.b.logEnabled(l.comp, LevelInfo) {
+    l.out().Fmt(f, v...)
+  }
+}
+
+
+func (l *levelLogger) With(kv ...interface{}) Logger {
+  fields := append(append([]interface{}{}, l.fields...), kv...)
+  return &levelLogger{ b: l.b, comp: l.comp, fields: fields }
+}
+
+
+//
+// 不支持字段的日志, 字段作为文本前缀
+//
+type prefixLogger struct {
+  out    Logger
+  prefix string
+}
+
+
+func (p *prefixLogger) Debug(v ...interface{}) { p.out.Debug(append([]interface{}{ p.prefix }, v...)...) }
+func (p *prefixLogger) Info(v ...interface{})  { p.out.Info(append([]interface{}{ p.prefix }, v...)...) }
+func (p *prefixLogger) Warn(v ...interface{})  { p.out.Warn(append([]interface{}{ p.prefix }, v...)...) }
+func (p *prefixLogger) Error(v ...interface{}) { p.out.Error(append([]interface{}{ p.prefix }, v...)...) }
+func (p *prefixLogger) Fmt(f string, v ...interface{}) { p.out.Fmt("%s "+ f, append([]interface{}{ p.prefix }, v...)...) }
+
+
+//
+// "[access] method=GET path=/a"
+//
+func textFields(comp string, kv []interface{}) string {
+  var parts []string
+  if comp != "" {
+    parts = append(parts, "["+ comp +"]")
+  }
+  for i := 0; i+1 < len(kv); i += 2 {
+    parts = append(parts, fmt.Sprint(kv[i], "=", kv[i+1]))
+  }
+  return strings.Join(parts, " ")
+}
+
+
+//
+// 当前请求的日志, 带有 method, path 和 request_id 字段
+//
+func (h *Http) Log() Logger {
+  return (&levelLogger{ b: h.b }).With("method", h.R.Method, "path", h.R.URL.Path, "request_id", h.RequestID())
+}
+
+
+//
+// 请求的 ID: 可信代理传来的 X-Request-Id, 否则随机生成; 同时在响应头 X-Request-Id 中返回
+//
+func (h *Http) RequestID() string {
+  if h.reqID == "" {
+    h.reqID = h.b.requestID(h)
+    if !h.written() {
+      h.W.Header().Set("X-Request-Id", h.reqID)
+    }
+  }
+  return h.reqID
+}
+
+
+func (b *Brick) requestID(h *Http) string {
+  if id := h.R.Header.Get("X-Request-Id"); id != "" && len(id) <= 64 &&
+      len(b.trusted) > 0 && b.trusted.contains(remoteIP(h.R)) && validRequestID(id) {
+    return id
+  }
+  var buf [8]byte
+  rand.Read(buf[:])
+  return hex.EncodeToString(buf[:])
+}
+
+
+func validRequestID(id string) bool {
+  for _, c := range id {
+    if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+      return false
+    }
+  }
+  return true
+}
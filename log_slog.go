@@ -0,0 +1,49 @@
+//go:build go1.21
+
+package brick
+
+import (
+  "context"
+  "fmt"
+  "log/slog"
+  "strings"
+)
+
+//
+// 把 slog.Logger 适配为 Logger, 组件和请求的字段成为 slog 的属性:
+//
+//   b.SetLogger(brick.NewSlogLogger(slog.New(slog.NewJSONHandler(os.Stdout, nil))))
+//
+// 级别过滤由 Brick.SetLogLevel() 完成, handler 的级别同样有效.
+//
+func NewSlogLogger(l *slog.Logger) Logger {
+  return &slogLogger{ l: l }
+}
+
+type slogLogger struct {
+  l *slog.Logger
+}
+
+
+func (s *slogLogger) log(level slog.Level, v []interface{}) {
+  if !s.l.Enabled(context.Background(), level) {
+    return
+  }
+  s.l.Log(context.Background(), level, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+
+func (s *slogLogger) Debug(v ...interface{}) { s.log(slog.LevelDebug, v) }
+func (s *slogLogger) Info(v ...interface{})  { s.log(slog.LevelInfo, v) }
+func (s *slogLogger) Warn(v ...interface{})  { s.log(slog.LevelWarn, v) }
+func (s *slogLogger) Error(v ...interface{}) { s.log(slog.LevelError, v) }
+
+
+func (s *slogLogger) Fmt(f string, v ...interface{}) {
+  s.l.Info(fmt.Sprintf(f, v...))
+}
+
+
+func (s *slogLogger) With(kv ...interface{}) Logger {
+  return &slogLogger{ l: s.l.With(kv...) }
+}
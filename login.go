@@ -0,0 +1,104 @@
+package brick
+
+import (
+  "net/http"
+  "net/url"
+  "strings"
+  "time"
+)
+
+// 保存登录前请求的地址的 cookie, 参考 LoginRequired()
+const returnToCookie = "brick_return_to"
+
+// 登录前地址的有效期, 超过后登录成功跳转到默认页面
+const returnToExp = 15 * time.Minute
+
+
+
+//
+// 返回要求登录的中间件, loggedIn 返回 false 时: 浏览器的 GET 请求保存当前地址
+// (签名并加密的 cookie, 15 分钟有效) 并跳转到 loginURL, 其他请求返回 401.
+// loggedIn 为 nil 时检查 h.User(). 登录成功后用 h.RedirectAfterLogin() 跳回原来的地址:
+//
+//   app := b.Group("/app", b.LoginRequired("/login", func(h *brick.Http) bool {
+//     return h.Session().Get("user") != nil
+//   }))
+//   b.Service("/login", func(h *brick.Http) error {
+//     ... 验证密码, 设置会话
+//     h.RedirectAfterLogin("/app/")
+//     return nil
+//   })
+//
+func (b *Brick) LoginRequired(loginURL string, loggedIn func(h *Http) bool) Middleware {
+  if loggedIn == nil {
+    loggedIn = func(h *Http) bool { return h.User() != nil }
+  }
+  loginPath := loginURL
+  if u, err := url.Parse(loginURL); err == nil {
+    loginPath = u.Path
+  }
+
+  return func(next HttpHandler) HttpHandler {
+    return func(h *Http) error {
+      if h.R.URL.Path == loginPath || loggedIn(h) {
+        return next(h)
+      }
+      get := h.R.Method == http.MethodGet || h.R.Method == http.MethodHead
+      if !get || !h.WantsHTML() {
+        return ErrUnauthorized
+      }
+      if to := h.R.URL.RequestURI(); IsLocalRedirect(to) {
+        if err := h.SetSecureCookie(returnToCookie, to, returnToOptions(h)); err != nil {
+          h.b.log.Warn("Save login return url", err)
+        }
+      }
+      h.CacheTime(0)
+      h.Redirect(http.StatusFound, loginURL)
+      return nil
+    }
+  }
+}
+
+
+//
+// 登录成功后跳转到 LoginRequired() 保存的地址, 没有保存, 已经过期或不是本站的地址时
+// 跳转到 fallback. 使用 303, 登录表单的 POST 之后浏览器用 GET 请求新地址.
+//
+func (h *Http) RedirectAfterLogin(fallback string) {
+  to := fallback
+  opt := returnToOptions(h)
+  var saved string
+  if err := h.GetSecureCookie(returnToCookie, &saved, opt); err == nil && IsLocalRedirect(saved) {
+    to = saved
+  }
+  if _, err := h.R.Cookie(returnToCookie); err == nil {
+    h.DeleteCookie(returnToCookie, opt)
+  }
+  h.CacheTime(0)
+  h.Redirect(http.StatusSeeOther, to)
+}
+
+
+func returnToOptions(h *Http) *CookieOptions {
+  o := cookieDefaults(h.R, nil)
+  o.MaxAge = returnToExp
+  return &o
+}
+
+
+//
+// u 是本站的路径, 可以安全地用作跳转地址: 以 "/" 开头, 不是 "//host" 或 "/\host",
+// 不含控制字符和反斜杠 (浏览器会忽略制表符和换行, 把 "\" 当作 "/")
+//
+func IsLocalRedirect(u string) bool {
+  if !strings.HasPrefix(u, "/") || strings.HasPrefix(u, "//") {
+    return false
+  }
+  for i := 0; i < len(u); i++ {
+    if c := u[i]; c < 0x20 || c == 0x7f || c == '\\' {
+      return false
+    }
+  }
+  p, err := url.Parse(u)
+  return err == nil && p.Scheme == "" && p.Host == ""
+}
@@ -0,0 +1,338 @@
+package brick
+
+import (
+  "bytes"
+  "fmt"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+//
+// 请求耗时直方图的默认分桶, 单位秒
+//
+var DefaultLatencyBuckets = []float64{
+  0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+//
+// 请求计数, 耗时和模板缓存统计, 以 Prometheus 文本格式输出,
+// 其他组件可以通过 Inc() 和 Gauge() 添加自己的指标.
+//
+type Metrics struct {
+  lock      sync.Mutex
+  buckets   []float64
+  routes    map[string]*routeMetrics
+  templates map[string]*templateMetrics
+  counters  map[string]*counterFamily
+  gauges    map[string]*gaugeFamily
+  inFlight  int64
+  start     time.Time
+}
+
+type routeMetrics struct {
+  codes    map[int]uint64
+  buckets  []uint64
+  sum      float64
+  count    uint64
+  inFlight int64
+}
+
+type templateMetrics struct {
+  hit  uint64
+  miss uint64
+}
+
+type counterFamily struct {
+  help   string
+  values map[string]float64
+}
+
+type gaugeFamily struct {
+  help string
+  fn   func() float64
+}
+
+
+func newMetrics() *Metrics {
+  return &Metrics{
+    buckets   : DefaultLatencyBuckets,
+    routes    : make(map[string]*routeMetrics),
+    templates : make(map[string]*templateMetrics),
+    counters  : make(map[string]*counterFamily),
+    gauges    : make(map[string]*gaugeFamily),
+    start     : time.Now(),
+  }
+}
+
+
+//
+// 开启指标统计并在 path 上输出, 返回的对象可以添加自定义指标
+//
+func (b *Brick) EnableMetrics(path string) *Metrics {
+  if b.metrics == nil {
+    b.metrics = newMetrics()
+    b.shedGauge()
+  }
+  m := b.metrics
+  b.Service(path, func(h *Http) error {
+    h.W.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    h.CacheTime(0)
+    _, err := h.W.Write(m.Render())
+    return err
+  })
+  return m
+}
+
+
+//
+// 返回指标对象, 没有调用 EnableMetrics() 返回 nil
+//
+func (b *Brick) Metrics() *Metrics {
+  return b.metrics
+}
+
+
+//
+// 设置耗时直方图的分桶, 必须在处理请求之前调用
+//
+func (m *Metrics) SetBuckets(buckets ...float64) {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  sort.Float64s(buckets)
+  m.buckets = buckets
+  m.routes = make(map[string]*routeMetrics)
+}
+
+
+//
+// 计数器 name 加 1, labels 是成对的标签名和值
+//
+func (m *Metrics) Inc(name string, help string, labels ...string) {
+  m.Add(name, help, 1, labels...)
+}
+
+
+//
+// 计数器 name 加 delta, labels 是成对的标签名和值
+//
+func (m *Metrics) Add(name string, help string, delta float64, labels ...string) {
+  if m == nil {
+    return
+  }
+  key := formatLabels(labels...)
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  c := m.counters[name]
+  if c == nil {
+    c = &counterFamily{ help: help, values: make(map[string]float64) }
+    m.counters[name] = c
+  }
+  c.values[key] += delta
+}
+
+
+//
+// 注册一个输出时才求值的仪表盘指标
+//
+func (m *Metrics) Gauge(name string, help string, fn func() float64) {
+  if m == nil {
+    return
+  }
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  m.gauges[name] = &gaugeFamily{ help: help, fn: fn }
+}
+
+
+func (m *Metrics) route(path string) *routeMetrics {
+  r := m.routes[path]
+  if r == nil {
+    r = &routeMetrics{
+      codes   : make(map[int]uint64),
+      buckets : make([]uint64, len(m.buckets)),
+    }
+    m.routes[path] = r
+  }
+  return r
+}
+
+
+func (m *Metrics) begin(path string) {
+  atomic.AddInt64(&m.inFlight, 1)
+  m.lock.Lock()
+  m.route(path).inFlight++
+  m.lock.Unlock()
+}
+
+
+func (m *Metrics) end(path string, code int, begin time.Time) {
+  atomic.AddInt64(&m.inFlight, -1)
+  sec := time.Since(begin).Seconds()
+  if code == 0 {
+    code = http.StatusOK
+  }
+
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  r := m.route(path)
+  r.inFlight--
+  r.codes[code]++
+  r.count++
+  r.sum += sec
+  for i, le := range m.buckets {
+    if sec <= le {
+      r.buckets[i]++
+    }
+  }
+}
+
+
+func (m *Metrics) templateCache(fileName string, hit bool) {
+  if m == nil {
+    return
+  }
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  t := m.templates[fileName]
+  if t == nil {
+    t = &templateMetrics{}
+    m.templates[fileName] = t
+  }
+  if hit {
+    t.hit++
+  } else {
+    t.miss++
+  }
+}
+
+
+//
+// 以 Prometheus 文本格式输出全部指标
+//
+func (m *Metrics) Render() []byte {
+  m.lock.Lock()
+  var buf bytes.Buffer
+
+  routes := make([]string, 0, len(m.routes))
+  for p := range m.routes {
+    routes = append(routes, p)
+  }
+  sort.Strings(routes)
+
+  writeMetricHead(&buf, "brick_requests_total", "counter", "Total HTTP requests by route and status code.")
+  for _, p := range routes {
+    r := m.routes[p]
+    codes := make([]int, 0, len(r.codes))
+    for c := range r.codes {
+      codes = append(codes, c)
+    }
+    sort.Ints(codes)
+    for _, c := range codes {
+      fmt.Fprintf(&buf, "brick_requests_total%s %d\n",
+        formatLabels("route", p, "code", strconv.Itoa(c)), r.codes[c])
+    }
+  }
+
+  writeMetricHead(&buf, "brick_request_duration_seconds", "histogram", "HTTP request latency by route.")
+  for _, p := range routes {
+    r := m.routes[p]
+    for i, le := range m.buckets {
+      fmt.Fprintf(&buf, "brick_request_duration_seconds_bucket%s %d\n",
+        formatLabels("route", p, "le", strconv.FormatFloat(le, 'g', -1, 64)), r.buckets[i])
+    }
+    fmt.Fprintf(&buf, "brick_request_duration_seconds_bucket%s %d\n",
+      formatLabels("route", p, "le", "+Inf"), r.count)
+    fmt.Fprintf(&buf, "brick_request_duration_seconds_sum%s %g\n", formatLabels("route", p), r.sum)
+    fmt.Fprintf(&buf, "brick_request_duration_seconds_count%s %d\n", formatLabels("route", p), r.count)
+  }
+
+  writeMetricHead(&buf, "brick_requests_in_flight", "gauge", "HTTP requests being served.")
+  fmt.Fprintf(&buf, "brick_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+  for _, p := range routes {
+    fmt.Fprintf(&buf, "brick_requests_in_flight%s %d\n", formatLabels("route", p), m.routes[p].inFlight)
+  }
+
+  tpls := make([]string, 0, len(m.templates))
+  for t := range m.templates {
+    tpls = append(tpls, t)
+  }
+  sort.Strings(tpls)
+  writeMetricHead(&buf, "brick_template_cache_total", "counter", "Template cache lookups by result.")
+  for _, t := range tpls {
+    fmt.Fprintf(&buf, "brick_template_cache_total%s %d\n",
+      formatLabels("template", t, "result", "hit"), m.templates[t].hit)
+    fmt.Fprintf(&buf, "brick_template_cache_total%s %d\n",
+      formatLabels("template", t, "result", "miss"), m.templates[t].miss)
+  }
+
+  names := make([]string, 0, len(m.counters))
+  for n := range m.counters {
+    names = append(names, n)
+  }
+  sort.Strings(names)
+  for _, n := range names {
+    c := m.counters[n]
+    writeMetricHead(&buf, n, "counter", c.help)
+    keys := make([]string, 0, len(c.values))
+    for k := range c.values {
+      keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+      fmt.Fprintf(&buf, "%s%s %g\n", n, k, c.values[k])
+    }
+  }
+
+  names = names[:0]
+  for n := range m.gauges {
+    names = append(names, n)
+  }
+  sort.Strings(names)
+  gauges := make([]*gaugeFamily, len(names))
+  for i, n := range names {
+    gauges[i] = m.gauges[n]
+  }
+  m.lock.Unlock()
+
+  // 仪表盘的求值函数可能调用其他组件的锁, 甚至回头调用 Inc(), 不能持有 m.lock
+  for i, n := range names {
+    writeMetricHead(&buf, n, "gauge", gauges[i].help)
+    fmt.Fprintf(&buf, "%s %g\n", n, gauges[i].fn())
+  }
+
+  writeMetricHead(&buf, "brick_uptime_seconds", "gauge", "Seconds since metrics were enabled.")
+  fmt.Fprintf(&buf, "brick_uptime_seconds %g\n", time.Since(m.start).Seconds())
+  return buf.Bytes()
+}
+
+
+func writeMetricHead(buf *bytes.Buffer, name string, typ string, help string) {
+  fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+
+//
+// 成对的标签名和值格式化为 '{a="1",b="2"}'
+//
+func formatLabels(labels ...string) string {
+  if len(labels) < 2 {
+    return ""
+  }
+  parts := make([]string, 0, len(labels)/2)
+  for i := 0; i+1 < len(labels); i += 2 {
+    parts = append(parts, labels[i] +"=\""+ escapeLabel(labels[i+1]) +"\"")
+  }
+  return "{"+ strings.Join(parts, ",") +"}"
+}
+
+
+func escapeLabel(v string) string {
+  v = strings.Replace(v, `\`, `\\`, -1)
+  v = strings.Replace(v, "\n", `\n`, -1)
+  return strings.Replace(v, `"`, `\"`, -1)
+}
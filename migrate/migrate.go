@@ -0,0 +1,389 @@
+//
+// 数据库迁移: 按版本执行 SQL 文件, 支持 up/down 和多实例同时启动时的咨询锁.
+//
+// 文件名格式为 "<版本>_<名字>.up.sql" 和 "<版本>_<名字>.down.sql",
+// 通常用 embed 打包进程序:
+//
+//   //go:embed migrations/*.sql
+//   var files embed.FS
+//
+//   list, err := migrate.Load(files, "migrations")
+//   r := &migrate.Runner{ DB: db, Migrations: list, Dialect: migrate.Postgres }
+//   b.OnStart(r.Up)
+//
+package migrate
+
+import (
+  "context"
+  "database/sql"
+  "errors"
+  "fmt"
+  "io"
+  "io/fs"
+  "path"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+//
+// 一个版本的迁移
+//
+type Migration struct {
+  Version int64
+  Name    string
+  Up      string
+  Down    string
+}
+
+//
+// 迁移的状态, 参考 Runner.Status()
+//
+type Status struct {
+  Migration
+  Applied   bool
+  AppliedAt time.Time
+}
+
+//
+// 数据库的差异: 参数占位符和咨询锁
+//
+type Dialect struct {
+  // 第 n 个 (从 1 开始) 参数的占位符
+  Placeholder func(n int) string
+  // 获取和释放咨询锁的语句, 参数是锁的 ID; 为空不加锁
+  LockSQL     string
+  UnlockSQL   string
+}
+
+var Postgres = Dialect{
+  Placeholder : func(n int) string { return "$"+ strconv.Itoa(n) },
+  LockSQL     : "SELECT pg_advisory_lock($1)",
+  UnlockSQL   : "SELECT pg_advisory_unlock($1)",
+}
+
+var MySQL = Dialect{
+  Placeholder : func(int) string { return "?" },
+  LockSQL     : "SELECT GET_LOCK(CONCAT('brick_migrate_', ?), 600)",
+  UnlockSQL   : "SELECT RELEASE_LOCK(CONCAT('brick_migrate_', ?))",
+}
+
+// SQLite 只有一个写入者, 不需要咨询锁
+var SQLite = Dialect{
+  Placeholder : func(int) string { return "?" },
+}
+
+type Runner struct {
+  DB         *sql.DB
+  Migrations []Migration
+  Dialect    Dialect
+  // 记录已执行版本的表, 默认 "schema_migrations"
+  Table      string
+  // 咨询锁的 ID, 默认 7077
+  LockID     int64
+  // 输出执行过程, 默认不输出
+  Log        func(v ...interface{})
+}
+
+
+//
+// 从 dir 中读取迁移文件, 按版本排序; 同一版本必须有 up 文件
+//
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+  entries, err := fs.ReadDir(fsys, dir)
+  if err != nil {
+    return nil, err
+  }
+  byVersion := make(map[int64]*Migration)
+
+  for _, e := range entries {
+    name := e.Name()
+    if e.IsDir() || !strings.HasSuffix(name, ".sql") {
+      continue
+    }
+    base := strings.TrimSuffix(name, ".sql")
+    up := strings.HasSuffix(base, ".up")
+    if !up && !strings.HasSuffix(base, ".down") {
+      return nil, fmt.Errorf("migration %s: name must end with .up.sql or .down.sql", name)
+    }
+    base = strings.TrimSuffix(strings.TrimSuffix(base, ".up"), ".down")
+
+    i := strings.IndexByte(base, '_')
+    if i < 0 {
+      i = len(base)
+    }
+    v, err := strconv.ParseInt(base[:i], 10, 64)
+    if err != nil {
+      return nil, fmt.Errorf("migration %s: bad version", name)
+    }
+    body, err := fs.ReadFile(fsys, path.Join(dir, name))
+    if err != nil {
+      return nil, err
+    }
+
+    m := byVersion[v]
+    if m == nil {
+      m = &Migration{ Version: v, Name: strings.TrimPrefix(base[i:], "_") }
+      byVersion[v] = m
+    }
+    if up {
+      m.Up = string(body)
+    } else {
+      m.Down = string(body)
+    }
+  }
+
+  list := make([]Migration, 0, len(byVersion))
+  for _, m := range byVersion {
+    if m.Up == "" {
+      return nil, fmt.Errorf("migration %d: missing up file", m.Version)
+    }
+    list = append(list, *m)
+  }
+  sort.Slice(list, func(a, b int) bool { return list[a].Version < list[b].Version })
+  return list, nil
+}
+
+
+//
+// 执行所有未执行的迁移, 可以直接作为 brick.StartHook
+//
+func (r *Runner) Up(ctx context.Context) error {
+  _, err := r.UpCount(ctx)
+  return err
+}
+
+
+//
+// 执行所有未执行的迁移, 返回执行的数量
+//
+func (r *Runner) UpCount(ctx context.Context) (int, error) {
+  n := 0
+  err := r.locked(ctx, func(conn *sql.Conn, applied map[int64]time.Time) error {
+    for _, m := range r.Migrations {
+      if _, has := applied[m.Version]; has {
+        continue
+      }
+      r.log("migrate up", m.Version, m.Name)
+      if err := r.apply(ctx, conn, m.Up, m.Version, true); err != nil {
+        return fmt.Errorf("migration %d %s: %s", m.Version, m.Name, err)
+      }
+      n++
+    }
+    return nil
+  })
+  return n, err
+}
+
+
+//
+// 回滚最近执行的 steps 个迁移, 返回回滚的数量
+//
+func (r *Runner) Down(ctx context.Context, steps int) (int, error) {
+  n := 0
+  err := r.locked(ctx, func(conn *sql.Conn, applied map[int64]time.Time) error {
+    for i := len(r.Migrations) - 1; i >= 0 && n < steps; i-- {
+      m := r.Migrations[i]
+      if _, has := applied[m.Version]; !has {
+        continue
+      }
+      if m.Down == "" {
+        return fmt.Errorf("migration %d %s: no down file", m.Version, m.Name)
+      }
+      r.log("migrate down", m.Version, m.Name)
+      if err := r.apply(ctx, conn, m.Down, m.Version, false); err != nil {
+        return fmt.Errorf("migration %d %s: %s", m.Version, m.Name, err)
+      }
+      n++
+    }
+    return nil
+  })
+  return n, err
+}
+
+
+//
+// 所有迁移的执行状态
+//
+func (r *Runner) Status(ctx context.Context) ([]Status, error) {
+  conn, err := r.DB.Conn(ctx)
+  if err != nil {
+    return nil, err
+  }
+  defer conn.Close()
+  if err := r.ensureTable(ctx, conn); err != nil {
+    return nil, err
+  }
+  applied, err := r.applied(ctx, conn)
+  if err != nil {
+    return nil, err
+  }
+  ret := make([]Status, len(r.Migrations))
+  for i, m := range r.Migrations {
+    t, has := applied[m.Version]
+    ret[i] = Status{ Migration: m, Applied: has, AppliedAt: t }
+  }
+  return ret, nil
+}
+
+
+//
+// 命令行入口, 在程序中处理 "migrate" 子命令:
+//
+//   if len(os.Args) > 1 && os.Args[1] == "migrate" {
+//     err := runner.Command(ctx, os.Args[2:], os.Stdout)
+//   }
+//
+// 支持 "up", "down [n]" (默认 1) 和 "status" (默认).
+//
+func (r *Runner) Command(ctx context.Context, args []string, out io.Writer) error {
+  cmd := "status"
+  if len(args) > 0 {
+    cmd = args[0]
+  }
+  switch cmd {
+  case "up":
+    n, err := r.UpCount(ctx)
+    fmt.Fprintf(out, "%d migrations applied\n", n)
+    return err
+
+  case "down":
+    steps := 1
+    if len(args) > 1 {
+      s, err := strconv.Atoi(args[1])
+      if err != nil || s < 1 {
+        return errors.New("down: steps must be a positive number")
+      }
+      steps = s
+    }
+    n, err := r.Down(ctx, steps)
+    fmt.Fprintf(out, "%d migrations rolled back\n", n)
+    return err
+
+  case "status":
+    list, err := r.Status(ctx)
+    if err != nil {
+      return err
+    }
+    for _, s := range list {
+      state := "pending"
+      if s.Applied {
+        state = s.AppliedAt.Format(time.RFC3339)
+      }
+      fmt.Fprintf(out, "%6d  %-25s  %s\n", s.Version, state, s.Name)
+    }
+    return nil
+  }
+  return errors.New("unknown migrate command '"+ cmd +"', want up, down or status")
+}
+
+
+//
+// 在一个连接上加锁后执行 f, 多个实例同时启动时只有一个执行迁移
+//
+func (r *Runner) locked(ctx context.Context, f func(*sql.Conn, map[int64]time.Time) error) error {
+  conn, err := r.DB.Conn(ctx)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+
+  if r.Dialect.LockSQL != "" {
+    if _, err := conn.ExecContext(ctx, r.Dialect.LockSQL, r.lockID()); err != nil {
+      return fmt.Errorf("migrate lock: %s", err)
+    }
+    defer conn.ExecContext(context.Background(), r.Dialect.UnlockSQL, r.lockID())
+  }
+
+  if err := r.ensureTable(ctx, conn); err != nil {
+    return err
+  }
+  applied, err := r.applied(ctx, conn)
+  if err != nil {
+    return err
+  }
+  return f(conn, applied)
+}
+
+
+func (r *Runner) apply(ctx context.Context, conn *sql.Conn, stmt string, version int64, up bool) error {
+  tx, err := conn.BeginTx(ctx, nil)
+  if err != nil {
+    return err
+  }
+  if _, err := tx.ExecContext(ctx, stmt); err != nil {
+    tx.Rollback()
+    return err
+  }
+
+  p := r.placeholder
+  if up {
+    _, err = tx.ExecContext(ctx, "INSERT INTO "+ r.table() +" (version, applied_at) VALUES ("+
+        p(1) +", "+ p(2) +")", version, time.Now().UTC())
+  } else {
+    _, err = tx.ExecContext(ctx, "DELETE FROM "+ r.table() +" WHERE version = "+ p(1), version)
+  }
+  if err != nil {
+    tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
+
+
+func (r *Runner) ensureTable(ctx context.Context, conn *sql.Conn) error {
+  _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+ r.table() +
+      " (version BIGINT PRIMARY KEY, applied_at TIMESTAMP NOT NULL)")
+  return err
+}
+
+
+func (r *Runner) applied(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+  rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM "+ r.table())
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  ret := make(map[int64]time.Time)
+  for rows.Next() {
+    var v int64
+    var t time.Time
+    if err := rows.Scan(&v, &t); err != nil {
+      return nil, err
+    }
+    ret[v] = t
+  }
+  return ret, rows.Err()
+}
+
+
+func (r *Runner) table() string {
+  if r.Table == "" {
+    return "schema_migrations"
+  }
+  return r.Table
+}
+
+
+func (r *Runner) lockID() int64 {
+  if r.LockID == 0 {
+    return 7077
+  }
+  return r.LockID
+}
+
+
+func (r *Runner) placeholder(n int) string {
+  if r.Dialect.Placeholder == nil {
+    return "?"
+  }
+  return r.Dialect.Placeholder(n)
+}
+
+
+func (r *Runner) log(v ...interface{}) {
+  if r.Log != nil {
+    r.Log(v...)
+  }
+}
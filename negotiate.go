@@ -0,0 +1,98 @@
+package brick
+
+import (
+  "net/http"
+  "strings"
+)
+
+var htmlOffers = []string{ "text/html", "application/xhtml+xml", "application/json" }
+
+
+//
+// 根据 Accept 头域 (含 q 值) 从 offers 中选择客户端最想要的 mime 类型,
+// q 值相同时取 offers 中靠前的; 没有 Accept 头域时返回 offers[0],
+// 都不接受时返回空字符串.
+// 例如 h.Negotiate("text/html", "application/json")
+//
+func (h *Http) Negotiate(offers ...string) string {
+  h.Vary("Accept")
+  return negotiate(h.R.Header.Get("Accept"), offers)
+}
+
+
+//
+// 客户端更想要 json 而不是 html, 用于在同一个处理器中返回 Msg 结构
+//
+func (h *Http) WantsJSON() bool {
+  h.Vary("Accept")
+  return wantsJSON(h.R)
+}
+
+
+//
+// 客户端更想要 html 页面, 没有 Accept 头域时也返回 true
+//
+func (h *Http) WantsHTML() bool {
+  h.Vary("Accept")
+  t := negotiate(h.R.Header.Get("Accept"), htmlOffers)
+  return t == "text/html" || t == "application/xhtml+xml"
+}
+
+
+func wantsJSON(r *http.Request) bool {
+  return negotiate(r.Header.Get("Accept"), htmlOffers) == "application/json"
+}
+
+
+func negotiate(accept string, offers []string) string {
+  if len(offers) == 0 {
+    return ""
+  }
+  if strings.TrimSpace(accept) == "" {
+    return offers[0]
+  }
+
+  ranges := parseQualityList(accept)
+  best, bestQ := "", 0.0
+  for _, offer := range offers {
+    if q := offerQuality(ranges, offer); q > bestQ {
+      best, bestQ = offer, q
+    }
+  }
+  return best
+}
+
+
+//
+// offer 的 q 值取最具体的匹配项: "type/sub" > "type/*" > "*/*"
+//
+func offerQuality(ranges []qualityItem, offer string) float64 {
+  q, spec := 0.0, -1
+  for _, it := range ranges {
+    if s := mediaMatch(strings.ToLower(it.value), strings.ToLower(offer)); s > spec {
+      q, spec = it.q, s
+    }
+  }
+  return q
+}
+
+
+//
+// 返回匹配的具体程度, 不匹配返回 -1;
+// "application/problem+json" 这类结构化后缀也算作接受 "application/json".
+//
+func mediaMatch(r string, offer string) int {
+  switch {
+  case r == offer:
+    return 3
+  case r == "*/*" || r == "*":
+    return 0
+  case strings.HasSuffix(r, "/*"):
+    if strings.HasPrefix(offer, r[:len(r)-1]) {
+      return 1
+    }
+  case offer == "application/json" && strings.HasSuffix(r, "+json"):
+    return 2
+  }
+  return -1
+}
@@ -0,0 +1,553 @@
+package brick
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "html"
+  "net/http"
+  "reflect"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+//
+// Swagger UI 的 js/css 地址, 离线环境可以换成自己部署的 swagger-ui-dist
+//
+var SwaggerUIAssets = "https://unpkg.com/swagger-ui-dist@5"
+
+//
+// OpenAPI 文档的 info 部分, 参考 Brick.OpenAPI()
+//
+type OpenAPIInfo struct {
+  Title       string `json:"title"`
+  Version     string `json:"version"`
+  Description string `json:"description,omitempty"`
+  // 只包含路径以它开头的服务, 例如 "/api/"; 空包含所有服务
+  Prefix      string `json:"-"`
+}
+
+//
+// OpenAPI 3 文档
+//
+type OpenAPIDoc struct {
+  OpenAPI string                                  `json:"openapi"`
+  Info    OpenAPIInfo                             `json:"info"`
+  Paths   map[string]map[string]*OpenAPIOperation `json:"paths"`
+}
+
+//
+// 一个路径上一个请求方法的描述
+//
+type OpenAPIOperation struct {
+  Summary     string                 `json:"summary,omitempty"`
+  OperationID string                 `json:"operationId,omitempty"`
+  Deprecated  bool                   `json:"deprecated,omitempty"`
+  Parameters  []OpenAPIParameter     `json:"parameters,omitempty"`
+  RequestBody map[string]interface{} `json:"requestBody,omitempty"`
+  Responses   map[string]interface{} `json:"responses"`
+}
+
+//
+// 请求参数, 来自绑定的结构体
+//
+type OpenAPIParameter struct {
+  Name     string                 `json:"name"`
+  In       string                 `json:"in"`
+  Required bool                   `json:"required,omitempty"`
+  Schema   map[string]interface{} `json:"schema"`
+}
+
+//
+// 路由的请求和响应结构, 参考 Route.Accepts()
+//
+type routeTypes struct {
+  req     reflect.Type
+  reqJSON bool
+  // 显式声明的请求结构不会被 Bind() 记录的类型替换
+  reqSet  bool
+  resp    *schemaNode
+}
+
+
+//
+// 声明服务接受的 json 请求体, sample 是绑定的结构体或其指针, 用于 OpenAPI 文档.
+// 没有声明时使用处理函数第一次调用 Bind()/BindForm()/BindJSON() 时的结构体.
+//
+func (r *Route) Accepts(sample interface{}) *Route {
+  return r.setRequest(sample, true)
+}
+
+
+//
+// 声明服务从 URI 参数或表单绑定的结构体, 参考 Accepts()
+//
+func (r *Route) AcceptsForm(sample interface{}) *Route {
+  return r.setRequest(sample, false)
+}
+
+
+func (r *Route) setRequest(sample interface{}, isJSON bool) *Route {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  r.types.req, r.types.reqJSON, r.types.reqSet = structType(sample), isJSON, true
+  return r
+}
+
+
+//
+// 声明服务的 json 响应结构, sample 是示例值, 规则与 Brick.ResponseSchema() 相同;
+// 没有声明时使用 ResponseSchema() 注册的结构
+//
+func (r *Route) Returns(sample interface{}) *Route {
+  node := buildSchema(reflect.ValueOf(sample))
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  r.types.resp = node
+  return r
+}
+
+
+//
+// 记录处理函数绑定的结构体, 由 Bind() 等方法调用
+//
+func (r *Route) noteBind(out interface{}, isJSON bool) {
+  if r == nil {
+    return
+  }
+  t := structType(out)
+  r.lock.RLock()
+  known := r.types.reqSet || (r.types.req == t && r.types.reqJSON == isJSON)
+  r.lock.RUnlock()
+  if known {
+    return
+  }
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  if !r.types.reqSet {
+    r.types.req, r.types.reqJSON = t, isJSON
+  }
+}
+
+
+func structType(sample interface{}) reflect.Type {
+  t := reflect.TypeOf(sample)
+  for t != nil && t.Kind() == reflect.Ptr {
+    t = t.Elem()
+  }
+  if t == nil || t.Kind() != reflect.Struct {
+    panic(fmt.Errorf("request sample must be a struct, got %T", sample))
+  }
+  return t
+}
+
+
+//
+// 由注册的服务生成 OpenAPI 3 文档: 路径, 请求方法, 说明, 弃用标记,
+// 请求参数和请求体 (参考 Route.Accepts()) 以及 json 响应结构 (参考 Route.Returns()).
+// 以 "/" 结尾的路径匹配其下的所有路径; 没有限制方法的服务列为 GET 和 POST.
+//
+func (b *Brick) OpenAPI(info OpenAPIInfo) *OpenAPIDoc {
+  doc := &OpenAPIDoc{ OpenAPI: "3.0.3", Info: info, Paths: make(map[string]map[string]*OpenAPIOperation) }
+  b.routeLock.RLock()
+  routes := append([]*Route(nil), b.routes...)
+  b.routeLock.RUnlock()
+
+  for _, rt := range routes {
+    ri := rt.Info()
+    if ri.Kind != "service" || !strings.HasPrefix(ri.Path, info.Prefix) {
+      continue
+    }
+    methods := ri.Methods
+    if len(methods) == 0 {
+      methods = []string{ http.MethodGet, http.MethodPost }
+    }
+    item := doc.Paths[ri.Path]
+    if item == nil {
+      item = make(map[string]*OpenAPIOperation)
+      doc.Paths[ri.Path] = item
+    }
+    for _, m := range methods {
+      if m == http.MethodOptions {
+        continue
+      }
+      item[strings.ToLower(m)] = b.openAPIOperation(rt, ri, m)
+    }
+  }
+  return doc
+}
+
+
+func (b *Brick) openAPIOperation(rt *Route, ri RouteInfo, method string) *OpenAPIOperation {
+  rt.lock.RLock()
+  types := rt.types
+  deprecated := rt.dep != nil
+  rt.lock.RUnlock()
+
+  op := &OpenAPIOperation{
+    Summary     : ri.Description,
+    OperationID : operationID(method, ri.Path),
+    Deprecated  : deprecated,
+  }
+  if types.req != nil {
+    props, required := requestSchema(types.req, types.reqJSON)
+    body := method != http.MethodGet && method != http.MethodHead && method != http.MethodDelete
+    if !types.reqJSON && !body {
+      names := make([]string, 0, len(props))
+      for n := range props {
+        names = append(names, n)
+      }
+      sort.Strings(names)
+      for _, n := range names {
+        op.Parameters = append(op.Parameters, OpenAPIParameter{
+          Name     : n,
+          In       : "query",
+          Required : required[n],
+          Schema   : props[n],
+        })
+      }
+    } else {
+      mime := "application/x-www-form-urlencoded"
+      if types.reqJSON {
+        mime = "application/json"
+      }
+      schema := map[string]interface{}{ "type": "object", "properties": props }
+      if len(required) > 0 {
+        schema["required"] = sortedKeys(required)
+      }
+      op.RequestBody = map[string]interface{}{
+        "content": map[string]interface{}{ mime: map[string]interface{}{ "schema": schema } },
+      }
+    }
+  }
+
+  resp := types.resp
+  if resp == nil {
+    b.schemaLock.Lock()
+    resp = b.schemas[ri.Host + ri.Path]
+    b.schemaLock.Unlock()
+  }
+  ok := map[string]interface{}{ "description": "OK" }
+  if resp != nil {
+    ok["content"] = map[string]interface{}{
+      "application/json": map[string]interface{}{ "schema": resp.openAPI() },
+    }
+  }
+  op.Responses = map[string]interface{}{ "200": ok }
+  return op
+}
+
+
+var nonIdent = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+//
+// "GET", "/api/v1/users" -> "get_api_v1_users"
+//
+func operationID(method string, path string) string {
+  return strings.ToLower(method) + strings.TrimSuffix(nonIdent.ReplaceAllString(path, "_"), "_")
+}
+
+
+//
+// 绑定结构体的属性和必填字段, 参数名和 validate 规则与 Bind() 相同
+//
+func requestSchema(t reflect.Type, isJSON bool) (map[string]map[string]interface{}, map[string]bool) {
+  tag := "form"
+  if isJSON {
+    tag = "json"
+  }
+  fields := make(map[string]*bindField)
+  collectBindFields(t, nil, tag, fields)
+  props := make(map[string]map[string]interface{}, len(fields))
+  required := make(map[string]bool)
+  for name, f := range fields {
+    if f.protected {
+      continue
+    }
+    s := typeSchema(t.FieldByIndex(f.index).Type)
+    for _, rule := range strings.Split(f.rules, ",") {
+      if rule == "required" {
+        required[name] = true
+      }
+    }
+    applyRules(s, f.rules)
+    props[name] = s
+  }
+  return props, required
+}
+
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+  for t.Kind() == reflect.Ptr {
+    t = t.Elem()
+  }
+  if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+    return map[string]interface{}{ "type": "string" }
+  }
+  switch t.Kind() {
+  case reflect.String:
+    return map[string]interface{}{ "type": "string" }
+  case reflect.Bool:
+    return map[string]interface{}{ "type": "boolean" }
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+       reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+    return map[string]interface{}{ "type": "integer" }
+  case reflect.Float32, reflect.Float64:
+    return map[string]interface{}{ "type": "number" }
+  case reflect.Slice, reflect.Array:
+    if t.Elem().Kind() == reflect.Uint8 {
+      return map[string]interface{}{ "type": "string", "format": "byte" }
+    }
+    return map[string]interface{}{ "type": "array", "items": typeSchema(t.Elem()) }
+  case reflect.Map:
+    return map[string]interface{}{ "type": "object", "additionalProperties": typeSchema(t.Elem()) }
+  case reflect.Struct:
+    return buildSchema(reflect.Zero(t)).openAPI()
+  }
+  return map[string]interface{}{}
+}
+
+
+//
+// 把 validate 标签中的规则转换为 schema 的约束
+//
+func applyRules(s map[string]interface{}, rules string) {
+  for rules != "" {
+    var rule string
+    if strings.HasPrefix(rules, "regexp=") {
+      rule, rules = rules, ""
+    } else if i := strings.IndexByte(rules, ','); i >= 0 {
+      rule, rules = rules[:i], rules[i+1:]
+    } else {
+      rule, rules = rules, ""
+    }
+    key, arg := rule, ""
+    if i := strings.IndexByte(rule, '='); i >= 0 {
+      key, arg = rule[:i], rule[i+1:]
+    }
+
+    switch key {
+    case "min", "max":
+      n, err := strconv.ParseFloat(arg, 64)
+      if err != nil {
+        continue
+      }
+      typ, _ := s["type"].(string)
+      name := map[string]string{ "string": "Length", "array": "Items", "object": "Properties" }[typ]
+      if name == "" {
+        name = map[string]string{ "min": "minimum", "max": "maximum" }[key]
+      } else {
+        name = key + name
+      }
+      s[name] = n
+    case "oneof":
+      s["enum"] = strings.Fields(arg)
+    case "regexp":
+      s["pattern"] = arg
+    }
+  }
+}
+
+
+//
+// 转换为 OpenAPI 3.0 的 schema
+//
+func (n *schemaNode) openAPI() map[string]interface{} {
+  s := map[string]interface{}{}
+  switch n.kind {
+  case "object":
+    s["type"] = "object"
+    props := make(map[string]interface{}, len(n.fields))
+    var required []string
+    for name, f := range n.fields {
+      props[name] = f.node.openAPI()
+      if !f.optional {
+        required = append(required, name)
+      }
+    }
+    s["properties"] = props
+    if len(required) > 0 {
+      sort.Strings(required)
+      s["required"] = required
+    }
+  case "map":
+    s["type"] = "object"
+    s["additionalProperties"] = n.elem.openAPI()
+  case "array":
+    s["type"] = "array"
+    s["items"] = n.elem.openAPI()
+  case "string", "number", "boolean":
+    s["type"] = n.kind
+  case "ref":
+    // 内联的 schema 不能引用自己, 递归的部分只描述为对象
+    s["type"] = "object"
+    s["description"] = "recursive "+ n.name
+  }
+  if n.nullable && n.kind != "any" {
+    s["nullable"] = true
+  }
+  return s
+}
+
+
+func sortedKeys(m map[string]bool) []string {
+  ret := make([]string, 0, len(m))
+  for k := range m {
+    ret = append(ret, k)
+  }
+  sort.Strings(ret)
+  return ret
+}
+
+
+//
+// json 格式的文档
+//
+func (d *OpenAPIDoc) JSON() ([]byte, error) {
+  return json.MarshalIndent(d, "", "  ")
+}
+
+
+//
+// yaml 格式的文档
+//
+func (d *OpenAPIDoc) YAML() ([]byte, error) {
+  buf, err := json.Marshal(d)
+  if err != nil {
+    return nil, err
+  }
+  var v map[string]interface{}
+  if err := json.Unmarshal(buf, &v); err != nil {
+    return nil, err
+  }
+  var out bytes.Buffer
+  yamlMap(&out, v, 0, false)
+  return out.Bytes(), nil
+}
+
+
+var yamlPlainKey = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_./-]*$`)
+
+
+//
+// 输出 json 解码得到的值, inline 为 true 时第一个键接在 "- " 后面
+//
+func yamlMap(w *bytes.Buffer, m map[string]interface{}, indent int, inline bool) {
+  keys := make([]string, 0, len(m))
+  for k := range m {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  for i, k := range keys {
+    if i > 0 || !inline {
+      w.WriteString(strings.Repeat(" ", indent))
+    }
+    if yamlPlainKey.MatchString(k) && k != "true" && k != "false" && k != "null" {
+      w.WriteString(k)
+    } else {
+      yamlScalar(w, k)
+    }
+    w.WriteByte(':')
+    yamlValue(w, m[k], indent + 2)
+  }
+}
+
+
+func yamlValue(w *bytes.Buffer, v interface{}, indent int) {
+  switch x := v.(type) {
+  case map[string]interface{}:
+    if len(x) == 0 {
+      w.WriteString(" {}\n")
+      return
+    }
+    w.WriteByte('\n')
+    yamlMap(w, x, indent, false)
+  case []interface{}:
+    if len(x) == 0 {
+      w.WriteString(" []\n")
+      return
+    }
+    w.WriteByte('\n')
+    for _, item := range x {
+      w.WriteString(strings.Repeat(" ", indent) +"-")
+      if m, ok := item.(map[string]interface{}); ok && len(m) > 0 {
+        w.WriteByte(' ')
+        yamlMap(w, m, indent + 2, true)
+      } else {
+        yamlValue(w, item, indent + 2)
+      }
+    }
+  default:
+    w.WriteByte(' ')
+    yamlScalar(w, v)
+    w.WriteByte('\n')
+  }
+}
+
+
+//
+// json 的字符串, 数字, 布尔和 null 都是合法的 yaml 标量
+//
+func yamlScalar(w *bytes.Buffer, v interface{}) {
+  buf, _ := json.Marshal(v)
+  w.Write(buf)
+}
+
+
+//
+// 提供 OpenAPI() 生成的文档, 请求的路径以 .yaml/.yml 结尾, 参数 format=yaml
+// 或 Accept 中有 yaml 时返回 yaml, 否则返回 json:
+//
+//   b.Service("/openapi.json", b.OpenAPIPage(brick.OpenAPIInfo{ Title: "Shop", Version: "1.0" }))
+//
+func (b *Brick) OpenAPIPage(info OpenAPIInfo) HttpHandler {
+  return func(h *Http) error {
+    doc := b.OpenAPI(info)
+    yaml := strings.HasSuffix(h.R.URL.Path, ".yaml") || strings.HasSuffix(h.R.URL.Path, ".yml") ||
+        h.R.URL.Query().Get("format") == "yaml" || strings.Contains(h.R.Header.Get("Accept"), "yaml")
+    var buf []byte
+    var err error
+    if yaml {
+      buf, err = doc.YAML()
+      h.W.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+    } else {
+      buf, err = doc.JSON()
+      h.W.Header().Set("Content-Type", "application/json; charset=utf-8")
+    }
+    if err != nil {
+      return err
+    }
+    h.CacheTime(0)
+    h.W.Write(buf)
+    return nil
+  }
+}
+
+
+//
+// Swagger UI 页面, 显示 specURL 的文档, 只在 Debug 模式下可用, 否则返回 404.
+// 页面本身内嵌在程序中, 脚本和样式从 SwaggerUIAssets 加载:
+//
+//   b.Service("/docs", b.SwaggerUI("/openapi.json"))
+//
+func (b *Brick) SwaggerUI(specURL string) HttpHandler {
+  return func(h *Http) error {
+    if !b.Debug {
+      return NewHttpError(http.StatusNotFound, "")
+    }
+    assets := html.EscapeString(strings.TrimSuffix(SwaggerUIAssets, "/"))
+    spec, _ := json.Marshal(specURL)
+    h.CacheTime(0)
+    h.W.Header().Set("Content-Type", "text/html; charset=utf-8")
+    h.WriteStr(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>API</title>
+<link rel="stylesheet" href="`+ assets +`/swagger-ui.css"></head>
+<body><div id="swagger-ui"></div>
+<script src="`+ assets +`/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({ url: `+ string(spec) +`, dom_id: "#swagger-ui" })</script>
+</body></html>`)
+    return nil
+  }
+}
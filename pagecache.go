@@ -0,0 +1,447 @@
+package brick
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// 超过这个大小的响应不缓存
+const maxCachedBody = 4 << 20
+
+//
+// 保存的响应, 参考 Brick.Cached()
+//
+type CachedResponse struct {
+  // 缓存键, 以主机 (参考 Cache.Purge()) 和请求的 path+query 开头
+  Key     string
+  Status  int
+  Header  http.Header
+  Body    []byte
+  Expires time.Time
+  // 响应的缓存标签, 参考 Http.CacheTag()
+  Tags    []string
+}
+
+//
+// 响应的存储, 参考 Cache.UseStore(); 实现必须可以并发调用
+//
+type CacheStore interface {
+  Get(key string) (*CachedResponse, bool)
+  Set(r *CachedResponse)
+  // 删除键以 prefix 开头的响应, 返回删除的数量
+  DeletePrefix(prefix string) int
+  Len() int
+}
+
+//
+// Cached() 使用的存储和统计
+//
+type pageCache struct {
+  lock   sync.Mutex
+  store  CacheStore
+  hits   uint64
+  misses uint64
+  bypass uint64
+}
+
+
+//
+// 设置 Cached() 使用的存储, 默认 NewMemoryCacheStore(10000)
+//
+func (c *Cache) UseStore(s CacheStore) {
+  c.pages.lock.Lock()
+  defer c.pages.lock.Unlock()
+  c.pages.store = s
+}
+
+
+func (c *Cache) pageStore() CacheStore {
+  c.pages.lock.Lock()
+  defer c.pages.lock.Unlock()
+  if c.pages.store == nil {
+    c.pages.store = NewMemoryCacheStore(10000)
+  }
+  return c.pages.store
+}
+
+
+//
+// 清除地址以 prefix 开头的缓存响应, 例如 "/news/", 返回清除的数量.
+// 虚拟主机上的路由的地址以主机开头, 例如 "admin.example.com/news/",
+// 通配的主机使用请求的主机名, 参考 Brick.Host().
+//
+func (c *Cache) Purge(prefix string) int {
+  c.lock.Lock()
+  share := c.share
+  c.lock.Unlock()
+  if share != nil {
+    share("purge", []string{ prefix })
+  }
+  return c.pageStore().DeletePrefix(prefix)
+}
+
+
+//
+// Cached() 的命中统计
+//
+func (c *Cache) Stats() CacheStats {
+  return CacheStats{
+    Hits    : atomic.LoadUint64(&c.pages.hits),
+    Misses  : atomic.LoadUint64(&c.pages.misses),
+    Bypass  : atomic.LoadUint64(&c.pages.bypass),
+    Entries : c.pageStore().Len(),
+  }
+}
+
+
+//
+// 缓存 h 的响应 ttl 时间, 命中时不再执行 h. 键是主机, path+query 和 vary 中列出的
+// 请求头 (同时加入 Vary 响应头). 只缓存 GET/HEAD 请求的 200 响应;
+// 带有 Authorization 或 Cookie 的请求不使用缓存 (vary 中有 "Cookie" 时 cookie 是键的一部分, 可以缓存),
+// 使用了会话, 设置了 Set-Cookie 或 Cache-Control: no-store/private
+// 的响应不缓存; 响应的 Vary 中有 vary 以外的请求头时 (例如 h.Locale() 加入的 Accept-Language) 也不缓存.
+// CacheTag() 标记的响应在 PurgeTag() 时一起清除, 标签下已有 1000 个地址时新地址的响应不缓存.
+// 响应头 X-Cache 为 HIT/MISS/BYPASS.
+//
+//   b.Service("/news/", b.Cached(time.Hour, b.TemplatePage("www/news.html", loadNews)))
+//
+func (b *Brick) Cached(ttl time.Duration, h HttpHandler, vary ...string) HttpHandler {
+  c := b.Cache()
+  varyCookie := false
+  for _, v := range vary {
+    varyCookie = varyCookie || strings.EqualFold(v, "Cookie")
+  }
+  return func(hd *Http) error {
+    // 带 cookie 的请求可能得到按用户生成的页面, 除非 cookie 在键中
+    if (hd.R.Method != http.MethodGet && hd.R.Method != http.MethodHead) ||
+        hd.R.Header.Get("Authorization") != "" ||
+        (hd.R.Header.Get("Cookie") != "" && !varyCookie) {
+      atomic.AddUint64(&c.pages.bypass, 1)
+      hd.W.Header().Set("X-Cache", "BYPASS")
+      return h(hd)
+    }
+    hd.Vary(vary...)
+
+    store := c.pageStore()
+    key := pageKey(hd, vary)
+    if r, has := store.Get(key); has && time.Now().Before(r.Expires) {
+      atomic.AddUint64(&c.pages.hits, 1)
+      hd.tags = append(hd.tags, r.Tags...)
+      hdr := hd.W.Header()
+      for k, v := range r.Header {
+        hdr[k] = append([]string(nil), v...)
+      }
+      hdr.Set("X-Cache", "HIT")
+      hdr.Set("Age", strconv.Itoa(int(ttl.Seconds() - time.Until(r.Expires).Seconds())))
+      hdr.Set("Content-Length", strconv.Itoa(len(r.Body)))
+      hd.W.WriteHeader(r.Status)
+      if hd.R.Method != http.MethodHead {
+        hd.W.Write(r.Body)
+      }
+      return nil
+    }
+
+    atomic.AddUint64(&c.pages.misses, 1)
+    hd.W.Header().Set("X-Cache", "MISS")
+    orig := hd.W
+    cw := &captureWriter{ ResponseWriter: orig }
+    hd.W = &responseWriter{ ResponseWriter: cw }
+    err := h(hd)
+    hd.W = orig
+
+    if err != nil || cw.status != http.StatusOK || cw.over || hd.R.Method == http.MethodHead ||
+        !pageCacheable(cw.Header()) {
+      return err
+    }
+    if hd.s != nil && !varyCookie {
+      b.log.Debug("Not cached, the handler used the session")
+      return err
+    }
+    if !varyCovered(cw.Header(), vary) {
+      b.log.Debug("Not cached, response varies on", cw.Header().Get("Vary"), "which is not in the cache key")
+      return err
+    }
+    // 标签索引满了的页面无法被 PurgeTag() 清除, 不保存
+    if len(hd.tags) > 0 && !c.index(hd.cacheHost() + hd.R.URL.RequestURI(), hd.tags) {
+      b.log.Debug("Not cached, too many pages with tags", hd.tags)
+      return err
+    }
+    header := cw.Header().Clone()
+    header.Del("X-Cache")
+    header.Del("Content-Length")
+    store.Set(&CachedResponse{
+      Key     : key,
+      Status  : cw.status,
+      Header  : header,
+      Body    : cw.body,
+      Expires : time.Now().Add(ttl),
+      Tags    : hd.tags,
+    })
+    return nil
+  }
+}
+
+
+func pageKey(h *Http, vary []string) string {
+  r := h.R
+  key := h.cacheHost() + r.URL.RequestURI() +"\x00"
+  for _, v := range vary {
+    key += strings.Join(r.Header.Values(v), ",") +"\x00"
+  }
+  return key
+}
+
+
+func pageCacheable(h http.Header) bool {
+  if h.Get("Set-Cookie") != "" {
+    return false
+  }
+  cc := strings.ToLower(h.Get("Cache-Control"))
+  return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private")
+}
+
+
+//
+// 响应的 Vary 中的请求头都在缓存键中, 否则不同客户端会拿到错误的缓存
+//
+func varyCovered(h http.Header, vary []string) bool {
+  for _, k := range varyKeys(h) {
+    if k == "*" {
+      return false
+    }
+    found := false
+    for _, v := range vary {
+      if strings.EqualFold(k, v) {
+        found = true
+        break
+      }
+    }
+    if !found {
+      return false
+    }
+  }
+  return true
+}
+
+
+//
+// 把响应同时写给客户端和缓冲区
+//
+type captureWriter struct {
+  http.ResponseWriter
+  status int
+  body   []byte
+  over   bool
+}
+
+
+func (w *captureWriter) WriteHeader(code int) {
+  if w.status == 0 {
+    w.status = code
+  }
+  w.ResponseWriter.WriteHeader(code)
+}
+
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  if !w.over {
+    if len(w.body) + len(b) > maxCachedBody {
+      w.over, w.body = true, nil
+    } else {
+      w.body = append(w.body, b...)
+    }
+  }
+  return w.ResponseWriter.Write(b)
+}
+
+
+func (w *captureWriter) Flush() {
+  if f, ok := w.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+
+//
+// 内存中的响应存储, 超过 maxEntries 时先删除过期的, 然后删除最早过期的
+//
+func NewMemoryCacheStore(maxEntries int) CacheStore {
+  return &memoryPages{ max: maxEntries, pages: make(map[string]*CachedResponse) }
+}
+
+type memoryPages struct {
+  lock  sync.Mutex
+  max   int
+  pages map[string]*CachedResponse
+}
+
+
+func (m *memoryPages) Get(key string) (*CachedResponse, bool) {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  r, has := m.pages[key]
+  return r, has
+}
+
+
+func (m *memoryPages) Set(r *CachedResponse) {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  if _, has := m.pages[r.Key]; !has && m.max > 0 && len(m.pages) >= m.max {
+    now := time.Now()
+    var oldest string
+    for k, p := range m.pages {
+      if now.After(p.Expires) {
+        delete(m.pages, k)
+      } else if oldest == "" || p.Expires.Before(m.pages[oldest].Expires) {
+        oldest = k
+      }
+    }
+    if len(m.pages) >= m.max {
+      delete(m.pages, oldest)
+    }
+  }
+  m.pages[r.Key] = r
+}
+
+
+func (m *memoryPages) DeletePrefix(prefix string) int {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  n := 0
+  for k := range m.pages {
+    if strings.HasPrefix(k, prefix) {
+      delete(m.pages, k)
+      n++
+    }
+  }
+  return n
+}
+
+
+func (m *memoryPages) Len() int {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  return len(m.pages)
+}
+
+
+//
+// 磁盘上的响应存储, 每个响应一个 json 文件, 重启后仍然有效;
+// 打开时从目录中读取键的索引并删除过期的文件
+//
+func NewDiskCacheStore(dir string) (CacheStore, error) {
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return nil, err
+  }
+  d := &diskPages{ dir: dir, index: make(map[string]time.Time) }
+  entries, err := os.ReadDir(dir)
+  if err != nil {
+    return nil, err
+  }
+  now := time.Now()
+  for _, e := range entries {
+    file := filepath.Join(dir, e.Name())
+    if r, err := d.read(file); err == nil && now.Before(r.Expires) {
+      d.index[r.Key] = r.Expires
+    } else if strings.HasSuffix(file, ".json") {
+      os.Remove(file)
+    }
+  }
+  return d, nil
+}
+
+type diskPages struct {
+  lock  sync.Mutex
+  dir   string
+  // 键 -> 过期时间
+  index map[string]time.Time
+}
+
+
+func (d *diskPages) file(key string) string {
+  sum := sha256.Sum256([]byte(key))
+  return filepath.Join(d.dir, hex.EncodeToString(sum[:]) +".json")
+}
+
+
+func (d *diskPages) read(file string) (*CachedResponse, error) {
+  buf, err := os.ReadFile(file)
+  if err != nil {
+    return nil, err
+  }
+  r := &CachedResponse{}
+  if err := json.Unmarshal(buf, r); err != nil {
+    return nil, err
+  }
+  return r, nil
+}
+
+
+func (d *diskPages) Get(key string) (*CachedResponse, bool) {
+  d.lock.Lock()
+  _, has := d.index[key]
+  d.lock.Unlock()
+  if !has {
+    return nil, false
+  }
+  r, err := d.read(d.file(key))
+  if err != nil || r.Key != key {
+    return nil, false
+  }
+  return r, true
+}
+
+
+func (d *diskPages) Set(r *CachedResponse) {
+  buf, err := json.Marshal(r)
+  if err != nil {
+    return
+  }
+  file := d.file(r.Key)
+  tmp := file +".tmp"
+  if err := os.WriteFile(tmp, buf, 0600); err != nil {
+    return
+  }
+  if err := os.Rename(tmp, file); err != nil {
+    os.Remove(tmp)
+    return
+  }
+  d.lock.Lock()
+  d.index[r.Key] = r.Expires
+  d.lock.Unlock()
+}
+
+
+func (d *diskPages) DeletePrefix(prefix string) int {
+  d.lock.Lock()
+  defer d.lock.Unlock()
+  n := 0
+  for k := range d.index {
+    if strings.HasPrefix(k, prefix) {
+      os.Remove(d.file(k))
+      delete(d.index, k)
+      n++
+    }
+  }
+  return n
+}
+
+
+func (d *diskPages) Len() int {
+  d.lock.Lock()
+  defer d.lock.Unlock()
+  return len(d.index)
+}
@@ -0,0 +1,691 @@
+package brick
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "os"
+  "reflect"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+//
+// 策略文件, 按路由设置跨域, 认证, 缓存和限流, 运维人员修改文件后重启即可生效,
+// 参考 Brick.LoadPolicy(). 多个条目匹配同一个路由时, 后面条目中设置的字段覆盖前面的.
+//
+type Policy struct {
+  Routes []RoutePolicy `json:"routes"`
+}
+
+//
+// 一组路由的策略
+//
+type RoutePolicy struct {
+  // 路由的路径, 以 "*" 结尾时匹配前缀; 虚拟主机的路由写成 "admin.example.com/path";
+  // 只能匹配服务, 匹配到静态文件或跳转时 Run() 返回错误
+  Match     string           `json:"match"`
+  CORS      *CORSPolicy      `json:"cors,omitempty"`
+  // "public" 不需要认证, "required" 需要认证 (取消 AuthExempt)
+  Auth      string           `json:"auth,omitempty"`
+  // 认证的用户至少有其中一个角色, 否则 403
+  Roles     []string         `json:"roles,omitempty"`
+  // Cache-Control: "no-store", "no-cache", "private" 或缓存时间 "10m";
+  // 处理函数设置的 Cache-Control 优先
+  Cache     string           `json:"cache,omitempty"`
+  RateLimit *RateLimitPolicy `json:"rate_limit,omitempty"`
+}
+
+//
+// 跨域资源共享 (CORS)
+//
+type CORSPolicy struct {
+  // 允许的来源, 例如 "https://app.example.com", "*" 允许所有来源
+  Origins     []string      `json:"origins"`
+  // 预检请求允许的方法, 为空时使用路由的方法
+  Methods     []string      `json:"methods,omitempty"`
+  // 预检请求允许的请求头
+  Headers     []string      `json:"headers,omitempty"`
+  // 允许脚本读取的响应头
+  Expose      []string      `json:"expose_headers,omitempty"`
+  Credentials bool          `json:"credentials,omitempty"`
+  // 预检结果的缓存时间, 例如 "1h"
+  MaxAge      time.Duration `json:"max_age,omitempty"`
+}
+
+//
+// 路由的限流, 按客户端 IP 区分, 参考 Brick.RateLimit()
+//
+type RateLimitPolicy struct {
+  Rate  float64 `json:"rate"`
+  Burst int     `json:"burst"`
+}
+
+type policyState struct {
+  lock    sync.RWMutex
+  pending *Policy
+  routes  map[*Route]*RoutePolicy
+}
+
+
+//
+// 读取策略文件 (yaml 或 json), 在 Run() 时检查并应用到已注册的路由,
+// 匹配不到任何路由的条目使 Run() 返回错误. 例如:
+//
+//   routes:
+//     - match: /api/*
+//       cors:
+//         origins: [https://app.example.com]
+//         credentials: true
+//         max_age: 1h
+//       cache: no-store
+//       rate_limit: { rate: 10, burst: 20 }
+//     - match: /admin/*
+//       auth: required
+//       roles: [admin]
+//     - match: /health
+//       auth: public
+//
+// yaml 只支持常用的子集: 缩进的映射和列表, 行内列表, 字符串, 数字和布尔值.
+//
+func (b *Brick) LoadPolicy(file string) error {
+  buf, err := os.ReadFile(file)
+  if err != nil {
+    return err
+  }
+  p, err := ParsePolicy(buf)
+  if err != nil {
+    return fmt.Errorf("%s: %w", file, err)
+  }
+  b.SetPolicy(p)
+  return nil
+}
+
+
+//
+// 解析策略文件的内容, 以 "{" 开头时作为 json, 否则作为 yaml; 未知的字段返回错误
+//
+func ParsePolicy(data []byte) (*Policy, error) {
+  var raw interface{}
+  var err error
+  if t := bytes.TrimSpace(data); len(t) > 0 && t[0] == '{' {
+    err = json.Unmarshal(t, &raw)
+  } else {
+    raw, err = parseYAML(string(data))
+  }
+  if err != nil {
+    return nil, err
+  }
+  raw, err = prepareConfig(raw, reflect.TypeOf(Policy{}), "$", nil)
+  if err != nil {
+    return nil, err
+  }
+  buf, _ := json.Marshal(raw)
+  dec := json.NewDecoder(bytes.NewReader(buf))
+  dec.DisallowUnknownFields()
+  p := &Policy{}
+  if err := dec.Decode(p); err != nil {
+    return nil, err
+  }
+  return p, nil
+}
+
+
+//
+// 设置策略, 在 Run() 时应用, 参考 LoadPolicy()
+//
+func (b *Brick) SetPolicy(p *Policy) {
+  b.policy.lock.Lock()
+  defer b.policy.lock.Unlock()
+  b.policy.pending = p
+}
+
+
+//
+// 检查策略并应用到路由, 由 Run() 调用
+//
+func (b *Brick) applyPolicy() error {
+  b.policy.lock.Lock()
+  p := b.policy.pending
+  b.policy.pending = nil
+  b.policy.lock.Unlock()
+  if p == nil {
+    return nil
+  }
+
+  b.routeLock.RLock()
+  routes := append([]*Route(nil), b.routes...)
+  b.routeLock.RUnlock()
+  b.auth.lock.RLock()
+  hasAuth := len(b.auth.list) > 0
+  b.auth.lock.RUnlock()
+
+  merged := make(map[*Route]*RoutePolicy)
+  for i := range p.Routes {
+    rp := &p.Routes[i]
+    if err := rp.validate(hasAuth); err != nil {
+      return fmt.Errorf("policy routes[%d] '%s': %w", i, rp.Match, err)
+    }
+    n := 0
+    for _, rt := range routes {
+      if !rp.matches(rt) {
+        continue
+      }
+      // 静态文件和跳转不经过中间件, 策略不会生效
+      if rt.info.Kind != "service" {
+        return fmt.Errorf("policy routes[%d] '%s' matches %s route '%s', policies only apply to services",
+            i, rp.Match, rt.info.Kind, rt.info.Host + rt.info.Path)
+      }
+      n++
+      m := merged[rt]
+      if m == nil {
+        m = &RoutePolicy{ Match: rt.info.Host + rt.info.Path }
+        merged[rt] = m
+      }
+      m.merge(rp)
+    }
+    if n == 0 {
+      return fmt.Errorf("policy routes[%d] '%s' does not match any route", i, rp.Match)
+    }
+  }
+
+  for rt, m := range merged {
+    // 与 Http.rkey 相同, 虚拟主机上的路由带有主机
+    key := rt.info.Host + rt.info.Path
+    switch m.Auth {
+    case "public":
+      b.AuthExempt(key)
+    case "required":
+      b.auth.lock.Lock()
+      delete(b.auth.exempt, key)
+      b.auth.lock.Unlock()
+    }
+    if m.RateLimit != nil {
+      b.RateLimit(key, RateLimit{ Rate: m.RateLimit.Rate, Burst: m.RateLimit.Burst })
+    }
+  }
+
+  b.policy.lock.Lock()
+  first := b.policy.routes == nil
+  b.policy.routes = merged
+  b.policy.lock.Unlock()
+  if first {
+    // 在认证之前处理跨域, 预检请求不带认证信息
+    b.middleware = append([]Middleware{ b.policyMiddleware }, b.middleware...)
+  }
+  b.log.Info("Policy applied to", len(merged), "routes")
+  return nil
+}
+
+
+func (rp *RoutePolicy) validate(hasAuth bool) error {
+  if rp.Match == "" {
+    return errors.New("match is empty")
+  }
+  switch rp.Auth {
+  case "", "public", "required":
+  default:
+    return fmt.Errorf("auth must be 'public' or 'required', got '%s'", rp.Auth)
+  }
+  if (rp.Auth == "required" || len(rp.Roles) > 0) && !hasAuth {
+    return errors.New("auth is required but no auth scheme is configured")
+  }
+  if rp.Auth == "public" && len(rp.Roles) > 0 {
+    return errors.New("roles on a public route")
+  }
+  if rp.Cache != "" {
+    if _, err := cacheControl(rp.Cache); err != nil {
+      return err
+    }
+  }
+  if c := rp.CORS; c != nil {
+    if len(c.Origins) == 0 {
+      return errors.New("cors.origins is empty")
+    }
+    for _, o := range c.Origins {
+      if o == "*" && c.Credentials {
+        return errors.New("cors origin '*' cannot be used with credentials")
+      }
+    }
+  }
+  if r := rp.RateLimit; r != nil {
+    conf := RateLimit{ Rate: r.Rate, Burst: r.Burst }
+    if err := conf.validate(); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+
+func (rp *RoutePolicy) matches(rt *Route) bool {
+  name := rt.info.Path
+  if !strings.HasPrefix(rp.Match, "/") {
+    name = rt.info.Host + rt.info.Path
+  }
+  if strings.HasSuffix(rp.Match, "*") {
+    return strings.HasPrefix(name, strings.TrimSuffix(rp.Match, "*"))
+  }
+  return name == rp.Match
+}
+
+
+func (rp *RoutePolicy) merge(o *RoutePolicy) {
+  if o.CORS != nil {
+    rp.CORS = o.CORS
+  }
+  if o.Auth != "" {
+    rp.Auth = o.Auth
+  }
+  if o.Roles != nil {
+    rp.Roles = o.Roles
+  }
+  if o.Cache != "" {
+    rp.Cache = o.Cache
+  }
+  if o.RateLimit != nil {
+    rp.RateLimit = o.RateLimit
+  }
+}
+
+
+func cacheControl(v string) (string, error) {
+  switch v {
+  case "no-store", "no-cache", "private":
+    return v, nil
+  }
+  d, err := time.ParseDuration(v)
+  if err != nil || d < 0 {
+    return "", fmt.Errorf("cache must be no-store, no-cache, private or a duration, got '%s'", v)
+  }
+  if d == 0 {
+    return "no-cache", nil
+  }
+  return "max-age="+ strconv.FormatFloat(d.Seconds(), 'f', 0, 64), nil
+}
+
+
+func (b *Brick) routePolicy(rt *Route) *RoutePolicy {
+  b.policy.lock.RLock()
+  defer b.policy.lock.RUnlock()
+  return b.policy.routes[rt]
+}
+
+
+//
+// 跨域和缓存策略, 预检请求直接返回 204
+//
+func (b *Brick) policyMiddleware(next HttpHandler) HttpHandler {
+  return func(h *Http) error {
+    rp := b.routePolicy(h.rt)
+    if rp == nil {
+      return next(h)
+    }
+    if rp.CORS != nil && rp.CORS.apply(h.rt, h.W.Header(), h.R) {
+      h.W.WriteHeader(http.StatusNoContent)
+      return nil
+    }
+    if rp.Cache != "" {
+      cc, _ := cacheControl(rp.Cache)
+      h.W.Header().Set("Cache-Control", cc)
+    }
+    return next(h)
+  }
+}
+
+
+//
+// 没有匹配方法的 OPTIONS 请求不经过中间件, 由 dispatch() 调用
+//
+func (b *Brick) policyPreflight(rt *Route, hdr http.Header, r *http.Request) {
+  if rp := b.routePolicy(rt); rp != nil && rp.CORS != nil {
+    rp.CORS.apply(rt, hdr, r)
+  }
+}
+
+
+//
+// 来源允许时设置跨域响应头, 是预检请求时返回 true
+//
+func (c *CORSPolicy) apply(rt *Route, hdr http.Header, r *http.Request) bool {
+  origin := r.Header.Get("Origin")
+  preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+  if origin == "" {
+    return false
+  }
+  addVary(hdr, "Origin")
+  allowed, any := false, false
+  for _, o := range c.Origins {
+    if o == "*" {
+      any = true
+    }
+    if o == "*" || strings.EqualFold(o, origin) {
+      allowed = true
+    }
+  }
+  if !allowed {
+    return preflight
+  }
+
+  if any && !c.Credentials {
+    hdr.Set("Access-Control-Allow-Origin", "*")
+  } else {
+    hdr.Set("Access-Control-Allow-Origin", origin)
+  }
+  if c.Credentials {
+    hdr.Set("Access-Control-Allow-Credentials", "true")
+  }
+  if !preflight {
+    if len(c.Expose) > 0 {
+      hdr.Set("Access-Control-Expose-Headers", strings.Join(c.Expose, ", "))
+    }
+    return false
+  }
+
+  methods := c.Methods
+  if len(methods) == 0 {
+    methods = rt.Info().Methods
+  }
+  if len(methods) == 0 {
+    methods = []string{ http.MethodGet, http.MethodHead, http.MethodPost }
+  }
+  hdr.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+  if len(c.Headers) > 0 {
+    hdr.Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ", "))
+  }
+  if c.MaxAge > 0 {
+    hdr.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+  }
+  return true
+}
+
+
+//
+// 认证的用户是否满足路由策略中的角色, 由认证中间件调用
+//
+func (b *Brick) policyAllows(rt *Route, p *Principal) bool {
+  rp := b.routePolicy(rt)
+  if rp == nil || len(rp.Roles) == 0 {
+    return true
+  }
+  for _, want := range rp.Roles {
+    for _, has := range p.Roles {
+      if want == has {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+
+type yamlLine struct {
+  num    int
+  indent int
+  text   string
+}
+
+
+//
+// 解析 yaml 的子集: 缩进的映射和列表, 行内列表 [a, b] 和映射 {a: 1},
+// 带引号和不带引号的字符串, 数字, 布尔值, null 和注释. 不支持多行字符串, 锚点和多文档.
+//
+func parseYAML(src string) (interface{}, error) {
+  var lines []yamlLine
+  for i, s := range strings.Split(src, "\n") {
+    s = strings.TrimRight(yamlComment(s), " \r")
+    text := strings.TrimLeft(s, " ")
+    if text == "" || text == "---" {
+      continue
+    }
+    if strings.HasPrefix(text, "\t") {
+      return nil, fmt.Errorf("yaml line %d: tab in indentation", i+1)
+    }
+    lines = append(lines, yamlLine{ num: i+1, indent: len(s) - len(text), text: text })
+  }
+  if len(lines) == 0 {
+    return nil, nil
+  }
+  v, next, err := parseYAMLBlock(lines, 0, lines[0].indent)
+  if err != nil {
+    return nil, err
+  }
+  if next < len(lines) {
+    return nil, fmt.Errorf("yaml line %d: bad indentation", lines[next].num)
+  }
+  return v, nil
+}
+
+
+func parseYAMLBlock(lines []yamlLine, i int, indent int) (interface{}, int, error) {
+  if isYAMLItem(lines[i].text) {
+    var list []interface{}
+    for i < len(lines) && lines[i].indent == indent && isYAMLItem(lines[i].text) {
+      l := lines[i]
+      rest := strings.TrimLeft(l.text[1:], " ")
+      if rest == "" {
+        if i+1 < len(lines) && lines[i+1].indent > indent {
+          v, next, err := parseYAMLBlock(lines, i+1, lines[i+1].indent)
+          if err != nil {
+            return nil, 0, err
+          }
+          list, i = append(list, v), next
+        } else {
+          list, i = append(list, nil), i+1
+        }
+        continue
+      }
+      if _, _, ok := splitYAMLKey(rest); ok && rest[0] != '[' && rest[0] != '{' {
+        // "- key: value" 开始一个映射, 映射的缩进是 key 的位置
+        lines[i] = yamlLine{ num: l.num, indent: l.indent + len(l.text) - len(rest), text: rest }
+        v, next, err := parseYAMLBlock(lines, i, lines[i].indent)
+        if err != nil {
+          return nil, 0, err
+        }
+        list, i = append(list, v), next
+        continue
+      }
+      v, err := yamlAtom(rest, l.num)
+      if err != nil {
+        return nil, 0, err
+      }
+      list, i = append(list, v), i+1
+    }
+    return list, i, nil
+  }
+
+  m := make(map[string]interface{})
+  for i < len(lines) && lines[i].indent == indent {
+    l := lines[i]
+    key, rest, ok := splitYAMLKey(l.text)
+    if !ok {
+      return nil, 0, fmt.Errorf("yaml line %d: expected 'key: value'", l.num)
+    }
+    if _, dup := m[key]; dup {
+      return nil, 0, fmt.Errorf("yaml line %d: duplicate key '%s'", l.num, key)
+    }
+    i++
+    if rest != "" {
+      v, err := yamlAtom(rest, l.num)
+      if err != nil {
+        return nil, 0, err
+      }
+      m[key] = v
+      continue
+    }
+    switch {
+    case i < len(lines) && lines[i].indent > indent:
+    case i < len(lines) && lines[i].indent == indent && isYAMLItem(lines[i].text):
+    default:
+      m[key] = nil
+      continue
+    }
+    v, next, err := parseYAMLBlock(lines, i, lines[i].indent)
+    if err != nil {
+      return nil, 0, err
+    }
+    m[key], i = v, next
+  }
+  if i < len(lines) && lines[i].indent > indent {
+    return nil, 0, fmt.Errorf("yaml line %d: bad indentation", lines[i].num)
+  }
+  return m, i, nil
+}
+
+
+func isYAMLItem(text string) bool {
+  return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+
+//
+// 分开 "key: value", 冒号后面必须是空格或行尾, 引号中的冒号不算
+//
+func splitYAMLKey(text string) (string, string, bool) {
+  var quote byte
+  for i := 0; i < len(text); i++ {
+    c := text[i]
+    switch {
+    case quote != 0:
+      if c == '\\' && quote == '"' {
+        i++
+      } else if c == quote {
+        quote = 0
+      }
+    case c == '"' || c == '\'':
+      quote = c
+    case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+      key := strings.TrimSpace(text[:i])
+      if k, err := yamlAtom(key, 0); err == nil {
+        if s, ok := k.(string); ok {
+          key = s
+        }
+      }
+      return key, strings.TrimSpace(text[i+1:]), key != ""
+    }
+  }
+  return "", "", false
+}
+
+
+//
+// 删除注释: 行首或空格后的 "#", 引号中的除外
+//
+func yamlComment(s string) string {
+  var quote byte
+  for i := 0; i < len(s); i++ {
+    c := s[i]
+    switch {
+    case quote != 0:
+      if c == '\\' && quote == '"' {
+        i++
+      } else if c == quote {
+        quote = 0
+      }
+    case c == '"' || c == '\'':
+      quote = c
+    case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+      return s[:i]
+    }
+  }
+  return s
+}
+
+
+func yamlAtom(s string, num int) (interface{}, error) {
+  switch {
+  case s == "" || s == "~" || s == "null":
+    return nil, nil
+  case s == "true":
+    return true, nil
+  case s == "false":
+    return false, nil
+  case s[0] == '"':
+    v, err := strconv.Unquote(s)
+    if err != nil {
+      return nil, fmt.Errorf("yaml line %d: bad string %s", num, s)
+    }
+    return v, nil
+  case s[0] == '\'':
+    if len(s) < 2 || s[len(s)-1] != '\'' {
+      return nil, fmt.Errorf("yaml line %d: bad string %s", num, s)
+    }
+    return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+  case s[0] == '[' || s[0] == '{':
+    return yamlFlow(s, num)
+  case s[0] == '&' || s[0] == '*' || s[0] == '|' || s[0] == '>' || s[0] == '!':
+    return nil, fmt.Errorf("yaml line %d: unsupported syntax %s", num, s)
+  }
+  if _, err := strconv.ParseFloat(s, 64); err == nil {
+    return json.Number(s), nil
+  }
+  return s, nil
+}
+
+
+//
+// 行内的 [a, b] 和 {a: 1, b: 2}, 不支持嵌套
+//
+func yamlFlow(s string, num int) (interface{}, error) {
+  open, close := s[0], byte(']')
+  if open == '{' {
+    close = '}'
+  }
+  if s[len(s)-1] != close {
+    return nil, fmt.Errorf("yaml line %d: unterminated %c", num, open)
+  }
+  body := strings.TrimSpace(s[1:len(s)-1])
+  var parts []string
+  if body != "" {
+    var quote byte
+    start := 0
+    for i := 0; i < len(body); i++ {
+      c := body[i]
+      switch {
+      case quote != 0:
+        if c == '\\' && quote == '"' {
+          i++
+        } else if c == quote {
+          quote = 0
+        }
+      case c == '"' || c == '\'':
+        quote = c
+      case c == '[' || c == '{':
+        return nil, fmt.Errorf("yaml line %d: nested flow collections are not supported", num)
+      case c == ',':
+        parts = append(parts, strings.TrimSpace(body[start:i]))
+        start = i+1
+      }
+    }
+    parts = append(parts, strings.TrimSpace(body[start:]))
+  }
+
+  if open == '[' {
+    list := make([]interface{}, 0, len(parts))
+    for _, p := range parts {
+      v, err := yamlAtom(p, num)
+      if err != nil {
+        return nil, err
+      }
+      list = append(list, v)
+    }
+    return list, nil
+  }
+  m := make(map[string]interface{}, len(parts))
+  for _, p := range parts {
+    key, rest, ok := splitYAMLKey(p)
+    if !ok {
+      return nil, fmt.Errorf("yaml line %d: expected 'key: value' in %s", num, s)
+    }
+    v, err := yamlAtom(rest, num)
+    if err != nil {
+      return nil, err
+    }
+    m[key] = v
+  }
+  return m, nil
+}
@@ -0,0 +1,133 @@
+package brick
+
+import (
+  "encoding/json"
+  "reflect"
+  "testing"
+  "time"
+)
+
+
+func TestParseYAML(t *testing.T) {
+  tests := []struct {
+    name string
+    src  string
+    want string
+    ok   bool
+  }{
+    { "empty",    "# only a comment\n---\n", `null`, true },
+    { "scalars",  "a: 1\nb: true\nc: ~\nd: hello world\ne: '1'\nf: \"x: y\"",
+      `{"a":1,"b":true,"c":null,"d":"hello world","e":"1","f":"x: y"}`, true },
+    { "comments", "a: x#y # comment\nb: 'a # b'",
+      `{"a":"x#y","b":"a # b"}`, true },
+    { "nested",   "a:\n  b:\n    c: 1\n  d: 2",
+      `{"a":{"b":{"c":1},"d":2}}`, true },
+    { "list",     "- 1\n- two\n-\n- [a, 'b, c']",
+      `[1,"two",null,["a","b, c"]]`, true },
+    { "list of maps", "routes:\n  - match: /a\n    auth: public\n  - match: /b",
+      `{"routes":[{"auth":"public","match":"/a"},{"match":"/b"}]}`, true },
+    { "list at key indent", "a:\n- 1\n- 2\nb: 3",
+      `{"a":[1,2],"b":3}`, true },
+    { "flow map", "rl: { rate: 10, burst: 20 }",
+      `{"rl":{"burst":20,"rate":10}}`, true },
+    { "empty value", "a:\nb: 1", `{"a":null,"b":1}`, true },
+    { "tab",          "a:\n\tb: 1",    ``, false },
+    { "duplicate",    "a: 1\na: 2",    ``, false },
+    { "bad indent",   "a: 1\n    b: 2", ``, false },
+    { "no key",       "a: 1\nplain",   ``, false },
+    { "nested flow",  "a: [[1]]",      ``, false },
+    { "unterminated", "a: [1, 2",      ``, false },
+    { "anchor",       "a: &x 1",       ``, false },
+    { "bad string",   `a: "x`,         ``, false },
+  }
+  for _, tt := range tests {
+    v, err := parseYAML(tt.src)
+    if (err == nil) != tt.ok {
+      t.Errorf("%s: error = %v", tt.name, err)
+      continue
+    }
+    if !tt.ok {
+      continue
+    }
+    got, _ := json.Marshal(v)
+    if string(got) != tt.want {
+      t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+    }
+  }
+}
+
+
+func TestParsePolicy(t *testing.T) {
+  yaml := `
+routes:
+  - match: /api/*
+    cors:
+      origins: [https://app.example.com]
+      credentials: true
+      max_age: 1h
+    cache: no-store
+    rate_limit: { rate: 10, burst: 20 }
+  - match: /admin/*
+    auth: required
+    roles: [admin]
+`
+  want := &Policy{ Routes: []RoutePolicy{
+    { Match: "/api/*", Cache: "no-store",
+      CORS: &CORSPolicy{ Origins: []string{ "https://app.example.com" },
+                         Credentials: true, MaxAge: time.Hour },
+      RateLimit: &RateLimitPolicy{ Rate: 10, Burst: 20 } },
+    { Match: "/admin/*", Auth: "required", Roles: []string{ "admin" } },
+  }}
+
+  tests := []struct {
+    name string
+    src  string
+    ok   bool
+  }{
+    { "yaml",          yaml, true },
+    { "json",          `{"routes":[{"match":"/api/*","cors":{"origins":["https://app.example.com"],
+      "credentials":true,"max_age":"1h"},"cache":"no-store","rate_limit":{"rate":10,"burst":20}},
+      {"match":"/admin/*","auth":"required","roles":["admin"]}]}`, true },
+    { "unknown field", "routes:\n  - match: /a\n    caching: 1m", false },
+    { "bad duration",  "routes:\n  - match: /a\n    cors:\n      origins: [x]\n      max_age: soon", false },
+    { "bad yaml",      "routes:\n\t- match: /a", false },
+  }
+  for _, tt := range tests {
+    p, err := ParsePolicy([]byte(tt.src))
+    if (err == nil) != tt.ok {
+      t.Errorf("%s: error = %v", tt.name, err)
+      continue
+    }
+    if tt.ok && !reflect.DeepEqual(p, want) {
+      t.Errorf("%s: got %+v", tt.name, p)
+    }
+  }
+}
+
+
+func TestRoutePolicyValidate(t *testing.T) {
+  tests := []struct {
+    name    string
+    rp      RoutePolicy
+    hasAuth bool
+    ok      bool
+  }{
+    { "plain",            RoutePolicy{ Match: "/a" }, false, true },
+    { "no match",         RoutePolicy{}, false, false },
+    { "bad auth",         RoutePolicy{ Match: "/a", Auth: "maybe" }, true, false },
+    { "auth without scheme", RoutePolicy{ Match: "/a", Auth: "required" }, false, false },
+    { "roles",            RoutePolicy{ Match: "/a", Roles: []string{ "admin" } }, true, true },
+    { "public roles",     RoutePolicy{ Match: "/a", Auth: "public", Roles: []string{ "x" } }, true, false },
+    { "cache duration",   RoutePolicy{ Match: "/a", Cache: "10m" }, false, true },
+    { "bad cache",        RoutePolicy{ Match: "/a", Cache: "forever" }, false, false },
+    { "cors no origins",  RoutePolicy{ Match: "/a", CORS: &CORSPolicy{} }, false, false },
+    { "cors star creds",  RoutePolicy{ Match: "/a",
+        CORS: &CORSPolicy{ Origins: []string{ "*" }, Credentials: true } }, false, false },
+    { "bad rate limit",   RoutePolicy{ Match: "/a", RateLimit: &RateLimitPolicy{} }, false, false },
+  }
+  for _, tt := range tests {
+    if err := tt.rp.validate(tt.hasAuth); (err == nil) != tt.ok {
+      t.Errorf("%s: validate = %v", tt.name, err)
+    }
+  }
+}
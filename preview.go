@@ -0,0 +1,135 @@
+package brick
+
+import (
+  "bytes"
+  "fmt"
+  "html"
+  "net/http"
+  "net/url"
+  "path/filepath"
+  "sync"
+)
+
+//
+// 注册的邮件模板, 参考 Brick.EmailTemplate()
+//
+type EmailTemplateInfo struct {
+  Name string `json:"name"`
+  File string `json:"file"`
+}
+
+type emailTemplate struct {
+  EmailTemplateInfo
+  sample func() interface{}
+}
+
+type emailTemplates struct {
+  lock sync.Mutex
+  list []*emailTemplate
+}
+
+
+//
+// 注册一个邮件模板和预览用的示例数据, sample 可以是 func() interface{}, 每次预览时调用.
+// 模板中 {{ define "subject" }} 定义的主题显示在预览页的标题中.
+//
+func (b *Brick) EmailTemplate(name string, file string, sample interface{}) {
+  et := &emailTemplate{ EmailTemplateInfo: EmailTemplateInfo{ Name: name, File: file } }
+  if fn, ok := sample.(func() interface{}); ok {
+    et.sample = fn
+  } else {
+    et.sample = func() interface{} { return sample }
+  }
+  b.emails.lock.Lock()
+  defer b.emails.lock.Unlock()
+  for i, e := range b.emails.list {
+    if e.Name == name {
+      b.emails.list[i] = et
+      return
+    }
+  }
+  b.emails.list = append(b.emails.list, et)
+}
+
+
+//
+// 所有注册的邮件模板
+//
+func (b *Brick) EmailTemplates() []EmailTemplateInfo {
+  b.emails.lock.Lock()
+  defer b.emails.lock.Unlock()
+  ret := make([]EmailTemplateInfo, len(b.emails.list))
+  for i, e := range b.emails.list {
+    ret[i] = e.EmailTemplateInfo
+  }
+  return ret
+}
+
+
+//
+// 只在 Debug 模式下可用的邮件预览, 非 Debug 返回 404:
+// 没有参数时列出全部模板, ?name=welcome 用示例数据渲染模板, 不发送任何邮件.
+// 例如 b.Service("/debug/email", b.EmailPreview())
+//
+func (b *Brick) EmailPreview() HttpHandler {
+  return func(h *Http) error {
+    if !b.Debug {
+      return NewHttpError(http.StatusNotFound, "")
+    }
+    h.CacheTime(0)
+    name := h.R.URL.Query().Get("name")
+    if name == "" {
+      return b.emailList(h)
+    }
+
+    var et *emailTemplate
+    b.emails.lock.Lock()
+    for _, e := range b.emails.list {
+      if e.Name == name {
+        et = e
+      }
+    }
+    b.emails.lock.Unlock()
+    if et == nil {
+      return Errorf(http.StatusNotFound, "email template '%s' not found", name)
+    }
+
+    ct, err := b.GetCachedTemplate(et.File)
+    if err != nil {
+      return err
+    }
+    data := et.sample()
+    var buf bytes.Buffer
+    fc := TplFuncCtx{ &buf, &data, filepath.Dir(et.File), ct.template, h }
+    if err := ct.template.Execute(&buf, fc); err != nil {
+      return err
+    }
+    if sub := ct.template.Lookup("subject"); sub != nil {
+      var subject bytes.Buffer
+      if err := sub.Execute(&subject, fc); err != nil {
+        return err
+      }
+      h.W.Header().Set("X-Email-Subject", subject.String())
+    }
+    h.W.Header().Set("Content-Type", "text/html; charset=utf-8")
+    _, err = buf.WriteTo(h.W)
+    return err
+  }
+}
+
+
+func (b *Brick) emailList(h *Http) error {
+  list := b.EmailTemplates()
+  if h.WantsJSON() {
+    h.Json(Msg{ Data: list })
+    return nil
+  }
+  h.W.Header().Set("Content-Type", "text/html; charset=utf-8")
+  h.WriteStr("<table><tr><th>Name</th><th>File</th></tr>\n")
+  for _, e := range list {
+    fmt.Fprintf(h.W, "<tr><td><a href=\"?name=%s\">%s</a></td><td>%s</td></tr>\n",
+        html.EscapeString(url.QueryEscape(e.Name)), html.EscapeString(e.Name), html.EscapeString(e.File))
+  }
+  h.WriteStr("</table>")
+  return nil
+}
@@ -0,0 +1,238 @@
+package brick
+
+import (
+  "context"
+  "errors"
+  "net"
+  "net/http"
+  "net/http/httputil"
+  "net/url"
+  "strings"
+  "time"
+)
+
+//
+// ProxyMapping 的选项
+//
+type ProxyOption func(*proxyOptions)
+
+type proxyOptions struct {
+  stripPrefix     bool
+  preserveHost    bool
+  setHeader       http.Header
+  removeHeader    []string
+  responseHeader  http.Header
+  dialTimeout     time.Duration
+  responseTimeout time.Duration
+  flushInterval   time.Duration
+  transport       http.RoundTripper
+}
+
+type proxyErrorKey struct{}
+
+
+//
+// 转发前从路径中去掉 ProxyMapping 的前缀
+//
+func ProxyStripPrefix() ProxyOption {
+  return func(o *proxyOptions) {
+    o.stripPrefix = true
+  }
+}
+
+
+//
+// 保留客户端请求的 Host 头域, 默认改写为目标服务的 Host
+//
+func ProxyPreserveHost() ProxyOption {
+  return func(o *proxyOptions) {
+    o.preserveHost = true
+  }
+}
+
+
+//
+// 设置发往目标服务的请求头
+//
+func ProxySetHeader(name string, value string) ProxyOption {
+  return func(o *proxyOptions) {
+    o.setHeader.Set(name, value)
+  }
+}
+
+
+//
+// 删除发往目标服务的请求头, 例如 "Cookie"
+//
+func ProxyRemoveHeader(names ...string) ProxyOption {
+  return func(o *proxyOptions) {
+    o.removeHeader = append(o.removeHeader, names...)
+  }
+}
+
+
+//
+// 设置返回给客户端的响应头
+//
+func ProxyResponseHeader(name string, value string) ProxyOption {
+  return func(o *proxyOptions) {
+    o.responseHeader.Set(name, value)
+  }
+}
+
+
+//
+// 连接目标服务和等待响应头的超时时间, 0 表示不限制
+//
+func ProxyTimeout(dial time.Duration, responseHeader time.Duration) ProxyOption {
+  return func(o *proxyOptions) {
+    o.dialTimeout = dial
+    o.responseTimeout = responseHeader
+  }
+}
+
+
+//
+// 响应体刷新到客户端的间隔, 负数表示每次写出后立即刷新;
+// 流式响应 (text/event-stream 或没有长度) 总是立即刷新.
+//
+func ProxyFlushInterval(d time.Duration) ProxyOption {
+  return func(o *proxyOptions) {
+    o.flushInterval = d
+  }
+}
+
+
+//
+// 使用自定义的 Transport, 此时 ProxyTimeout 无效
+//
+func ProxyTransport(t http.RoundTripper) ProxyOption {
+  return func(o *proxyOptions) {
+    o.transport = t
+  }
+}
+
+
+//
+// 把 prefix 路径上的请求转发到 target, 请求和响应体以流的方式传输,
+// 支持 WebSocket 升级; 转发失败时错误交给 HttpErrorHandler 处理.
+// 协议升级, 接受 text/event-stream 的请求, 以及 ProxyFlushInterval() 为负数时的全部请求
+// 不受 Config.RequestTimeout 限制.
+//
+func (b *Brick) ProxyMapping(prefix string, target *url.URL, opts ...ProxyOption) {
+  o := &proxyOptions{
+    setHeader      : http.Header{},
+    responseHeader : http.Header{},
+    dialTimeout    : 30 * time.Second,
+  }
+  for _, op := range opts {
+    op(o)
+  }
+  rp := b.newReverseProxy(prefix, target, o)
+
+  rt := b.Service(prefix, func(h *Http) error {
+    var proxyErr error
+    ctx := context.WithValue(h.R.Context(), proxyErrorKey{}, &proxyErr)
+    rp.ServeHTTP(h.W, h.R.WithContext(ctx))
+    if proxyErr == nil {
+      return nil
+    }
+    if errors.Is(proxyErr, context.DeadlineExceeded) {
+      return WrapHttpError(http.StatusGatewayTimeout, proxyErr)
+    }
+    if ne, ok := proxyErr.(net.Error); ok && ne.Timeout() {
+      return WrapHttpError(http.StatusGatewayTimeout, proxyErr)
+    }
+    return WrapHttpError(http.StatusBadGateway, proxyErr)
+  })
+  rt.untimed = func(r *http.Request) bool {
+    return o.flushInterval < 0 || r.Header.Get("Upgrade") != "" ||
+        strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+  }
+}
+
+
+func (b *Brick) newReverseProxy(prefix string, target *url.URL,
+    o *proxyOptions) *httputil.ReverseProxy {
+  transport := o.transport
+  if transport == nil {
+    transport = &http.Transport{
+      Proxy                 : http.ProxyFromEnvironment,
+      DialContext           : (&net.Dialer{ Timeout: o.dialTimeout }).DialContext,
+      ResponseHeaderTimeout : o.responseTimeout,
+      MaxIdleConns          : 100,
+      IdleConnTimeout       : 90 * time.Second,
+    }
+  }
+
+  director := func(r *http.Request) {
+    p := r.URL.Path
+    if o.stripPrefix {
+      p = "/"+ strings.TrimPrefix(strings.TrimPrefix(p, prefix), "/")
+    }
+    r.Header.Set("X-Forwarded-Host", r.Host)
+    if r.TLS != nil {
+      r.Header.Set("X-Forwarded-Proto", "https")
+    } else {
+      r.Header.Set("X-Forwarded-Proto", "http")
+    }
+
+    r.URL.Scheme = target.Scheme
+    r.URL.Host = target.Host
+    r.URL.Path = joinURLPath(target.Path, p)
+    r.URL.RawPath = ""
+    if target.RawQuery == "" || r.URL.RawQuery == "" {
+      r.URL.RawQuery = target.RawQuery + r.URL.RawQuery
+    } else {
+      r.URL.RawQuery = target.RawQuery +"&"+ r.URL.RawQuery
+    }
+    if !o.preserveHost {
+      r.Host = target.Host
+    }
+
+    for _, name := range o.removeHeader {
+      r.Header.Del(name)
+    }
+    for name, v := range o.setHeader {
+      r.Header[name] = v
+    }
+    if _, has := r.Header["User-Agent"]; !has {
+      r.Header.Set("User-Agent", "")
+    }
+  }
+
+  return &httputil.ReverseProxy{
+    Director      : director,
+    Transport     : transport,
+    FlushInterval : o.flushInterval,
+
+    ModifyResponse: func(res *http.Response) error {
+      for name, v := range o.responseHeader {
+        res.Header[name] = v
+      }
+      return nil
+    },
+
+    ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+      if p, ok := r.Context().Value(proxyErrorKey{}).(*error); ok {
+        *p = err
+        return
+      }
+      b.log.Error("Proxy", r.URL.Path, err)
+      w.WriteHeader(http.StatusBadGateway)
+    },
+  }
+}
+
+
+func joinURLPath(a string, b string) string {
+  aslash := strings.HasSuffix(a, "/")
+  bslash := strings.HasPrefix(b, "/")
+  switch {
+  case aslash && bslash:
+    return a + b[1:]
+  case !aslash && !bslash:
+    return a +"/"+ b
+  }
+  return a + b
+}
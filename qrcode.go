@@ -0,0 +1,551 @@
+package brick
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "image"
+  "image/color"
+  "image/png"
+  "strings"
+)
+
+// 二维码四周的空白, 单位是模块
+const qrQuietZone = 4
+
+// 纠错等级 M 每个版本的纠错码字数 (每块) 和块数, 下标是版本号
+var (
+  qrECCPerBlock = [41]int{ -1,
+    10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+    26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28 }
+  qrECCBlocks = [41]int{ -1,
+    1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+    17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49 }
+)
+
+//
+// QR 码 (ISO/IEC 18004), 字节模式, 纠错等级 M, 参考 NewQRCode()
+//
+type QRCode struct {
+  size    int
+  modules []bool
+  // 功能图形 (定位, 时序, 格式信息等) 的位置, 不参与掩码
+  fixed   []bool
+}
+
+
+//
+// 把 text 编码为能容纳它的最小版本的 QR 码, 超过版本 40 的容量 (2331 字节) 时返回错误.
+// 用于 TOTPURI() 之类的短文本, 输出参考 PNG() 和 SVG().
+//
+func NewQRCode(text string) (*QRCode, error) {
+  data := []byte(text)
+  ver := 1
+  for ; ver <= 40; ver++ {
+    if qrDataBits(data, ver) <= qrDataCodewords(ver) * 8 {
+      break
+    }
+  }
+  if ver > 40 {
+    return nil, errors.New("QR code: text too long")
+  }
+
+  q := &QRCode{ size: ver * 4 + 17 }
+  q.modules = make([]bool, q.size * q.size)
+  q.fixed = make([]bool, q.size * q.size)
+  q.drawPatterns(ver)
+  q.drawCodewords(qrInterleave(qrEncode(data, ver), ver))
+
+  best, penalty := 0, -1
+  for mask := 0; mask < 8; mask++ {
+    q.applyMask(mask)
+    q.drawFormat(mask)
+    if p := q.penalty(); penalty < 0 || p < penalty {
+      best, penalty = mask, p
+    }
+    q.applyMask(mask)
+  }
+  q.applyMask(best)
+  q.drawFormat(best)
+  q.fixed = nil
+  return q, nil
+}
+
+
+//
+// 每边的模块数, 不含空白
+//
+func (q *QRCode) Size() int {
+  return q.size
+}
+
+
+//
+// x 列 y 行的模块是否为深色, 超出范围返回 false
+//
+func (q *QRCode) Dark(x, y int) bool {
+  return x >= 0 && y >= 0 && x < q.size && y < q.size && q.modules[y * q.size + x]
+}
+
+
+//
+// 输出 PNG 图片, 每个模块 scale 像素, 四周留 4 个模块的空白
+//
+func (q *QRCode) PNG(scale int) []byte {
+  if scale < 1 {
+    scale = 1
+  }
+  n := (q.size + qrQuietZone * 2) * scale
+  img := image.NewGray(image.Rect(0, 0, n, n))
+  for i := range img.Pix {
+    img.Pix[i] = 0xff
+  }
+  for y := 0; y < q.size; y++ {
+    for x := 0; x < q.size; x++ {
+      if !q.Dark(x, y) {
+        continue
+      }
+      for dy := 0; dy < scale; dy++ {
+        for dx := 0; dx < scale; dx++ {
+          img.SetGray((x + qrQuietZone) * scale + dx, (y + qrQuietZone) * scale + dy, color.Gray{})
+        }
+      }
+    }
+  }
+  var buf bytes.Buffer
+  png.Encode(&buf, img)
+  return buf.Bytes()
+}
+
+
+//
+// 输出 SVG 图片, 一个模块是一个单位, 可以直接嵌入 html
+//
+func (q *QRCode) SVG() string {
+  n := q.size + qrQuietZone * 2
+  var sb strings.Builder
+  fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, n, n)
+  fmt.Fprintf(&sb, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+  for y := 0; y < q.size; y++ {
+    for x := 0; x < q.size; x++ {
+      if q.Dark(x, y) {
+        fmt.Fprintf(&sb, "M%d %dh1v1h-1z", x + qrQuietZone, y + qrQuietZone)
+      }
+    }
+  }
+  sb.WriteString(`"/></svg>`)
+  return sb.String()
+}
+
+
+func (q *QRCode) set(x, y int, dark bool) {
+  q.modules[y * q.size + x] = dark
+  q.fixed[y * q.size + x] = true
+}
+
+
+//
+// 定位图形, 时序图形, 校正图形和版本信息; 格式信息的位置先占用, 选定掩码后再写入
+//
+func (q *QRCode) drawPatterns(ver int) {
+  n := q.size
+  for i := 0; i < n; i++ {
+    q.set(6, i, i % 2 == 0)
+    q.set(i, 6, i % 2 == 0)
+  }
+  for _, c := range [][2]int{ {3, 3}, {n - 4, 3}, {3, n - 4} } {
+    for dy := -4; dy <= 4; dy++ {
+      for dx := -4; dx <= 4; dx++ {
+        x, y := c[0] + dx, c[1] + dy
+        if x >= 0 && y >= 0 && x < n && y < n {
+          d := qrMax(qrAbs(dx), qrAbs(dy))
+          q.set(x, y, d != 2 && d != 4)
+        }
+      }
+    }
+  }
+
+  pos := qrAlignment(ver)
+  last := len(pos) - 1
+  for i, x := range pos {
+    for j, y := range pos {
+      if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+        continue
+      }
+      for dy := -2; dy <= 2; dy++ {
+        for dx := -2; dx <= 2; dx++ {
+          q.set(x + dx, y + dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+        }
+      }
+    }
+  }
+
+  q.drawFormat(0)
+  if ver >= 7 {
+    rem := ver
+    for i := 0; i < 12; i++ {
+      rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+    }
+    bits := ver << 12 | rem
+    for i := 0; i < 18; i++ {
+      dark := bits >> uint(i) & 1 != 0
+      a, b := n - 11 + i % 3, i / 3
+      q.set(a, b, dark)
+      q.set(b, a, dark)
+    }
+  }
+}
+
+
+//
+// 纠错等级 M 和掩码的格式信息, 两份
+//
+func (q *QRCode) drawFormat(mask int) {
+  data := mask
+  rem := data
+  for i := 0; i < 10; i++ {
+    rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+  }
+  bits := (data << 10 | rem) ^ 0x5412
+  bit := func(i int) bool { return bits >> uint(i) & 1 != 0 }
+
+  n := q.size
+  for i := 0; i <= 5; i++ {
+    q.set(8, i, bit(i))
+  }
+  q.set(8, 7, bit(6))
+  q.set(8, 8, bit(7))
+  q.set(7, 8, bit(8))
+  for i := 9; i < 15; i++ {
+    q.set(14 - i, 8, bit(i))
+  }
+  for i := 0; i < 8; i++ {
+    q.set(n - 1 - i, 8, bit(i))
+  }
+  for i := 8; i < 15; i++ {
+    q.set(8, n - 15 + i, bit(i))
+  }
+  q.set(8, n - 8, true)
+}
+
+
+//
+// 从右下角开始, 两列一组上下交替填入数据
+//
+func (q *QRCode) drawCodewords(data []byte) {
+  n := q.size
+  i := 0
+  for right := n - 1; right >= 1; right -= 2 {
+    if right == 6 {
+      right = 5
+    }
+    for vert := 0; vert < n; vert++ {
+      for j := 0; j < 2; j++ {
+        x := right - j
+        y := vert
+        if (right + 1) & 2 == 0 {
+          y = n - 1 - vert
+        }
+        if !q.fixed[y * n + x] && i < len(data) * 8 {
+          q.modules[y * n + x] = data[i >> 3] >> uint(7 - i & 7) & 1 != 0
+          i++
+        }
+      }
+    }
+  }
+}
+
+
+func (q *QRCode) applyMask(mask int) {
+  n := q.size
+  for y := 0; y < n; y++ {
+    for x := 0; x < n; x++ {
+      var flip bool
+      switch mask {
+      case 0: flip = (x + y) % 2 == 0
+      case 1: flip = y % 2 == 0
+      case 2: flip = x % 3 == 0
+      case 3: flip = (x + y) % 3 == 0
+      case 4: flip = (x / 3 + y / 2) % 2 == 0
+      case 5: flip = x * y % 2 + x * y % 3 == 0
+      case 6: flip = (x * y % 2 + x * y % 3) % 2 == 0
+      case 7: flip = ((x + y) % 2 + x * y % 3) % 2 == 0
+      }
+      if flip && !q.fixed[y * n + x] {
+        q.modules[y * n + x] = !q.modules[y * n + x]
+      }
+    }
+  }
+}
+
+
+//
+// 掩码的评分 (越小越好): 同色连续的行列, 2x2 同色块, 类似定位图形的序列, 深色比例
+//
+func (q *QRCode) penalty() int {
+  n := q.size
+  p := 0
+  line := make([]bool, n)
+  for dir := 0; dir < 2; dir++ {
+    for a := 0; a < n; a++ {
+      for b := 0; b < n; b++ {
+        if dir == 0 {
+          line[b] = q.modules[a * n + b]
+        } else {
+          line[b] = q.modules[b * n + a]
+        }
+      }
+      run := 1
+      for b := 1; b <= n; b++ {
+        if b < n && line[b] == line[b - 1] {
+          run++
+          continue
+        }
+        if run >= 5 {
+          p += run - 2
+        }
+        run = 1
+      }
+      for b := 0; b + 7 <= n; b++ {
+        if !qrFinderLike(line[b:b + 7]) {
+          continue
+        }
+        if qrLight(line, b - 4, b) || qrLight(line, b + 7, b + 11) {
+          p += 40
+        }
+      }
+    }
+  }
+
+  dark := 0
+  for y := 0; y < n; y++ {
+    for x := 0; x < n; x++ {
+      c := q.modules[y * n + x]
+      if c {
+        dark++
+      }
+      if x + 1 < n && y + 1 < n && c == q.modules[y * n + x + 1] &&
+          c == q.modules[(y + 1) * n + x] && c == q.modules[(y + 1) * n + x + 1] {
+        p += 3
+      }
+    }
+  }
+  total := n * n
+  k := (qrAbs(dark * 20 - total * 10) + total - 1) / total - 1
+  if k > 0 {
+    p += k * 10
+  }
+  return p
+}
+
+
+// 1:1:3:1:1 的深浅序列
+func qrFinderLike(s []bool) bool {
+  return s[0] && !s[1] && s[2] && s[3] && s[4] && !s[5] && s[6]
+}
+
+
+// [from, to) 都是浅色, 超出边界的部分算作浅色
+func qrLight(line []bool, from, to int) bool {
+  for i := from; i < to; i++ {
+    if i >= 0 && i < len(line) && line[i] {
+      return false
+    }
+  }
+  return true
+}
+
+
+//
+// 校正图形中心的坐标
+//
+func qrAlignment(ver int) []int {
+  if ver == 1 {
+    return nil
+  }
+  num := ver / 7 + 2
+  step := (ver * 8 + num * 3 + 5) / (num * 4 - 4) * 2
+  pos := make([]int, num)
+  pos[0] = 6
+  for i, p := num - 1, ver * 4 + 10; i >= 1; i, p = i - 1, p - step {
+    pos[i] = p
+  }
+  return pos
+}
+
+
+//
+// 版本 ver 中除功能图形之外的模块数
+//
+func qrRawModules(ver int) int {
+  n := (16 * ver + 128) * ver + 64
+  if ver >= 2 {
+    num := ver / 7 + 2
+    n -= (25 * num - 10) * num - 55
+    if ver >= 7 {
+      n -= 36
+    }
+  }
+  return n
+}
+
+
+func qrDataCodewords(ver int) int {
+  return qrRawModules(ver) / 8 - qrECCPerBlock[ver] * qrECCBlocks[ver]
+}
+
+
+// 字节模式的字符数字段长度
+func qrCountBits(ver int) int {
+  if ver <= 9 {
+    return 8
+  }
+  return 16
+}
+
+
+func qrDataBits(data []byte, ver int) int {
+  return 4 + qrCountBits(ver) + len(data) * 8
+}
+
+
+//
+// 模式, 长度, 数据, 结束符和填充字节
+//
+func qrEncode(data []byte, ver int) []byte {
+  capacity := qrDataCodewords(ver) * 8
+  var bits []bool
+  put := func(v int, n int) {
+    for i := n - 1; i >= 0; i-- {
+      bits = append(bits, v >> uint(i) & 1 != 0)
+    }
+  }
+  put(4, 4)
+  put(len(data), qrCountBits(ver))
+  for _, c := range data {
+    put(int(c), 8)
+  }
+  put(0, qrMin(4, capacity - len(bits)))
+  put(0, (8 - len(bits) % 8) % 8)
+
+  out := make([]byte, 0, capacity / 8)
+  for i := 0; i < len(bits); i += 8 {
+    var c byte
+    for j := 0; j < 8; j++ {
+      if bits[i + j] {
+        c |= 0x80 >> uint(j)
+      }
+    }
+    out = append(out, c)
+  }
+  for pad := byte(0xec); len(out) < capacity / 8; pad ^= 0xec ^ 0x11 {
+    out = append(out, pad)
+  }
+  return out
+}
+
+
+//
+// 数据分块, 每块加上纠错码, 然后按列交错
+//
+func qrInterleave(data []byte, ver int) []byte {
+  blocks, ecc := qrECCBlocks[ver], qrECCPerBlock[ver]
+  raw := qrRawModules(ver) / 8
+  short := blocks - raw % blocks
+  shortLen := raw / blocks
+  div := qrRSDivisor(ecc)
+
+  list := make([][]byte, blocks)
+  k := 0
+  for i := range list {
+    n := shortLen - ecc
+    if i >= short {
+      n++
+    }
+    dat := append([]byte(nil), data[k:k + n]...)
+    k += n
+    rem := qrRSRemainder(dat, div)
+    if i < short {
+      dat = append(dat, 0)
+    }
+    list[i] = append(dat, rem...)
+  }
+
+  out := make([]byte, 0, raw)
+  for i := range list[0] {
+    for j, blk := range list {
+      if i != shortLen - ecc || j >= short {
+        out = append(out, blk[i])
+      }
+    }
+  }
+  return out
+}
+
+
+//
+// Reed-Solomon 生成多项式的系数 (最高次项的 1 省略), GF(2^8) 模 0x11d
+//
+func qrRSDivisor(degree int) []byte {
+  div := make([]byte, degree)
+  div[degree - 1] = 1
+  root := byte(1)
+  for i := 0; i < degree; i++ {
+    for j := range div {
+      div[j] = qrMul(div[j], root)
+      if j + 1 < degree {
+        div[j] ^= div[j + 1]
+      }
+    }
+    root = qrMul(root, 2)
+  }
+  return div
+}
+
+
+func qrRSRemainder(data []byte, div []byte) []byte {
+  rem := make([]byte, len(div))
+  for _, b := range data {
+    factor := b ^ rem[0]
+    copy(rem, rem[1:])
+    rem[len(rem) - 1] = 0
+    for i, d := range div {
+      rem[i] ^= qrMul(d, factor)
+    }
+  }
+  return rem
+}
+
+
+func qrMul(x, y byte) byte {
+  var z int
+  for i := 7; i >= 0; i-- {
+    z = (z << 1) ^ ((z >> 7) * 0x11d)
+    z ^= int(y >> uint(i) & 1) * int(x)
+  }
+  return byte(z)
+}
+
+
+func qrAbs(v int) int {
+  if v < 0 {
+    return -v
+  }
+  return v
+}
+
+
+func qrMax(a, b int) int {
+  if a > b {
+    return a
+  }
+  return b
+}
+
+
+func qrMin(a, b int) int {
+  if a < b {
+    return a
+  }
+  return b
+}
@@ -0,0 +1,238 @@
+package brick
+
+import (
+  "bytes"
+  "image/png"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+
+//
+// 读出二维码中的文本并检查格式信息和每块的纠错码, 是 NewQRCode() 的逆过程
+//
+func decodeQRCode(t *testing.T, q *QRCode) string {
+  ver := (q.size - 17) / 4
+  n := q.size
+
+  var format int
+  for i := 0; i <= 5; i++ {
+    format |= qrBit(q.Dark(8, i)) << uint(i)
+  }
+  format |= qrBit(q.Dark(8, 7)) << 6 | qrBit(q.Dark(8, 8)) << 7 | qrBit(q.Dark(7, 8)) << 8
+  for i := 9; i < 15; i++ {
+    format |= qrBit(q.Dark(14 - i, 8)) << uint(i)
+  }
+  var copy2 int
+  for i := 0; i < 8; i++ {
+    copy2 |= qrBit(q.Dark(n - 1 - i, 8)) << uint(i)
+  }
+  for i := 8; i < 15; i++ {
+    copy2 |= qrBit(q.Dark(8, n - 15 + i)) << uint(i)
+  }
+  if format != copy2 {
+    t.Fatalf("format copies differ: %015b %015b", format, copy2)
+  }
+  format ^= 0x5412
+  if format >> 13 != 0 {
+    t.Fatalf("error correction level %d, want M", format >> 13)
+  }
+  mask := format >> 10 & 7
+
+  // 重新画出功能图形, 去掉掩码
+  p := &QRCode{ size: n, modules: append([]bool(nil), q.modules...), fixed: make([]bool, n * n) }
+  saved := append([]bool(nil), p.modules...)
+  p.drawPatterns(ver)
+  for i, f := range p.fixed {
+    if f {
+      p.modules[i] = saved[i]
+    }
+  }
+  p.applyMask(mask)
+
+  raw := make([]byte, qrRawModules(ver) / 8)
+  i := 0
+  for right := n - 1; right >= 1; right -= 2 {
+    if right == 6 {
+      right = 5
+    }
+    for vert := 0; vert < n; vert++ {
+      for j := 0; j < 2; j++ {
+        x, y := right - j, vert
+        if (right + 1) & 2 == 0 {
+          y = n - 1 - vert
+        }
+        if !p.fixed[y * n + x] && i < len(raw) * 8 {
+          if p.modules[y * n + x] {
+            raw[i >> 3] |= 0x80 >> uint(i & 7)
+          }
+          i++
+        }
+      }
+    }
+  }
+
+  blocks, ecc := qrECCBlocks[ver], qrECCPerBlock[ver]
+  short := blocks - len(raw) % blocks
+  shortLen := len(raw) / blocks
+  list := make([][]byte, blocks)
+  k := 0
+  for i := 0; i <= shortLen; i++ {
+    for j := range list {
+      if i == shortLen - ecc && j < short {
+        list[j] = append(list[j], 0)
+        continue
+      }
+      list[j] = append(list[j], raw[k])
+      k++
+    }
+  }
+
+  div := qrRSDivisor(ecc)
+  var data []byte
+  for j, blk := range list {
+    n := len(blk) - ecc
+    dat := blk[:n]
+    if j < short {
+      dat = blk[:n - 1]
+    }
+    if !bytes.Equal(qrRSRemainder(dat, div), blk[n:]) {
+      t.Fatalf("version %d block %d: bad error correction codewords", ver, j)
+    }
+    data = append(data, dat...)
+  }
+
+  read := func(pos, bits int) int {
+    v := 0
+    for b := pos; b < pos + bits; b++ {
+      v = v << 1 | int(data[b >> 3] >> uint(7 - b & 7) & 1)
+    }
+    return v
+  }
+  if m := read(0, 4); m != 4 {
+    t.Fatalf("mode %d, want byte mode", m)
+  }
+  count := read(4, qrCountBits(ver))
+  text := make([]byte, count)
+  for c := range text {
+    text[c] = byte(read(4 + qrCountBits(ver) + c * 8, 8))
+  }
+  return string(text)
+}
+
+
+func qrBit(dark bool) int {
+  if dark {
+    return 1
+  }
+  return 0
+}
+
+
+func TestQRCodeRoundTrip(t *testing.T) {
+  tests := []struct {
+    text string
+    ver  int
+  }{
+    { "",                                                     1 },
+    { "HELLO WORLD",                                          1 },
+    { TOTPURI("Brick", "alice@example.com", rfcTOTPSecret),   8 },
+    { strings.Repeat("ab", 70),                               8 },
+    { strings.Repeat("0123456789", 100),                      26 },
+    { strings.Repeat("x", 2331),                              40 },
+  }
+  for _, tt := range tests {
+    q, err := NewQRCode(tt.text)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if ver := (q.Size() - 17) / 4; ver != tt.ver {
+      t.Errorf("len %d: version %d, want %d", len(tt.text), ver, tt.ver)
+    }
+    if got := decodeQRCode(t, q); got != tt.text {
+      t.Errorf("len %d: decoded %q", len(tt.text), got)
+    }
+  }
+
+  if _, err := NewQRCode(strings.Repeat("x", 2332)); err == nil {
+    t.Error("2332 bytes should not fit in version 40")
+  }
+}
+
+
+func TestQRCodeTables(t *testing.T) {
+  // 常用的例子 "HELLO WORLD" 1-M 的数据码字和纠错码字
+  data := []byte{ 32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17 }
+  want := []byte{ 196, 35, 39, 119, 235, 215, 231, 226, 93, 23 }
+  if got := qrRSRemainder(data, qrRSDivisor(10)); !bytes.Equal(got, want) {
+    t.Errorf("Reed-Solomon remainder = %v, want %v", got, want)
+  }
+
+  tests := []struct {
+    ver       int
+    alignment []int
+    codewords int
+  }{
+    { 1,  nil,                                   16 },
+    { 2,  []int{ 6, 18 },                        28 },
+    { 7,  []int{ 6, 22, 38 },                    124 },
+    { 10, []int{ 6, 28, 50 },                    216 },
+    { 40, []int{ 6, 30, 58, 86, 114, 142, 170 }, 2334 },
+  }
+  for _, tt := range tests {
+    if got := qrAlignment(tt.ver); !reflect.DeepEqual(got, tt.alignment) {
+      t.Errorf("version %d: alignment %v, want %v", tt.ver, got, tt.alignment)
+    }
+    if got := qrDataCodewords(tt.ver); got != tt.codewords {
+      t.Errorf("version %d: %d data codewords, want %d", tt.ver, got, tt.codewords)
+    }
+  }
+
+  // 版本 7 的版本信息 000111110010010100, 右上角从低位开始每列 3 位
+  q, _ := NewQRCode(strings.Repeat("x", 110))
+  var bits int
+  for i := 0; i < 18; i++ {
+    bits |= qrBit(q.Dark(q.Size() - 11 + i % 3, i / 3)) << uint(i)
+  }
+  if bits != 0x07c94 {
+    t.Errorf("version information %018b", bits)
+  }
+}
+
+
+func TestQRCodeImages(t *testing.T) {
+  q, err := NewQRCode("HELLO WORLD")
+  if err != nil {
+    t.Fatal(err)
+  }
+  img, err := png.Decode(bytes.NewReader(q.PNG(3)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if s := img.Bounds().Size(); s.X != 87 || s.Y != 87 {
+    t.Errorf("PNG size %v, want 87x87", s)
+  }
+  tests := []struct {
+    x, y int
+    dark bool
+  }{
+    { 0, 0,   false },
+    { 11, 11, false },
+    { 12, 12, true },
+    { 14, 20, true },
+    { 16, 16, false },
+    { 84, 84, false },
+  }
+  for _, tt := range tests {
+    r, _, _, _ := img.At(tt.x, tt.y).RGBA()
+    if (r == 0) != tt.dark {
+      t.Errorf("PNG pixel %d,%d dark = %v", tt.x, tt.y, r == 0)
+    }
+  }
+
+  svg := q.SVG()
+  if !strings.Contains(svg, `viewBox="0 0 29 29"`) || !strings.Contains(svg, "M4 4h1v1h-1z") {
+    t.Errorf("unexpected SVG %.120s", svg)
+  }
+}
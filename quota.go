@@ -0,0 +1,293 @@
+package brick
+
+import (
+  "context"
+  "errors"
+  "net/http"
+  "sort"
+  "strconv"
+  "sync"
+  "time"
+)
+
+//
+// 一个 API key 在一个周期中某类路由的用量
+//
+type Usage struct {
+  Requests int64 `json:"requests"`
+  // 响应体的字节数
+  Bytes    int64 `json:"bytes"`
+}
+
+//
+// 一类路由在一个周期中的额度, 0 表示不限制
+//
+type QuotaLimit struct {
+  Requests int64 `json:"requests"`
+  Bytes    int64 `json:"bytes"`
+}
+
+//
+// 用量的存储, 多个实例共享额度时使用 redis/数据库实现
+//
+type QuotaStore interface {
+  // 累加用量
+  Add(ctx context.Context, apiKey string, period string, class string, u Usage) error
+  // 周期中每类路由的用量
+  Get(ctx context.Context, apiKey string, period string) (map[string]Usage, error)
+}
+
+//
+// 计量 API 的配置, 参考 Brick.EnableQuota()
+//
+type Quota struct {
+  // 返回请求的 API key, 空字符串的请求不计量
+  APIKey func(*Http) string
+  // 每类路由的额度, 类名参考 Brick.RouteClass(); nil 只计量不限制
+  Limits func(apiKey string) map[string]QuotaLimit
+  // 计量周期, 默认 QuotaMonthly
+  Period QuotaPeriod
+  // 默认 NewMemoryQuotaStore()
+  Store  QuotaStore
+}
+
+//
+// 计量周期, 返回时间所在周期的名字, 例如 "2026-10"
+//
+type QuotaPeriod func(time.Time) string
+
+var QuotaMonthly QuotaPeriod = func(t time.Time) string { return t.UTC().Format("2006-01") }
+var QuotaDaily   QuotaPeriod = func(t time.Time) string { return t.UTC().Format("2006-01-02") }
+
+//
+// 用量报告, 参考 Brick.QuotaUsage()
+//
+type QuotaReport struct {
+  Period  string                `json:"period"`
+  Usage   map[string]Usage      `json:"usage"`
+  Limits  map[string]QuotaLimit `json:"limits"`
+}
+
+// 没有设置 RouteClass 的路由的类别
+const DefaultRouteClass = "default"
+
+//
+// 超过额度时返回, 响应 429
+//
+var ErrQuotaExceeded = NewHttpError(http.StatusTooManyRequests, "quota exceeded")
+
+type quotas struct {
+  lock    sync.Mutex
+  conf    *Quota
+  classes map[string]string
+}
+
+
+//
+// 按 API key 计量请求数和响应字节数, 超过额度返回 429 和 ErrQuotaExceeded.
+// 与限流 (Config.RateLimit) 独立, 限流控制速度, 额度控制周期内的总量.
+//
+func (b *Brick) EnableQuota(q Quota) {
+  if q.APIKey == nil {
+    panic(errors.New("Quota.APIKey is required"))
+  }
+  if q.Period == nil {
+    q.Period = QuotaMonthly
+  }
+  if q.Store == nil {
+    q.Store = NewMemoryQuotaStore()
+  }
+  b.quota.lock.Lock()
+  first := b.quota.conf == nil
+  b.quota.conf = &q
+  b.quota.lock.Unlock()
+  if first {
+    b.Use(b.quotaMiddleware)
+  }
+}
+
+
+//
+// 设置 path 路由的计量类别, 例如 "search", "export"; 默认 DefaultRouteClass
+//
+func (b *Brick) RouteClass(path string, class string) {
+  b.quota.lock.Lock()
+  defer b.quota.lock.Unlock()
+  if b.quota.classes == nil {
+    b.quota.classes = make(map[string]string)
+  }
+  b.quota.classes[path] = class
+}
+
+
+//
+// apiKey 在当前周期的用量和额度
+//
+func (b *Brick) QuotaUsage(ctx context.Context, apiKey string) (*QuotaReport, error) {
+  q := b.quotaConf()
+  if q == nil {
+    return nil, errors.New("quota is not enabled")
+  }
+  period := q.Period(time.Now())
+  usage, err := q.Store.Get(ctx, apiKey, period)
+  if err != nil {
+    return nil, err
+  }
+  if usage == nil {
+    usage = map[string]Usage{}
+  }
+  var limits map[string]QuotaLimit
+  if q.Limits != nil {
+    limits = q.Limits(apiKey)
+  }
+  return &QuotaReport{ Period: period, Usage: usage, Limits: limits }, nil
+}
+
+
+//
+// 返回调用者 API key 的用量和额度 (json), 例如 b.Service("/api/usage", b.QuotaPage())
+//
+func (b *Brick) QuotaPage() HttpHandler {
+  return func(h *Http) error {
+    q := b.quotaConf()
+    if q == nil {
+      return NewHttpError(http.StatusNotFound, "")
+    }
+    apiKey := q.APIKey(h)
+    if apiKey == "" {
+      return ErrUnauthorized
+    }
+    report, err := b.QuotaUsage(h.Ctx(), apiKey)
+    if err != nil {
+      return err
+    }
+    h.CacheTime(0)
+    h.Json(Msg{ Data: report })
+    return nil
+  }
+}
+
+
+func (b *Brick) quotaConf() *Quota {
+  b.quota.lock.Lock()
+  defer b.quota.lock.Unlock()
+  return b.quota.conf
+}
+
+
+func (b *Brick) quotaMiddleware(next HttpHandler) HttpHandler {
+  return func(h *Http) error {
+    b.quota.lock.Lock()
+    q := b.quota.conf
+    class, has := b.quota.classes[h.rkey]
+    b.quota.lock.Unlock()
+    if !has {
+      class = DefaultRouteClass
+    }
+    apiKey := q.APIKey(h)
+    if apiKey == "" {
+      return next(h)
+    }
+    period := q.Period(time.Now())
+
+    if q.Limits != nil {
+      if limit, has := q.Limits(apiKey)[class]; has && (limit.Requests > 0 || limit.Bytes > 0) {
+        usage, err := q.Store.Get(h.Ctx(), apiKey, period)
+        if err != nil {
+          // 存储故障时不拒绝请求
+          b.log.Error("Quota store", err)
+        }
+        u := usage[class]
+        if limit.Requests > 0 {
+          h.W.Header().Set("X-Quota-Limit", strconv.FormatInt(limit.Requests, 10))
+          remain := limit.Requests - u.Requests - 1
+          if remain < 0 {
+            remain = 0
+          }
+          h.W.Header().Set("X-Quota-Remaining", strconv.FormatInt(remain, 10))
+        }
+        if (limit.Requests > 0 && u.Requests >= limit.Requests) ||
+            (limit.Bytes > 0 && u.Bytes >= limit.Bytes) {
+          b.metrics.Inc("brick_quota_rejected_total", "Requests rejected by quota.", "class", class)
+          return ErrQuotaExceeded
+        }
+      }
+    }
+
+    err := next(h)
+    var size int64
+    if rw, ok := h.W.(*responseWriter); ok {
+      size = rw.size
+    }
+    // 请求可能已经取消, 计量使用独立的 ctx
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    if e := q.Store.Add(ctx, apiKey, period, class, Usage{ Requests: 1, Bytes: size }); e != nil {
+      b.log.Error("Quota store", e)
+    }
+    return err
+  }
+}
+
+
+//
+// 内存中的用量存储, 只保留最近两个周期, 重启后清零
+//
+func NewMemoryQuotaStore() QuotaStore {
+  return &memoryQuota{ data: make(map[string]map[string]map[string]Usage) }
+}
+
+type memoryQuota struct {
+  lock sync.Mutex
+  // 周期 -> API key -> 类别 -> 用量
+  data map[string]map[string]map[string]Usage
+}
+
+
+func (m *memoryQuota) Add(ctx context.Context, apiKey string, period string, class string, u Usage) error {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  keys := m.data[period]
+  if keys == nil {
+    keys = make(map[string]map[string]Usage)
+    m.data[period] = keys
+    m.trim()
+  }
+  classes := keys[apiKey]
+  if classes == nil {
+    classes = make(map[string]Usage)
+    keys[apiKey] = classes
+  }
+  old := classes[class]
+  classes[class] = Usage{ Requests: old.Requests + u.Requests, Bytes: old.Bytes + u.Bytes }
+  return nil
+}
+
+
+func (m *memoryQuota) Get(ctx context.Context, apiKey string, period string) (map[string]Usage, error) {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  ret := make(map[string]Usage)
+  for class, u := range m.data[period][apiKey] {
+    ret[class] = u
+  }
+  return ret, nil
+}
+
+
+//
+// 周期名按时间排序, 删除最早的; 调用者持有锁
+//
+func (m *memoryQuota) trim() {
+  if len(m.data) <= 2 {
+    return
+  }
+  periods := make([]string, 0, len(m.data))
+  for p := range m.data {
+    periods = append(periods, p)
+  }
+  sort.Strings(periods)
+  for _, p := range periods[:len(periods)-2] {
+    delete(m.data, p)
+  }
+}
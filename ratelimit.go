@@ -0,0 +1,270 @@
+package brick
+
+import (
+  "errors"
+  "fmt"
+  "math"
+  "net"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+)
+
+//
+// 令牌桶限流配置, 每秒补充 Rate 个令牌, 最多积累 Burst 个,
+// 每个请求消耗路由的权重个令牌 (默认 1, 参考 Brick.RouteCost),
+// 没有令牌时返回 429 和 Retry-After.
+//
+type RateLimit struct {
+  Rate     float64
+  Burst    int
+  // 限流的主体, 默认是客户端 IP
+  KeyFunc  func(*Http) string
+  // 返回请求的 API key, 非空时同一个 key 的所有请求共享一个令牌桶,
+  // 不再按 KeyFunc/IP 和 PerRoute 区分. 必须只返回验证过的 key,
+  // 否则客户端每次换一个 key 就能得到新的令牌桶
+  APIKeyFunc func(*Http) string
+  // 确认 API key 并返回它的额度, rate 或 burst 不是正数时使用 Rate 和 Burst;
+  // ok 为 false 表示不认识这个 key, 请求按 KeyFunc/IP 限流
+  KeyBudget  func(apiKey string) (rate float64, burst int, ok bool)
+  // 全局限流时每个路由使用独立的令牌桶, 否则所有路由共享
+  PerRoute bool
+}
+
+type bucket struct {
+  tokens float64
+  last   time.Time
+  rate   float64
+  burst  float64
+}
+
+//
+// 一组按 key 区分的令牌桶
+//
+type limiter struct {
+  lock    sync.Mutex
+  // 共享令牌桶时区分限流器, 参考 Brick.ShareLocal()
+  name    string
+  conf    RateLimit
+  buckets map[string]*bucket
+  sweep   time.Time
+}
+
+
+func (r *RateLimit) validate() error {
+  if r.Rate <= 0 || math.IsInf(r.Rate, 0) || math.IsNaN(r.Rate) {
+    return errors.New("RateLimit.Rate must be a positive number")
+  }
+  if r.Burst < 1 {
+    return errors.New("RateLimit.Burst must be at least 1")
+  }
+  return nil
+}
+
+
+func newLimiter(name string, conf RateLimit) *limiter {
+  return &limiter{
+    name    : name,
+    conf    : conf,
+    buckets : make(map[string]*bucket),
+    sweep   : time.Now(),
+  }
+}
+
+
+//
+// 从 key 的令牌桶中取出 n 个令牌, 失败时返回需要等待的时间.
+// 权重大于 Burst 的请求在令牌桶满时允许通过, 令牌数变为负值.
+//
+func (l *limiter) take(key string, n float64, now time.Time,
+    rate float64, burst int) (bool, time.Duration) {
+  l.lock.Lock()
+  defer l.lock.Unlock()
+  l.clean(now)
+
+  b := l.buckets[key]
+  if b == nil {
+    b = &bucket{ tokens: float64(burst), last: now }
+    l.buckets[key] = b
+  } else {
+    b.tokens = math.Min(b.burst, b.tokens + now.Sub(b.last).Seconds() * b.rate)
+    b.last = now
+  }
+  b.rate, b.burst = rate, float64(burst)
+
+  need := math.Min(n, b.burst)
+  if b.tokens >= need {
+    b.tokens -= n
+    return true, 0
+  }
+  wait := (need - b.tokens) / b.rate
+  return false, time.Duration(wait * float64(time.Second))
+}
+
+
+//
+// 删除已经补满的令牌桶, 避免 key 过多时占用内存
+//
+func (l *limiter) clean(now time.Time) {
+  full := time.Duration(float64(l.conf.Burst) / l.conf.Rate * float64(time.Second))
+  if full < time.Minute {
+    full = time.Minute
+  }
+  if now.Sub(l.sweep) < full {
+    return
+  }
+  l.sweep = now
+  for k, b := range l.buckets {
+    elapsed := now.Sub(b.last)
+    if elapsed > full && b.tokens + elapsed.Seconds() * b.rate >= b.burst {
+      delete(l.buckets, k)
+    }
+  }
+}
+
+
+//
+// 为 path 路由单独设置限流, 与 Config.RateLimit 的全局限流同时生效
+//
+func (b *Brick) RateLimit(path string, conf RateLimit) {
+  if err := conf.validate(); err != nil {
+    panic(err)
+  }
+  b.limitLock.Lock()
+  defer b.limitLock.Unlock()
+  if b.routeLimits == nil {
+    b.routeLimits = make(map[string]*limiter)
+  }
+  b.routeLimits[path] = newLimiter("route:"+ path, conf)
+}
+
+
+//
+// 设置 path 路由每个请求消耗的令牌数, 默认 1, 0 表示该路由不受限流
+//
+func (b *Brick) RouteCost(path string, cost float64) {
+  if cost < 0 || math.IsNaN(cost) || math.IsInf(cost, 0) {
+    panic(fmt.Errorf("invalid route cost %g", cost))
+  }
+  b.limitLock.Lock()
+  defer b.limitLock.Unlock()
+  if b.routeCosts == nil {
+    b.routeCosts = make(map[string]float64)
+  }
+  b.routeCosts[path] = cost
+}
+
+
+//
+// 限流中间件, 在 NewBrickConfig 中安装
+//
+func (b *Brick) rateLimitMiddleware(next HttpHandler) HttpHandler {
+  return func(h *Http) error {
+    now := time.Now()
+    b.limitLock.Lock()
+    l := b.routeLimits[h.rkey]
+    cost, hasCost := b.routeCosts[h.rkey]
+    b.limitLock.Unlock()
+
+    if !hasCost {
+      cost = 1
+    }
+    if cost == 0 {
+      return next(h)
+    }
+
+    if g := b.globalLimit; g != nil {
+      if err := b.allowRequest(h, g, cost, now, g.conf.PerRoute); err != nil {
+        return err
+      }
+    }
+    if l != nil {
+      if err := b.allowRequest(h, l, cost, now, false); err != nil {
+        return err
+      }
+    }
+    return next(h)
+  }
+}
+
+
+//
+// 返回令牌桶的 key 和额度
+//
+func (l *limiter) bucketFor(h *Http, perRoute bool) (string, float64, int) {
+  if l.conf.APIKeyFunc != nil {
+    if apiKey := l.conf.APIKeyFunc(h); apiKey != "" {
+      if l.conf.KeyBudget == nil {
+        return "key\x00"+ apiKey, l.conf.Rate, l.conf.Burst
+      }
+      if rate, burst, ok := l.conf.KeyBudget(apiKey); ok {
+        if rate > 0 && burst > 0 {
+          return "key\x00"+ apiKey, rate, burst
+        }
+        return "key\x00"+ apiKey, l.conf.Rate, l.conf.Burst
+      }
+    }
+  }
+
+  var key string
+  if l.conf.KeyFunc != nil {
+    key = l.conf.KeyFunc(h)
+  } else {
+    key = h.ClientIP()
+  }
+  if perRoute {
+    key = h.rkey +"\x00"+ key
+  }
+  return key, l.conf.Rate, l.conf.Burst
+}
+
+
+//
+// 没有足够的令牌时设置 Retry-After 并返回 429 错误
+//
+func (b *Brick) allowRequest(h *Http, l *limiter, cost float64,
+    now time.Time, perRoute bool) error {
+  key, rate, burst := l.bucketFor(h, perRoute)
+  ok, wait := b.takeToken(l, key, cost, now, rate, burst)
+  if ok {
+    b.metrics.Inc("brick_ratelimit_allowed_total", "Requests passed the rate limiter.", "route", h.route)
+    return nil
+  }
+
+  b.metrics.Inc("brick_ratelimit_rejected_total", "Requests rejected by the rate limiter.", "route", h.route)
+  sec := int(math.Ceil(wait.Seconds()))
+  if sec < 1 {
+    sec = 1
+  }
+  h.W.Header().Set("Retry-After", strconv.Itoa(sec))
+  return NewHttpError(http.StatusTooManyRequests, "")
+}
+
+
+func (b *Brick) rateLimitReport() string {
+  b.limitLock.Lock()
+  routes := len(b.routeLimits)
+  b.limitLock.Unlock()
+
+  global := "off"
+  if l := b.globalLimit; l != nil {
+    global = fmt.Sprintf("%g/s burst %d", l.conf.Rate, l.conf.Burst)
+    if l.conf.PerRoute {
+      global += " per route"
+    }
+  }
+  return fmt.Sprintf("global %s, %d routes", global, routes)
+}
+
+
+//
+// 请求的对端地址, 不含端口
+//
+func remoteIP(r *http.Request) string {
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    return r.RemoteAddr
+  }
+  return host
+}
@@ -0,0 +1,109 @@
+package brick
+
+import (
+  "math"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+
+func TestRateLimitValidate(t *testing.T) {
+  tests := []struct {
+    conf RateLimit
+    ok   bool
+  }{
+    { RateLimit{ Rate: 1, Burst: 1 },           true },
+    { RateLimit{ Rate: 0.5, Burst: 10 },        true },
+    { RateLimit{ Rate: 0, Burst: 1 },           false },
+    { RateLimit{ Rate: -1, Burst: 1 },          false },
+    { RateLimit{ Rate: math.NaN(), Burst: 1 },  false },
+    { RateLimit{ Rate: math.Inf(1), Burst: 1 }, false },
+    { RateLimit{ Rate: 1, Burst: 0 },           false },
+  }
+  for _, tt := range tests {
+    if err := tt.conf.validate(); (err == nil) != tt.ok {
+      t.Errorf("%+v validate = %v", tt.conf, err)
+    }
+  }
+}
+
+
+func TestLimiterTake(t *testing.T) {
+  l := newLimiter("test", RateLimit{ Rate: 1, Burst: 2 })
+  start := time.Now()
+
+  tests := []struct {
+    after time.Duration
+    key   string
+    cost  float64
+    ok    bool
+    wait  time.Duration
+  }{
+    { 0,                      "a", 1, true,  0 },
+    { 0,                      "a", 1, true,  0 },
+    { 0,                      "a", 1, false, time.Second },
+    { 0,                      "b", 1, true,  0 },
+    { 500 * time.Millisecond, "a", 1, false, 500 * time.Millisecond },
+    { time.Second,            "a", 1, true,  0 },
+    // 权重大于 Burst 时在令牌桶满后通过, 令牌数变为负值
+    { 3 * time.Second,        "a", 5, true,  0 },
+    { 4 * time.Second,        "a", 1, false, 3 * time.Second },
+  }
+  for i, tt := range tests {
+    ok, wait := l.take(tt.key, tt.cost, start.Add(tt.after), 1, 2)
+    if ok != tt.ok || wait != tt.wait {
+      t.Errorf("#%d take = %v, %s, want %v, %s", i, ok, wait, tt.ok, tt.wait)
+    }
+  }
+}
+
+
+func TestLimiterBucketFor(t *testing.T) {
+  budget := func(apiKey string) (float64, int, bool) {
+    switch apiKey {
+    case "gold":
+      return 100, 200, true
+    case "plain":
+      return 0, 0, true
+    }
+    return 0, 0, false
+  }
+  apiKey := func(h *Http) string { return h.R.Header.Get("X-API-Key") }
+  user   := func(h *Http) string { return "user" }
+
+  tests := []struct {
+    name     string
+    conf     RateLimit
+    apiKey   string
+    perRoute bool
+    key      string
+    rate     float64
+    burst    int
+  }{
+    { "ip",               RateLimit{},                                 "",     false, "192.0.2.1", 1, 2 },
+    { "ip per route",     RateLimit{},                                 "",     true,  "example.com/a\x00192.0.2.1", 1, 2 },
+    { "key func",         RateLimit{ KeyFunc: user },                  "",     false, "user", 1, 2 },
+    { "api key",          RateLimit{ APIKeyFunc: apiKey },             "k1",   true,  "key\x00k1", 1, 2 },
+    { "api key missing",  RateLimit{ APIKeyFunc: apiKey },             "",     false, "192.0.2.1", 1, 2 },
+    { "budget",           RateLimit{ APIKeyFunc: apiKey, KeyBudget: budget }, "gold",  false, "key\x00gold", 100, 200 },
+    { "budget default",   RateLimit{ APIKeyFunc: apiKey, KeyBudget: budget }, "plain", false, "key\x00plain", 1, 2 },
+    { "budget unknown",   RateLimit{ APIKeyFunc: apiKey, KeyBudget: budget, KeyFunc: user }, "forged", false, "user", 1, 2 },
+  }
+  for _, tt := range tests {
+    tt.conf.Rate, tt.conf.Burst = 1, 2
+    l := newLimiter("test", tt.conf)
+    r := httptest.NewRequest("GET", "/a", nil)
+    r.RemoteAddr = "192.0.2.1:1234"
+    if tt.apiKey != "" {
+      r.Header.Set("X-API-Key", tt.apiKey)
+    }
+    h := &Http{ b: &Brick{}, R: r, rkey: "example.com/a" }
+
+    key, rate, burst := l.bucketFor(h, tt.perRoute)
+    if key != tt.key || rate != tt.rate || burst != tt.burst {
+      t.Errorf("%s: bucketFor = %q, %g, %d, want %q, %g, %d",
+          tt.name, key, rate, burst, tt.key, tt.rate, tt.burst)
+    }
+  }
+}
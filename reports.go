@@ -0,0 +1,454 @@
+package brick
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "math/rand"
+  "mime"
+  "net"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// 一个请求中最多处理的报告数量
+const maxClientReports = 50
+
+// 报告中字符串的最大长度, 超过截断
+const maxReportString = 4096
+
+// Reporting-Endpoints, Report-To 和 NEL 中的分组名
+const reportGroup = "brick"
+
+// 记录为指标标签的报告类型, 其他类型记为 "other"
+var reportTypes = map[string]bool{
+  "csp-violation"                : true,
+  "js-error"                     : true,
+  "network-error"                : true,
+  "deprecation"                  : true,
+  "intervention"                 : true,
+  "crash"                        : true,
+  "coep"                         : true,
+  "coop"                         : true,
+  "permissions-policy-violation" : true,
+}
+
+//
+// 客户端报告接口的配置, 参考 Brick.ClientReports()
+//
+type ClientReports struct {
+  // 记录日志和调用 OnReport 的比例 (0, 1], 默认 1; 指标统计全部报告
+  Sample    float64
+  // 每个客户端 IP 的限流, 默认每秒 1 个请求, 最多积累 20 个
+  RateLimit *RateLimit
+  // 请求体的字节数上限, 默认 64KB
+  MaxBytes  int64
+  // 收到 (抽样后的) 报告时调用, 例如转发到错误跟踪系统
+  OnReport  func(h *Http, r ClientReport)
+}
+
+//
+// 浏览器发送的一个报告
+//
+type ClientReport struct {
+  // "csp-violation", "js-error", "network-error" (NEL) 或 Reporting API 的其他类型
+  Type      string                 `json:"type"`
+  // 发生问题的页面
+  URL       string                 `json:"url"`
+  UserAgent string                 `json:"user_agent"`
+  // 报告的内容, 字符串超过 4096 字节时截断
+  Body      map[string]interface{} `json:"body"`
+}
+
+//
+// 安全相关的响应头, 参考 Brick.SecurityHeaders()
+//
+type SecurityHeaders struct {
+  // Content-Security-Policy, 例如 "default-src 'self'"; 空不设置
+  CSP            string
+  // 使用 Content-Security-Policy-Report-Only, 只报告不拦截
+  CSPReportOnly  bool
+  // 浏览器报告的地址, 默认 ClientReports() 注册的路径; "-" 不声明
+  ReportPath     string
+  // 报告地址的 origin, 例如 "https://app.example.com". 不设置时只有请求的 Host
+  // 是 Brick.Host() 注册的主机才使用请求的地址, 否则 Reporting-Endpoints 使用相对地址,
+  // 不设置 Report-To 和 NEL (它们需要完整的地址)
+  ReportOrigin   string
+  // https 请求声明 NEL, 浏览器报告网络错误 (DNS, TLS, 连接重置等)
+  NEL            bool
+  // Report-To 和 NEL 的有效期, 默认 7 天
+  ReportMaxAge   time.Duration
+  // https 请求的 Strict-Transport-Security 有效期, 0 不设置
+  HSTS           time.Duration
+  // X-Frame-Options, 默认 "DENY"; "-" 不设置
+  FrameOptions   string
+  // Referrer-Policy, 默认 "strict-origin-when-cross-origin"; "-" 不设置
+  ReferrerPolicy string
+}
+
+type clientReports struct {
+  lock    sync.Mutex
+  // ClientReports() 注册的路径
+  path    string
+  // 是否调用过 SecurityHeaders(), 参考 SecurityAudit()
+  headers bool
+}
+
+
+//
+// 在 path 上注册接收浏览器报告的 POST 接口: CSP 违规 (report-uri 和 report-to),
+// Reporting API 的报告 (包括 NEL 网络错误) 和页面脚本发送的 js 错误.
+// 报告经过检查和抽样后写入日志 (LogClient), 按类型计入指标 brick_client_reports_total.
+// 接口按客户端 IP 限流; 用 SecurityHeaders() 向浏览器声明这个地址.
+//
+//   b.ClientReports("/_reports", brick.ClientReports{ Sample: 0.1 })
+//   b.Use(b.SecurityHeaders(brick.SecurityHeaders{ CSP: "default-src 'self'", NEL: true }))
+//
+// 页面脚本的 js 错误是一个 json 对象, 至少有 message:
+//
+//   window.addEventListener("error", e => navigator.sendBeacon("/_reports", JSON.stringify({
+//     message: e.message, url: location.href, source: e.filename,
+//     line: e.lineno, column: e.colno, stack: e.error && e.error.stack })))
+//
+func (b *Brick) ClientReports(path string, conf ClientReports) *Route {
+  if conf.Sample < 0 || conf.Sample > 1 {
+    panic(errors.New("ClientReports.Sample must be between 0 and 1"))
+  }
+  if conf.Sample == 0 {
+    conf.Sample = 1
+  }
+  if conf.MaxBytes <= 0 {
+    conf.MaxBytes = 64 << 10
+  }
+  limit := RateLimit{ Rate: 1, Burst: 20 }
+  if conf.RateLimit != nil {
+    limit = *conf.RateLimit
+  }
+  b.RateLimit(path, limit)
+
+  b.reports.lock.Lock()
+  b.reports.path = path
+  b.reports.lock.Unlock()
+
+  return b.Service(path, func(h *Http) error {
+    return b.receiveReports(h, &conf)
+  }).Methods("POST").Describe("browser CSP, NEL and js error reports")
+}
+
+
+func (b *Brick) receiveReports(h *Http, conf *ClientReports) error {
+  switch ct, _, _ := mime.ParseMediaType(h.R.Header.Get("Content-Type")); ct {
+  case "application/csp-report", "application/reports+json", "application/json", "text/plain":
+  default:
+    return NewHttpError(http.StatusUnsupportedMediaType, "")
+  }
+  h.R.Body = http.MaxBytesReader(h.W, h.R.Body, conf.MaxBytes)
+  body, err := ioutil.ReadAll(h.R.Body)
+  if err != nil {
+    return NewHttpError(http.StatusRequestEntityTooLarge, "")
+  }
+  list, err := parseReports(body)
+  if err != nil {
+    return &HttpError{ Code: http.StatusBadRequest, Msg: "Invalid report", Err: err }
+  }
+
+  ua := h.R.Header.Get("User-Agent")
+  valid := 0
+  for _, r := range list {
+    if r.UserAgent == "" {
+      r.UserAgent = ua
+    }
+    if !r.valid() {
+      b.metrics.Inc("brick_client_reports_invalid_total", "Client reports dropped as invalid")
+      continue
+    }
+    valid++
+    label := r.Type
+    if !reportTypes[label] {
+      label = "other"
+    }
+    b.metrics.Inc("brick_client_reports_total", "Client reports received", "type", label)
+    if conf.Sample < 1 && rand.Float64() >= conf.Sample {
+      continue
+    }
+    (&levelLogger{ b: b, comp: LogClient }).With(
+        "type", r.Type, "url", r.URL, "client", h.ClientIP(), "user_agent", r.UserAgent,
+    ).Warn(r.summary())
+    if conf.OnReport != nil {
+      conf.OnReport(h, r)
+    }
+  }
+  if valid == 0 {
+    return NewHttpError(http.StatusBadRequest, "No valid report")
+  }
+  h.NoContent()
+  return nil
+}
+
+
+//
+// 解析报告: report-uri 的 {"csp-report": ...} (application/csp-report),
+// Reporting API 的数组 (application/reports+json) 或 js 错误对象 (sendBeacon 的字符串是 text/plain)
+//
+func parseReports(body []byte) ([]ClientReport, error) {
+  var v interface{}
+  if err := json.Unmarshal(body, &v); err != nil {
+    return nil, err
+  }
+  var items []interface{}
+  switch t := v.(type) {
+  case []interface{}:
+    items = t
+  case map[string]interface{}:
+    items = []interface{}{ t }
+  default:
+    return nil, errors.New("report must be an object or an array")
+  }
+  if len(items) > maxClientReports {
+    items = items[:maxClientReports]
+  }
+
+  list := make([]ClientReport, 0, len(items))
+  for _, it := range items {
+    m, ok := it.(map[string]interface{})
+    if !ok {
+      continue
+    }
+    clampStrings(m)
+    if csp, ok := m["csp-report"].(map[string]interface{}); ok {
+      uri, _ := csp["document-uri"].(string)
+      list = append(list, ClientReport{ Type: "csp-violation", URL: uri, Body: csp })
+      continue
+    }
+    if rb, ok := m["body"].(map[string]interface{}); ok {
+      r := ClientReport{ Body: rb }
+      r.Type, _ = m["type"].(string)
+      r.URL, _ = m["url"].(string)
+      r.UserAgent, _ = m["user_agent"].(string)
+      list = append(list, r)
+      continue
+    }
+    if _, ok := m["message"].(string); ok {
+      u, _ := m["url"].(string)
+      list = append(list, ClientReport{ Type: "js-error", URL: u, Body: m })
+    }
+  }
+  return list, nil
+}
+
+
+//
+// 截断过长的字符串, 避免日志被单个报告撑大
+//
+func clampStrings(m map[string]interface{}) {
+  for k, v := range m {
+    switch t := v.(type) {
+    case string:
+      if len(t) > maxReportString {
+        m[k] = t[:maxReportString]
+      }
+    case map[string]interface{}:
+      clampStrings(t)
+    }
+  }
+}
+
+
+func (r *ClientReport) valid() bool {
+  if r.Type == "" || len(r.Type) > 64 || r.Body == nil {
+    return false
+  }
+  if r.URL != "" {
+    u, err := url.Parse(r.URL)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+      return false
+    }
+  }
+  return true
+}
+
+
+//
+// 日志中的一行说明
+//
+func (r *ClientReport) summary() string {
+  str := func(keys ...string) string {
+    for _, k := range keys {
+      if s, ok := r.Body[k].(string); ok && s != "" {
+        return s
+      }
+    }
+    return ""
+  }
+  switch r.Type {
+  case "csp-violation":
+    return "CSP blocked "+ str("blockedURL", "blocked-uri") +
+        " by "+ str("effectiveDirective", "effective-directive", "violated-directive")
+  case "js-error":
+    msg := "JS error: "+ str("message")
+    if src := str("source"); src != "" {
+      msg += " at "+ src
+      if line, ok := r.Body["line"].(float64); ok {
+        msg += ":"+ strconv.Itoa(int(line))
+      }
+    }
+    return msg
+  case "network-error":
+    return "Network error "+ str("type") +" in "+ str("phase")
+  }
+  if msg := str("message"); msg != "" {
+    return "Client report "+ r.Type +": "+ msg
+  }
+  return "Client report "+ r.Type
+}
+
+
+//
+// 返回设置安全响应头的中间件, 并向浏览器声明 ClientReports() 的报告地址:
+// CSP 加上 report-uri 和 report-to, 设置 Reporting-Endpoints, Report-To 和 NEL.
+// 同时设置 X-Content-Type-Options: nosniff, X-Frame-Options, Referrer-Policy 和 (https 时) HSTS.
+// 处理函数可以覆盖这些响应头.
+//
+//   b.Use(b.SecurityHeaders(brick.SecurityHeaders{
+//     CSP: "default-src 'self'", NEL: true, HSTS: 180 * 24 * time.Hour }))
+//
+func (b *Brick) SecurityHeaders(conf SecurityHeaders) Middleware {
+  if conf.ReportMaxAge <= 0 {
+    conf.ReportMaxAge = 7 * 24 * time.Hour
+  }
+  if conf.FrameOptions == "" {
+    conf.FrameOptions = "DENY"
+  }
+  if conf.ReferrerPolicy == "" {
+    conf.ReferrerPolicy = "strict-origin-when-cross-origin"
+  }
+  if conf.ReportOrigin != "" {
+    u, err := url.Parse(conf.ReportOrigin)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+        strings.Trim(u.Path, "/") != "" {
+      panic("SecurityHeaders.ReportOrigin must be like https://app.example.com")
+    }
+    conf.ReportOrigin = u.Scheme +"://"+ u.Host
+  }
+  b.reports.lock.Lock()
+  b.reports.headers = true
+  b.reports.lock.Unlock()
+  maxAge := int(conf.ReportMaxAge.Seconds())
+
+  return func(next HttpHandler) HttpHandler {
+    return func(h *Http) error {
+      hdr := h.W.Header()
+      secure := b.requestScheme(h.R) == "https"
+      report := conf.ReportPath
+      if report == "" {
+        b.reports.lock.Lock()
+        report = b.reports.path
+        b.reports.lock.Unlock()
+      } else if report == "-" {
+        report = ""
+      }
+
+      hdr.Set("X-Content-Type-Options", "nosniff")
+      if conf.FrameOptions != "-" {
+        hdr.Set("X-Frame-Options", conf.FrameOptions)
+      }
+      if conf.ReferrerPolicy != "-" {
+        hdr.Set("Referrer-Policy", conf.ReferrerPolicy)
+      }
+      if secure && conf.HSTS > 0 {
+        hdr.Set("Strict-Transport-Security", "max-age="+ strconv.Itoa(int(conf.HSTS.Seconds())))
+      }
+      if report != "" {
+        // 客户端的 Host 头不可信, 会随响应一起进入缓存
+        origin := conf.ReportOrigin
+        if origin == "" {
+          origin = b.hostOrigin(h.R)
+        }
+        if origin == "" {
+          hdr.Set("Reporting-Endpoints", reportGroup +`="`+ report +`"`)
+        } else {
+          abs := origin + report
+          hdr.Set("Reporting-Endpoints", reportGroup +`="`+ abs +`"`)
+          if secure {
+            hdr.Set("Report-To", jsonHeader(map[string]interface{}{
+              "group": reportGroup, "max_age": maxAge,
+              "endpoints": []map[string]string{{ "url": abs }},
+            }))
+            if conf.NEL {
+              hdr.Set("NEL", jsonHeader(map[string]interface{}{
+                "report_to": reportGroup, "max_age": maxAge,
+              }))
+            }
+          }
+        }
+      }
+      if conf.CSP != "" {
+        csp := conf.CSP
+        if report != "" {
+          csp += "; report-uri "+ report +"; report-to "+ reportGroup
+        }
+        name := "Content-Security-Policy"
+        if conf.CSPReportOnly {
+          name += "-Report-Only"
+        }
+        hdr.Set(name, csp)
+      }
+      return next(h)
+    }
+  }
+}
+
+
+//
+// 请求的协议, 可信代理的 X-Forwarded-Proto 优先
+//
+//
+// 请求的 Host 是 Brick.Host() 注册的主机时返回请求的 origin, 否则返回空字符串
+//
+func (b *Brick) hostOrigin(r *http.Request) string {
+  hs := b.matchHost(r)
+  if hs == nil {
+    return ""
+  }
+  name := hostName(r)
+  if strings.HasPrefix(hs.pattern, "*.") {
+    if !strings.HasSuffix(name, hs.pattern[1:]) || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789.-") != "" {
+      return ""
+    }
+  } else if name != hs.pattern {
+    return ""
+  }
+  if _, port, err := net.SplitHostPort(r.Host); err == nil {
+    if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+      return ""
+    }
+    name = net.JoinHostPort(name, port)
+  }
+  return b.requestScheme(r) +"://"+ name
+}
+
+
+func jsonHeader(v interface{}) string {
+  buf, _ := json.Marshal(v)
+  return string(buf)
+}
+
+
+func (b *Brick) requestScheme(r *http.Request) string {
+  if len(b.trusted) > 0 && b.trusted.contains(remoteIP(r)) {
+    if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+      if strings.EqualFold(strings.TrimSpace(strings.Split(p, ",")[0]), "https") {
+        return "https"
+      }
+      return "http"
+    }
+  }
+  if r.TLS != nil {
+    return "https"
+  }
+  return "http"
+}
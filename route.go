@@ -0,0 +1,248 @@
+package brick
+
+import (
+  "fmt"
+  "html"
+  "net/http"
+  "reflect"
+  "runtime"
+  "sort"
+  "strings"
+  "sync"
+)
+
+//
+// 注册的路由信息, 参考 Brick.Routes()
+//
+type RouteInfo struct {
+  // 虚拟主机的 pattern, 直接注册在 Brick 上时为空, 参考 Brick.Host()
+  Host    string
+  Path    string
+  // 允许的请求方法, 空表示不限制
+  Methods []string
+  // 处理函数的名字; 跳转路由为目标地址, 静态路由为文件目录
+  Handler string
+  // "service", "redirect" 或 "static"
+  Kind    string
+  // 路由的说明, 出现在错误日志和路由表中, 参考 Route.Describe()
+  Description string
+}
+
+//
+// Service() 返回的路由, 用于进一步设置
+//
+type Route struct {
+  // 使用统计, 原子操作的字段放在最前面保证 64 位对齐
+  use  routeUse
+  lock sync.RWMutex
+  info RouteInfo
+  h    HttpHandler
+  g    *Group
+  // 参考 Deprecate()
+  dep  *Deprecation
+  // 参考 Available()
+  avail *availability
+  // 参考 Accepts() 和 Returns()
+  types routeTypes
+  // 返回 true 的请求不受 Config.RequestTimeout 限制, 参考 ProxyMapping()
+  untimed func(*http.Request) bool
+  // 参考 SkipSelfTest()
+  noSelfTest bool
+}
+
+
+//
+// 限制路由的请求方法, 其他方法返回 405, OPTIONS 自动应答 Allow 头域.
+// 同一路径可以用不同方法注册多个服务:
+//
+//   b.Service("/users", listUsers).Methods("GET")
+//   b.Service("/users", createUser).Methods("POST")
+//
+func (r *Route) Methods(methods ...string) *Route {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  for _, m := range methods {
+    r.info.Methods = append(r.info.Methods, strings.ToUpper(m))
+  }
+  return r
+}
+
+
+//
+// 设置路由的说明, 出错时日志中会带上它, 方便值班人员知道出错的接口是做什么的:
+//
+//   b.Service("/api/pay", pay).Describe("支付回调, 失败会导致订单卡在待支付")
+//
+func (r *Route) Describe(text string) *Route {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  r.info.Description = text
+  return r
+}
+
+
+//
+// 路由信息的副本
+//
+func (r *Route) Info() RouteInfo {
+  r.lock.RLock()
+  defer r.lock.RUnlock()
+  info := r.info
+  info.Methods = append([]string(nil), r.info.Methods...)
+  return info
+}
+
+
+//
+// 按注册顺序返回所有路由, 可用于启动时打印路由表和测试断言
+//
+func (b *Brick) Routes() []RouteInfo {
+  b.routeLock.RLock()
+  defer b.routeLock.RUnlock()
+  ret := make([]RouteInfo, len(b.routes))
+  for i, r := range b.routes {
+    ret[i] = r.Info()
+  }
+  return ret
+}
+
+
+func (b *Brick) addRoute(info RouteInfo, hs *Host) *Route {
+  info.Host = hs.name()
+  rt := &Route{ info: info }
+  if hs != nil {
+    rt.g = &hs.root
+  }
+  b.routeLock.Lock()
+  defer b.routeLock.Unlock()
+  b.routes = append(b.routes, rt)
+  return rt
+}
+
+
+//
+// 按请求方法选择路径上的服务, 没有匹配的方法时
+// OPTIONS 返回 204 和 Allow, 其他方法返回 405.
+//
+func (b *Brick) dispatch(path string, w http.ResponseWriter, r *http.Request) {
+  b.routeLock.RLock()
+  routes := b.pathRoutes[path]
+  b.routeLock.RUnlock()
+
+  for _, rt := range routes {
+    if rt.allows(r.Method) {
+      b.serve(rt, rt.h, w, r)
+      return
+    }
+  }
+
+  allow := allowHeader(routes)
+  w.Header().Set("Allow", allow)
+  if r.Method == http.MethodOptions {
+    b.policyPreflight(routes[0], w.Header(), r)
+    w.WriteHeader(http.StatusNoContent)
+    return
+  }
+  b.serve(routes[0], func(h *Http) error {
+    return NewHttpError(http.StatusMethodNotAllowed, "")
+  }, w, r)
+}
+
+
+func (r *Route) allows(method string) bool {
+  r.lock.RLock()
+  defer r.lock.RUnlock()
+  if len(r.info.Methods) == 0 {
+    return true
+  }
+  for _, m := range r.info.Methods {
+    if m == method || (m == http.MethodGet && method == http.MethodHead) {
+      return true
+    }
+  }
+  return false
+}
+
+
+func allowHeader(routes []*Route) string {
+  set := map[string]bool{ http.MethodOptions: true }
+  for _, rt := range routes {
+    for _, m := range rt.Info().Methods {
+      set[m] = true
+      if m == http.MethodGet {
+        set[http.MethodHead] = true
+      }
+    }
+  }
+  list := make([]string, 0, len(set))
+  for m := range set {
+    list = append(list, m)
+  }
+  sort.Strings(list)
+  return strings.Join(list, ", ")
+}
+
+
+//
+// 当前请求的路由, 不是通过 Service() 进入时只有 Path
+//
+func (h *Http) Route() RouteInfo {
+  if h.rt == nil {
+    return RouteInfo{ Path: h.route }
+  }
+  return h.rt.Info()
+}
+
+
+//
+// 日志中的路由标识: 路径和说明
+//
+func (h *Http) routeLabel() string {
+  if h.rt == nil {
+    return h.route
+  }
+  h.rt.lock.RLock()
+  defer h.rt.lock.RUnlock()
+  if h.rt.info.Description == "" {
+    return h.rt.info.Host + h.rt.info.Path
+  }
+  return h.rt.info.Host + h.rt.info.Path +" ("+ h.rt.info.Description +")"
+}
+
+
+//
+// 路由表页面, 列出方法, 路径, 处理函数和说明; 请求 json 时返回 []RouteInfo.
+// 页面暴露内部结构, 应注册在需要认证的分组中:
+//
+//   admin.Service("/routes", b.RoutesPage()).Methods("GET")
+//
+func (b *Brick) RoutesPage() HttpHandler {
+  return func(h *Http) error {
+    routes := b.Routes()
+    if h.WantsJSON() {
+      h.Json(Msg{ Data: routes })
+      return nil
+    }
+    h.W.Header().Set("Content-Type", "text/html; charset=utf-8")
+    h.WriteStr("<table><tr><th>Kind</th><th>Methods</th><th>Path</th><th>Handler</th><th>Description</th></tr>\n")
+    for _, r := range routes {
+      methods := "*"
+      if len(r.Methods) > 0 {
+        methods = strings.Join(r.Methods, ", ")
+      }
+      fmt.Fprintf(h.W, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+          html.EscapeString(r.Kind), html.EscapeString(methods), html.EscapeString(r.Host + r.Path),
+          html.EscapeString(r.Handler), html.EscapeString(r.Description))
+    }
+    h.WriteStr("</table>")
+    return nil
+  }
+}
+
+
+func handlerName(h HttpHandler) string {
+  if f := runtime.FuncForPC(reflect.ValueOf(h).Pointer()); f != nil {
+    return f.Name()
+  }
+  return "?"
+}
@@ -0,0 +1,440 @@
+//
+// SAML 2.0 服务提供者 (SP): 元数据, 登录跳转 (HTTP-Redirect) 和
+// 断言消费服务 (ACS, HTTP-POST), 断言中的属性写入会话.
+//
+// XML 签名的规范化 (exc-c14n) 不在标准库中, 签名验证通过 Verifier 接入,
+// 例如包装 goxmldsig; 没有 Verifier 时 New() 返回错误.
+//
+package saml
+
+import (
+  "bytes"
+  "compress/flate"
+  "crypto/rand"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/xml"
+  "errors"
+  "io"
+  "net/http"
+  "net/url"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/yanmingsohu/brick"
+)
+
+//
+// 会话中保存的键
+//
+const (
+  SessionNameID    = "saml.nameid"
+  SessionIndex     = "saml.session_index"
+  sessionRequestID = "saml.request_id"
+)
+
+//
+// 验证 doc 中 ID 属性为 id 的元素上的 XML 签名, 签名必须覆盖该元素并由 IdP 的证书签发.
+// 返回签名覆盖的那个元素本身 (例如规范化后的字节, 包含用到的命名空间声明),
+// 断言的内容只从返回的字节中读取, 不再读取原文档.
+//
+type Verifier interface {
+  Verify(doc []byte, id string) ([]byte, error)
+}
+
+//
+// 已通过验证的断言
+//
+type Assertion struct {
+  Issuer       string
+  NameID       string
+  SessionIndex string
+  Attributes   map[string][]string
+  NotOnOrAfter time.Time
+}
+
+type Config struct {
+  // SP 的实体 ID, 通常是元数据的地址
+  EntityID          string
+  // ACS 的完整地址, IdP 把断言 POST 到这里
+  ACSURL            string
+  // IdP 的实体 ID, 断言的 Issuer 必须与之相同
+  IdPEntityID       string
+  // IdP 的单点登录地址 (HTTP-Redirect 绑定)
+  IdPSSOURL         string
+  // 验证 Response 或 Assertion 的签名
+  Verifier          Verifier
+  // SAML 属性名 -> 会话键, 只有一个值时保存字符串, 否则保存 []string
+  Attributes        map[string]string
+  // 允许的时钟误差, 默认 2 分钟
+  ClockSkew         time.Duration
+  // 没有 RelayState 时登录后跳转的地址, 默认 "/"
+  AfterLogin        string
+  // 接受 IdP 主动发起的登录 (没有 InResponseTo)
+  AllowIdPInitiated bool
+  // 断言写入会话后调用, 返回错误则登录失败
+  OnLogin           func(h *brick.Http, a *Assertion) error
+}
+
+type ServiceProvider struct {
+  conf Config
+  lock sync.Mutex
+  // 已使用的断言 ID, 防止重放
+  used map[string]time.Time
+}
+
+
+func New(conf Config) (*ServiceProvider, error) {
+  if conf.Verifier == nil {
+    return nil, errors.New("saml: Verifier is required")
+  }
+  if conf.EntityID == "" || conf.ACSURL == "" || conf.IdPSSOURL == "" {
+    return nil, errors.New("saml: EntityID, ACSURL and IdPSSOURL are required")
+  }
+  if conf.ClockSkew <= 0 {
+    conf.ClockSkew = 2 * time.Minute
+  }
+  if conf.AfterLogin == "" {
+    conf.AfterLogin = "/"
+  }
+  return &ServiceProvider{ conf: conf, used: make(map[string]time.Time) }, nil
+}
+
+
+//
+// 在 prefix 下注册 metadata, login 和 acs 服务, 这些服务不需要认证.
+// 例如 sp.Mount(b, "/saml/") 注册 /saml/metadata, /saml/login, /saml/acs
+//
+func (sp *ServiceProvider) Mount(b *brick.Brick, prefix string) {
+  prefix = strings.TrimSuffix(prefix, "/")
+  b.Service(prefix +"/metadata", sp.metadata)
+  b.Service(prefix +"/login", sp.login)
+  b.Service(prefix +"/acs", sp.acs)
+  b.AuthExempt(prefix +"/metadata", prefix +"/login", prefix +"/acs")
+}
+
+
+//
+// SP 的元数据 xml
+//
+func (sp *ServiceProvider) Metadata() []byte {
+  return metadataXML(sp.conf.EntityID, sp.conf.ACSURL)
+}
+
+
+func (sp *ServiceProvider) metadata(h *brick.Http) error {
+  h.W.Header().Set("Content-Type", "application/samlmetadata+xml")
+  _, err := h.W.Write(sp.Metadata())
+  return err
+}
+
+
+//
+// 跳转到 IdP 登录, 参数 "to" 作为 RelayState, 登录后跳回该地址
+//
+func (sp *ServiceProvider) login(h *brick.Http) error {
+  id, err := newID()
+  if err != nil {
+    return err
+  }
+  req, err := deflate(authnRequestXML(id, time.Now(), sp.conf.EntityID,
+      sp.conf.ACSURL, sp.conf.IdPSSOURL))
+  if err != nil {
+    return err
+  }
+  h.Session().Set(sessionRequestID, id)
+
+  u, err := url.Parse(sp.conf.IdPSSOURL)
+  if err != nil {
+    return err
+  }
+  q := u.Query()
+  q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(req))
+  if to := h.Get("to"); localPath(to) {
+    q.Set("RelayState", to)
+  }
+  u.RawQuery = q.Encode()
+  h.Redirect(http.StatusFound, u.String())
+  return nil
+}
+
+
+func (sp *ServiceProvider) acs(h *brick.Http) error {
+  if h.R.Method != http.MethodPost {
+    return brick.NewHttpError(http.StatusMethodNotAllowed, "")
+  }
+  raw, err := base64.StdEncoding.DecodeString(h.Get("SAMLResponse"))
+  if err != nil {
+    return brick.WrapHttpError(http.StatusBadRequest, err)
+  }
+
+  s := h.Session()
+  expectID, _ := s.Get(sessionRequestID).(string)
+  s.Delete(sessionRequestID)
+
+  a, err := sp.ParseResponse(raw, expectID, time.Now())
+  if err != nil {
+    return brick.WrapHttpError(http.StatusForbidden, err)
+  }
+
+  // 登录后更换会话 ID, 防止会话固定攻击
+  s = h.SessionRegenerate()
+  s.Set(SessionNameID, a.NameID)
+  s.Set(SessionIndex, a.SessionIndex)
+  for name, key := range sp.conf.Attributes {
+    switch v := a.Attributes[name]; len(v) {
+    case 0:
+      s.Delete(key)
+    case 1:
+      s.Set(key, v[0])
+    default:
+      s.Set(key, v)
+    }
+  }
+  if sp.conf.OnLogin != nil {
+    if err := sp.conf.OnLogin(h, a); err != nil {
+      return err
+    }
+  }
+
+  to := sp.conf.AfterLogin
+  if rs := h.Get("RelayState"); localPath(rs) {
+    to = rs
+  }
+  h.Redirect(http.StatusSeeOther, to)
+  return nil
+}
+
+
+//
+// 解析并验证 IdP 返回的 Response 文档: 签名, 状态, Issuer, 接收者, 受众,
+// 有效期和重放. expectID 是本 SP 发出的请求 ID, 为空表示 IdP 主动发起,
+// 此时需要 Config.AllowIdPInitiated. 只签名了断言时不读取外层 Response 的状态,
+// Destination 和 InResponseTo, 只检查断言中 SubjectConfirmationData 的 Recipient 和 InResponseTo.
+//
+func (sp *ServiceProvider) ParseResponse(doc []byte, expectID string, now time.Time) (*Assertion, error) {
+  // 没有发出过请求时只能是 IdP 主动发起, 不允许时拒绝, 防止登录 CSRF
+  if expectID == "" && !sp.conf.AllowIdPInitiated {
+    return nil, errors.New("saml: unsolicited response")
+  }
+  // 相同 ID 的元素可以让签名验证和读取内容指向不同的元素
+  if err := uniqueIDs(doc); err != nil {
+    return nil, err
+  }
+  var res xmlResponse
+  if err := xml.Unmarshal(doc, &res); err != nil {
+    return nil, err
+  }
+  if len(res.Encrypted) > 0 {
+    return nil, errors.New("saml: encrypted assertions are not supported")
+  }
+  // 只接受一个断言, 防止签名包装攻击
+  if len(res.Assertions) != 1 {
+    return nil, errors.New("saml: response must contain exactly one assertion")
+  }
+  a := &res.Assertions[0]
+
+  // 只使用签名覆盖的元素中的内容; 只签名了断言时外层 Response 的属性都不可信
+  var envelope *xmlResponse
+  switch {
+  case a.Signature != nil && a.ID != "":
+    signed, err := sp.conf.Verifier.Verify(doc, a.ID)
+    if err != nil {
+      return nil, err
+    }
+    var sa xmlAssertion
+    if err := xml.Unmarshal(signed, &sa); err != nil {
+      return nil, err
+    }
+    if sa.ID != a.ID {
+      return nil, errors.New("saml: verified element is not the assertion")
+    }
+    a = &sa
+  case res.Signature != nil && res.ID != "":
+    signed, err := sp.conf.Verifier.Verify(doc, res.ID)
+    if err != nil {
+      return nil, err
+    }
+    var sr xmlResponse
+    if err := xml.Unmarshal(signed, &sr); err != nil {
+      return nil, err
+    }
+    if sr.ID != res.ID || len(sr.Assertions) != 1 || len(sr.Encrypted) > 0 {
+      return nil, errors.New("saml: verified element is not the response")
+    }
+    envelope = &sr
+    a = &sr.Assertions[0]
+  default:
+    return nil, errors.New("saml: response is not signed")
+  }
+
+  if sp.conf.IdPEntityID != "" && strings.TrimSpace(a.Issuer) != sp.conf.IdPEntityID {
+    return nil, errors.New("saml: unexpected issuer "+ a.Issuer)
+  }
+  // 签名的 Response 已经对应到本次请求时, 断言中可以不再重复 InResponseTo
+  bound := false
+  if e := envelope; e != nil {
+    if e.Status.Code.Value != statusOK {
+      return nil, errors.New("saml: login failed, status "+ e.Status.Code.Value)
+    }
+    if e.Destination != "" && e.Destination != sp.conf.ACSURL {
+      return nil, errors.New("saml: wrong destination "+ e.Destination)
+    }
+    if e.InResponseTo != expectID && !(e.InResponseTo == "" && sp.conf.AllowIdPInitiated) {
+      return nil, errors.New("saml: unexpected InResponseTo")
+    }
+    bound = expectID != "" && e.InResponseTo == expectID
+  }
+  if err := sp.checkConditions(a, expectID, bound, now); err != nil {
+    return nil, err
+  }
+
+  ret := &Assertion{
+    Issuer       : strings.TrimSpace(a.Issuer),
+    NameID       : strings.TrimSpace(a.Subject.NameID),
+    SessionIndex : a.AuthnStatement.SessionIndex,
+    Attributes   : make(map[string][]string, len(a.Attributes)),
+  }
+  ret.NotOnOrAfter, _ = parseTime(a.Conditions.NotOnOrAfter)
+  for _, attr := range a.Attributes {
+    ret.Attributes[attr.Name] = append(ret.Attributes[attr.Name], attr.Values...)
+  }
+  if err := sp.markUsed(a.ID, ret.NotOnOrAfter, now); err != nil {
+    return nil, err
+  }
+  return ret, nil
+}
+
+
+func (sp *ServiceProvider) checkConditions(a *xmlAssertion, expectID string, bound bool,
+    now time.Time) error {
+  skew := sp.conf.ClockSkew
+  notBefore, err := parseTime(a.Conditions.NotBefore)
+  if err != nil {
+    return err
+  }
+  notAfter, err := parseTime(a.Conditions.NotOnOrAfter)
+  if err != nil {
+    return err
+  }
+  if !notBefore.IsZero() && now.Add(skew).Before(notBefore) {
+    return errors.New("saml: assertion not yet valid")
+  }
+  if !notAfter.IsZero() && !now.Add(-skew).Before(notAfter) {
+    return errors.New("saml: assertion expired")
+  }
+
+  if len(a.Conditions.Audiences) > 0 {
+    ok := false
+    for _, aud := range a.Conditions.Audiences {
+      ok = ok || strings.TrimSpace(aud) == sp.conf.EntityID
+    }
+    if !ok {
+      return errors.New("saml: audience mismatch")
+    }
+  }
+
+  for _, c := range a.Subject.Confirmation {
+    if c.Method != bearer {
+      continue
+    }
+    d := c.Data
+    until, err := parseTime(d.NotOnOrAfter)
+    if err != nil {
+      return err
+    }
+    if (until.IsZero() || now.Add(-skew).Before(until)) &&
+        (d.Recipient == "" || d.Recipient == sp.conf.ACSURL) &&
+        (d.InResponseTo == expectID || (d.InResponseTo == "" && (bound || sp.conf.AllowIdPInitiated))) {
+      return nil
+    }
+  }
+  return errors.New("saml: no valid bearer subject confirmation")
+}
+
+
+func (sp *ServiceProvider) markUsed(id string, until time.Time, now time.Time) error {
+  sp.lock.Lock()
+  defer sp.lock.Unlock()
+  for k, t := range sp.used {
+    if now.After(t) {
+      delete(sp.used, k)
+    }
+  }
+  if _, has := sp.used[id]; has {
+    return errors.New("saml: assertion replayed")
+  }
+  if until.IsZero() {
+    until = now.Add(time.Hour)
+  }
+  sp.used[id] = until.Add(sp.conf.ClockSkew)
+  return nil
+}
+
+
+//
+// 文档中的 ID 属性不能重复
+//
+func uniqueIDs(doc []byte) error {
+  seen := make(map[string]bool)
+  d := xml.NewDecoder(bytes.NewReader(doc))
+  for {
+    tok, err := d.Token()
+    if err == io.EOF {
+      return nil
+    }
+    if err != nil {
+      return err
+    }
+    se, ok := tok.(xml.StartElement)
+    if !ok {
+      continue
+    }
+    for _, attr := range se.Attr {
+      if attr.Name.Local != "ID" {
+        continue
+      }
+      if seen[attr.Value] {
+        return errors.New("saml: duplicate ID "+ attr.Value)
+      }
+      seen[attr.Value] = true
+    }
+  }
+}
+
+
+func deflate(b []byte) ([]byte, error) {
+  var buf bytes.Buffer
+  w, err := flate.NewWriter(&buf, flate.BestCompression)
+  if err != nil {
+    return nil, err
+  }
+  if _, err := w.Write(b); err != nil {
+    return nil, err
+  }
+  if err := w.Close(); err != nil {
+    return nil, err
+  }
+  return buf.Bytes(), nil
+}
+
+
+//
+// SAML 的 ID 不能以数字开头
+//
+func newID() (string, error) {
+  b := make([]byte, 20)
+  if _, err := rand.Read(b); err != nil {
+    return "", err
+  }
+  return "_"+ hex.EncodeToString(b), nil
+}
+
+
+//
+// 只允许跳转到本站的路径, 防止开放重定向
+//
+func localPath(p string) bool {
+  return brick.IsLocalRedirect(p)
+}
@@ -0,0 +1,249 @@
+package saml
+
+import (
+  "bytes"
+  "encoding/xml"
+  "errors"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+)
+
+//
+// 把 valid 中的 ID 当作签名有效, 返回该元素的原文
+//
+type fakeVerifier struct {
+  valid map[string]bool
+}
+
+
+func (v fakeVerifier) Verify(doc []byte, id string) ([]byte, error) {
+  if !v.valid[id] {
+    return nil, errors.New("bad signature")
+  }
+  d := xml.NewDecoder(bytes.NewReader(doc))
+  for {
+    start := d.InputOffset()
+    tok, err := d.Token()
+    if err != nil {
+      return nil, err
+    }
+    se, ok := tok.(xml.StartElement)
+    if !ok {
+      continue
+    }
+    for _, a := range se.Attr {
+      if a.Name.Local == "ID" && a.Value == id {
+        if err := d.Skip(); err != nil {
+          return nil, err
+        }
+        return doc[start:d.InputOffset()], nil
+      }
+    }
+  }
+}
+
+
+type testDoc struct {
+  respID, respIRT, destination, status string
+  signResp, signAssertion             bool
+  assertionID, issuer, audience       string
+  recipient, subjectIRT               string
+  notBefore, notAfter                 time.Time
+  // 追加在第一个断言之后的内容
+  extra                               string
+}
+
+
+var testNow = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+
+func newTestDoc() *testDoc {
+  return &testDoc{
+    respID        : "_resp",
+    respIRT       : "_req",
+    destination   : "https://sp.example.com/saml/acs",
+    status        : statusOK,
+    signAssertion : true,
+    assertionID   : "_assert",
+    issuer        : "https://idp.example.com",
+    audience      : "https://sp.example.com",
+    recipient     : "https://sp.example.com/saml/acs",
+    subjectIRT    : "_req",
+    notBefore     : testNow.Add(-time.Minute),
+    notAfter      : testNow.Add(5 * time.Minute),
+  }
+}
+
+
+func (t *testDoc) bytes() []byte {
+  sig := func(on bool) string {
+    if on {
+      return `<Signature xmlns="http://www.w3.org/2000/09/xmldsig#"/>`
+    }
+    return ""
+  }
+  return []byte(`<Response xmlns="`+ nsProtocol +`" ID="`+ t.respID +`" Destination="`+ t.destination +
+    `" InResponseTo="`+ t.respIRT +`">` +
+    `<Issuer xmlns="`+ nsAssertion +`">`+ t.issuer +`</Issuer>`+ sig(t.signResp) +
+    `<Status><StatusCode Value="`+ t.status +`"/></Status>` +
+    `<Assertion xmlns="`+ nsAssertion +`" ID="`+ t.assertionID +`">` +
+    `<Issuer>`+ t.issuer +`</Issuer>`+ sig(t.signAssertion) +
+    `<Subject><NameID>alice</NameID><SubjectConfirmation Method="`+ bearer +`">` +
+    `<SubjectConfirmationData NotOnOrAfter="`+ samlTime(t.notAfter) +`" Recipient="`+ t.recipient +
+    `" InResponseTo="`+ t.subjectIRT +`"/></SubjectConfirmation></Subject>` +
+    `<Conditions NotBefore="`+ samlTime(t.notBefore) +`" NotOnOrAfter="`+ samlTime(t.notAfter) +`">` +
+    `<AudienceRestriction><Audience>`+ t.audience +`</Audience></AudienceRestriction></Conditions>` +
+    `<AuthnStatement SessionIndex="s1"/>` +
+    `<AttributeStatement><Attribute Name="role"><AttributeValue>admin</AttributeValue>` +
+    `<AttributeValue>dev</AttributeValue></Attribute></AttributeStatement>` +
+    `</Assertion>`+ t.extra +`</Response>`)
+}
+
+
+func newTestSP(t *testing.T, idpInitiated bool) *ServiceProvider {
+  sp, err := New(Config{
+    EntityID          : "https://sp.example.com",
+    ACSURL            : "https://sp.example.com/saml/acs",
+    IdPEntityID       : "https://idp.example.com",
+    IdPSSOURL         : "https://idp.example.com/sso",
+    Verifier          : fakeVerifier{ valid: map[string]bool{ "_resp": true, "_assert": true } },
+    AllowIdPInitiated : idpInitiated,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  return sp
+}
+
+
+func TestParseResponse(t *testing.T) {
+  tests := []struct {
+    name         string
+    edit         func(d *testDoc)
+    expectID     string
+    idpInitiated bool
+    err          string
+  }{
+    { "signed assertion", func(d *testDoc) {}, "_req", false, "" },
+    { "signed response", func(d *testDoc) {
+        d.signResp, d.signAssertion, d.subjectIRT = true, false, ""
+      }, "_req", false, "" },
+    { "unsigned outer InResponseTo", func(d *testDoc) {
+        d.subjectIRT = ""
+      }, "_req", false, "no valid bearer subject confirmation" },
+    { "unsolicited", func(d *testDoc) {
+        d.respIRT, d.subjectIRT = "", ""
+      }, "", false, "unsolicited response" },
+    { "idp initiated", func(d *testDoc) {
+        d.respIRT, d.subjectIRT = "", ""
+      }, "", true, "" },
+    { "other request", func(d *testDoc) {
+        d.subjectIRT = "_other"
+      }, "_req", true, "no valid bearer subject confirmation" },
+    { "signed response for other request", func(d *testDoc) {
+        d.signResp, d.signAssertion, d.respIRT, d.subjectIRT = true, false, "_other", ""
+      }, "_req", false, "unexpected InResponseTo" },
+    { "not signed", func(d *testDoc) {
+        d.signAssertion = false
+      }, "_req", false, "not signed" },
+    { "bad signature", func(d *testDoc) {
+        d.assertionID = "_forged"
+      }, "_req", false, "bad signature" },
+    { "wrong issuer", func(d *testDoc) {
+        d.issuer = "https://evil.example.com"
+      }, "_req", false, "unexpected issuer" },
+    { "wrong audience", func(d *testDoc) {
+        d.audience = "https://other.example.com"
+      }, "_req", false, "audience mismatch" },
+    { "wrong recipient", func(d *testDoc) {
+        d.recipient = "https://other.example.com/acs"
+      }, "_req", false, "no valid bearer subject confirmation" },
+    { "expired", func(d *testDoc) {
+        d.notAfter = testNow.Add(-3 * time.Minute)
+      }, "_req", false, "expired" },
+    { "not yet valid", func(d *testDoc) {
+        d.notBefore = testNow.Add(3 * time.Minute)
+      }, "_req", false, "not yet valid" },
+    { "failed status", func(d *testDoc) {
+        d.signResp, d.signAssertion = true, false
+        d.status = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+      }, "_req", false, "login failed" },
+    { "wrong destination", func(d *testDoc) {
+        d.signResp, d.signAssertion = true, false
+        d.destination = "https://other.example.com/acs"
+      }, "_req", false, "wrong destination" },
+    { "two assertions", func(d *testDoc) {
+        d.extra = `<Assertion xmlns="`+ nsAssertion +`" ID="_second"/>`
+      }, "_req", false, "exactly one assertion" },
+    { "duplicate id", func(d *testDoc) {
+        d.extra = `<Extensions ID="_assert"/>`
+      }, "_req", false, "duplicate ID" },
+    { "encrypted", func(d *testDoc) {
+        d.extra = `<EncryptedAssertion xmlns="`+ nsAssertion +`"/>`
+      }, "_req", false, "encrypted" },
+  }
+
+  for _, tt := range tests {
+    d := newTestDoc()
+    tt.edit(d)
+    a, err := newTestSP(t, tt.idpInitiated).ParseResponse(d.bytes(), tt.expectID, testNow)
+    if tt.err != "" {
+      if err == nil || !strings.Contains(err.Error(), tt.err) {
+        t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%s: %v", tt.name, err)
+      continue
+    }
+    want := &Assertion{
+      Issuer       : "https://idp.example.com",
+      NameID       : "alice",
+      SessionIndex : "s1",
+      Attributes   : map[string][]string{ "role": { "admin", "dev" } },
+      NotOnOrAfter : d.notAfter,
+    }
+    if !reflect.DeepEqual(a, want) {
+      t.Errorf("%s: got %+v", tt.name, a)
+    }
+  }
+}
+
+
+func TestParseResponseReplay(t *testing.T) {
+  sp := newTestSP(t, false)
+  doc := newTestDoc().bytes()
+  if _, err := sp.ParseResponse(doc, "_req", testNow); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := sp.ParseResponse(doc, "_req", testNow.Add(time.Minute)); err == nil {
+    t.Error("replayed assertion was accepted")
+  }
+  // 过期后从记录中删除, 断言本身也已过期
+  if _, err := sp.ParseResponse(doc, "_req", testNow.Add(time.Hour)); err == nil {
+    t.Error("expired assertion was accepted")
+  }
+}
+
+
+func TestNew(t *testing.T) {
+  v := fakeVerifier{}
+  tests := []struct {
+    conf Config
+    ok   bool
+  }{
+    { Config{ EntityID: "e", ACSURL: "a", IdPSSOURL: "s", Verifier: v }, true },
+    { Config{ EntityID: "e", ACSURL: "a", IdPSSOURL: "s" },              false },
+    { Config{ ACSURL: "a", IdPSSOURL: "s", Verifier: v },                false },
+    { Config{ EntityID: "e", IdPSSOURL: "s", Verifier: v },              false },
+    { Config{ EntityID: "e", ACSURL: "a", Verifier: v },                 false },
+  }
+  for i, tt := range tests {
+    if _, err := New(tt.conf); (err == nil) != tt.ok {
+      t.Errorf("#%d New error = %v", i, err)
+    }
+  }
+}
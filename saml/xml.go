@@ -0,0 +1,112 @@
+package saml
+
+import (
+  "bytes"
+  "encoding/xml"
+  "fmt"
+  "time"
+)
+
+const (
+  nsProtocol   = "urn:oasis:names:tc:SAML:2.0:protocol"
+  nsAssertion  = "urn:oasis:names:tc:SAML:2.0:assertion"
+  nsMetadata   = "urn:oasis:names:tc:SAML:2.0:metadata"
+  bindingPOST  = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+  statusOK     = "urn:oasis:names:tc:SAML:2.0:status:Success"
+  bearer       = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+  nameIDFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+)
+
+type xmlResponse struct {
+  XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
+  ID           string   `xml:"ID,attr"`
+  Destination  string   `xml:"Destination,attr"`
+  InResponseTo string   `xml:"InResponseTo,attr"`
+  Issuer       string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+  Status       struct {
+    Code struct {
+      Value string `xml:"Value,attr"`
+    } `xml:"StatusCode"`
+  } `xml:"Status"`
+  Signature    *struct{}      `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+  Assertions   []xmlAssertion `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+  Encrypted    []struct{}     `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedAssertion"`
+}
+
+type xmlAssertion struct {
+  XMLName   xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+  ID        string    `xml:"ID,attr"`
+  Issuer    string    `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+  Signature *struct{} `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+  Subject   struct {
+    NameID       string `xml:"NameID"`
+    Confirmation []struct {
+      Method string `xml:"Method,attr"`
+      Data   struct {
+        NotOnOrAfter string `xml:"NotOnOrAfter,attr"`
+        Recipient    string `xml:"Recipient,attr"`
+        InResponseTo string `xml:"InResponseTo,attr"`
+      } `xml:"SubjectConfirmationData"`
+    } `xml:"SubjectConfirmation"`
+  } `xml:"Subject"`
+  Conditions struct {
+    NotBefore    string   `xml:"NotBefore,attr"`
+    NotOnOrAfter string   `xml:"NotOnOrAfter,attr"`
+    Audiences    []string `xml:"AudienceRestriction>Audience"`
+  } `xml:"Conditions"`
+  AuthnStatement struct {
+    SessionIndex string `xml:"SessionIndex,attr"`
+  } `xml:"AuthnStatement"`
+  Attributes []struct {
+    Name   string   `xml:"Name,attr"`
+    Values []string `xml:"AttributeValue"`
+  } `xml:"AttributeStatement>Attribute"`
+}
+
+
+func esc(s string) string {
+  var buf bytes.Buffer
+  xml.EscapeText(&buf, []byte(s))
+  return buf.String()
+}
+
+
+func samlTime(t time.Time) string {
+  return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+
+//
+// 空字符串返回零值
+//
+func parseTime(s string) (time.Time, error) {
+  if s == "" {
+    return time.Time{}, nil
+  }
+  t, err := time.Parse(time.RFC3339, s)
+  if err != nil {
+    return t, fmt.Errorf("bad time '%s'", s)
+  }
+  return t, nil
+}
+
+
+func metadataXML(entityID string, acs string) []byte {
+  return []byte(`<?xml version="1.0" encoding="UTF-8"?>` +"\n"+
+    `<md:EntityDescriptor xmlns:md="`+ nsMetadata +`" entityID="`+ esc(entityID) +`">`+
+    `<md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true"`+
+    ` protocolSupportEnumeration="`+ nsProtocol +`">`+
+    `<md:NameIDFormat>`+ nameIDFormat +`</md:NameIDFormat>`+
+    `<md:AssertionConsumerService Binding="`+ bindingPOST +`" Location="`+ esc(acs) +`" index="0" isDefault="true"/>`+
+    `</md:SPSSODescriptor></md:EntityDescriptor>`)
+}
+
+
+func authnRequestXML(id string, now time.Time, entityID, acs, dest string) []byte {
+  return []byte(`<samlp:AuthnRequest xmlns:samlp="`+ nsProtocol +`" xmlns:saml="`+ nsAssertion +`"`+
+    ` ID="`+ esc(id) +`" Version="2.0" IssueInstant="`+ samlTime(now) +`"`+
+    ` Destination="`+ esc(dest) +`" AssertionConsumerServiceURL="`+ esc(acs) +`"`+
+    ` ProtocolBinding="`+ bindingPOST +`">`+
+    `<saml:Issuer>`+ esc(entityID) +`</saml:Issuer>`+
+    `</samlp:AuthnRequest>`)
+}
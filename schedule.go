@@ -0,0 +1,367 @@
+package brick
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "runtime"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+//
+// 后台任务, 返回的错误写入日志
+//
+type JobFunc func(ctx context.Context) error
+
+//
+// 任务的状态, 参考 Brick.Jobs()
+//
+type JobInfo struct {
+  Name     string
+  // "every 5m0s" 或 cron 表达式
+  Schedule string
+  Runs     uint64
+  Failures uint64
+  LastRun  time.Time
+  LastErr  string
+  Next     time.Time
+}
+
+type job struct {
+  info    JobInfo
+  fn      JobFunc
+  next    func(time.Time) time.Time
+  running bool
+}
+
+//
+// 随 Brick 启动和关闭的任务调度, Run() 开始后启动, Shutdown() 时
+// 取消 ctx 并等待正在执行的任务结束.
+//
+type scheduler struct {
+  lock    sync.Mutex
+  jobs    []*job
+  ctx     context.Context
+  cancel  context.CancelFunc
+  wg      sync.WaitGroup
+}
+
+
+//
+// 每隔 interval 执行一次 fn, 同一个任务不会重叠执行 (上次未结束时跳过)
+//
+func (b *Brick) Every(interval time.Duration, name string, fn JobFunc) {
+  if interval <= 0 {
+    panic(errors.New("job '"+ name +"' interval must be positive"))
+  }
+  b.addJob(name, "every "+ interval.String(), fn, func(t time.Time) time.Time {
+    return t.Add(interval)
+  })
+}
+
+
+//
+// 按 cron 表达式执行 fn, 使用本地时区; 支持 "分 时 日 月 周" 五个字段
+// (* , - / 和数字, 周日为 0 或 7) 以及 @hourly, @daily, @weekly, @monthly, @yearly
+//
+func (b *Brick) Cron(spec string, name string, fn JobFunc) error {
+  c, err := parseCron(spec)
+  if err != nil {
+    return fmt.Errorf("job '%s': %s", name, err)
+  }
+  b.addJob(name, spec, fn, c.next)
+  return nil
+}
+
+
+//
+// 所有任务的状态
+//
+func (b *Brick) Jobs() []JobInfo {
+  s := &b.jobs
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  ret := make([]JobInfo, len(s.jobs))
+  for i, j := range s.jobs {
+    ret[i] = j.info
+  }
+  return ret
+}
+
+
+func (b *Brick) addJob(name string, schedule string, fn JobFunc, next func(time.Time) time.Time) {
+  j := &job{ info: JobInfo{ Name: name, Schedule: schedule }, fn: fn, next: next }
+  s := &b.jobs
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  s.jobs = append(s.jobs, j)
+  if s.ctx != nil {
+    b.startJob(j)
+  }
+}
+
+
+//
+// 启动所有任务, 由 Run() 调用
+//
+func (b *Brick) startJobs() {
+  s := &b.jobs
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  if s.ctx != nil {
+    return
+  }
+  s.ctx, s.cancel = context.WithCancel(context.Background())
+  for _, j := range s.jobs {
+    b.startJob(j)
+  }
+}
+
+
+//
+// 停止调度并等待正在执行的任务, 最多等到 ctx 结束
+//
+func (b *Brick) stopJobs(ctx context.Context) error {
+  s := &b.jobs
+  s.lock.Lock()
+  if s.cancel == nil {
+    s.lock.Unlock()
+    return nil
+  }
+  s.cancel()
+  s.ctx, s.cancel = nil, nil
+  s.lock.Unlock()
+
+  done := make(chan struct{})
+  go func() {
+    s.wg.Wait()
+    close(done)
+  }()
+  select {
+  case <-done:
+    return nil
+  case <-ctx.Done():
+    return errors.New("jobs still running at shutdown")
+  }
+}
+
+
+//
+// 调度一个任务的循环; 调用者持有锁
+//
+func (b *Brick) startJob(j *job) {
+  ctx := b.jobs.ctx
+  b.jobs.wg.Add(1)
+  go func() {
+    defer b.jobs.wg.Done()
+    for {
+      b.jobs.lock.Lock()
+      at := j.next(time.Now())
+      j.info.Next = at
+      b.jobs.lock.Unlock()
+
+      t := time.NewTimer(time.Until(at))
+      select {
+      case <-ctx.Done():
+        t.Stop()
+        return
+      case <-t.C:
+      }
+
+      b.jobs.lock.Lock()
+      if j.running {
+        b.jobs.lock.Unlock()
+        b.log.Warn("Job", j.info.Name, "still running, skipped")
+        continue
+      }
+      j.running = true
+      b.jobs.lock.Unlock()
+
+      b.jobs.wg.Add(1)
+      go func() {
+        defer b.jobs.wg.Done()
+        b.runJob(ctx, j)
+      }()
+    }
+  }()
+}
+
+
+//
+// 执行一次任务, 异常写入日志, 结果计入指标 brick_job_runs_total 和 brick_job_seconds_total
+//
+func (b *Brick) runJob(ctx context.Context, j *job) {
+  begin := time.Now()
+  result := "ok"
+  var err error
+
+  func() {
+    defer func() {
+      if p := recover(); p != nil {
+        var buf [4096]byte
+        n := runtime.Stack(buf[:], false)
+        b.log.Error("Job", j.info.Name, "panic:", p, string(buf[:n]))
+        err = fmt.Errorf("panic: %v", p)
+        result = "panic"
+      }
+    }()
+    err = j.fn(ctx)
+  }()
+  if err != nil && result == "ok" {
+    b.log.Error("Job", j.info.Name, err)
+    result = "error"
+  }
+
+  b.jobs.lock.Lock()
+  j.running = false
+  j.info.Runs++
+  j.info.LastRun = begin
+  j.info.LastErr = ""
+  if err != nil {
+    j.info.Failures++
+    j.info.LastErr = err.Error()
+  }
+  b.jobs.lock.Unlock()
+
+  b.metrics.Inc("brick_job_runs_total", "Background job runs by result", "job", j.info.Name, "result", result)
+  b.metrics.Add("brick_job_seconds_total", "Time spent in background jobs",
+      time.Since(begin).Seconds(), "job", j.info.Name)
+}
+
+
+//
+// 解析后的 cron 表达式, 每个字段是允许值的位图
+//
+type cronSpec struct {
+  minute, hour, dom, month, dow uint64
+  // 日和周都被限制时, 满足其中一个即可 (与 cron 相同)
+  domStar, dowStar bool
+}
+
+var cronMacros = map[string]string{
+  "@yearly"   : "0 0 1 1 *",
+  "@annually" : "0 0 1 1 *",
+  "@monthly"  : "0 0 1 * *",
+  "@weekly"   : "0 0 * * 0",
+  "@daily"    : "0 0 * * *",
+  "@midnight" : "0 0 * * *",
+  "@hourly"   : "0 * * * *",
+}
+
+
+func parseCron(spec string) (*cronSpec, error) {
+  if m, has := cronMacros[strings.TrimSpace(spec)]; has {
+    spec = m
+  }
+  f := strings.Fields(spec)
+  if len(f) != 5 {
+    return nil, errors.New("cron '"+ spec +"' must have 5 fields")
+  }
+  c := &cronSpec{ domStar: f[2] == "*", dowStar: f[4] == "*" }
+  var err error
+  if c.minute, err = cronField(f[0], 0, 59); err != nil {
+    return nil, err
+  }
+  if c.hour, err = cronField(f[1], 0, 23); err != nil {
+    return nil, err
+  }
+  if c.dom, err = cronField(f[2], 1, 31); err != nil {
+    return nil, err
+  }
+  if c.month, err = cronField(f[3], 1, 12); err != nil {
+    return nil, err
+  }
+  if c.dow, err = cronField(f[4], 0, 7); err != nil {
+    return nil, err
+  }
+  // 7 也表示周日
+  if c.dow & (1 << 7) != 0 {
+    c.dow |= 1
+  }
+  return c, nil
+}
+
+
+//
+// 解析 "*", "*/15", "1-5", "1,3,5", "10-40/10"
+//
+func cronField(s string, min int, max int) (uint64, error) {
+  var bits uint64
+  for _, part := range strings.Split(s, ",") {
+    step := 1
+    if i := strings.IndexByte(part, '/'); i >= 0 {
+      n, err := strconv.Atoi(part[i+1:])
+      if err != nil || n < 1 {
+        return 0, errors.New("cron: bad step in '"+ part +"'")
+      }
+      step = n
+      part = part[:i]
+    }
+    lo, hi := min, max
+    if part != "*" {
+      bounds := strings.SplitN(part, "-", 2)
+      var err error
+      if lo, err = strconv.Atoi(bounds[0]); err != nil {
+        return 0, errors.New("cron: bad value '"+ part +"'")
+      }
+      hi = lo
+      if len(bounds) == 2 {
+        if hi, err = strconv.Atoi(bounds[1]); err != nil {
+          return 0, errors.New("cron: bad value '"+ part +"'")
+        }
+      } else if step > 1 {
+        hi = max
+      }
+      if lo < min || hi > max || lo > hi {
+        return 0, fmt.Errorf("cron: '%s' out of range %d-%d", part, min, max)
+      }
+    }
+    for v := lo; v <= hi; v += step {
+      bits |= 1 << uint(v)
+    }
+  }
+  return bits, nil
+}
+
+
+//
+// t 之后第一个匹配的时间 (精确到分钟)
+//
+func (c *cronSpec) next(t time.Time) time.Time {
+  t = t.Truncate(time.Minute).Add(time.Minute)
+  // 最多找 5 年, 例如 2 月 30 日永远不会匹配
+  limit := t.AddDate(5, 0, 0)
+  for t.Before(limit) {
+    if c.month & (1 << uint(t.Month())) == 0 {
+      t = time.Date(t.Year(), t.Month() + 1, 1, 0, 0, 0, 0, t.Location())
+      continue
+    }
+    if !c.dayMatch(t) {
+      t = time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, t.Location())
+      continue
+    }
+    if c.hour & (1 << uint(t.Hour())) == 0 {
+      t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour() + 1, 0, 0, 0, t.Location())
+      continue
+    }
+    if c.minute & (1 << uint(t.Minute())) == 0 {
+      t = t.Add(time.Minute)
+      continue
+    }
+    return t
+  }
+  return limit
+}
+
+
+func (c *cronSpec) dayMatch(t time.Time) bool {
+  dom := c.dom & (1 << uint(t.Day())) != 0
+  dow := c.dow & (1 << uint(t.Weekday())) != 0
+  if c.domStar || c.dowStar {
+    return dom && dow
+  }
+  return dom || dow
+}
@@ -0,0 +1,75 @@
+package brick
+
+import (
+  "testing"
+  "time"
+)
+
+
+func TestParseCron(t *testing.T) {
+  tests := []struct {
+    spec string
+    ok   bool
+  }{
+    { "* * * * *",          true },
+    { "*/15 0-6,22 1 1-12/2 0", true },
+    { "* * * * mon",        false },
+    { "10-40/10 5/6 * * 1-5", true },
+    { " @hourly ",          true },
+    { "@every 5m",          false },
+    { "* * * *",            false },
+    { "60 * * * *",         false },
+    { "* 24 * * *",         false },
+    { "* * 0 * *",          false },
+    { "* * * 13 *",         false },
+    { "* * * * 8",          false },
+    { "*/0 * * * *",        false },
+    { "5-1 * * * *",        false },
+    { "a * * * *",          false },
+    { "1-x * * * *",        false },
+  }
+  for _, tt := range tests {
+    if _, err := parseCron(tt.spec); (err == nil) != tt.ok {
+      t.Errorf("parseCron(%q) error = %v", tt.spec, err)
+    }
+  }
+}
+
+
+func TestCronNext(t *testing.T) {
+  // 星期一
+  from := time.Date(2024, 1, 15, 10, 7, 30, 0, time.UTC)
+  at := func(month time.Month, day, hour, min int) time.Time {
+    return time.Date(2024, month, day, hour, min, 0, 0, time.UTC)
+  }
+
+  tests := []struct {
+    spec string
+    want time.Time
+  }{
+    { "*/15 * * * *",      at(1, 15, 10, 15) },
+    { "10-40/10 * * * *",  at(1, 15, 10, 10) },
+    { "7 10 * * *",        at(1, 16, 10, 7) },
+    { "@hourly",           at(1, 15, 11, 0) },
+    { "@daily",            at(1, 16, 0, 0) },
+    { "30 9 * * 1-5",      at(1, 16, 9, 30) },
+    { "0 0 * * 0",         at(1, 21, 0, 0) },
+    { "0 0 * * 7",         at(1, 21, 0, 0) },
+    { "0 0 1 * *",         at(2, 1, 0, 0) },
+    { "0 0 29 2 *",        at(2, 29, 0, 0) },
+    // 日和周都被限制时满足其中一个即可: 13 日或星期五
+    { "0 12 13 * 5",       at(1, 19, 12, 0) },
+    { "0 0 1 * 1",         at(1, 22, 0, 0) },
+    // 永远不会匹配, 返回 5 年后
+    { "0 0 30 2 *",        time.Date(2029, 1, 15, 10, 8, 0, 0, time.UTC) },
+  }
+  for _, tt := range tests {
+    c, err := parseCron(tt.spec)
+    if err != nil {
+      t.Fatalf("parseCron(%q): %v", tt.spec, err)
+    }
+    if got := c.next(from); !got.Equal(tt.want) {
+      t.Errorf("%q next = %s, want %s", tt.spec, got, tt.want)
+    }
+  }
+}
@@ -0,0 +1,285 @@
+package brick
+
+import (
+  "encoding"
+  "encoding/json"
+  "fmt"
+  "reflect"
+  "sort"
+  "strings"
+)
+
+//
+// 由示例值生成的 json 结构描述, 用于 Debug 模式下检查 Json() 的输出
+//
+type schemaNode struct {
+  // object, map, array, string, number, boolean, any;
+  // ref 是递归类型对外层结构的引用, 参考 ref
+  kind     string
+  nullable bool
+  fields   map[string]*schemaField
+  elem     *schemaNode
+  // kind 为 ref 时引用的结构和它的类型名
+  ref      *schemaNode
+  name     string
+}
+
+type schemaField struct {
+  node     *schemaNode
+  optional bool
+}
+
+var (
+  jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+  textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+
+//
+// 为 path 路由注册 json 响应的结构, sample 是响应类型的示例值,
+// 例如 brick.Msg{ Data: User{} }, interface{} 字段的结构取示例中的值.
+// 只在 Debug 模式下, 每次调用 Json()/JsonCode() 时检查输出,
+// 多余的字段, 类型错误和缺少的字段会记录到日志.
+//
+func (b *Brick) ResponseSchema(path string, sample interface{}) {
+  node := buildSchema(reflect.ValueOf(sample))
+  b.schemaLock.Lock()
+  defer b.schemaLock.Unlock()
+  if b.schemas == nil {
+    b.schemas = make(map[string]*schemaNode)
+  }
+  b.schemas[path] = node
+}
+
+
+//
+// 检查将要输出的 json 数据是否符合路由注册的结构
+//
+func (h *Http) checkResponseSchema(m interface{}) {
+  if !h.b.Debug {
+    return
+  }
+  h.b.schemaLock.Lock()
+  node := h.b.schemas[h.rkey]
+  h.b.schemaLock.Unlock()
+  if node == nil {
+    return
+  }
+
+  buf, err := json.Marshal(m)
+  if err != nil {
+    return
+  }
+  var v interface{}
+  if err := json.Unmarshal(buf, &v); err != nil {
+    return
+  }
+
+  var problems []string
+  node.check("$", v, &problems)
+  if len(problems) > 0 {
+    h.b.log.Warn("Response schema mismatch", h.route, "\n  "+ strings.Join(problems, "\n  "))
+  }
+}
+
+
+func buildSchema(v reflect.Value) *schemaNode {
+  return buildNode(v, make(map[reflect.Type]*schemaNode))
+}
+
+
+//
+// building 是正在生成的结构类型, 再次遇到时生成引用,
+// 否则 type Node struct { Children []Node } 这样的类型会无限递归
+//
+func buildNode(v reflect.Value, building map[reflect.Type]*schemaNode) *schemaNode {
+  if !v.IsValid() {
+    return &schemaNode{ kind: "any", nullable: true }
+  }
+  t := v.Type()
+
+  if t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) {
+    return &schemaNode{ kind: "any", nullable: true }
+  }
+  if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+    return &schemaNode{ kind: "string" }
+  }
+
+  switch t.Kind() {
+  case reflect.Ptr:
+    var n *schemaNode
+    if v.IsNil() {
+      n = buildNode(reflect.Zero(t.Elem()), building)
+    } else {
+      n = buildNode(v.Elem(), building)
+    }
+    n.nullable = true
+    return n
+
+  case reflect.Interface:
+    if v.IsNil() {
+      return &schemaNode{ kind: "any", nullable: true }
+    }
+    n := buildNode(v.Elem(), building)
+    n.nullable = true
+    return n
+
+  case reflect.Struct:
+    if outer := building[t]; outer != nil {
+      return &schemaNode{ kind: "ref", ref: outer, name: t.String() }
+    }
+    n := &schemaNode{ kind: "object", fields: make(map[string]*schemaField) }
+    building[t] = n
+    collectSchemaFields(v, n.fields, building)
+    delete(building, t)
+    return n
+
+  case reflect.Map:
+    elem := reflect.Zero(t.Elem())
+    if v.Len() > 0 {
+      elem = v.MapIndex(v.MapKeys()[0])
+    }
+    return &schemaNode{ kind: "map", nullable: true, elem: buildNode(elem, building) }
+
+  case reflect.Slice:
+    if t.Elem().Kind() == reflect.Uint8 {
+      return &schemaNode{ kind: "string", nullable: true }
+    }
+    fallthrough
+  case reflect.Array:
+    elem := reflect.Zero(t.Elem())
+    if v.Len() > 0 {
+      elem = v.Index(0)
+    }
+    return &schemaNode{ kind: "array", nullable: t.Kind() == reflect.Slice,
+                        elem: buildNode(elem, building) }
+
+  case reflect.String:
+    return &schemaNode{ kind: "string" }
+  case reflect.Bool:
+    return &schemaNode{ kind: "boolean" }
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+       reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+       reflect.Float32, reflect.Float64:
+    return &schemaNode{ kind: "number" }
+  }
+  return &schemaNode{ kind: "any", nullable: true }
+}
+
+
+func collectSchemaFields(v reflect.Value, out map[string]*schemaField,
+    building map[reflect.Type]*schemaNode) {
+  t := v.Type()
+  for i := 0; i < t.NumField(); i++ {
+    sf := t.Field(i)
+    tag := sf.Tag.Get("json")
+    if tag == "-" {
+      continue
+    }
+    opts := strings.Split(tag, ",")
+    name := opts[0]
+
+    if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+      collectSchemaFields(v.Field(i), out, building)
+      continue
+    }
+    if sf.PkgPath != "" {
+      continue
+    }
+    if name == "" {
+      name = sf.Name
+    }
+
+    f := &schemaField{ node: buildNode(v.Field(i), building) }
+    for _, o := range opts[1:] {
+      if o == "omitempty" {
+        f.optional = true
+      }
+      if o == "string" {
+        f.node = &schemaNode{ kind: "string" }
+      }
+    }
+    out[name] = f
+  }
+}
+
+
+func jsonKind(v interface{}) string {
+  switch v.(type) {
+  case nil:
+    return "null"
+  case map[string]interface{}:
+    return "object"
+  case []interface{}:
+    return "array"
+  case string:
+    return "string"
+  case float64:
+    return "number"
+  case bool:
+    return "boolean"
+  }
+  return fmt.Sprintf("%T", v)
+}
+
+
+func (n *schemaNode) check(path string, v interface{}, out *[]string) {
+  kind := jsonKind(v)
+  if n.kind == "any" {
+    return
+  }
+  if n.kind == "ref" {
+    if kind != "null" || !n.nullable {
+      n.ref.check(path, v, out)
+    }
+    return
+  }
+  if kind == "null" {
+    if !n.nullable {
+      *out = append(*out, fmt.Sprintf("%s: null, expect %s", path, n.kind))
+    }
+    return
+  }
+
+  expect := n.kind
+  if expect == "map" {
+    expect = "object"
+  }
+  if kind != expect {
+    *out = append(*out, fmt.Sprintf("%s: %s, expect %s", path, kind, expect))
+    return
+  }
+
+  switch n.kind {
+  case "object":
+    obj := v.(map[string]interface{})
+    names := make([]string, 0, len(obj))
+    for k := range obj {
+      names = append(names, k)
+    }
+    sort.Strings(names)
+    for _, k := range names {
+      f, has := n.fields[k]
+      if !has {
+        *out = append(*out, fmt.Sprintf("%s.%s: extra field", path, k))
+        continue
+      }
+      f.node.check(path +"."+ k, obj[k], out)
+    }
+    for k, f := range n.fields {
+      if _, has := obj[k]; !has && !f.optional {
+        *out = append(*out, fmt.Sprintf("%s.%s: missing field", path, k))
+      }
+    }
+
+  case "map":
+    for k, e := range v.(map[string]interface{}) {
+      n.elem.check(path +"."+ k, e, out)
+    }
+
+  case "array":
+    for i, e := range v.([]interface{}) {
+      n.elem.check(fmt.Sprintf("%s[%d]", path, i), e, out)
+    }
+  }
+}
@@ -0,0 +1,246 @@
+package brick
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "net/http"
+  "os"
+  "sort"
+  "strings"
+  "time"
+)
+
+// 命令行参数, 参考 SelfTestMain()
+const selfTestFlag = "--selftest"
+
+// 自检中每个路由请求的最长时间
+const selfTestTimeout = 10 * time.Second
+
+//
+// 自检的一个步骤
+//
+type SelfTestStep struct {
+  // "start", "template", "health" 或 "route"
+  Kind     string        `json:"kind"`
+  Name     string        `json:"name"`
+  OK       bool          `json:"ok"`
+  Status   int           `json:"status,omitempty"`
+  Error    string        `json:"error,omitempty"`
+  Duration time.Duration `json:"duration"`
+}
+
+//
+// 自检结果, 参考 Brick.SelfTest()
+//
+type SelfTestReport struct {
+  OK    bool           `json:"ok"`
+  Steps []SelfTestStep `json:"steps"`
+}
+
+
+//
+// 不监听端口, 按启动服务的步骤检查应用: 检查配置和策略, 启动组件, 执行 OnStart() 的函数,
+// 编译 TemplatePage() 注册的模板, 执行就绪探针, 然后用 HEAD 请求在内部访问每个允许 GET 的路由,
+// 响应 5xx 算作失败 (需要认证的路由返回 401 不算失败). 最后关闭组件.
+// 组件和 OnStart() 的函数与正式启动时一样执行, 它们的副作用 (例如数据库迁移) 同样会发生;
+// GET 请求有副作用的路由用 Route.SkipSelfTest() 排除.
+// 有任何失败时返回错误, 报告中有每一步的结果. 用于容器的启动探针和发布前的检查,
+// 命令行方式参考 SelfTestMain().
+//
+func (b *Brick) SelfTest(ctx context.Context) (*SelfTestReport, error) {
+  rep := &SelfTestReport{ OK: true }
+  step := func(kind, name string, begin time.Time, status int, err error) {
+    s := SelfTestStep{ Kind: kind, Name: name, OK: err == nil, Status: status,
+        Duration: time.Since(begin) }
+    if err != nil {
+      s.Error = err.Error()
+      rep.OK = false
+    }
+    rep.Steps = append(rep.Steps, s)
+  }
+
+  begin := time.Now()
+  err := b.validate()
+  if err == nil {
+    err = b.applyPolicy()
+  }
+  if err == nil {
+    err = b.startComponents(ctx)
+  }
+  if err != nil {
+    step("start", "config", begin, 0, err)
+    return rep, rep.err()
+  }
+  defer func() {
+    if err := b.stopComponents(ctx); err != nil {
+      b.log.Error(err)
+    }
+  }()
+  step("start", "config", begin, 0, nil)
+
+  begin = time.Now()
+  step("start", "OnStart", begin, 0, b.runStartHooks())
+  if !rep.OK {
+    return rep, rep.err()
+  }
+
+  for _, file := range b.registeredTemplates() {
+    begin = time.Now()
+    _, err := b.GetCachedTemplate(file)
+    step("template", file, begin, 0, err)
+  }
+
+  begin = time.Now()
+  checks := b.runHealthChecks(ctx)
+  names := make([]string, 0, len(checks))
+  for name := range checks {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    var err error
+    if res := checks[name]; res.Status != "ok" {
+      err = errors.New(res.Error)
+    }
+    step("health", name, begin, 0, err)
+  }
+
+  b.routeLock.RLock()
+  routes := append([]*Route(nil), b.routes...)
+  b.routeLock.RUnlock()
+  for _, rt := range routes {
+    info := rt.Info()
+    if !rt.allows(http.MethodGet) || rt.selfTestSkipped() {
+      continue
+    }
+    begin = time.Now()
+    status, err := b.selfTestRoute(ctx, info)
+    step("route", info.Host + info.Path, begin, status, err)
+  }
+  return rep, rep.err()
+}
+
+
+//
+// 自检时不请求这个路由, 用于 GET 请求也有副作用 (例如发送消息, 扣费) 的路由
+//
+func (r *Route) SkipSelfTest() *Route {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  r.noSelfTest = true
+  return r
+}
+
+
+func (r *Route) selfTestSkipped() bool {
+  r.lock.RLock()
+  defer r.lock.RUnlock()
+  return r.noSelfTest
+}
+
+
+func (rep *SelfTestReport) err() error {
+  n := 0
+  for _, s := range rep.Steps {
+    if !s.OK {
+      n++
+    }
+  }
+  if n == 0 {
+    return nil
+  }
+  return fmt.Errorf("self test: %d step(s) failed", n)
+}
+
+
+//
+// 输出自检结果, 每步一行
+//
+func (rep *SelfTestReport) WriteTo(w io.Writer) (int64, error) {
+  var sb strings.Builder
+  for _, s := range rep.Steps {
+    mark := "ok  "
+    if !s.OK {
+      mark = "FAIL"
+    }
+    fmt.Fprintf(&sb, "%s %-8s %s", mark, s.Kind, s.Name)
+    if s.Status != 0 {
+      fmt.Fprintf(&sb, " %d", s.Status)
+    }
+    fmt.Fprintf(&sb, " (%s)", s.Duration.Round(time.Millisecond))
+    if s.Error != "" {
+      sb.WriteString(": "+ s.Error)
+    }
+    sb.WriteByte('\n')
+  }
+  n, err := io.WriteString(w, sb.String())
+  return int64(n), err
+}
+
+
+//
+// TemplatePage() 注册的和已经加载过的模板
+//
+func (b *Brick) registeredTemplates() []string {
+  u := &b.usage
+  u.lock.Lock()
+  defer u.lock.Unlock()
+  list := make([]string, 0, len(u.templates))
+  for file := range u.templates {
+    list = append(list, file)
+  }
+  sort.Strings(list)
+  return list
+}
+
+
+func (b *Brick) selfTestRoute(ctx context.Context, info RouteInfo) (int, error) {
+  ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+  defer cancel()
+  r, err := http.NewRequestWithContext(ctx, http.MethodHead, info.Path, nil)
+  if err != nil {
+    return 0, err
+  }
+  r.RemoteAddr = "127.0.0.1:0"
+  r.Host = "localhost"
+  if info.Host != "" {
+    r.Host = strings.Replace(info.Host, "*", "selftest", 1)
+  }
+  r.Header.Set("Accept", "text/html")
+
+  w := &warmWriter{ header: http.Header{} }
+  b.ServeHTTP(w, r)
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  if w.status >= 500 {
+    return w.status, errors.New(http.StatusText(w.status))
+  }
+  return w.status, nil
+}
+
+
+//
+// 命令行参数有 "--selftest" 时执行 SelfTest(), 输出结果并退出, 失败时退出码为 1;
+// 没有这个参数时什么都不做. 注册完路由和组件后, 在 Run() 之前调用:
+//
+//   b.SelfTestMain()
+//   err := b.Run()
+//
+func (b *Brick) SelfTestMain() {
+  for _, arg := range os.Args[1:] {
+    if arg != selfTestFlag {
+      continue
+    }
+    rep, err := b.SelfTest(context.Background())
+    rep.WriteTo(os.Stdout)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(1)
+    }
+    os.Exit(0)
+  }
+}
+
@@ -0,0 +1,326 @@
+package brick
+
+import (
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/kataras/go-sessions"
+)
+
+//
+// 管理本进程见过的会话, 参考 Brick.Sessions().
+// 使用共享的会话存储 (例如 redis) 时只能看到访问过本进程的会话.
+//
+type SessionManager struct {
+  b    *Brick
+  lock sync.Mutex
+  // 会话 ID -> 最后访问时间
+  seen map[string]time.Time
+  // 上次清理 seen 的时间, 参考 touch()
+  swept time.Time
+}
+
+const (
+  // 记录的会话数量上限, 超过时丢弃最久没有访问的记录
+  maxSeenSessions = 100000
+  // touch() 清理过期记录的间隔
+  seenSweepInterval = time.Minute
+)
+
+
+//
+// 返回会话管理器, 用于管理工具
+//
+func (b *Brick) Sessions() *SessionManager {
+  return &b.sessions
+}
+
+
+//
+// 未过期的会话数量
+//
+func (m *SessionManager) Count() int {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  m.prune()
+  return len(m.seen)
+}
+
+
+//
+// 未过期的会话 ID, 按最后访问时间从新到旧排序
+//
+func (m *SessionManager) IDs() []string {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  m.prune()
+  ids := make([]string, 0, len(m.seen))
+  for id := range m.seen {
+    ids = append(ids, id)
+  }
+  sort.Slice(ids, func(a, b int) bool {
+    return m.seen[ids[a]].After(m.seen[ids[b]])
+  })
+  return ids
+}
+
+
+//
+// 会话最后一次被访问的时间, 不存在返回零值
+//
+func (m *SessionManager) LastSeen(id string) time.Time {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  return m.seen[id]
+}
+
+
+//
+// 销毁会话, 持有该会话的用户在下一次请求时得到新的会话
+//
+func (m *SessionManager) Revoke(id string) {
+  m.b.sess.DestroyByID(id)
+  m.forget(id)
+}
+
+
+//
+// 销毁所有会话
+//
+func (m *SessionManager) RevokeAll() {
+  m.b.sess.DestroyAll()
+  m.lock.Lock()
+  m.seen = nil
+  m.lock.Unlock()
+}
+
+
+func (m *SessionManager) touch(id string) {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  if m.seen == nil {
+    m.seen = make(map[string]time.Time)
+  }
+  now := time.Now()
+  m.seen[id] = now
+  if now.Sub(m.swept) >= seenSweepInterval || len(m.seen) > maxSeenSessions {
+    m.prune()
+    m.swept = now
+  }
+}
+
+
+func (m *SessionManager) forget(id string) {
+  m.lock.Lock()
+  defer m.lock.Unlock()
+  delete(m.seen, id)
+}
+
+
+//
+// 删除超过会话有效期或空闲时间没有访问的记录, 两者都不限制时
+// 只保留最近访问的 maxSeenSessions 个的九成. 调用者持有锁.
+//
+func (m *SessionManager) prune() {
+  c := &m.b.config
+  exp := c.SessionExp
+  if c.SessionIdle > 0 && (exp <= 0 || c.SessionIdle < exp) {
+    exp = c.SessionIdle
+  }
+  if exp > 0 {
+    limit := time.Now().Add(-exp)
+    for id, t := range m.seen {
+      if t.Before(limit) {
+        delete(m.seen, id)
+      }
+    }
+  }
+  if len(m.seen) <= maxSeenSessions {
+    return
+  }
+  ids := make([]string, 0, len(m.seen))
+  for id := range m.seen {
+    ids = append(ids, id)
+  }
+  sort.Slice(ids, func(a, b int) bool {
+    return m.seen[ids[a]].Before(m.seen[ids[b]])
+  })
+  for _, id := range ids[:len(ids) - maxSeenSessions * 9 / 10] {
+    delete(m.seen, id)
+  }
+}
+
+
+//
+// 更换会话 ID 并保留会话中的值, 在登录或权限变化时调用以防止会话固定攻击.
+// 必须在写出响应之前调用.
+//
+func (h *Http) SessionRegenerate() *sessions.Session {
+  old := h.Session()
+  values := make(map[string]interface{}, old.Len())
+  old.Visit(func(k string, v interface{}) {
+    values[k] = v
+  })
+
+  h.destroySession()
+  h.b.sessions.forget(old.ID())
+  dropRequestCookie(h.R, h.b.config.SessionCookie)
+  h.s = nil
+
+  s := h.Session()
+  for k, v := range values {
+    s.Set(k, v)
+  }
+  return s
+}
+
+
+//
+// 开始会话, 会话 cookie 的 Domain 按虚拟主机的设置, 参考 Host.SessionDomain()
+//
+func (h *Http) startSession() *sessions.Session {
+  s := h.b.sess.Start(h.W, h.R)
+  h.fixSessionCookie()
+  return s
+}
+
+
+func (h *Http) destroySession() {
+  h.b.sess.Destroy(h.W, h.R)
+  h.fixSessionCookie()
+}
+
+
+//
+// 从请求中去掉 cookie, 之后的 Start() 会创建新的会话
+//
+func dropRequestCookie(r *http.Request, name string) {
+  cookies := r.Cookies()
+  r.Header.Del("Cookie")
+  var kept []string
+  for _, c := range cookies {
+    if c.Name != name {
+      kept = append(kept, c.String())
+    }
+  }
+  if len(kept) > 0 {
+    r.Header.Set("Cookie", strings.Join(kept, "; "))
+  }
+}
+
+
+//
+// 会话的空闲时间和最长时间, 参考 Config.SessionIdle 和 Config.SessionLifetime
+//
+const (
+  sessionCreated = "brick.session.created"
+  sessionActive  = "brick.session.active"
+)
+
+
+//
+// 会话超过空闲时间或最长时间时换成新的会话, 否则记录活动时间.
+// 活动时间最多每 30 秒 (或空闲时间的 1/10) 写一次, 减少对存储的写入.
+//
+func (h *Http) checkSessionActivity() {
+  c := &h.b.config
+  if c.SessionIdle <= 0 && c.SessionLifetime <= 0 {
+    return
+  }
+  now := time.Now()
+  created, active := h.sessionTimes()
+
+  if !created.IsZero() && h.sessionLeft(created, active, now) <= 0 {
+    h.b.Logger(LogSession).Debug("Session expired", h.R.URL.Path)
+    h.destroySession()
+    h.b.sessions.forget(h.s.ID())
+    dropRequestCookie(h.R, c.SessionCookie)
+    h.s = h.startSession()
+    h.b.sessions.touch(h.s.ID())
+    created = time.Time{}
+  }
+
+  if created.IsZero() {
+    h.s.Set(sessionCreated, now.Unix())
+    h.s.Set(sessionActive, now.Unix())
+    return
+  }
+  throttle := 30 * time.Second
+  if c.SessionIdle > 0 && c.SessionIdle / 10 < throttle {
+    throttle = c.SessionIdle / 10
+  }
+  if !h.passive && now.Sub(active) >= throttle {
+    h.s.Set(sessionActive, now.Unix())
+  }
+}
+
+
+//
+// 会话还剩多少时间失效 (空闲时间和最长时间中较早的一个),
+// 没有设置 SessionIdle 和 SessionLifetime 时第二个返回值为 false.
+//
+func (h *Http) SessionRemaining() (time.Duration, bool) {
+  c := &h.b.config
+  if c.SessionIdle <= 0 && c.SessionLifetime <= 0 {
+    return 0, false
+  }
+  h.Session()
+  created, active := h.sessionTimes()
+  left := h.sessionLeft(created, active, time.Now())
+  if left < 0 {
+    left = 0
+  }
+  return left, true
+}
+
+
+//
+// 提供会话状态的 json 接口, 供前端在即将退出登录时提示用户:
+// GET 返回剩余时间且不算作活动, POST 记录一次活动 (保持登录) 后返回.
+//
+func (b *Brick) SessionStatus(path string) {
+  b.Service(path, func(h *Http) error {
+    h.passive = h.R.Method != http.MethodPost
+    left, limited := h.SessionRemaining()
+    status := map[string]interface{}{
+      "limited"  : limited,
+      "remaining": int(left.Seconds()),
+      "idle"     : int(b.config.SessionIdle.Seconds()),
+      "lifetime" : int(b.config.SessionLifetime.Seconds()),
+    }
+    h.CacheTime(0)
+    h.Json(Msg{ Data: status })
+    return nil
+  }).Methods(http.MethodGet, http.MethodPost)
+}
+
+
+func (h *Http) sessionTimes() (created time.Time, active time.Time) {
+  if sec := h.s.GetInt64Default(sessionCreated, 0); sec > 0 {
+    created = time.Unix(sec, 0)
+  }
+  if sec := h.s.GetInt64Default(sessionActive, 0); sec > 0 {
+    active = time.Unix(sec, 0)
+  }
+  return
+}
+
+
+func (h *Http) sessionLeft(created time.Time, active time.Time, now time.Time) time.Duration {
+  c := &h.b.config
+  left := time.Duration(1<<63 - 1)
+  if c.SessionIdle > 0 {
+    if d := active.Add(c.SessionIdle).Sub(now); d < left {
+      left = d
+    }
+  }
+  if c.SessionLifetime > 0 {
+    if d := created.Add(c.SessionLifetime).Sub(now); d < left {
+      left = d
+    }
+  }
+  return left
+}
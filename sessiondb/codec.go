@@ -0,0 +1,40 @@
+//
+// go-sessions 的存储实现, 用于 brick.Config.SessionDB:
+//
+//   db := sessiondb.NewRedis(sessiondb.RedisConfig{ Addr: "127.0.0.1:6379" })
+//   b, err := brick.NewBrickConfig(brick.Config{ SessionDB: db, ... })
+//
+// 会话中的值用 gob 编码, 基本类型之外的值需要先 gob.Register().
+// 实现了 Ping(ctx) 的存储会自动加入健康检查 "sessions".
+//
+package sessiondb
+
+import (
+  "bytes"
+  "encoding/gob"
+)
+
+//
+// 用 wrapper 保存接口类型的值
+//
+type wrapper struct {
+  V interface{}
+}
+
+
+func encodeValue(v interface{}) ([]byte, error) {
+  var buf bytes.Buffer
+  if err := gob.NewEncoder(&buf).Encode(wrapper{ V: v }); err != nil {
+    return nil, err
+  }
+  return buf.Bytes(), nil
+}
+
+
+func decodeValue(b []byte) (interface{}, error) {
+  var w wrapper
+  if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&w); err != nil {
+    return nil, err
+  }
+  return w.V, nil
+}
@@ -0,0 +1,211 @@
+package sessiondb
+
+import (
+  "bytes"
+  "context"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "crypto/sha256"
+  "errors"
+  "time"
+
+  "github.com/kataras/go-sessions"
+)
+
+//
+// 加密会话存储的包装, 会话中的值用 AES-GCM 加密后交给下层存储,
+// 用于共享的 redis/数据库等需要静态加密的环境:
+//
+//   db, err := sessiondb.NewEncrypted(sessiondb.NewRedis(conf), newKey, oldKey)
+//
+// 第一个密钥用于加密, 其他密钥只用于解密; 用旧密钥加密的值在读取时
+// 用新密钥重新加密, 所有会话过期后即可删除旧密钥.
+// 值绑定会话 ID 和键名, 复制到其他会话或键上无法解密.
+//
+type Encrypted struct {
+  db      sessions.Database
+  keys    []encryptKey
+  OnError func(error)
+}
+
+type encryptKey struct {
+  id   [4]byte
+  aead cipher.AEAD
+}
+
+var errNoKey = errors.New("sessiondb: value encrypted with an unknown key")
+
+
+//
+// keys 是 16, 24 或 32 字节的 AES 密钥, 至少一个
+//
+func NewEncrypted(db sessions.Database, keys ...[]byte) (*Encrypted, error) {
+  if db == nil {
+    return nil, errors.New("sessiondb: nil database")
+  }
+  if len(keys) == 0 {
+    return nil, errors.New("sessiondb: no encryption key")
+  }
+  e := &Encrypted{ db: db }
+  for _, k := range keys {
+    block, err := aes.NewCipher(k)
+    if err != nil {
+      return nil, err
+    }
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+      return nil, err
+    }
+    sum := sha256.Sum256(k)
+    ek := encryptKey{ aead: aead }
+    copy(ek.id[:], sum[:])
+    e.keys = append(e.keys, ek)
+  }
+  return e, nil
+}
+
+
+//
+// 关闭下层存储 (如果它实现了 Close)
+//
+func (e *Encrypted) Close() error {
+  if c, ok := e.db.(interface{ Close() error }); ok {
+    return c.Close()
+  }
+  return nil
+}
+
+
+//
+// 检查下层存储 (如果它实现了 Ping), 可作为 brick.HealthCheck
+//
+func (e *Encrypted) Ping(ctx context.Context) error {
+  if p, ok := e.db.(interface{ Ping(context.Context) error }); ok {
+    return p.Ping(ctx)
+  }
+  return nil
+}
+
+
+func (e *Encrypted) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+  return e.db.Acquire(sid, expires)
+}
+
+
+func (e *Encrypted) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+  return e.db.OnUpdateExpiration(sid, newExpires)
+}
+
+
+func (e *Encrypted) Set(sid string, lifetime sessions.LifeTime, key string, value interface{}, immutable bool) {
+  b, err := e.seal(sid, key, value)
+  if err != nil {
+    e.fail(err)
+    return
+  }
+  e.db.Set(sid, lifetime, key, b, immutable)
+}
+
+
+func (e *Encrypted) Get(sid string, key string) interface{} {
+  v, ok := e.open(sid, key, e.db.Get(sid, key))
+  if !ok {
+    return nil
+  }
+  return v
+}
+
+
+func (e *Encrypted) Visit(sid string, cb func(key string, value interface{})) {
+  e.db.Visit(sid, func(key string, value interface{}) {
+    if v, ok := e.open(sid, key, value); ok {
+      cb(key, v)
+    }
+  })
+}
+
+
+func (e *Encrypted) Len(sid string) int {
+  return e.db.Len(sid)
+}
+
+
+func (e *Encrypted) Delete(sid string, key string) bool {
+  return e.db.Delete(sid, key)
+}
+
+
+func (e *Encrypted) Clear(sid string) {
+  e.db.Clear(sid)
+}
+
+
+func (e *Encrypted) Release(sid string) {
+  e.db.Release(sid)
+}
+
+
+//
+// 加密后的格式: 密钥 ID (4) + nonce + 密文
+//
+func (e *Encrypted) seal(sid string, key string, value interface{}) ([]byte, error) {
+  plain, err := encodeValue(value)
+  if err != nil {
+    return nil, err
+  }
+  k := e.keys[0]
+  out := make([]byte, len(k.id), len(k.id) + k.aead.NonceSize() + len(plain) + k.aead.Overhead())
+  copy(out, k.id[:])
+  nonce := make([]byte, k.aead.NonceSize())
+  if _, err := rand.Read(nonce); err != nil {
+    return nil, err
+  }
+  out = append(out, nonce...)
+  return k.aead.Seal(out, nonce, plain, additional(sid, key)), nil
+}
+
+
+//
+// 解密下层存储返回的值; 使用旧密钥时用当前密钥重新加密
+//
+func (e *Encrypted) open(sid string, key string, stored interface{}) (interface{}, bool) {
+  b, ok := stored.([]byte)
+  if !ok {
+    return nil, false
+  }
+  for i, k := range e.keys {
+    if len(b) < len(k.id) + k.aead.NonceSize() || !bytes.Equal(b[:len(k.id)], k.id[:]) {
+      continue
+    }
+    nonce := b[len(k.id) : len(k.id) + k.aead.NonceSize()]
+    plain, err := k.aead.Open(nil, nonce, b[len(k.id) + k.aead.NonceSize():], additional(sid, key))
+    if err != nil {
+      e.fail(err)
+      return nil, false
+    }
+    v, err := decodeValue(plain)
+    if err != nil {
+      e.fail(err)
+      return nil, false
+    }
+    if i > 0 {
+      e.Set(sid, sessions.LifeTime{}, key, v, false)
+    }
+    return v, true
+  }
+  e.fail(errNoKey)
+  return nil, false
+}
+
+
+func additional(sid string, key string) []byte {
+  return []byte(sid +"\x00"+ key)
+}
+
+
+func (e *Encrypted) fail(err error) {
+  if e.OnError != nil {
+    e.OnError(err)
+  }
+}
@@ -0,0 +1,323 @@
+package sessiondb
+
+import (
+  "context"
+  "crypto/sha1"
+  "encoding/gob"
+  "encoding/hex"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/kataras/go-sessions"
+)
+
+//
+// 文件会话存储, 每个会话一个文件, 适合单机部署.
+// 文件的修改时间被设置为会话的过期时间, 清理时只需要读取目录.
+//
+type File struct {
+  dir     string
+  lock    sync.Mutex
+  stop    chan struct{}
+  OnError func(error)
+}
+
+type fileSession struct {
+  Expires time.Time
+  Values  map[string][]byte
+}
+
+const fileExt = ".sess"
+
+
+//
+// 在 dir 中保存会话, cleanup > 0 时定期删除过期的会话文件
+//
+func NewFile(dir string, cleanup time.Duration) (*File, error) {
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return nil, err
+  }
+  f := &File{ dir: dir, stop: make(chan struct{}) }
+  if cleanup > 0 {
+    go f.cleanupLoop(cleanup)
+  }
+  return f, nil
+}
+
+
+//
+// 停止定期清理
+//
+func (f *File) Close() error {
+  select {
+  case <-f.stop:
+  default:
+    close(f.stop)
+  }
+  return nil
+}
+
+
+//
+// 检查目录是否可写, 可作为 brick.HealthCheck
+//
+func (f *File) Ping(ctx context.Context) error {
+  tmp, err := ioutil.TempFile(f.dir, ".ping")
+  if err != nil {
+    return err
+  }
+  name := tmp.Name()
+  tmp.Close()
+  return os.Remove(name)
+}
+
+
+//
+// 删除过期的会话文件, 返回删除的数量
+//
+func (f *File) Cleanup() int {
+  entries, err := ioutil.ReadDir(f.dir)
+  if err != nil {
+    f.fail(err)
+    return 0
+  }
+  now := time.Now()
+  n := 0
+  for _, e := range entries {
+    if e.IsDir() || !strings.HasSuffix(e.Name(), fileExt) || e.ModTime().After(now) {
+      continue
+    }
+    f.lock.Lock()
+    // 加锁后再检查一次, 会话可能刚被延期
+    if st, err := os.Stat(filepath.Join(f.dir, e.Name())); err == nil && !st.ModTime().After(now) {
+      if os.Remove(filepath.Join(f.dir, e.Name())) == nil {
+        n++
+      }
+    }
+    f.lock.Unlock()
+  }
+  return n
+}
+
+
+func (f *File) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  s := f.load(sid)
+  if s == nil {
+    return sessions.LifeTime{}
+  }
+  return sessions.LifeTime{ Time: s.Expires }
+}
+
+
+func (f *File) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  s := f.load(sid)
+  if s == nil {
+    return errors.New("session not found")
+  }
+  s.Expires = time.Now().Add(newExpires)
+  return f.save(sid, s)
+}
+
+
+func (f *File) Set(sid string, lifetime sessions.LifeTime, key string, value interface{}, immutable bool) {
+  b, err := encodeValue(value)
+  if err != nil {
+    f.fail(err)
+    return
+  }
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  s := f.load(sid)
+  if s == nil {
+    s = &fileSession{ Values: make(map[string][]byte) }
+  }
+  if !lifetime.IsZero() {
+    s.Expires = lifetime.Time
+  }
+  s.Values[key] = b
+  if err := f.save(sid, s); err != nil {
+    f.fail(err)
+  }
+}
+
+
+func (f *File) Get(sid string, key string) interface{} {
+  f.lock.Lock()
+  s := f.load(sid)
+  f.lock.Unlock()
+  if s == nil || s.Values[key] == nil {
+    return nil
+  }
+  v, err := decodeValue(s.Values[key])
+  if err != nil {
+    f.fail(err)
+    return nil
+  }
+  return v
+}
+
+
+func (f *File) Visit(sid string, cb func(key string, value interface{})) {
+  f.lock.Lock()
+  s := f.load(sid)
+  f.lock.Unlock()
+  if s == nil {
+    return
+  }
+  for k, b := range s.Values {
+    v, err := decodeValue(b)
+    if err != nil {
+      f.fail(err)
+      continue
+    }
+    cb(k, v)
+  }
+}
+
+
+func (f *File) Len(sid string) int {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  if s := f.load(sid); s != nil {
+    return len(s.Values)
+  }
+  return 0
+}
+
+
+func (f *File) Delete(sid string, key string) bool {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  s := f.load(sid)
+  if s == nil {
+    return false
+  }
+  if _, has := s.Values[key]; !has {
+    return false
+  }
+  delete(s.Values, key)
+  if err := f.save(sid, s); err != nil {
+    f.fail(err)
+    return false
+  }
+  return true
+}
+
+
+func (f *File) Clear(sid string) {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  s := f.load(sid)
+  if s == nil {
+    return
+  }
+  s.Values = make(map[string][]byte)
+  if err := f.save(sid, s); err != nil {
+    f.fail(err)
+  }
+}
+
+
+func (f *File) Release(sid string) {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  if err := os.Remove(f.path(sid)); err != nil && !os.IsNotExist(err) {
+    f.fail(err)
+  }
+}
+
+
+//
+// 会话 ID 来自客户端, 文件名使用它的散列
+//
+func (f *File) path(sid string) string {
+  sum := sha1.Sum([]byte(sid))
+  return filepath.Join(f.dir, hex.EncodeToString(sum[:]) + fileExt)
+}
+
+
+//
+// 读取会话, 不存在或已过期返回 nil; 调用者持有锁
+//
+func (f *File) load(sid string) *fileSession {
+  r, err := os.Open(f.path(sid))
+  if err != nil {
+    if !os.IsNotExist(err) {
+      f.fail(err)
+    }
+    return nil
+  }
+  defer r.Close()
+  var s fileSession
+  if err := gob.NewDecoder(r).Decode(&s); err != nil {
+    f.fail(err)
+    return nil
+  }
+  if !s.Expires.IsZero() && time.Now().After(s.Expires) {
+    return nil
+  }
+  if s.Values == nil {
+    s.Values = make(map[string][]byte)
+  }
+  return &s
+}
+
+
+//
+// 写入临时文件后改名, 避免读到写了一半的文件; 调用者持有锁
+//
+func (f *File) save(sid string, s *fileSession) error {
+  tmp, err := ioutil.TempFile(f.dir, ".tmp")
+  if err != nil {
+    return err
+  }
+  if err := gob.NewEncoder(tmp).Encode(s); err != nil {
+    tmp.Close()
+    os.Remove(tmp.Name())
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    os.Remove(tmp.Name())
+    return err
+  }
+  p := f.path(sid)
+  if err := os.Rename(tmp.Name(), p); err != nil {
+    os.Remove(tmp.Name())
+    return err
+  }
+  expires := s.Expires
+  if expires.IsZero() {
+    expires = time.Now().Add(24 * time.Hour)
+  }
+  return os.Chtimes(p, time.Now(), expires)
+}
+
+
+func (f *File) cleanupLoop(d time.Duration) {
+  t := time.NewTicker(d)
+  defer t.Stop()
+  for {
+    select {
+    case <-f.stop:
+      return
+    case <-t.C:
+      f.Cleanup()
+    }
+  }
+}
+
+
+func (f *File) fail(err error) {
+  if f.OnError != nil {
+    f.OnError(err)
+  }
+}
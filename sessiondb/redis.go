@@ -0,0 +1,347 @@
+package sessiondb
+
+import (
+  "bufio"
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "strconv"
+  "time"
+
+  "github.com/kataras/go-sessions"
+)
+
+type RedisConfig struct {
+  // 默认 "127.0.0.1:6379"
+  Addr     string
+  Password string
+  DB       int
+  // 会话键的前缀, 默认 "brick:sess:"
+  Prefix   string
+  // 连接池大小, 默认 8
+  PoolSize int
+  // 连接和读写的超时, 默认 5 秒
+  Timeout  time.Duration
+  // sessions.Database 的方法不返回错误, 错误交给这个函数, 默认忽略
+  OnError  func(error)
+}
+
+//
+// Redis 会话存储, 每个会话是一个 hash, 过期由 redis 的 TTL 完成
+//
+type Redis struct {
+  conf RedisConfig
+  pool chan *redisConn
+}
+
+type redisConn struct {
+  c net.Conn
+  r *bufio.Reader
+}
+
+// redis 返回的错误回复, 不影响连接
+type redisError string
+
+func (e redisError) Error() string {
+  return "redis: "+ string(e)
+}
+
+
+func NewRedis(c RedisConfig) *Redis {
+  if c.Addr == "" {
+    c.Addr = "127.0.0.1:6379"
+  }
+  if c.Prefix == "" {
+    c.Prefix = "brick:sess:"
+  }
+  if c.PoolSize <= 0 {
+    c.PoolSize = 8
+  }
+  if c.Timeout <= 0 {
+    c.Timeout = 5 * time.Second
+  }
+  return &Redis{ conf: c, pool: make(chan *redisConn, c.PoolSize) }
+}
+
+
+//
+// 关闭连接池中的连接
+//
+func (r *Redis) Close() error {
+  for {
+    select {
+    case c := <-r.pool:
+      c.c.Close()
+    default:
+      return nil
+    }
+  }
+}
+
+
+//
+// 检查 redis 是否可用, 可作为 brick.HealthCheck
+//
+func (r *Redis) Ping(ctx context.Context) error {
+  ret, err := r.do(ctx, "PING")
+  if err != nil {
+    return err
+  }
+  if s, _ := ret.(string); s != "PONG" {
+    return fmt.Errorf("redis: unexpected PING reply %v", ret)
+  }
+  return nil
+}
+
+
+func (r *Redis) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+  ret, err := r.do(context.Background(), "PTTL", r.key(sid))
+  if err != nil {
+    r.fail(err)
+    return sessions.LifeTime{}
+  }
+  if ms, _ := ret.(int64); ms > 0 {
+    return sessions.LifeTime{ Time: time.Now().Add(time.Duration(ms) * time.Millisecond) }
+  }
+  return sessions.LifeTime{}
+}
+
+
+func (r *Redis) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+  _, err := r.do(context.Background(), "PEXPIRE", r.key(sid), strconv.FormatInt(int64(newExpires / time.Millisecond), 10))
+  return err
+}
+
+
+func (r *Redis) Set(sid string, lifetime sessions.LifeTime, key string, value interface{}, immutable bool) {
+  b, err := encodeValue(value)
+  if err != nil {
+    r.fail(err)
+    return
+  }
+  k := r.key(sid)
+  if _, err := r.do(context.Background(), "HSET", k, key, string(b)); err != nil {
+    r.fail(err)
+    return
+  }
+  if !lifetime.IsZero() {
+    at := lifetime.UnixNano() / int64(time.Millisecond)
+    if _, err := r.do(context.Background(), "PEXPIREAT", k, strconv.FormatInt(at, 10)); err != nil {
+      r.fail(err)
+    }
+  }
+}
+
+
+func (r *Redis) Get(sid string, key string) interface{} {
+  ret, err := r.do(context.Background(), "HGET", r.key(sid), key)
+  if err != nil {
+    r.fail(err)
+    return nil
+  }
+  b, ok := ret.([]byte)
+  if !ok {
+    return nil
+  }
+  v, err := decodeValue(b)
+  if err != nil {
+    r.fail(err)
+    return nil
+  }
+  return v
+}
+
+
+func (r *Redis) Visit(sid string, cb func(key string, value interface{})) {
+  ret, err := r.do(context.Background(), "HGETALL", r.key(sid))
+  if err != nil {
+    r.fail(err)
+    return
+  }
+  list, _ := ret.([]interface{})
+  for i := 0; i + 1 < len(list); i += 2 {
+    k, _ := list[i].([]byte)
+    b, _ := list[i+1].([]byte)
+    v, err := decodeValue(b)
+    if err != nil {
+      r.fail(err)
+      continue
+    }
+    cb(string(k), v)
+  }
+}
+
+
+func (r *Redis) Len(sid string) int {
+  ret, err := r.do(context.Background(), "HLEN", r.key(sid))
+  if err != nil {
+    r.fail(err)
+    return 0
+  }
+  n, _ := ret.(int64)
+  return int(n)
+}
+
+
+func (r *Redis) Delete(sid string, key string) bool {
+  ret, err := r.do(context.Background(), "HDEL", r.key(sid), key)
+  if err != nil {
+    r.fail(err)
+    return false
+  }
+  n, _ := ret.(int64)
+  return n > 0
+}
+
+
+func (r *Redis) Clear(sid string) {
+  if _, err := r.do(context.Background(), "DEL", r.key(sid)); err != nil {
+    r.fail(err)
+  }
+}
+
+
+func (r *Redis) Release(sid string) {
+  r.Clear(sid)
+}
+
+
+func (r *Redis) key(sid string) string {
+  return r.conf.Prefix + sid
+}
+
+
+func (r *Redis) fail(err error) {
+  if r.conf.OnError != nil {
+    r.conf.OnError(err)
+  }
+}
+
+
+//
+// 执行一条命令, 超时取 ctx 和配置中较早的一个
+//
+func (r *Redis) do(ctx context.Context, args ...string) (interface{}, error) {
+  c, err := r.get(ctx)
+  if err != nil {
+    return nil, err
+  }
+  deadline := time.Now().Add(r.conf.Timeout)
+  if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+    deadline = d
+  }
+  c.c.SetDeadline(deadline)
+
+  ret, err := c.command(args...)
+  if _, isReply := err.(redisError); err != nil && !isReply {
+    c.c.Close()
+    return nil, err
+  }
+  select {
+  case r.pool <- c:
+  default:
+    c.c.Close()
+  }
+  return ret, err
+}
+
+
+func (r *Redis) get(ctx context.Context) (*redisConn, error) {
+  select {
+  case c := <-r.pool:
+    return c, nil
+  default:
+  }
+
+  d := net.Dialer{ Timeout: r.conf.Timeout }
+  nc, err := d.DialContext(ctx, "tcp", r.conf.Addr)
+  if err != nil {
+    return nil, err
+  }
+  nc.SetDeadline(time.Now().Add(r.conf.Timeout))
+  c := &redisConn{ c: nc, r: bufio.NewReader(nc) }
+
+  if r.conf.Password != "" {
+    if _, err := c.command("AUTH", r.conf.Password); err != nil {
+      nc.Close()
+      return nil, err
+    }
+  }
+  if r.conf.DB != 0 {
+    if _, err := c.command("SELECT", strconv.Itoa(r.conf.DB)); err != nil {
+      nc.Close()
+      return nil, err
+    }
+  }
+  return c, nil
+}
+
+
+func (c *redisConn) command(args ...string) (interface{}, error) {
+  buf := make([]byte, 0, 64)
+  buf = append(buf, '*')
+  buf = strconv.AppendInt(buf, int64(len(args)), 10)
+  buf = append(buf, '\r', '\n')
+  for _, a := range args {
+    buf = append(buf, '$')
+    buf = strconv.AppendInt(buf, int64(len(a)), 10)
+    buf = append(buf, '\r', '\n')
+    buf = append(buf, a...)
+    buf = append(buf, '\r', '\n')
+  }
+  if _, err := c.c.Write(buf); err != nil {
+    return nil, err
+  }
+  return c.reply()
+}
+
+
+//
+// 读取一个 RESP 回复: string, redisError, int64, []byte, nil 或 []interface{}
+//
+func (c *redisConn) reply() (interface{}, error) {
+  line, err := c.r.ReadString('\n')
+  if err != nil {
+    return nil, err
+  }
+  if len(line) < 3 {
+    return nil, errors.New("redis: bad reply")
+  }
+  body := line[1:len(line)-2]
+
+  switch line[0] {
+  case '+':
+    return body, nil
+  case '-':
+    return nil, redisError(body)
+  case ':':
+    return strconv.ParseInt(body, 10, 64)
+  case '$':
+    n, err := strconv.Atoi(body)
+    if err != nil || n < 0 {
+      return nil, err
+    }
+    b := make([]byte, n + 2)
+    if _, err := io.ReadFull(c.r, b); err != nil {
+      return nil, err
+    }
+    return b[:n], nil
+  case '*':
+    n, err := strconv.Atoi(body)
+    if err != nil || n < 0 {
+      return nil, err
+    }
+    list := make([]interface{}, n)
+    for i := range list {
+      if list[i], err = c.reply(); err != nil {
+        if _, isReply := err.(redisError); !isReply {
+          return nil, err
+        }
+      }
+    }
+    return list, nil
+  }
+  return nil, errors.New("redis: bad reply type "+ line[:1])
+}
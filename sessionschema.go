@@ -0,0 +1,158 @@
+package brick
+
+import (
+  "encoding/json"
+  "fmt"
+  "sync"
+)
+
+//
+// 把会话值从 n 版本升级到 n+1 版本, data 是旧版本的 json, 返回新版本的值 (会被编码为 json)
+//
+type SessionMigration func(data json.RawMessage) (interface{}, error)
+
+//
+// 保存在会话中的版本信封, 编码为 json 字符串, 会话存储 (gob) 不需要注册类型
+//
+type sessionEnvelope struct {
+  V int             `json:"_v"`
+  D json.RawMessage `json:"_d"`
+}
+
+type sessionSchema struct {
+  version  int
+  migrate  []SessionMigration
+}
+
+type sessionSchemas struct {
+  lock sync.RWMutex
+  keys map[string]*sessionSchema
+}
+
+
+//
+// 登记会话值 key 的当前版本 version (从 1 开始) 和升级函数, migrate[i] 把 i 版本升级到 i+1,
+// 0 版本是没有用 SetSessionValue() 保存的旧值. 读取旧版本的值时依次升级并写回会话,
+// 缺少升级函数或升级失败时丢弃这个值 (而不是让用户退出登录). 例如 Cart 增加了币种:
+//
+//   b.SessionSchema("cart", 2,
+//     nil,                                        // 0 -> 1: 没有可升级的旧值
+//     func(data json.RawMessage) (interface{}, error) {
+//       var v1 CartV1
+//       err := json.Unmarshal(data, &v1)
+//       return Cart{ Items: v1.Items, Currency: "CNY" }, err
+//     })
+//
+func (b *Brick) SessionSchema(key string, version int, migrate ...SessionMigration) {
+  if version < 1 {
+    panic(fmt.Errorf("session schema '%s': version must be at least 1", key))
+  }
+  if len(migrate) > version {
+    panic(fmt.Errorf("session schema '%s': %d migrations for version %d", key, len(migrate), version))
+  }
+  b.sessSchemas.lock.Lock()
+  defer b.sessSchemas.lock.Unlock()
+  if b.sessSchemas.keys == nil {
+    b.sessSchemas.keys = make(map[string]*sessionSchema)
+  }
+  b.sessSchemas.keys[key] = &sessionSchema{ version: version, migrate: migrate }
+}
+
+
+func (b *Brick) sessionSchema(key string) *sessionSchema {
+  b.sessSchemas.lock.RLock()
+  defer b.sessSchemas.lock.RUnlock()
+  if s := b.sessSchemas.keys[key]; s != nil {
+    return s
+  }
+  return &sessionSchema{ version: 1 }
+}
+
+
+//
+// 把 v 编码为 json 并带上 SessionSchema() 登记的版本保存到会话中
+//
+func (h *Http) SetSessionValue(key string, v interface{}) error {
+  data, err := json.Marshal(v)
+  if err != nil {
+    return err
+  }
+  env, _ := json.Marshal(sessionEnvelope{ V: h.b.sessionSchema(key).version, D: data })
+  h.Session().Set(key, string(env))
+  return nil
+}
+
+
+//
+// 读取 SetSessionValue() 保存的值到 out, 没有这个值时返回 false.
+// 旧版本的值按 SessionSchema() 的升级函数升级后写回会话; 不能升级的值从会话中删除并返回 false.
+//
+func (h *Http) SessionValue(key string, out interface{}) (bool, error) {
+  s := h.Session()
+  raw := s.Get(key)
+  if raw == nil {
+    return false, nil
+  }
+  schema := h.b.sessionSchema(key)
+  env, ok := parseSessionEnvelope(raw)
+  if !ok {
+    // 没有版本信封的旧值
+    data, err := json.Marshal(raw)
+    if err != nil {
+      h.dropSessionValue(key, 0, err)
+      return false, nil
+    }
+    env = sessionEnvelope{ V: 0, D: data }
+  }
+
+  if env.V > schema.version {
+    // 新版本写入后回滚了程序
+    h.dropSessionValue(key, env.V, fmt.Errorf("newer than version %d", schema.version))
+    return false, nil
+  }
+  if env.V < schema.version {
+    from := env.V
+    for env.V < schema.version {
+      if env.V >= len(schema.migrate) || schema.migrate[env.V] == nil {
+        h.dropSessionValue(key, from, fmt.Errorf("no migration from version %d", env.V))
+        return false, nil
+      }
+      v, err := schema.migrate[env.V](env.D)
+      if err == nil {
+        env.D, err = json.Marshal(v)
+      }
+      if err != nil {
+        h.dropSessionValue(key, from, err)
+        return false, nil
+      }
+      env.V++
+    }
+    buf, _ := json.Marshal(env)
+    s.Set(key, string(buf))
+    h.b.Logger(LogSession).Debug("Session value", key, "migrated from version", from, "to", env.V)
+  }
+
+  if err := json.Unmarshal(env.D, out); err != nil {
+    return false, err
+  }
+  return true, nil
+}
+
+
+func parseSessionEnvelope(raw interface{}) (sessionEnvelope, bool) {
+  var env sessionEnvelope
+  str, ok := raw.(string)
+  if !ok || len(str) < 2 || str[0] != '{' {
+    return env, false
+  }
+  if err := json.Unmarshal([]byte(str), &env); err != nil || env.V < 1 || env.D == nil {
+    return env, false
+  }
+  return env, true
+}
+
+
+func (h *Http) dropSessionValue(key string, version int, err error) {
+  h.b.Logger(LogSession).Info("Session value", key, "version", version, "dropped:", err)
+  h.Session().Delete(key)
+}
@@ -0,0 +1,321 @@
+package brick
+
+import (
+  "fmt"
+  "math"
+  "net/http"
+  "runtime/metrics"
+  "strconv"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+//
+// 路由的优先级, 过载时先拒绝低优先级的路由
+//
+type Priority int
+
+const (
+  // 永远不会被拒绝
+  PriorityCritical Priority = iota
+  // 默认优先级, 严重过载时拒绝
+  PriorityNormal
+  // 开始过载就拒绝
+  PriorityLow
+)
+
+//
+// 降级等级: 0 正常, 1 拒绝 PriorityLow, 2 拒绝 PriorityLow 和 PriorityNormal
+//
+const maxShedLevel = 2
+
+//
+// 过载保护配置, 参考 Brick.EnableShedding()
+//
+type ShedConfig struct {
+  // 请求耗时 (指数移动平均) 的目标值, 0 不检查
+  TargetLatency   time.Duration
+  // 同时处理的请求数上限, 0 不检查
+  MaxInFlight     int
+  // 调度延迟 (goroutine 等待 CPU 的时间) 上限, 反映 CPU 压力, 0 不检查
+  MaxSchedLatency time.Duration
+  // 重新计算降级等级的间隔, 默认 1 秒
+  Interval        time.Duration
+  // 被拒绝的请求的 Retry-After, 默认 5 秒
+  RetryAfter      time.Duration
+  // 降级等级变化时调用, 用于告警
+  OnChange        func(level int, reason string)
+}
+
+type shedder struct {
+  conf      ShedConfig
+  level     int32
+  inFlight  int64
+  lock      sync.Mutex
+  ewma      float64
+  // 上次计算等级以来完成的请求数
+  samples   int
+  lastSched []uint64
+  // 计算等级的协程运行时非 nil, 参考 startShedding()
+  stop      chan struct{}
+}
+
+
+//
+// 开启过载保护: 定期根据请求耗时, 并发数和调度延迟计算降级等级,
+// 降级时对低优先级的路由返回 503 和 Retry-After, 参考 RoutePriority().
+// 处理函数可以通过 h.Degraded() 判断是否需要输出简化的内容.
+//
+func (b *Brick) EnableShedding(conf ShedConfig) {
+  if conf.Interval <= 0 {
+    conf.Interval = time.Second
+  }
+  if conf.RetryAfter <= 0 {
+    conf.RetryAfter = 5 * time.Second
+  }
+  if b.shed != nil {
+    panic(fmt.Errorf("shedding already enabled"))
+  }
+  b.shed = &shedder{ conf: conf }
+  b.Use(b.shedMiddleware)
+  b.shedGauge()
+  b.startShedding()
+}
+
+
+//
+// 注册降级等级指标, 过载保护和指标先后开启都会调用, 两者都开启后才注册
+//
+func (b *Brick) shedGauge() {
+  s, m := b.shed, b.metrics
+  if s == nil || m == nil {
+    return
+  }
+  m.Gauge("brick_shed_level", "Current load shedding level.", func() float64 {
+    return float64(atomic.LoadInt32(&s.level))
+  })
+}
+
+
+//
+// 启动计算降级等级的协程, EnableShedding() 和 Run() 调用, 已经运行时什么都不做
+//
+func (b *Brick) startShedding() {
+  s := b.shed
+  if s == nil {
+    return
+  }
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  if s.stop == nil {
+    s.stop = make(chan struct{})
+    go s.watch(b, s.stop)
+  }
+}
+
+
+//
+// 停止计算降级等级的协程, 可以重复调用, 之后的 Run() 重新启动
+//
+func (b *Brick) stopShedding() {
+  s := b.shed
+  if s == nil {
+    return
+  }
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  if s.stop != nil {
+    close(s.stop)
+    s.stop = nil
+  }
+}
+
+
+//
+// 设置路由的优先级, 默认 PriorityNormal
+//
+func (b *Brick) RoutePriority(path string, p Priority) {
+  b.limitLock.Lock()
+  defer b.limitLock.Unlock()
+  if b.priorities == nil {
+    b.priorities = make(map[string]Priority)
+  }
+  b.priorities[path] = p
+}
+
+
+//
+// 服务是否处于降级状态, 处理函数可以据此减少开销较大的内容
+//
+func (h *Http) Degraded() bool {
+  s := h.b.shed
+  return s != nil && atomic.LoadInt32(&s.level) > 0
+}
+
+
+func (b *Brick) shedMiddleware(next HttpHandler) HttpHandler {
+  return func(h *Http) error {
+    s := b.shed
+    b.limitLock.Lock()
+    p, has := b.priorities[h.rkey]
+    b.limitLock.Unlock()
+    if !has {
+      p = PriorityNormal
+    }
+
+    level := int(atomic.LoadInt32(&s.level))
+    if p != PriorityCritical && level > 0 && int(p) + level > maxShedLevel {
+      b.metrics.Inc("brick_shed_rejected_total", "Requests rejected by load shedding.", "route", h.route)
+      h.W.Header().Set("Retry-After", strconv.Itoa(int(s.conf.RetryAfter.Seconds())))
+      return NewHttpError(http.StatusServiceUnavailable, "")
+    }
+
+    atomic.AddInt64(&s.inFlight, 1)
+    begin := time.Now()
+    defer func() {
+      atomic.AddInt64(&s.inFlight, -1)
+      s.observe(time.Since(begin))
+    }()
+    return next(h)
+  }
+}
+
+
+func (s *shedder) observe(d time.Duration) {
+  const alpha = 0.1
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  s.samples++
+  if s.ewma == 0 {
+    s.ewma = float64(d)
+  } else {
+    s.ewma = alpha * float64(d) + (1 - alpha) * s.ewma
+  }
+}
+
+
+func (s *shedder) watch(b *Brick, stop chan struct{}) {
+  t := time.NewTicker(s.conf.Interval)
+  defer t.Stop()
+  for {
+    select {
+    case <-stop:
+      return
+    case <-t.C:
+      s.update(b)
+    }
+  }
+}
+
+
+//
+// 计算过载比例并调整降级等级, 比例超过 1 升一级, 超过 2 直接到最高级,
+// 低于 0.8 才降一级, 避免在阈值附近来回切换.
+//
+func (s *shedder) update(b *Brick) {
+  ratio, reason := s.overload()
+  old := int(atomic.LoadInt32(&s.level))
+  level := old
+
+  switch {
+  case ratio > 2:
+    level = maxShedLevel
+  case ratio > 1 && level < maxShedLevel:
+    level++
+  case ratio < 0.8 && level > 0:
+    level--
+  }
+  if level == old {
+    return
+  }
+
+  atomic.StoreInt32(&s.level, int32(level))
+  if level > old {
+    b.log.Warn("Load shedding level", old, "->", level, reason)
+  } else {
+    b.log.Info("Load shedding level", old, "->", level, reason)
+  }
+  b.metrics.Inc("brick_shed_changes_total", "Load shedding level changes.")
+  if s.conf.OnChange != nil {
+    s.conf.OnChange(level, reason)
+  }
+}
+
+
+func (s *shedder) overload() (float64, string) {
+  ratio, reason := 0.0, "normal"
+  check := func(r float64, why string) {
+    if r > ratio {
+      ratio, reason = r, why
+    }
+  }
+
+  if s.conf.TargetLatency > 0 {
+    s.lock.Lock()
+    ewma := s.ewma
+    // 这段时间没有请求时逐渐恢复, 有请求时平均值只由请求耗时决定
+    if s.samples == 0 {
+      s.ewma *= 0.5
+    }
+    s.samples = 0
+    s.lock.Unlock()
+    check(ewma / float64(s.conf.TargetLatency),
+          fmt.Sprintf("latency %s", time.Duration(ewma)))
+  }
+  if s.conf.MaxInFlight > 0 {
+    n := atomic.LoadInt64(&s.inFlight)
+    check(float64(n) / float64(s.conf.MaxInFlight), fmt.Sprintf("in-flight %d", n))
+  }
+  if s.conf.MaxSchedLatency > 0 {
+    if lat, ok := s.schedLatency(); ok {
+      check(lat.Seconds() / s.conf.MaxSchedLatency.Seconds(),
+            fmt.Sprintf("sched latency %s", lat))
+    }
+  }
+  return ratio, reason
+}
+
+
+//
+// 读取上次检查以来 goroutine 调度延迟的 p99
+//
+func (s *shedder) schedLatency() (time.Duration, bool) {
+  sample := []metrics.Sample{{ Name: "/sched/latencies:seconds" }}
+  metrics.Read(sample)
+  if sample[0].Value.Kind() != metrics.KindFloat64Histogram {
+    return 0, false
+  }
+  h := sample[0].Value.Float64Histogram()
+
+  last := s.lastSched
+  s.lastSched = append([]uint64(nil), h.Counts...)
+  if len(last) != len(h.Counts) {
+    return 0, false
+  }
+
+  var total uint64
+  delta := make([]uint64, len(h.Counts))
+  for i, c := range h.Counts {
+    delta[i] = c - last[i]
+    total += delta[i]
+  }
+  if total == 0 {
+    return 0, true
+  }
+
+  want := uint64(math.Ceil(float64(total) * 0.99))
+  var acc uint64
+  for i, c := range delta {
+    acc += c
+    if acc >= want {
+      // Buckets[i+1] 是第 i 个计数的上界
+      upper := h.Buckets[i+1]
+      if math.IsInf(upper, 1) {
+        upper = h.Buckets[i]
+      }
+      return time.Duration(upper * float64(time.Second)), true
+    }
+  }
+  return 0, true
+}
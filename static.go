@@ -0,0 +1,131 @@
+package brick
+
+import (
+  "bytes"
+  "compress/gzip"
+  "fmt"
+  "hash/crc32"
+  "io/ioutil"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+)
+
+//
+// 资源包中文件的响应缓存, gzip 是资源包中的原始内容,
+// plain 在客户端不接受 gzip 时才解压生成.
+//
+type mappingEntry struct {
+  gzip    []byte
+  etag    string
+  modTime time.Time
+  once    sync.Once
+  plain   []byte
+  err     error
+}
+
+// 资源包中的文件使用进程启动 (或资源包替换) 的时间作为修改时间
+var mappingModTime = time.Now()
+
+var mappingEntries sync.Map
+
+
+//
+// 用 m 整体替换资源包, 正在处理的请求仍使用旧的内容.
+// m 中的内容必须是 gzip 压缩的, 与 build.js 生成的相同.
+//
+func ReplaceFileMapping(m map[string][]byte) {
+  file_mapping_lock.Lock()
+  file_mapping = m
+  mappingModTime = time.Now()
+  file_mapping_lock.Unlock()
+
+  mappingEntries.Range(func(k, v interface{}) bool {
+    mappingEntries.Delete(k)
+    return true
+  })
+}
+
+
+func lookupMapping(fileName string) ([]byte, bool) {
+  file_mapping_lock.RLock()
+  defer file_mapping_lock.RUnlock()
+  content, has := file_mapping[fileName]
+  return content, has
+}
+
+
+func getMappingEntry(fileName string, content []byte) *mappingEntry {
+  if e, has := mappingEntries.Load(fileName); has {
+    me := e.(*mappingEntry)
+    // 资源包中的内容被替换后重新生成
+    if len(me.gzip) == len(content) && (len(content) == 0 || &me.gzip[0] == &content[0]) {
+      return me
+    }
+  }
+  file_mapping_lock.RLock()
+  modTime := mappingModTime
+  file_mapping_lock.RUnlock()
+  me := &mappingEntry{
+    gzip    : content,
+    etag    : fmt.Sprintf("%08x", crc32.ChecksumIEEE(content)),
+    modTime : modTime,
+  }
+  mappingEntries.Store(fileName, me)
+  return me
+}
+
+
+func (e *mappingEntry) unzip() ([]byte, error) {
+  e.once.Do(func() {
+    r, err := gzip.NewReader(bytes.NewReader(e.gzip))
+    if err != nil {
+      e.err = err
+      return
+    }
+    defer r.Close()
+    e.plain, e.err = ioutil.ReadAll(r)
+  })
+  return e.plain, e.err
+}
+
+
+//
+// 输出资源包中的文件, 支持 Range, HEAD 和条件请求;
+// 客户端接受 gzip 时直接输出压缩内容, 否则输出解压后的内容.
+//
+func serveMapping(w http.ResponseWriter, r *http.Request, fileName string, content []byte) {
+  e := getMappingEntry(fileName, content)
+  hd := w.Header()
+  hd.Set("Content-Type", getMimeType(fileName))
+  addVary(hd, "Accept-Encoding")
+  if isHashedAsset(fileName) && hd.Get("Cache-Control") == "" {
+    hd.Set("Cache-Control", "public, max-age=31536000, immutable")
+  }
+
+  if acceptsGzip(r) {
+    hd.Set("Content-Encoding", "gzip")
+    hd.Set("ETag", `"`+ e.etag +`-gz"`)
+    http.ServeContent(w, r, fileName, e.modTime, bytes.NewReader(e.gzip))
+    return
+  }
+
+  plain, err := e.unzip()
+  if err != nil {
+    http.Error(w, "Resource fail", http.StatusInternalServerError)
+    return
+  }
+  hd.Set("ETag", `"`+ e.etag +`"`)
+  http.ServeContent(w, r, fileName, e.modTime, bytes.NewReader(plain))
+}
+
+
+func acceptsGzip(r *http.Request) bool {
+  for _, it := range parseQualityList(r.Header.Get("Accept-Encoding")) {
+    if it.q > 0 && (strings.EqualFold(it.value, "gzip") || it.value == "*") {
+      return true
+    }
+  }
+  return false
+}
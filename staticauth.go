@@ -0,0 +1,136 @@
+package brick
+
+import (
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/base64"
+  "net/http"
+  "net/url"
+  "path"
+  "strconv"
+  "strings"
+  "time"
+)
+
+//
+// 判断请求能否读取静态文件 file (相对于 BaseUrl 的路径), 返回 nil 允许,
+// 返回 ErrForbidden, ErrUnauthorized 或其他错误时交给错误处理器. 参考 StaticPage.Protect()
+//
+type StaticAuthorizer func(h *Http, file string) error
+
+type staticRule struct {
+  pattern string
+  auth    StaticAuthorizer
+}
+
+
+//
+// 用 auth 保护匹配 pattern 的文件, 在读取文件之前检查. pattern 相对于 BaseUrl,
+// 以 "/*" 结尾时匹配目录下的所有文件 (包括子目录), 否则按 path.Match 匹配, 例如 "*.pdf".
+// 多个规则都匹配时都要通过. SignURL() 签名的地址在有效期内不检查.
+//
+//   p := b.StaticPage("/static", "www/static")
+//   p.Protect("private/*", func(h *brick.Http, file string) error {
+//     if h.Session().Get("user") == nil {
+//       return brick.ErrForbidden
+//     }
+//     return nil
+//   })
+//
+func (p *StaticPage) Protect(pattern string, auth StaticAuthorizer) *StaticPage {
+  if _, err := path.Match(pattern, ""); err != nil {
+    panic(err)
+  }
+  p.b.routeLock.Lock()
+  defer p.b.routeLock.Unlock()
+  p.rules = append(p.rules, staticRule{ pattern: strings.TrimPrefix(pattern, "/"), auth: auth })
+  return p
+}
+
+
+//
+// 返回 file 在 ttl 时间内不需要 Protect() 检查的地址, 例如放在邮件里的下载链接.
+// 签名使用 Config.HashKey, 没有设置时进程重启后地址失效.
+//
+func (p *StaticPage) SignURL(file string, ttl time.Duration) string {
+  file = cleanStaticPath(file)
+  exp := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+  q := url.Values{}
+  q.Set("exp", exp)
+  q.Set("sig", p.urlSignature(file, exp))
+  return p.BaseUrl + file +"?"+ q.Encode()
+}
+
+
+func (p *StaticPage) urlSignature(file string, exp string) string {
+  mac := hmac.New(sha256.New, p.b.cookies.hashKey)
+  mac.Write([]byte("brick.static\x00"+ p.BaseUrl + file +"\x00"+ exp))
+  return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+
+//
+// 检查 Protect() 的规则, 由 serveFile() 调用
+//
+func (p *StaticPage) authorize(h *Http, fileName string) error {
+  p.b.routeLock.RLock()
+  rules := p.rules
+  p.b.routeLock.RUnlock()
+  if len(rules) == 0 {
+    return nil
+  }
+  file := cleanStaticPath(fileName)
+  var matched []staticRule
+  for _, r := range rules {
+    if staticMatch(r.pattern, file) {
+      matched = append(matched, r)
+    }
+  }
+  if len(matched) == 0 {
+    return nil
+  }
+
+  // 受保护的文件不能被共享缓存保存
+  h.W.Header().Set("Cache-Control", "private, no-cache")
+  if p.signedURL(h.R, file) {
+    return nil
+  }
+  for _, r := range matched {
+    if err := r.auth(h, file); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+
+func (p *StaticPage) signedURL(r *http.Request, file string) bool {
+  q := r.URL.Query()
+  exp, sig := q.Get("exp"), q.Get("sig")
+  if exp == "" || sig == "" {
+    return false
+  }
+  sec, err := strconv.ParseInt(exp, 10, 64)
+  if err != nil || time.Now().Unix() > sec {
+    return false
+  }
+  return hmac.Equal([]byte(sig), []byte(p.urlSignature(file, exp)))
+}
+
+
+//
+// 去掉 "..", 重复的 "/" 和开头的 "/", 与文件服务看到的路径相同
+//
+func cleanStaticPath(file string) string {
+  return strings.TrimPrefix(path.Clean("/"+ file), "/")
+}
+
+
+func staticMatch(pattern string, file string) bool {
+  if strings.HasSuffix(pattern, "/*") {
+    dir := strings.TrimSuffix(pattern, "*")
+    return strings.HasPrefix(file, dir) || file +"/" == dir
+  }
+  ok, _ := path.Match(pattern, file)
+  return ok
+}
@@ -0,0 +1,273 @@
+package brick
+
+import (
+  "context"
+  "errors"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+)
+
+//
+// 服务正在关闭, 长连接的处理函数收到通知后返回这个错误, 响应 503
+//
+var ErrShuttingDown = NewHttpError(http.StatusServiceUnavailable, "server shutting down")
+
+// 发送给长连接的关闭原因
+const shutdownReason = "server shutting down, reconnect"
+
+//
+// 正在服务的长连接 (SSE, WebSocket), Shutdown() 时先通知它们再关闭监听
+//
+type streamConns struct {
+  lock    sync.Mutex
+  next    int
+  notify  map[int]func(reason string)
+  wg      sync.WaitGroup
+  closing bool
+}
+
+//
+// 请求结束时注销通知, 参考 Http.CloseOnEnd()
+//
+type streamEntry struct {
+  s    *streamConns
+  id   int
+  once sync.Once
+}
+
+
+func (e *streamEntry) Close() {
+  e.once.Do(func() {
+    e.s.lock.Lock()
+    delete(e.s.notify, e.id)
+    e.s.lock.Unlock()
+    e.s.wg.Done()
+  })
+}
+
+
+//
+// 注册长连接的关闭通知: 服务关闭时在其他 goroutine 中调用 fn, 请求结束时自动注销.
+// WebSocket 在 fn 中发送带 reason 的关闭帧 (1001 Going Away) 后返回处理函数,
+// 客户端会重新连接到新的实例; Shutdown() 最多等待 Config.StreamGrace.
+// 服务已经在关闭时立即调用 fn.
+//
+func (h *Http) NotifyShutdown(fn func(reason string)) {
+  s := &h.b.streams
+  s.lock.Lock()
+  if s.closing {
+    s.lock.Unlock()
+    fn(shutdownReason)
+    return
+  }
+  if s.notify == nil {
+    s.notify = make(map[int]func(string))
+  }
+  s.next++
+  id := s.next
+  s.notify[id] = fn
+  s.wg.Add(1)
+  s.lock.Unlock()
+  h.CloseOnEnd(&streamEntry{ s: s, id: id })
+}
+
+
+//
+// 通知所有长连接服务正在关闭, 等待它们结束, 最多等到 Config.StreamGrace 或 ctx 结束
+//
+func (b *Brick) drainStreams(ctx context.Context) {
+  s := &b.streams
+  s.lock.Lock()
+  s.closing = true
+  fns := make([]func(string), 0, len(s.notify))
+  for _, fn := range s.notify {
+    fns = append(fns, fn)
+  }
+  s.lock.Unlock()
+  if len(fns) == 0 {
+    return
+  }
+
+  b.log.Info("Notify", len(fns), "streaming connections of shutdown")
+  for _, fn := range fns {
+    // 写入慢速客户端可能阻塞, 每个通知使用单独的 goroutine
+    go func(fn func(string)) {
+      defer func() {
+        if p := recover(); p != nil {
+          b.log.Error("Stream shutdown notify panic:", p)
+        }
+      }()
+      fn(shutdownReason)
+    }(fn)
+  }
+
+  done := make(chan struct{})
+  go func() {
+    s.wg.Wait()
+    close(done)
+  }()
+  t := time.NewTimer(b.streamGrace())
+  defer t.Stop()
+  select {
+  case <-done:
+  case <-t.C:
+    b.log.Warn("Streaming connections still open after", b.streamGrace())
+  case <-ctx.Done():
+  }
+}
+
+
+//
+// Run() 再次启动时接受新的长连接
+//
+func (b *Brick) resetStreams() {
+  b.streams.lock.Lock()
+  b.streams.closing = false
+  b.streams.lock.Unlock()
+}
+
+
+func (b *Brick) streamGrace() time.Duration {
+  if b.config.StreamGrace > 0 {
+    return b.config.StreamGrace
+  }
+  return 5 * time.Second
+}
+
+
+//
+// Server-Sent Events 输出, 参考 Http.EventStream()
+//
+type EventStream struct {
+  w      http.ResponseWriter
+  f      http.Flusher
+  lock   sync.Mutex
+  done   chan struct{}
+  once   sync.Once
+  err    error
+}
+
+
+//
+// 开始输出 text/event-stream 响应. 服务关闭时向客户端发送注释 ": <原因>",
+// 然后 Done() 关闭, Err() 返回 ErrShuttingDown; 客户端断开时 Err() 返回 ctx 的错误.
+// 处理函数应该在 Done() 后返回:
+//
+//   s, err := h.EventStream()
+//   for {
+//     select {
+//     case <-s.Done():
+//       return nil
+//     case msg := <-ch:
+//       s.Send("message", msg)
+//     }
+//   }
+//
+func (h *Http) EventStream() (*EventStream, error) {
+  f, ok := h.W.(http.Flusher)
+  if !ok {
+    return nil, errors.New("ResponseWriter not support Flush")
+  }
+  hd := h.W.Header()
+  hd.Set("Content-Type", "text/event-stream; charset=utf-8")
+  hd.Set("Cache-Control", "no-cache")
+  // 禁止 nginx 缓冲
+  hd.Set("X-Accel-Buffering", "no")
+  h.W.WriteHeader(http.StatusOK)
+  f.Flush()
+
+  s := &EventStream{ w: h.W, f: f, done: make(chan struct{}) }
+  ctx := h.Ctx()
+  go func() {
+    select {
+    case <-ctx.Done():
+      s.close(ctx.Err())
+    case <-s.done:
+    }
+  }()
+  h.NotifyShutdown(func(reason string) {
+    s.lock.Lock()
+    if s.err == nil {
+      s.write(": "+ reason +"\n\n")
+    }
+    s.lock.Unlock()
+    s.close(ErrShuttingDown)
+  })
+  return s, nil
+}
+
+
+//
+// 发送一个事件, event 为空时是默认的 "message" 事件; 多行 data 分为多个 data 字段
+//
+func (s *EventStream) Send(event string, data string) error {
+  var buf strings.Builder
+  if event != "" {
+    buf.WriteString("event: "+ event +"\n")
+  }
+  for _, line := range strings.Split(data, "\n") {
+    buf.WriteString("data: "+ line +"\n")
+  }
+  buf.WriteString("\n")
+  return s.send(buf.String())
+}
+
+
+//
+// 发送注释, 客户端忽略, 可以用作心跳保持代理的连接
+//
+func (s *EventStream) Comment(text string) error {
+  return s.send(": "+ strings.ReplaceAll(text, "\n", " ") +"\n\n")
+}
+
+
+//
+// 客户端断开或服务关闭时关闭
+//
+func (s *EventStream) Done() <-chan struct{} {
+  return s.done
+}
+
+
+//
+// 流结束的原因, 没有结束时返回 nil
+//
+func (s *EventStream) Err() error {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  return s.err
+}
+
+
+func (s *EventStream) send(msg string) error {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  if s.err != nil {
+    return s.err
+  }
+  return s.write(msg)
+}
+
+
+//
+// 调用者持有锁
+//
+func (s *EventStream) write(msg string) error {
+  if _, err := s.w.Write([]byte(msg)); err != nil {
+    return err
+  }
+  s.f.Flush()
+  return nil
+}
+
+
+func (s *EventStream) close(err error) {
+  s.once.Do(func() {
+    s.lock.Lock()
+    s.err = err
+    s.lock.Unlock()
+    close(s.done)
+  })
+}
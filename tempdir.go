@@ -0,0 +1,65 @@
+package brick
+
+import (
+  "os"
+  "path/filepath"
+  "time"
+)
+
+// 请求临时目录的前缀, 参考 Http.TempDir()
+const tempDirPrefix = "brick-req-"
+
+//
+// 请求结束时删除的临时目录
+//
+type tempDir struct {
+  path string
+  log  Logger
+}
+
+
+//
+// 返回本次请求专用的临时目录, 第一次调用时创建, 请求结束时连同其中的文件一起删除,
+// 处理函数出现异常时也会删除; 用于文件转换等需要中间文件的处理:
+//
+//   dir, err := h.TempDir()
+//   src := filepath.Join(dir, "upload.docx")
+//
+func (h *Http) TempDir() (string, error) {
+  if h.tmpDir != "" {
+    return h.tmpDir, nil
+  }
+  dir, err := os.MkdirTemp("", tempDirPrefix)
+  if err != nil {
+    return "", err
+  }
+  h.tmpDir = dir
+  h.CloseOnEnd(&tempDir{ path: dir, log: h.b.log })
+  return dir, nil
+}
+
+
+func (t *tempDir) Close() {
+  if err := os.RemoveAll(t.path); err != nil {
+    t.log.Warn("Remove temp dir", err)
+  }
+}
+
+
+//
+// 删除进程异常退出时留下的请求临时目录, 由 Run() 在后台调用
+//
+func sweepTempDirs(log Logger) {
+  list, err := filepath.Glob(filepath.Join(os.TempDir(), tempDirPrefix +"*"))
+  if err != nil {
+    return
+  }
+  expire := time.Now().Add(-24 * time.Hour)
+  for _, dir := range list {
+    if st, err := os.Stat(dir); err == nil && st.IsDir() && st.ModTime().Before(expire) {
+      if err := os.RemoveAll(dir); err != nil {
+        log.Warn("Remove stale temp dir", err)
+      }
+    }
+  }
+}
@@ -0,0 +1,116 @@
+package brick
+
+import (
+  "fmt"
+  "strings"
+  "sync"
+  "time"
+)
+
+//
+// 对路径前缀下的响应暴露性能数据给跨域的浏览器脚本,
+// 参考 Brick.ExposeTiming()
+//
+type TimingExposure struct {
+  // 路径前缀, 例如 "/api/"
+  Prefix        string
+  // 允许读取性能数据的源, "*" 表示全部
+  Origins       []string
+  // 除 Server-Timing 外通过 Access-Control-Expose-Headers 暴露的头域
+  ExposeHeaders []string
+}
+
+type timingExposures struct {
+  lock  sync.RWMutex
+  list  []TimingExposure
+}
+
+
+//
+// 对 prefix 下的服务, 当请求的 Origin 在 origins 中时,
+// 输出 Timing-Allow-Origin 和包含 Server-Timing 与 headers 的
+// Access-Control-Expose-Headers, 使前端 RUM 工具可以跨域读取
+// Server-Timing 和请求 ID 等头域.
+//
+func (b *Brick) ExposeTiming(prefix string, origins []string, headers ...string) {
+  b.timing.lock.Lock()
+  defer b.timing.lock.Unlock()
+  if len(b.timing.list) == 0 {
+    b.Use(b.timingMiddleware)
+  }
+  b.timing.list = append(b.timing.list, TimingExposure{
+    Prefix        : prefix,
+    Origins       : origins,
+    ExposeHeaders : headers,
+  })
+}
+
+
+func (b *Brick) timingMiddleware(next HttpHandler) HttpHandler {
+  return func(h *Http) error {
+    if te := b.timing.match(h.R.URL.Path); te != nil {
+      te.apply(h)
+    }
+    return next(h)
+  }
+}
+
+
+//
+// 返回前缀最长的匹配项
+//
+func (t *timingExposures) match(path string) *TimingExposure {
+  t.lock.RLock()
+  defer t.lock.RUnlock()
+  var best *TimingExposure
+  for i := range t.list {
+    te := &t.list[i]
+    if strings.HasPrefix(path, te.Prefix) && (best == nil || len(te.Prefix) > len(best.Prefix)) {
+      best = te
+    }
+  }
+  return best
+}
+
+
+func (te *TimingExposure) apply(h *Http) {
+  origin := h.R.Header.Get("Origin")
+  allow := ""
+  for _, o := range te.Origins {
+    if o == "*" {
+      allow = "*"
+      break
+    }
+    if origin != "" && strings.EqualFold(o, origin) {
+      allow = origin
+      break
+    }
+  }
+
+  hd := h.W.Header()
+  if allow != "*" {
+    addVary(hd, "Origin")
+  }
+  if allow == "" {
+    return
+  }
+  hd.Set("Timing-Allow-Origin", allow)
+  expose := append([]string{ "Server-Timing" }, te.ExposeHeaders...)
+  if old := hd.Get("Access-Control-Expose-Headers"); old != "" {
+    expose = append([]string{ old }, expose...)
+  }
+  hd.Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+}
+
+
+//
+// 添加一条 Server-Timing 指标, 必须在写出响应之前调用,
+// 例如 h.ServerTiming("db", 12*time.Millisecond, "user query")
+//
+func (h *Http) ServerTiming(name string, d time.Duration, desc string) {
+  v := fmt.Sprintf("%s;dur=%.3f", name, float64(d) / float64(time.Millisecond))
+  if desc != "" {
+    v += fmt.Sprintf(";desc=%q", desc)
+  }
+  h.W.Header().Add("Server-Timing", v)
+}
@@ -0,0 +1,251 @@
+package brick
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha1"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base32"
+  "encoding/binary"
+  "encoding/hex"
+  "fmt"
+  "net/http"
+  "net/url"
+  "strings"
+  "time"
+)
+
+const (
+  totpPeriod = 30
+  totpDigits = 6
+
+  // 会话中的两步验证状态
+  session2FAPending = "brick.2fa.pending"
+  session2FATime    = "brick.2fa.time"
+  // 最后一次接受的验证码的时间步, 防止重放
+  session2FAStep    = "brick.2fa.step"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+
+//
+// 生成新的 TOTP 密钥 (base32, 160 位)
+//
+func GenerateTOTPSecret() (string, error) {
+  b := make([]byte, 20)
+  if _, err := rand.Read(b); err != nil {
+    return "", err
+  }
+  return totpEncoding.EncodeToString(b), nil
+}
+
+
+//
+// 验证器应用使用的 otpauth:// 地址, 通常编码为二维码给用户扫描
+//
+func TOTPURI(issuer string, account string, secret string) string {
+  q := url.Values{}
+  q.Set("secret", secret)
+  q.Set("issuer", issuer)
+  q.Set("algorithm", "SHA1")
+  q.Set("digits", fmt.Sprint(totpDigits))
+  q.Set("period", fmt.Sprint(totpPeriod))
+  label := url.PathEscape(issuer +":"+ account)
+  return "otpauth://totp/"+ label +"?"+ q.Encode()
+}
+
+
+//
+// TOTPURI() 的二维码 PNG 图片, 每个模块 scale 像素, 参考 NewQRCode()
+//
+func TOTPQRCode(issuer string, account string, secret string, scale int) ([]byte, error) {
+  q, err := NewQRCode(TOTPURI(issuer, account, secret))
+  if err != nil {
+    return nil, err
+  }
+  return q.PNG(scale), nil
+}
+
+
+//
+// 计算 t 时刻的验证码
+//
+func TOTPCode(secret string, t time.Time) (string, error) {
+  key, err := decodeTOTPSecret(secret)
+  if err != nil {
+    return "", err
+  }
+  return totpAt(key, t.Unix() / totpPeriod), nil
+}
+
+
+//
+// 验证 code, drift 是允许前后偏差的时间步数 (每步 30 秒), 通常为 1;
+// 返回匹配的时间步. 同一个验证码在偏差范围内可以重复通过, 调用者必须保存
+// 用户最后一次接受的时间步并拒绝不大于它的时间步 (RFC 6238 5.2), 参考 Http.CheckTOTP().
+//
+func VerifyTOTP(secret string, code string, t time.Time, drift int) (int64, bool) {
+  key, err := decodeTOTPSecret(secret)
+  if err != nil {
+    return 0, false
+  }
+  code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+  if len(code) != totpDigits {
+    return 0, false
+  }
+  now := t.Unix() / totpPeriod
+  var step int64
+  ok := false
+  for i := -drift; i <= drift; i++ {
+    if subtle.ConstantTimeCompare([]byte(totpAt(key, now + int64(i))), []byte(code)) == 1 {
+      step, ok = now + int64(i), true
+    }
+  }
+  return step, ok
+}
+
+
+//
+// 用当前时间验证 code (前后偏差 1 步), 拒绝本会话已经用过的和更早的验证码,
+// 通过时记录时间步. 多个会话之间的重放需要应用按用户保存 VerifyTOTP() 返回的时间步.
+//
+//   if h.CheckTOTP(user.Secret, h.Get("code")) { h.Complete2FA() }
+//
+func (h *Http) CheckTOTP(secret string, code string) bool {
+  step, ok := VerifyTOTP(secret, code, time.Now(), 1)
+  if !ok {
+    return false
+  }
+  s := h.Session()
+  if step <= s.GetInt64Default(session2FAStep, 0) {
+    return false
+  }
+  s.Set(session2FAStep, step)
+  return true
+}
+
+
+//
+// 生成 n 个一次性恢复码, 把 plain 显示给用户, 只保存 hashes
+//
+func GenerateRecoveryCodes(n int) (plain []string, hashes []string, err error) {
+  for i := 0; i < n; i++ {
+    b := make([]byte, 5)
+    if _, err := rand.Read(b); err != nil {
+      return nil, nil, err
+    }
+    c := strings.ToLower(totpEncoding.EncodeToString(b))
+    c = c[:4] +"-"+ c[4:]
+    plain = append(plain, c)
+    hashes = append(hashes, hashRecoveryCode(c))
+  }
+  return plain, hashes, nil
+}
+
+
+//
+// 检查恢复码, 成功时返回去掉该码后的 hashes, 调用者需要保存
+//
+func UseRecoveryCode(hashes []string, code string) ([]string, bool) {
+  h := hashRecoveryCode(code)
+  for i, stored := range hashes {
+    if subtle.ConstantTimeCompare([]byte(stored), []byte(h)) == 1 {
+      return append(append([]string{}, hashes[:i]...), hashes[i+1:]...), true
+    }
+  }
+  return hashes, false
+}
+
+
+//
+// 密码验证通过后调用, 会话进入等待第二步验证的状态
+//
+func (h *Http) Begin2FA() {
+  s := h.Session()
+  s.Set(session2FAPending, true)
+  s.Delete(session2FATime)
+}
+
+
+//
+// 验证码或恢复码验证通过后调用, 记录验证时间
+//
+func (h *Http) Complete2FA() {
+  s := h.Session()
+  s.Delete(session2FAPending)
+  s.Set(session2FATime, time.Now().Unix())
+}
+
+
+//
+// 会话已通过密码验证但还没有完成第二步验证
+//
+func (h *Http) Requires2FA() bool {
+  v, _ := h.Session().GetBoolean(session2FAPending)
+  return v
+}
+
+
+//
+// 最近一次完成两步验证的时间, 没有验证过返回零值
+//
+func (h *Http) Verified2FA() time.Time {
+  sec := h.Session().GetInt64Default(session2FATime, 0)
+  if sec <= 0 {
+    return time.Time{}
+  }
+  return time.Unix(sec, 0)
+}
+
+
+//
+// 要求 maxAge 内完成过两步验证的中间件 (maxAge 为 0 表示本次会话内),
+// 用于敏感的路由分组, 例如 admin.Use(brick.Require2FA(10*time.Minute, "/2fa")).
+// 浏览器请求跳转到 verifyURL?to=原地址, 其他请求返回 403.
+//
+func Require2FA(maxAge time.Duration, verifyURL string) Middleware {
+  return func(next HttpHandler) HttpHandler {
+    return func(h *Http) error {
+      t := h.Verified2FA()
+      if !h.Requires2FA() && !t.IsZero() && (maxAge <= 0 || time.Since(t) <= maxAge) {
+        return next(h)
+      }
+      if verifyURL != "" && h.WantsHTML() {
+        h.Redirect(http.StatusFound, verifyURL +"?to="+ url.QueryEscape(h.R.URL.RequestURI()))
+        return nil
+      }
+      return NewHttpError(http.StatusForbidden, "Two-factor authentication required")
+    }
+  }
+}
+
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+  s := strings.ToUpper(strings.Replace(strings.TrimSpace(secret), " ", "", -1))
+  return totpEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+
+//
+// RFC 6238 / RFC 4226
+//
+func totpAt(key []byte, step int64) string {
+  var msg [8]byte
+  binary.BigEndian.PutUint64(msg[:], uint64(step))
+  mac := hmac.New(sha1.New, key)
+  mac.Write(msg[:])
+  sum := mac.Sum(nil)
+
+  off := sum[len(sum)-1] & 0x0f
+  v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+  return fmt.Sprintf("%0*d", totpDigits, v % 1000000)
+}
+
+
+func hashRecoveryCode(code string) string {
+  c := strings.ToLower(strings.Replace(strings.TrimSpace(code), " ", "", -1))
+  sum := sha256.Sum256([]byte(c))
+  return hex.EncodeToString(sum[:])
+}
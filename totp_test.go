@@ -0,0 +1,91 @@
+package brick
+
+import (
+  "testing"
+  "time"
+)
+
+// RFC 6238 附录 B 的密钥 "12345678901234567890"
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+
+func TestTOTPCode(t *testing.T) {
+  tests := []struct {
+    unix int64
+    code string
+  }{
+    { 59,          "287082" },
+    { 1111111109,  "081804" },
+    { 1111111111,  "050471" },
+    { 1234567890,  "005924" },
+    { 2000000000,  "279037" },
+    { 20000000000, "353130" },
+  }
+  for _, tt := range tests {
+    code, err := TOTPCode(rfcTOTPSecret, time.Unix(tt.unix, 0))
+    if err != nil {
+      t.Fatal(err)
+    }
+    if code != tt.code {
+      t.Errorf("TOTPCode(%d) = %s, want %s", tt.unix, code, tt.code)
+    }
+  }
+}
+
+
+func TestVerifyTOTP(t *testing.T) {
+  now := time.Unix(1111111111, 0)
+  step := now.Unix() / totpPeriod
+  at := func(d time.Duration) string {
+    code, _ := TOTPCode(rfcTOTPSecret, now.Add(d))
+    return code
+  }
+
+  tests := []struct {
+    name   string
+    secret string
+    code   string
+    drift  int
+    ok     bool
+    step   int64
+  }{
+    { "current",        rfcTOTPSecret, at(0),                 1, true,  step },
+    { "spaces",         rfcTOTPSecret, "050 471",             1, true,  step },
+    { "lower secret",   "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", at(0), 0, true, step },
+    { "previous step",  rfcTOTPSecret, at(-totpPeriod * time.Second), 1, true, step - 1 },
+    { "next step",      rfcTOTPSecret, at(totpPeriod * time.Second),  1, true, step + 1 },
+    { "outside drift",  rfcTOTPSecret, at(-2 * totpPeriod * time.Second), 1, false, 0 },
+    { "no drift",       rfcTOTPSecret, at(totpPeriod * time.Second),  0, false, 0 },
+    { "wrong code",     rfcTOTPSecret, "000000",              1, false, 0 },
+    { "short code",     rfcTOTPSecret, "05047",               1, false, 0 },
+    { "bad secret",     "not base32!", at(0),                 1, false, 0 },
+  }
+  for _, tt := range tests {
+    s, ok := VerifyTOTP(tt.secret, tt.code, now, tt.drift)
+    if ok != tt.ok || s != tt.step {
+      t.Errorf("%s: VerifyTOTP = %d, %v, want %d, %v", tt.name, s, ok, tt.step, tt.ok)
+    }
+  }
+}
+
+
+func TestRecoveryCodes(t *testing.T) {
+  plain, hashes, err := GenerateRecoveryCodes(3)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(plain) != 3 || len(hashes) != 3 {
+    t.Fatalf("got %d codes and %d hashes", len(plain), len(hashes))
+  }
+
+  left, ok := UseRecoveryCode(hashes, " "+ plain[1] +" ")
+  if !ok || len(left) != 2 {
+    t.Fatalf("UseRecoveryCode = %d, %v, want 2, true", len(left), ok)
+  }
+  if _, ok := UseRecoveryCode(left, plain[1]); ok {
+    t.Error("a used recovery code was accepted again")
+  }
+  if _, ok := UseRecoveryCode(left, "nonsense"); ok {
+    t.Error("an unknown recovery code was accepted")
+  }
+}
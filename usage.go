@@ -0,0 +1,261 @@
+package brick
+
+import (
+  "fmt"
+  "html"
+  "io/fs"
+  "net/http"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// 最多记录的未匹配路径数量, 超过时替换次数最少的
+const maxMissingPaths = 1000
+
+// 未匹配的路径只记录前面这么多字符
+const maxMissingPathLen = 200
+
+//
+// 路由的使用情况, 参考 Brick.Usage()
+//
+type RouteUsage struct {
+  Route    RouteInfo  `json:"route"`
+  Requests uint64     `json:"requests"`
+  NotFound uint64     `json:"not_found"`
+  // 5xx 响应的数量
+  Errors   uint64     `json:"errors"`
+  LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+//
+// 模板的使用情况, 没有使用过的模板 Renders 为 0
+//
+type TemplateUsage struct {
+  File     string     `json:"file"`
+  Renders  uint64     `json:"renders"`
+  LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+//
+// 没有匹配任何路由的路径
+//
+type PathCount struct {
+  Path  string    `json:"path"`
+  Count uint64    `json:"count"`
+  Last  time.Time `json:"last"`
+}
+
+//
+// 路由和模板的使用统计, 用于找出没有用的模板和经常出错的路径
+//
+type UsageReport struct {
+  // 统计开始的时间
+  Since     time.Time       `json:"since"`
+  // 按注册顺序
+  Routes    []RouteUsage    `json:"routes"`
+  // 按使用次数从少到多
+  Templates []TemplateUsage `json:"templates"`
+  // 按次数从多到少
+  NotFound  []PathCount     `json:"not_found"`
+}
+
+//
+// 路由上的计数, 用原子操作更新
+//
+type routeUse struct {
+  requests uint64
+  notFound uint64
+  errors   uint64
+  last     int64
+}
+
+type usageStats struct {
+  lock      sync.Mutex
+  since     time.Time
+  templates map[string]*TemplateUsage
+  missing   map[string]*PathCount
+}
+
+
+func (r *Route) recordUse(status int) {
+  if status == 0 {
+    status = http.StatusOK
+  }
+  atomic.AddUint64(&r.use.requests, 1)
+  if status == http.StatusNotFound {
+    atomic.AddUint64(&r.use.notFound, 1)
+  } else if status >= 500 {
+    atomic.AddUint64(&r.use.errors, 1)
+  }
+  atomic.StoreInt64(&r.use.last, time.Now().UnixNano())
+}
+
+
+func (u *usageStats) init() {
+  if u.templates == nil {
+    u.templates = make(map[string]*TemplateUsage)
+    u.missing = make(map[string]*PathCount)
+  }
+}
+
+
+//
+// 记录模板, render 为 false 时只登记 (TemplatePage() 注册时), 没有渲染过也出现在统计中
+//
+func (b *Brick) recordTemplate(file string, render bool) {
+  u := &b.usage
+  u.lock.Lock()
+  defer u.lock.Unlock()
+  u.init()
+  t := u.templates[file]
+  if t == nil {
+    t = &TemplateUsage{ File: file }
+    u.templates[file] = t
+  }
+  if render {
+    now := time.Now()
+    t.Renders++
+    t.LastUsed = &now
+  }
+}
+
+
+//
+// 记录没有匹配任何路由的请求
+//
+func (b *Brick) recordMissing(path string) {
+  if len(path) > maxMissingPathLen {
+    path = path[:maxMissingPathLen]
+  }
+  u := &b.usage
+  u.lock.Lock()
+  defer u.lock.Unlock()
+  u.init()
+  p := u.missing[path]
+  if p == nil {
+    if len(u.missing) >= maxMissingPaths {
+      var least *PathCount
+      for _, m := range u.missing {
+        if least == nil || m.Count < least.Count || (m.Count == least.Count && m.Last.Before(least.Last)) {
+          least = m
+        }
+      }
+      delete(u.missing, least.Path)
+    }
+    p = &PathCount{ Path: path }
+    u.missing[path] = p
+  }
+  p.Count++
+  p.Last = time.Now()
+}
+
+
+//
+// 返回路由和模板的使用统计. 模板包括 TemplatePage() 注册的, 渲染过的
+// 和模板目录 (SetTemplateDir()) 中没有加载过的 .html 文件
+//
+func (b *Brick) Usage() *UsageReport {
+  b.routeLock.RLock()
+  routes := append([]*Route(nil), b.routes...)
+  b.routeLock.RUnlock()
+
+  rep := &UsageReport{
+    Routes    : make([]RouteUsage, 0, len(routes)),
+    Templates : []TemplateUsage{},
+    NotFound  : []PathCount{},
+  }
+  for _, rt := range routes {
+    ru := RouteUsage{
+      Route    : rt.Info(),
+      Requests : atomic.LoadUint64(&rt.use.requests),
+      NotFound : atomic.LoadUint64(&rt.use.notFound),
+      Errors   : atomic.LoadUint64(&rt.use.errors),
+    }
+    if last := atomic.LoadInt64(&rt.use.last); last > 0 {
+      t := time.Unix(0, last)
+      ru.LastUsed = &t
+    }
+    rep.Routes = append(rep.Routes, ru)
+  }
+
+  seen := make(map[string]bool)
+  u := &b.usage
+  u.lock.Lock()
+  u.init()
+  rep.Since = u.since
+  for file, t := range u.templates {
+    rep.Templates = append(rep.Templates, *t)
+    seen[filepath.Clean(file)] = true
+  }
+  for _, p := range u.missing {
+    rep.NotFound = append(rep.NotFound, *p)
+  }
+  u.lock.Unlock()
+
+  if dir := b.templateDir; dir != "" {
+    filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+      if err == nil && !d.IsDir() && strings.HasSuffix(file, ".html") && !seen[filepath.Clean(file)] {
+        rep.Templates = append(rep.Templates, TemplateUsage{ File: file })
+      }
+      return nil
+    })
+  }
+
+  sort.Slice(rep.Templates, func(i, j int) bool {
+    a, c := rep.Templates[i], rep.Templates[j]
+    if a.Renders != c.Renders {
+      return a.Renders < c.Renders
+    }
+    return a.File < c.File
+  })
+  sort.Slice(rep.NotFound, func(i, j int) bool {
+    return rep.NotFound[i].Count > rep.NotFound[j].Count
+  })
+  return rep
+}
+
+
+//
+// 使用统计页面, 请求 json 时返回 UsageReport; 应注册在需要认证的分组中:
+//
+//   admin.Service("/usage", b.UsagePage()).Methods("GET")
+//
+func (b *Brick) UsagePage() HttpHandler {
+  return func(h *Http) error {
+    rep := b.Usage()
+    h.CacheTime(0)
+    if h.WantsJSON() {
+      h.Json(Msg{ Data: rep })
+      return nil
+    }
+    last := func(t *time.Time) string {
+      if t == nil {
+        return "never"
+      }
+      return t.Format(time.RFC3339)
+    }
+    h.W.Header().Set("Content-Type", "text/html; charset=utf-8")
+    fmt.Fprintf(h.W, "<p>Since %s</p>\n", rep.Since.Format(time.RFC3339))
+    h.WriteStr("<table><tr><th>Route</th><th>Requests</th><th>404</th><th>5xx</th><th>Last used</th></tr>\n")
+    for _, r := range rep.Routes {
+      fmt.Fprintf(h.W, "<tr><td>%s</td><td>%d</td><td>%d</td><td>%d</td><td>%s</td></tr>\n",
+          html.EscapeString(r.Route.Host + r.Route.Path), r.Requests, r.NotFound, r.Errors, last(r.LastUsed))
+    }
+    h.WriteStr("</table>\n<table><tr><th>Template</th><th>Renders</th><th>Last used</th></tr>\n")
+    for _, t := range rep.Templates {
+      fmt.Fprintf(h.W, "<tr><td>%s</td><td>%d</td><td>%s</td></tr>\n",
+          html.EscapeString(t.File), t.Renders, last(t.LastUsed))
+    }
+    h.WriteStr("</table>\n<table><tr><th>Not found</th><th>Count</th><th>Last</th></tr>\n")
+    for _, p := range rep.NotFound {
+      fmt.Fprintf(h.W, "<tr><td>%s</td><td>%d</td><td>%s</td></tr>\n",
+          html.EscapeString(p.Path), p.Count, p.Last.Format(time.RFC3339))
+    }
+    h.WriteStr("</table>")
+    return nil
+  }
+}
@@ -0,0 +1,294 @@
+package brick
+
+import (
+  "errors"
+  "fmt"
+  "html"
+  "reflect"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "unicode/utf8"
+)
+
+//
+// 一个参数的错误, Rule 是失败的规则: "type", "required", "min", "max", "regexp", "oneof"
+//
+type FieldError struct {
+  Field string `json:"field"`
+  Rule  string `json:"rule"`
+  Msg   string `json:"msg"`
+}
+
+//
+// 参数检查的全部错误, 默认错误处理输出 400, json 请求在 Msg.Data 中返回错误列表
+//
+type ValidationErrors []FieldError
+
+
+func (e ValidationErrors) Error() string {
+  msg := make([]string, len(e))
+  for i, f := range e {
+    msg[i] = f.Field +": "+ f.Msg
+  }
+  return "Invalid parameters: "+ strings.Join(msg, "; ")
+}
+
+
+//
+// 把 URI 参数或 POST 表单绑定到结构体 out 并按 validate 标签检查, 参数名和白名单规则与 Bind() 相同.
+// 类型转换失败不会立即返回, 与检查失败一起作为 ValidationErrors 返回:
+//
+//   type Signup struct {
+//     Name  string `form:"name"  validate:"required,min=2,max=20"`
+//     Age   int    `form:"age"   validate:"min=18"`
+//     Plan  string `form:"plan"  validate:"oneof=free pro"`
+//     Phone string `form:"phone" validate:"regexp=^[0-9]+$"`
+//   }
+//
+// regexp 必须是最后一个规则, 表达式中可以有逗号.
+//
+func (h *Http) BindForm(out interface{}, opts ...BindOption) error {
+  h.init_query()
+  fields, err := bindFields(out, "form")
+  if err != nil {
+    return err
+  }
+  h.rt.noteBind(out, false)
+
+  o := h.bindOptions(opts)
+  rv := reflect.ValueOf(out).Elem()
+  var rejected []string
+  var errs ValidationErrors
+  failed := make(map[string]bool)
+  present := make(map[string]bool)
+
+  for name, values := range *h.q {
+    f, has := fields[name]
+    if !has || !o.allowed(f) {
+      rejected = append(rejected, name)
+      continue
+    }
+    present[name] = true
+    if err := setFieldStrings(rv.FieldByIndex(f.index), values); err != nil {
+      errs = append(errs, FieldError{ Field: name, Rule: "type", Msg: typeErrorMsg(rv.FieldByIndex(f.index)) })
+      failed[name] = true
+    }
+  }
+  if err := h.rejectParams(o, rejected); err != nil {
+    return err
+  }
+
+  sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+  errs = append(errs, validateFields(rv, fields, failed, present)...)
+  if len(errs) > 0 {
+    return errs
+  }
+  return nil
+}
+
+
+//
+// 按 validate 标签检查结构体, v 是结构体或结构体指针;
+// 用于 BindJSON() 之后或其他来源的数据, 失败返回 ValidationErrors
+//
+func Validate(v interface{}) error {
+  rv := reflect.ValueOf(v)
+  if rv.Kind() == reflect.Ptr {
+    rv = rv.Elem()
+  }
+  if rv.Kind() != reflect.Struct {
+    return errors.New("Validate target must be a struct")
+  }
+  fields := make(map[string]*bindField)
+  collectBindFields(rv.Type(), nil, "form", fields)
+  if errs := validateFields(rv, fields, nil, nil); len(errs) > 0 {
+    return errs
+  }
+  return nil
+}
+
+
+//
+// 按字段在结构体中的顺序检查, 跳过 skip 中已经出错的参数.
+// present 是提交了的参数, 没有提交的参数只检查 required;
+// present 为 nil 时不知道哪些参数提交了, 零值视为没有提交.
+//
+func validateFields(rv reflect.Value, fields map[string]*bindField, skip map[string]bool,
+    present map[string]bool) ValidationErrors {
+  list := make([]*bindField, 0, len(fields))
+  for _, f := range fields {
+    if f.rules != "" && !skip[f.name] {
+      list = append(list, f)
+    }
+  }
+  sort.Slice(list, func(i, j int) bool { return indexLess(list[i].index, list[j].index) })
+
+  var errs ValidationErrors
+  for _, f := range list {
+    absent := present != nil && !present[f.name]
+    if fe := checkRules(f.name, rv.FieldByIndex(f.index), f.rules, absent, present == nil); fe != nil {
+      errs = append(errs, *fe)
+    }
+  }
+  return errs
+}
+
+
+func indexLess(a, b []int) bool {
+  for i := 0; i < len(a) && i < len(b); i++ {
+    if a[i] != b[i] {
+      return a[i] < b[i]
+    }
+  }
+  return len(a) < len(b)
+}
+
+
+//
+// 检查一个字段, 返回第一个失败的规则. required 检查零值; 没有提交的参数 (absent) 不检查其他规则,
+// 提交了的零值 (例如 age=0) 检查全部规则; zeroAbsent 时零值也视为没有提交.
+//
+func checkRules(name string, v reflect.Value, rules string, absent bool, zeroAbsent bool) *FieldError {
+  fail := func(rule string, format string, a ...interface{}) *FieldError {
+    return &FieldError{ Field: name, Rule: rule, Msg: fmt.Sprintf(format, a...) }
+  }
+  for v.Kind() == reflect.Ptr {
+    if v.IsNil() {
+      break
+    }
+    v = v.Elem()
+  }
+  empty := v.IsZero()
+  skip := absent || (zeroAbsent && empty)
+
+  for rules != "" {
+    var rule string
+    if strings.HasPrefix(rules, "regexp=") {
+      rule, rules = rules, ""
+    } else if i := strings.IndexByte(rules, ','); i >= 0 {
+      rule, rules = rules[:i], rules[i+1:]
+    } else {
+      rule, rules = rules, ""
+    }
+    key, arg := rule, ""
+    if i := strings.IndexByte(rule, '='); i >= 0 {
+      key, arg = rule[:i], rule[i+1:]
+    }
+
+    if key == "required" {
+      if empty {
+        return fail(key, "is required")
+      }
+      continue
+    }
+    if skip {
+      continue
+    }
+
+    switch key {
+    case "min", "max":
+      limit, err := strconv.ParseFloat(arg, 64)
+      if err != nil {
+        panic(errors.New("validate: bad "+ key +" '"+ arg +"' on "+ name))
+      }
+      n, unit := ruleSize(v)
+      if key == "min" && n < limit {
+        return fail(key, "must be at least %s%s", arg, unit)
+      }
+      if key == "max" && n > limit {
+        return fail(key, "must be at most %s%s", arg, unit)
+      }
+
+    case "regexp":
+      if !ruleRegexp(arg).MatchString(fmt.Sprint(v.Interface())) {
+        return fail(key, "has invalid format")
+      }
+
+    case "oneof":
+      s := fmt.Sprint(v.Interface())
+      ok := false
+      for _, o := range strings.Fields(arg) {
+        if o == s {
+          ok = true
+          break
+        }
+      }
+      if !ok {
+        return fail(key, "must be one of %s", strings.Join(strings.Fields(arg), ", "))
+      }
+
+    default:
+      panic(errors.New("validate: unknown rule '"+ key +"' on "+ name))
+    }
+  }
+  return nil
+}
+
+
+//
+// min/max 比较的值: 数字的值, 字符串的字符数, 切片和 map 的长度
+//
+func ruleSize(v reflect.Value) (float64, string) {
+  switch v.Kind() {
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    return float64(v.Int()), ""
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+    return float64(v.Uint()), ""
+  case reflect.Float32, reflect.Float64:
+    return v.Float(), ""
+  case reflect.String:
+    return float64(utf8.RuneCountInString(v.String())), " characters"
+  case reflect.Slice, reflect.Map, reflect.Array:
+    return float64(v.Len()), " items"
+  }
+  return 0, ""
+}
+
+
+var ruleRegexps sync.Map
+
+
+func ruleRegexp(expr string) *regexp.Regexp {
+  if re, has := ruleRegexps.Load(expr); has {
+    return re.(*regexp.Regexp)
+  }
+  re := regexp.MustCompile(expr)
+  ruleRegexps.Store(expr, re)
+  return re
+}
+
+
+func typeErrorMsg(v reflect.Value) string {
+  t := v.Type()
+  for t.Kind() == reflect.Ptr || (t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8) {
+    t = t.Elem()
+  }
+  switch t.Kind() {
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+       reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+    if t.String() == "time.Duration" {
+      return "must be a duration"
+    }
+    return "must be an integer"
+  case reflect.Float32, reflect.Float64:
+    return "must be a number"
+  case reflect.Bool:
+    return "must be true or false"
+  }
+  return "has invalid value"
+}
+
+
+//
+// 参数检查错误的 html 输出
+//
+func writeValidationErrors(hd *Http, errs ValidationErrors) {
+  hd.WriteStr(`<p>Invalid parameters</p><ul>`)
+  for _, f := range errs {
+    hd.WriteStr(`<li>`+ html.EscapeString(f.Field +": "+ f.Msg) +`</li>`)
+  }
+  hd.WriteStr(`</ul>`)
+}
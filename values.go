@@ -0,0 +1,164 @@
+package brick
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "sync"
+)
+
+//
+// 请求范围的资源构造函数, 参考 Brick.Provide()
+//
+type Provider func(h *Http) (interface{}, error)
+
+type providers struct {
+  lock sync.RWMutex
+  m    map[string]Provider
+}
+
+type valuesKey struct{}
+
+//
+// 一个请求中保存的值, 放在请求的 context 中
+//
+type requestValues struct {
+  lock sync.Mutex
+  m    map[string]interface{}
+}
+
+
+//
+// 在当前请求中保存一个值, 供后面的中间件和处理函数读取, 例如当前租户或数据库事务;
+// 值同时可以通过 h.Ctx() 用 ContextValue() 读取.
+//
+func (h *Http) SetValue(key string, v interface{}) {
+  rv := h.values()
+  rv.lock.Lock()
+  defer rv.lock.Unlock()
+  rv.m[key] = v
+}
+
+
+//
+// 读取 SetValue() 保存的值
+//
+func (h *Http) Value(key string) (interface{}, bool) {
+  return ContextValue(h.Ctx(), key)
+}
+
+
+//
+// 从请求的 context 中读取 Http.SetValue() 保存的值, 用于只有 ctx 的代码
+//
+func ContextValue(ctx context.Context, key string) (interface{}, bool) {
+  rv, _ := ctx.Value(valuesKey{}).(*requestValues)
+  if rv == nil {
+    return nil, false
+  }
+  rv.lock.Lock()
+  defer rv.lock.Unlock()
+  v, has := rv.m[key]
+  return v, has
+}
+
+
+//
+// 读取指定类型的值, 不存在或类型不同时返回零值和 false
+//
+func ValueOf[T any](h *Http, key string) (T, bool) {
+  v, _ := h.Value(key)
+  t, ok := v.(T)
+  return t, ok
+}
+
+
+func (h *Http) values() *requestValues {
+  if rv, _ := h.Ctx().Value(valuesKey{}).(*requestValues); rv != nil {
+    return rv
+  }
+  rv := &requestValues{ m: make(map[string]interface{}) }
+  h.R = h.R.WithContext(context.WithValue(h.R.Context(), valuesKey{}, rv))
+  return rv
+}
+
+
+//
+// 注册请求范围的资源, 第一次调用 h.Resource(name) 时创建, 同一个请求中共享;
+// 资源有 Close() 或 Close() error 方法时在请求结束后关闭, 参考 Http.CloseOnEnd().
+//
+//   b.Provide("db", func(h *brick.Http) (interface{}, error) { return pool.Conn(h.Ctx()) })
+//
+func (b *Brick) Provide(name string, p Provider) {
+  b.provs.lock.Lock()
+  defer b.provs.lock.Unlock()
+  if b.provs.m == nil {
+    b.provs.m = make(map[string]Provider)
+  }
+  b.provs.m[name] = p
+}
+
+
+//
+// 返回 Provide() 注册的资源, 本次请求中第一次调用时创建
+//
+func (h *Http) Resource(name string) (interface{}, error) {
+  key := "brick.resource:"+ name
+  if v, has := h.Value(key); has {
+    return v, nil
+  }
+  h.b.provs.lock.RLock()
+  p := h.b.provs.m[name]
+  h.b.provs.lock.RUnlock()
+  if p == nil {
+    return nil, errors.New("no provider for '"+ name +"'")
+  }
+
+  v, err := p(h)
+  if err != nil {
+    return nil, fmt.Errorf("provide '%s': %w", name, err)
+  }
+  switch c := v.(type) {
+  case Shutdown:
+    h.CloseOnEnd(c)
+  case io.Closer:
+    h.CloseOnEnd(&closeLogger{ c: c, name: name, log: h.b.log })
+  }
+  h.SetValue(key, v)
+  return v, nil
+}
+
+
+//
+// 返回指定类型的资源
+//
+func ResourceOf[T any](h *Http, name string) (T, error) {
+  var zero T
+  v, err := h.Resource(name)
+  if err != nil {
+    return zero, err
+  }
+  t, ok := v.(T)
+  if !ok {
+    return zero, fmt.Errorf("resource '%s' is %T", name, v)
+  }
+  return t, nil
+}
+
+
+//
+// 把 io.Closer 适配为 Shutdown, 关闭的错误写入日志
+//
+type closeLogger struct {
+  c    io.Closer
+  name string
+  log  Logger
+}
+
+
+func (c *closeLogger) Close() {
+  if err := c.c.Close(); err != nil {
+    c.log.Error("Close resource", c.name, err)
+  }
+}
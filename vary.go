@@ -0,0 +1,84 @@
+package brick
+
+import (
+  "net/http"
+  "strings"
+)
+
+
+//
+// 声明响应随请求头 keys 而不同, 例如根据 Accept-Language 选择了语言.
+// 协商内容的组件 (Negotiate(), Locale(), VaryDevice() 等) 会自动调用;
+// 所有来源的 Vary 在写出响应头时合并为一行, 去掉重复的, 缓存据此区分响应.
+//
+func (h *Http) Vary(keys ...string) {
+  addVary(h.W.Header(), keys...)
+}
+
+
+//
+// 把 keys 合并到 hdr 的 Vary 中, 结果只有一行; 有 "*" 时只保留 "*"
+//
+func addVary(hdr http.Header, keys ...string) {
+  list := varyKeys(hdr)
+  for _, k := range keys {
+    list = appendVary(list, k)
+  }
+  setVary(hdr, list)
+}
+
+
+//
+// 响应的 Vary 中的请求头, 已经规范化大小写并去掉重复
+//
+func varyKeys(hdr http.Header) []string {
+  var list []string
+  for _, line := range hdr.Values("Vary") {
+    for _, k := range strings.Split(line, ",") {
+      list = appendVary(list, k)
+    }
+  }
+  return list
+}
+
+
+func appendVary(list []string, k string) []string {
+  k = strings.TrimSpace(k)
+  if k == "" {
+    return list
+  }
+  if k != "*" {
+    k = http.CanonicalHeaderKey(k)
+  }
+  for _, v := range list {
+    if v == k {
+      return list
+    }
+  }
+  return append(list, k)
+}
+
+
+func setVary(hdr http.Header, list []string) {
+  for _, k := range list {
+    if k == "*" {
+      hdr.Set("Vary", "*")
+      return
+    }
+  }
+  if len(list) == 0 {
+    hdr.Del("Vary")
+    return
+  }
+  hdr.Set("Vary", strings.Join(list, ", "))
+}
+
+
+//
+// 合并其他代码用 Header().Add() 加入的多行 Vary, 在写出响应头之前调用
+//
+func normalizeVary(hdr http.Header) {
+  if len(hdr["Vary"]) > 1 || strings.Contains(hdr.Get("Vary"), "*") {
+    setVary(hdr, varyKeys(hdr))
+  }
+}
@@ -0,0 +1,168 @@
+package brick
+
+import (
+  "net/http"
+  "sync"
+  "time"
+)
+
+//
+// 预热的页面, Path 可以带参数, 例如 "/product?id=1"
+//
+type WarmTarget struct {
+  Path   string
+  // 虚拟主机的页面设置请求的 Host, 参考 Brick.Host()
+  Host   string
+  // 附加的请求头, 例如需要认证的页面的 Authorization
+  Header http.Header
+}
+
+type warmer struct {
+  lock     sync.Mutex
+  interval time.Duration
+  targets  []WarmTarget
+  started  bool
+  // 关闭时结束后台预热, 参考 stopWarmer()
+  stop     chan struct{}
+}
+
+//
+// 丢弃输出, 只记录状态码
+//
+type warmWriter struct {
+  header http.Header
+  status int
+}
+
+
+//
+// 服务启动后在后台渲染 targets 中的页面, interval > 0 时定期重复,
+// 请求经过完整的中间件链, 模板在第一个用户访问之前就已经解析完毕.
+// 多次调用会追加页面, interval 以最后一次调用为准.
+//
+func (b *Brick) WarmTemplates(interval time.Duration, targets ...WarmTarget) {
+  b.warm.lock.Lock()
+  defer b.warm.lock.Unlock()
+  b.warm.interval = interval
+  b.warm.targets = append(b.warm.targets, targets...)
+}
+
+
+//
+// 立即渲染一遍所有预热页面, 返回失败的页面数
+//
+func (b *Brick) WarmNow() int {
+  b.warm.lock.Lock()
+  targets := append([]WarmTarget(nil), b.warm.targets...)
+  b.warm.lock.Unlock()
+
+  failed := 0
+  for _, t := range targets {
+    if !b.warmOne(t) {
+      failed++
+    }
+  }
+  return failed
+}
+
+
+//
+// 由 StartHttpServer() 调用
+//
+func (b *Brick) startWarmer() {
+  b.warm.lock.Lock()
+  defer b.warm.lock.Unlock()
+  if b.warm.started || len(b.warm.targets) == 0 {
+    return
+  }
+  b.warm.started = true
+  stop := make(chan struct{})
+  b.warm.stop = stop
+
+  go func() {
+    b.WarmNow()
+    b.warm.lock.Lock()
+    interval := b.warm.interval
+    b.warm.lock.Unlock()
+    if interval <= 0 {
+      return
+    }
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+      select {
+      case <-stop:
+        return
+      case <-t.C:
+        b.WarmNow()
+      }
+    }
+  }()
+}
+
+
+//
+// 由 Shutdown() 调用, 结束定期预热, 之后的 Run() 可以重新开始
+//
+func (b *Brick) stopWarmer() {
+  b.warm.lock.Lock()
+  defer b.warm.lock.Unlock()
+  if b.warm.stop != nil {
+    close(b.warm.stop)
+    b.warm.stop = nil
+  }
+  b.warm.started = false
+}
+
+
+func (b *Brick) warmOne(t WarmTarget) bool {
+  r, err := http.NewRequest(http.MethodGet, t.Path, nil)
+  if err != nil {
+    b.log.Warn("Warm", t.Path, err)
+    return false
+  }
+  r.RemoteAddr = "127.0.0.1:0"
+  r.Host = "localhost"
+  if t.Host != "" {
+    r.Host = t.Host
+  }
+  for name, v := range t.Header {
+    r.Header[name] = v
+  }
+  if r.Header.Get("Accept") == "" {
+    r.Header.Set("Accept", "text/html")
+  }
+
+  begin := time.Now()
+  w := &warmWriter{ header: http.Header{} }
+  b.ServeHTTP(w, r)
+
+  if w.status >= 400 {
+    b.log.Warn("Warm", t.Path, "status", w.status)
+    b.metrics.Inc("brick_warm_failed_total", "Failed page warm-up renders.")
+    return false
+  }
+  b.log.Debug("Warm", t.Path, time.Since(begin))
+  b.metrics.Inc("brick_warm_total", "Page warm-up renders.")
+  return true
+}
+
+
+func (w *warmWriter) Header() http.Header {
+  return w.header
+}
+
+
+func (w *warmWriter) WriteHeader(code int) {
+  if w.status == 0 {
+    w.status = code
+  }
+}
+
+
+func (w *warmWriter) Write(p []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  return len(p), nil
+}
@@ -0,0 +1,122 @@
+package brick
+
+import (
+  "bufio"
+  "errors"
+  "net"
+  "net/http"
+)
+
+//
+// 包装 http.ResponseWriter, 记录状态码和写出的字节数,
+// 并转发 Flusher/Hijacker/Pusher 接口.
+//
+type responseWriter struct {
+  http.ResponseWriter
+  status int
+  size   int64
+}
+
+
+func (w *responseWriter) WriteHeader(code int) {
+  if w.status == 0 {
+    w.status = code
+    normalizeVary(w.Header())
+  }
+  w.ResponseWriter.WriteHeader(code)
+}
+
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+    normalizeVary(w.Header())
+  }
+  n, err := w.ResponseWriter.Write(b)
+  w.size += int64(n)
+  return n, err
+}
+
+
+//
+// 返回已经发送的状态码, 没有写出任何数据时返回 0
+//
+func (w *responseWriter) Status() int {
+  return w.status
+}
+
+
+//
+// 是否已经写出过响应头
+//
+func (w *responseWriter) Written() bool {
+  return w.status != 0
+}
+
+
+func (w *responseWriter) Flush() {
+  if f, ok := w.ResponseWriter.(http.Flusher); ok {
+    if w.status == 0 {
+      w.status = http.StatusOK
+      normalizeVary(w.Header())
+    }
+    f.Flush()
+  }
+}
+
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+    if w.status == 0 {
+      w.status = http.StatusSwitchingProtocols
+    }
+    return hj.Hijack()
+  }
+  return nil, nil, errors.New("ResponseWriter not support Hijack")
+}
+
+
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+  if p, ok := w.ResponseWriter.(http.Pusher); ok {
+    return p.Push(target, opts)
+  }
+  return http.ErrNotSupported
+}
+
+
+//
+// 用于 http.ResponseController 找到原始对象
+//
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+  return w.ResponseWriter
+}
+
+
+//
+// 使用 HTTP/2 服务器推送发送页面引用的资源, 必须在写出响应之前调用,
+// 例如在 TemplatePage 的 TemplateHandler 中推送 css/js.
+// 连接不支持推送 (HTTP/1, h2c 或客户端关闭了推送) 时什么都不做.
+//
+func (h *Http) Push(paths ...string) error {
+  p, ok := h.W.(http.Pusher)
+  if !ok {
+    return nil
+  }
+  opts := &http.PushOptions{ Header: http.Header{} }
+  // 推送的请求使用和页面相同的编码协商
+  for _, k := range []string{ "Accept-Encoding", "Accept-Language", "User-Agent" } {
+    if v := h.R.Header.Get(k); v != "" {
+      opts.Header.Set(k, v)
+    }
+  }
+  for _, target := range paths {
+    err := p.Push(target, opts)
+    if err == http.ErrNotSupported {
+      return nil
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}